@@ -10,11 +10,14 @@ import (
 
 	"github.com/vmihailenco/msgpack/v5"
 	"github.com/xyctruth/final"
+	"github.com/xyctruth/final/orm/gormtx"
+	"gorm.io/gorm"
 )
 
 func main() {
 	go send()
 	go sendGorm()
+	go sendGormCtx()
 	go receive()
 	select {}
 
@@ -91,6 +94,38 @@ func sendGorm() {
 	}
 }
 
+func sendGormCtx() {
+	bus := final.New("send_gorm_ctx_svc", _example.NewDB(), _example.NewAmqp(), final.DefaultOptions().WithPurgeOnStartup(true))
+	err := bus.Start()
+	if err != nil {
+		panic(err)
+	}
+	defer bus.Shutdown()
+	gormDB := _example.NewGormDB()
+	for true {
+		/* return err rollback，return nil commit */
+		err = gormtx.Transaction(bus, gormDB, func(tx *gorm.DB) error {
+			result := tx.Create(&_example.LocalBusiness{
+				Remark: "gorm ctx local business",
+			})
+			if result.Error != nil {
+				return result.Error
+			}
+
+			// tx.Statement.Context 中携带 TxBus，消息与 gorm 的修改在同一个事务中提交
+			msg := common.GeneralMessage{Type: "gorm ctx transaction message", Count: 100}
+			msgBytes, _ := msgpack.Marshal(msg)
+			return bus.PublishCtx(tx.Statement.Context, "topic1", msgBytes)
+		})
+
+		if err != nil {
+			panic(err)
+		}
+
+		time.Sleep(1 * time.Second)
+	}
+}
+
 func receive() {
 	bus := final.New("receive_svc", _example.NewDB(), _example.NewAmqp(), final.DefaultOptions().WithPurgeOnStartup(true))
 	bus.Subscribe("topic1").Middleware(common.Middleware1, common.Middleware2).Handler(common.EchoHandler)
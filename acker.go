@@ -2,16 +2,19 @@ package final
 
 import (
 	"context"
+	"sync/atomic"
 
-	"github.com/sirupsen/logrus"
+	"github.com/xyctruth/final/logger"
 )
 
 // acker 启动 Options.NumAcker 个goroutine接收消息队列ack消息后，Done掉 outbox 中的消息记录
 type acker struct {
-	logger *logrus.Entry
+	logger logger.Logger
 
 	// 退出信号
 	exit chan bool
+	// running acker goroutine 是否在运行
+	running int32
 
 	id  string
 	bus *Bus
@@ -19,7 +22,7 @@ type acker struct {
 
 func newAcker(id string, bus *Bus) *acker {
 	s := &acker{
-		logger: bus.logger.WithFields(logrus.Fields{
+		logger: bus.logger.WithFields(logger.Fields{
 			"module":   "acker",
 			"acker_id": id,
 		}),
@@ -33,7 +36,9 @@ func newAcker(id string, bus *Bus) *acker {
 func (acker *acker) Start(ctx context.Context) error {
 	acker.logger.Info("Acker start success")
 
+	atomic.StoreInt32(&acker.running, 1)
 	go func() {
+		defer atomic.StoreInt32(&acker.running, 0)
 		for {
 			select {
 			case <-ctx.Done():
@@ -53,8 +58,14 @@ func (acker *acker) Start(ctx context.Context) error {
 					acker.logger.Error("acker.nack close")
 					return
 				}
-				acker.logger.WithField("nack", nack).Error("nack received")
+				acker.bus.publisher.nacked(nack)
 				acker.logger.WithField("channel_len", len(acker.bus.publisher.nack)).Debug("length of nack channel")
+			case seq, ok := <-acker.bus.publisher.unroutable:
+				if !ok {
+					acker.logger.Error("acker.unroutable close")
+					return
+				}
+				acker.bus.publisher.unrouted(seq)
 
 			}
 		}
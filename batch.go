@@ -0,0 +1,60 @@
+package final
+
+import (
+	"context"
+	"time"
+
+	"github.com/xyctruth/final/message"
+)
+
+const (
+	defaultBatchSize = 100         // 默认每批最多处理的消息数量
+	defaultBatchWait = time.Second // 默认凑满一批消息的最长等待时间
+)
+
+type (
+	BatchHandlerFunc func(*BatchContext) error
+
+	// BatchContext 一批待处理的消息
+	// handler 返回 error 时整批消息处理失败，返回 nil 时只有 Fail 标记的消息处理失败
+	// 处理成功的消息立即 Ack，处理失败的消息单独重试，重试次数用完后 Reject
+	BatchContext struct {
+		Topic    string
+		Messages []*message.Message
+		// ctxs 携带每条消息 consumer span 的 context
+		ctxs []context.Context
+		errs []error
+	}
+)
+
+func newBatchContext(topic string, msgs []*message.Message, ctxs []context.Context) *BatchContext {
+	return &BatchContext{
+		Topic:    topic,
+		Messages: msgs,
+		ctxs:     ctxs,
+		errs:     make([]error, len(msgs)),
+	}
+}
+
+// Len 返回这一批消息的数量
+func (c *BatchContext) Len() int {
+	return len(c.Messages)
+}
+
+// Context 返回携带第 i 条消息 consumer span 的 context
+func (c *BatchContext) Context(i int) context.Context {
+	if c.ctxs == nil || c.ctxs[i] == nil {
+		return context.Background()
+	}
+	return c.ctxs[i]
+}
+
+// Fail 标记第 i 条消息处理失败，只有失败的消息会被重试
+func (c *BatchContext) Fail(i int, err error) {
+	c.errs[i] = err
+}
+
+// Err 返回第 i 条消息的处理结果
+func (c *BatchContext) Err(i int) error {
+	return c.errs[i]
+}
@@ -0,0 +1,176 @@
+package final
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// BreakerState topic 熔断器的状态
+type BreakerState int32
+
+const (
+	BreakerClosed   BreakerState = iota // 正常处理消息
+	BreakerOpen                         // 连续失败次数达到阈值，暂停处理消息
+	BreakerHalfOpen                     // 暂停时间结束，只允许处理一条探测消息
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// CircuitBreaker 为 topic 开启熔断器
+// handler 连续失败 failures 次后熔断器打开，暂停处理 topic 的消息，未 Ack 的消息保留在 mq 中，mq 不会再投递更多的消息
+// openTimeout 后熔断器半开，处理一条探测消息，成功时关闭熔断器，失败时重新打开
+// 等待熔断器不消耗重试次数，handler 处理失败的次数超过 Options.RetryCount 的消息仍然被 Reject
+// 需要 mq 驱动为每个 topic 使用独立的队列（mq.ITopicSubscriber），否则 Bus.Start 返回 ErrTopicQueuesRequired
+func (topic *routerTopic) CircuitBreaker(failures int, openTimeout time.Duration) *routerTopic {
+	bus := topic.bus
+	name := topic.name
+	topic.breaker = newBreaker(failures, openTimeout, func(from, to BreakerState) {
+		bus.logger.
+			WithField("topic", name).
+			WithField("from", from.String()).
+			WithField("to", to.String()).
+			Warn("circuit breaker state changed")
+		bus.metrics.setBreakerState(name, to)
+		bus.hooks.breakerStateChanged(name, from, to)
+	})
+	return topic
+}
+
+// circuitBreaker 返回 topic 的熔断器，topic 为 nil 时返回 nil
+func (topic *routerTopic) circuitBreaker() *breaker {
+	if topic == nil {
+		return nil
+	}
+	return topic.breaker
+}
+
+// breaker 记录 handler 连续失败的次数，控制 topic 是否可以处理消息
+type breaker struct {
+	threshold   int
+	openTimeout time.Duration
+	onChange    func(from, to BreakerState)
+
+	mutex    sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	// changed 在状态改变时关闭，等待的 goroutine 重新检查状态
+	changed chan struct{}
+}
+
+func newBreaker(threshold int, openTimeout time.Duration, onChange func(from, to BreakerState)) *breaker {
+	if threshold <= 0 {
+		threshold = 1
+	}
+	return &breaker{
+		threshold:   threshold,
+		openTimeout: openTimeout,
+		onChange:    onChange,
+		changed:     make(chan struct{}),
+	}
+}
+
+// allow 等待熔断器允许处理消息，ctx 结束时返回 ctx 的错误
+func (b *breaker) allow(ctx context.Context) error {
+	if b == nil {
+		return nil
+	}
+	for {
+		b.mutex.Lock()
+		state := b.state
+		changed := b.changed
+		var timeout <-chan time.Time
+		switch state {
+		case BreakerClosed:
+			b.mutex.Unlock()
+			return nil
+		case BreakerOpen:
+			wait := time.Until(b.openedAt.Add(b.openTimeout))
+			if wait <= 0 {
+				// 当前 goroutine 处理探测消息，其它 goroutine 等待探测结果
+				from, to := b.setState(BreakerHalfOpen)
+				b.mutex.Unlock()
+				b.notify(from, to)
+				return nil
+			}
+			timeout = time.After(wait)
+		}
+		b.mutex.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		case <-timeout:
+		}
+	}
+}
+
+// record 记录 handler 的处理结果
+func (b *breaker) record(err error) {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	from, to := b.state, b.state
+	switch b.state {
+	case BreakerClosed:
+		if err == nil {
+			b.failures = 0
+			break
+		}
+		b.failures++
+		if b.failures >= b.threshold {
+			from, to = b.setState(BreakerOpen)
+		}
+	case BreakerHalfOpen:
+		if err == nil {
+			from, to = b.setState(BreakerClosed)
+		} else {
+			from, to = b.setState(BreakerOpen)
+		}
+	}
+	b.mutex.Unlock()
+	b.notify(from, to)
+}
+
+// isClosed 熔断器是否关闭，为 nil 时总是关闭
+func (b *breaker) isClosed() bool {
+	if b == nil {
+		return true
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.state == BreakerClosed
+}
+
+// setState 修改熔断器的状态，调用前需要持有 mutex
+func (b *breaker) setState(state BreakerState) (BreakerState, BreakerState) {
+	from := b.state
+	b.state = state
+	b.failures = 0
+	if state == BreakerOpen {
+		b.openedAt = time.Now()
+	}
+	close(b.changed)
+	b.changed = make(chan struct{})
+	return from, state
+}
+
+func (b *breaker) notify(from, to BreakerState) {
+	if from != to && b.onChange != nil {
+		b.onChange(from, to)
+	}
+}
@@ -0,0 +1,135 @@
+package final
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/xyctruth/final/message"
+)
+
+func TestBreaker(t *testing.T) {
+	var changes [][2]BreakerState
+	b := newBreaker(2, 50*time.Millisecond, func(from, to BreakerState) {
+		changes = append(changes, [2]BreakerState{from, to})
+	})
+	ctx := context.Background()
+	failure := errors.New("failure")
+
+	b.record(failure)
+	b.record(nil)
+	b.record(failure)
+	require.True(t, b.isClosed())
+	b.record(failure)
+	require.False(t, b.isClosed())
+
+	// 打开时等待 openTimeout 后半开
+	start := time.Now()
+	require.Equal(t, nil, b.allow(ctx))
+	require.GreaterOrEqual(t, time.Since(start), 40*time.Millisecond)
+
+	// 半开时其它 goroutine 等待探测结果
+	timeoutCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, b.allow(timeoutCtx))
+
+	// 探测失败重新打开，探测成功关闭
+	b.record(failure)
+	require.Equal(t, nil, b.allow(ctx))
+	b.record(nil)
+	require.True(t, b.isClosed())
+
+	require.Equal(t, [][2]BreakerState{
+		{BreakerClosed, BreakerOpen},
+		{BreakerOpen, BreakerHalfOpen},
+		{BreakerHalfOpen, BreakerOpen},
+		{BreakerOpen, BreakerHalfOpen},
+		{BreakerHalfOpen, BreakerClosed},
+	}, changes)
+}
+
+func TestTopicCircuitBreaker(t *testing.T) {
+	provider := &topicProvider{prefetch: make(map[string]int), msgs: make(map[string]chan *message.Message)}
+	bus := New("test_svc", nil, provider, DefaultOptions().WithRetryCount(3).WithRetryInterval(time.Millisecond))
+
+	var (
+		mutex  sync.Mutex
+		states []BreakerState
+	)
+	bus.AddHook(Hook{OnBreakerStateChanged: func(topic string, from, to BreakerState) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		states = append(states, to)
+	}})
+
+	// 前 3 次处理失败，熔断器打开后等待的消息不消耗重试次数，不会被 Reject
+	var calls int32
+	bus.Subscribe("topic1").Concurrency(2).CircuitBreaker(3, 50*time.Millisecond).Handler(func(c *Context) error {
+		if atomic.AddInt32(&calls, 1) <= 3 {
+			return errors.New("downstream unavailable")
+		}
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	subscribers, err := bus.newSubscribers()
+	require.Equal(t, nil, err)
+	bus.subscribers = subscribers
+	require.Equal(t, nil, bus.subscribers[0].Start(ctx))
+
+	msgs := make([]*message.Message, 0, 4)
+	for i := 0; i < 4; i++ {
+		msg := message.NewMessage("", "topic1", nil)
+		msgs = append(msgs, msg)
+		provider.msgs["topic1"] <- msg
+	}
+
+	for _, msg := range msgs {
+		select {
+		case <-msg.Acked():
+		case <-msg.Rejected():
+			t.Fatal("message should not be rejected while the breaker is open")
+		case <-time.After(time.Second):
+			t.Fatal("message is not acked")
+		}
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	require.Equal(t, []BreakerState{BreakerOpen, BreakerHalfOpen, BreakerClosed}, states)
+}
+
+func TestTopicCircuitBreakerPoison(t *testing.T) {
+	provider := &topicProvider{prefetch: make(map[string]int), msgs: make(map[string]chan *message.Message)}
+	bus := New("test_svc", nil, provider, DefaultOptions().WithRetryCount(2).WithRetryInterval(time.Millisecond))
+
+	// 一直处理失败的消息在重试次数用完后 Reject，不会阻塞 topic
+	var calls int32
+	bus.Subscribe("topic1").Concurrency(1).CircuitBreaker(1, 10*time.Millisecond).Handler(func(c *Context) error {
+		atomic.AddInt32(&calls, 1)
+		return errors.New("poison message")
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	subscribers, err := bus.newSubscribers()
+	require.Equal(t, nil, err)
+	bus.subscribers = subscribers
+	require.Equal(t, nil, bus.subscribers[0].Start(ctx))
+
+	msg := message.NewMessage("", "topic1", nil)
+	provider.msgs["topic1"] <- msg
+	select {
+	case <-msg.Rejected():
+	case <-msg.Acked():
+		t.Fatal("message should be rejected")
+	case <-time.After(time.Second):
+		t.Fatal("message is not rejected")
+	}
+	require.Equal(t, int32(3), atomic.LoadInt32(&calls))
+}
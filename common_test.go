@@ -1,7 +1,11 @@
 package final
 
 import (
+	"context"
+	"sync"
+
 	"github.com/vmihailenco/msgpack/v5"
+	"github.com/xyctruth/final/message"
 )
 
 type DemoMessage struct {
@@ -14,3 +18,34 @@ func NewDemoMessage(t string, count int) []byte {
 	msgBytes, _ := msgpack.Marshal(msg)
 	return msgBytes
 }
+
+// fakeProvider 记录发送的消息，用于不依赖消息队列的测试
+type fakeProvider struct {
+	mutex     sync.Mutex
+	published []*message.Message
+	err       error
+}
+
+func (p *fakeProvider) Init(ctx context.Context, svcName string, purge bool, topics []string) error {
+	return nil
+}
+
+func (p *fakeProvider) Publish(msg *message.Message) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	p.published = append(p.published, msg.Clone())
+	return nil
+}
+
+func (p *fakeProvider) Subscribe(ctx context.Context, consumerTag string, msgs chan *message.Message) error {
+	return nil
+}
+
+func (p *fakeProvider) NotifyConfirm(ack, nack chan uint64) {}
+
+func (p *fakeProvider) Exit() error {
+	return nil
+}
@@ -1,6 +1,8 @@
 package final
 
 import (
+	"context"
+
 	"github.com/xyctruth/final/message"
 )
 
@@ -9,6 +11,9 @@ type (
 		Topic   string
 		Key     string
 		Message *message.Message
+		// ctx 携带 consumer span 的 context
+		ctx context.Context
+		bus *Bus
 		// middleware and handler
 		handlers []HandlerFunc
 		index    int
@@ -27,8 +32,17 @@ func (c *Context) Next() error {
 	return nil
 }
 
+// Context 返回携带 consumer span 的 context，在 handler 中发布消息时传递给 Bus.PublishCtx 可以延续 trace
+func (c *Context) Context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
 func (c *Context) Reset(m *message.Message, handlers []HandlerFunc) {
 	c.Topic = m.Topic
+	c.Key = m.Key()
 	c.Message = m
 	c.handlers = handlers
 	c.index = -1
@@ -9,8 +9,10 @@ import (
 	"sync"
 
 	"github.com/sirupsen/logrus"
+	"github.com/xyctruth/final/logger"
 	"github.com/xyctruth/final/message"
 	"github.com/xyctruth/final/mq"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type (
@@ -28,11 +30,16 @@ type (
 
 		router      *router       // router 是handler的路由程序，帮助消息的到正确的handler处理
 		outbox      *outbox       // outbox db发件箱，在未收到ack前消息会保存在 outbox 中
-		subscribers []*subscriber // subscriber 启动 Options.NumSubscriber 个 goroutine 订阅消息队列中的消息 使用 router 处理消息
+		subscribers []*subscriber // subscriber 订阅消息队列中的消息 使用 router 处理消息，在 Start 时创建
+		subMutex    sync.RWMutex  // subMutex 保护 subscribers，Health 可能与 Start 并发调用
 		publisher   *publisher    // publisher 发送消息到消息队列中
+		requester   *requester    // requester 接收 Request 的回复
 		ackers      []*acker      // acker 启动 Options.NumAcker 个goroutine接收消息队列ack消息后，Done掉 outbox 中的消息记录
+		metrics     *metrics      // metrics Prometheus 指标，未设置 Options.MetricsRegisterer 时为 nil
+		tracing     *tracing      // tracing OpenTelemetry 跟踪消息的发布和消费
+		hooks       hooks         // hooks 通过 AddHook 添加的消息生命周期回调
 
-		logger  *logrus.Entry
+		logger  logger.Logger
 		msgPool sync.Pool
 		cancel  context.CancelFunc
 	}
@@ -43,6 +50,14 @@ type (
 		msgs  []*message.Message
 		mutex sync.Mutex
 	}
+
+	// PublishResult 批量发布中单条消息的结果
+	// Err 为 nil 表示消息已经进入发送队列，由 publisher worker 异步发送，confirm 由 acker 异步处理
+	// Err 不为 nil 时（例如 ErrPublishQueueFull），开启 Confirm 的消息保留在 outbox 中，等待扫描重新发送
+	PublishResult struct {
+		UUID string
+		Err  error
+	}
 )
 
 // New 初始化Bus
@@ -50,18 +65,16 @@ type (
 // mqProvider mq.IProvider mq驱动实现，用于与消息队列交互, amqp 的实现 amqp_provider.Provider
 //
 func New(svcName string, db *sql.DB, mqProvider mq.IProvider, opt Options) *Bus {
-	logger := &logrus.Logger{
-		Out: os.Stdout,
-		Formatter: &logrus.TextFormatter{
-			FullTimestamp: true,
-		},
-		Hooks:        make(logrus.LevelHooks),
-		Level:        logrus.InfoLevel,
-		ExitFunc:     os.Exit,
-		ReportCaller: false,
+	logEntry := newLogger(opt).WithField("final", svcName)
+
+	opt, clamped := opt.clamp()
+	for _, name := range clamped {
+		logEntry.WithField("option", name).Warn("option must be greater than 0, using the default value")
 	}
 
-	logEntry := logger.WithField("final", svcName)
+	if setter, ok := mqProvider.(mq.ILoggerSetter); ok {
+		setter.SetLogger(logEntry)
+	}
 
 	var bus = &Bus{
 		svcName:    svcName,
@@ -69,27 +82,32 @@ func New(svcName string, db *sql.DB, mqProvider mq.IProvider, opt Options) *Bus
 		mqProvider: mqProvider,
 		opt:        opt,
 		logger:     logEntry,
-		router:     newRouter(),
 	}
 
+	// create router
+	bus.router = newRouter(bus)
+
 	// create outbox
 	bus.outbox = newOutBox(svcName, bus)
 
-	// create subscribers
-	bus.subscribers = make([]*subscriber, 0, bus.opt.NumSubscriber)
-	for i := 0; i < bus.opt.NumSubscriber; i++ {
-		bus.subscribers = append(bus.subscribers, newSubscriber(fmt.Sprintf("%s_subscribers_%d", svcName, i), bus))
-	}
-
 	// create publisher
 	bus.publisher = newPublisher(bus)
 
+	// create requester
+	bus.requester = newRequester(bus)
+
 	// create acker
 	bus.ackers = make([]*acker, 0, bus.opt.NumAcker)
 	for i := 0; i < bus.opt.NumAcker; i++ {
 		bus.ackers = append(bus.ackers, newAcker(fmt.Sprintf("%s_acker_%d", svcName, i), bus))
 	}
 
+	// create metrics
+	bus.metrics = newMetrics(bus)
+
+	// create tracing
+	bus.tracing = newTracing(bus)
+
 	bus.msgPool.New = func() interface{} {
 		return bus.allocateMessage()
 	}
@@ -115,7 +133,14 @@ func (bus *Bus) Start() error {
 		return err
 	}
 
-	for _, subscriber := range bus.subscribers {
+	subscribers, err := bus.newSubscribers()
+	if err != nil {
+		return err
+	}
+	bus.subMutex.Lock()
+	bus.subscribers = subscribers
+	bus.subMutex.Unlock()
+	for _, subscriber := range subscribers {
 		err = subscriber.Start(ctx)
 		if err != nil {
 			return err
@@ -127,6 +152,11 @@ func (bus *Bus) Start() error {
 		return err
 	}
 
+	err = bus.requester.Start(ctx)
+	if err != nil {
+		return err
+	}
+
 	for _, acker := range bus.ackers {
 		err = acker.Start(ctx)
 		if err != nil {
@@ -134,10 +164,58 @@ func (bus *Bus) Start() error {
 		}
 	}
 
+	err = bus.outbox.Start(ctx)
+	if err != nil {
+		return err
+	}
+
 	bus.logger.Info("Bus start success")
 	return nil
 }
 
+// newSubscribers 创建 subscriber，topic 在 New 之后通过 Subscribe 注册，所以在 Start 时创建
+// mq 驱动为每个 topic 使用独立的队列时，每个 topic 一个 subscriber，否则创建 Options.NumSubscriber 个订阅所有 topic 的 subscriber
+// 所有 topic 共享队列时，需要独立队列的 topic 设置返回 ErrTopicQueuesRequired
+func (bus *Bus) newSubscribers() ([]*subscriber, error) {
+	if ts, ok := bus.mqProvider.(mq.ITopicSubscriber); ok && ts.TopicQueues() {
+		subscribers := make([]*subscriber, 0, len(bus.router.topics))
+		for name, topic := range bus.router.topics {
+			subscribers = append(subscribers, newTopicSubscriber(fmt.Sprintf("%s_subscribers_%s", bus.svcName, name), topic, bus))
+		}
+		return subscribers, nil
+	}
+
+	for name, topic := range bus.router.topics {
+		if topic.orderByKey {
+			// 多个 subscriber 各自从共享队列中消费，相同 key 的消息无法保证由同一个 goroutine 处理
+			return nil, fmt.Errorf("topic %s OrderByKey: %w", name, ErrTopicQueuesRequired)
+		}
+		if bus.router.getBatchRoute(name) != nil {
+			// 共享队列的消息逐条到达 subscriber，无法凑成一批
+			return nil, fmt.Errorf("topic %s BatchHandler: %w", name, ErrTopicQueuesRequired)
+		}
+		if topic.maxInFlight > 0 {
+			// 共享队列的 Qos 作用于所有 topic，等待 MaxInFlight 的 subscriber 会阻塞其它 topic 的消息
+			return nil, fmt.Errorf("topic %s MaxInFlight: %w", name, ErrTopicQueuesRequired)
+		}
+		if topic.breaker != nil {
+			// 等待熔断器的 subscriber 会阻塞其它 topic 的消息
+			return nil, fmt.Errorf("topic %s CircuitBreaker: %w", name, ErrTopicQueuesRequired)
+		}
+	}
+
+	subscribers := make([]*subscriber, 0, bus.opt.NumSubscriber)
+	for i := 0; i < bus.opt.NumSubscriber; i++ {
+		subscribers = append(subscribers, newSubscriber(fmt.Sprintf("%s_subscribers_%d", bus.svcName, i), bus))
+	}
+	return subscribers, nil
+}
+
+// Logger 返回 Bus 的日志输出，基于 Bus 的子系统（例如 saga）使用相同的日志配置
+func (bus *Bus) Logger() logger.Logger {
+	return bus.logger
+}
+
 func (bus *Bus) Shutdown() error {
 	bus.cancel()
 	err := bus.mqProvider.Exit()
@@ -161,26 +239,100 @@ func (bus *Bus) Subscribe(topic string) *routerTopic {
 	return newTopic
 }
 
+// Publish 发布消息
+// 消息进入长度为 Options.PublishQueueSize 的发送队列，由 publisher worker 异步发送
+// 队列已满并且 Options.PublishBlocking 为 false 时返回 ErrPublishQueueFull
 func (bus *Bus) Publish(topic string, payload []byte, opts ...message.PolicyOption) error {
+	return bus.PublishCtx(context.Background(), topic, payload, opts...)
+}
+
+// PublishCtx 发布消息，ctx 中的 trace 作为 producer span 的 parent
+// ctx 中携带当前 Bus 的 TxBus 时（见 ContextWithTxBus），消息添加到 TxBus 的事务中
+func (bus *Bus) PublishCtx(ctx context.Context, topic string, payload []byte, opts ...message.PolicyOption) error {
+	if txBus, ok := TxBusFromContext(ctx); ok && txBus.bus == bus {
+		return txBus.PublishCtx(ctx, topic, payload, opts...)
+	}
+
 	var err error
 
+	err = bus.publisher.reserve()
+	if err != nil {
+		return err
+	}
+
 	msg := bus.msgPool.Get().(*message.Message)
 	msg.Reset("", topic, payload, opts...)
 
+	_, span := bus.tracing.startProducer(ctx, msg)
+	defer func() {
+		endSpan(span, err)
+	}()
+
 	if msg.Policy.Confirm {
 		err = bus.outbox.staging(nil, msg)
 		if err != nil {
+			bus.msgPool.Put(msg)
+			bus.publisher.release()
 			return err
 		}
 	}
-	go func() {
-		bus.publisher.publish(msg)
-		bus.msgPool.Put(msg)
-	}()
 
+	bus.publisher.enqueue(msg)
 	return nil
 }
 
+// PublishBatch 批量发布消息
+// 开启 Confirm 的消息使用一条多行 INSERT 暂存到 outbox 中，然后逐条进入发送队列，与 Publish 相同由 publisher worker 异步发送
+// 返回与 payloads 一一对应的结果
+func (bus *Bus) PublishBatch(topic string, payloads [][]byte, opts ...message.PolicyOption) ([]PublishResult, error) {
+	return bus.PublishBatchCtx(context.Background(), topic, payloads, opts...)
+}
+
+// PublishBatchCtx 批量发布消息，ctx 中的 trace 作为每条消息 producer span 的 parent
+// ctx 中携带当前 Bus 的 TxBus 时（见 ContextWithTxBus），消息添加到 TxBus 的事务中
+func (bus *Bus) PublishBatchCtx(ctx context.Context, topic string, payloads [][]byte, opts ...message.PolicyOption) ([]PublishResult, error) {
+	if txBus, ok := TxBusFromContext(ctx); ok && txBus.bus == bus {
+		return txBus.publishBatch(ctx, topic, payloads, opts...)
+	}
+
+	msgs := make([]*message.Message, 0, len(payloads))
+	spans := make([]trace.Span, 0, len(payloads))
+	confirmMsgs := make([]*message.Message, 0, len(payloads))
+	for _, payload := range payloads {
+		msg := bus.msgPool.Get().(*message.Message)
+		msg.Reset("", topic, payload, opts...)
+		_, span := bus.tracing.startProducer(ctx, msg)
+		msgs = append(msgs, msg)
+		spans = append(spans, span)
+		if msg.Policy.Confirm {
+			confirmMsgs = append(confirmMsgs, msg)
+		}
+	}
+
+	err := bus.outbox.stagingBatch(nil, confirmMsgs...)
+	if err != nil {
+		for i, msg := range msgs {
+			endSpan(spans[i], err)
+			bus.msgPool.Put(msg)
+		}
+		return nil, err
+	}
+
+	results := make([]PublishResult, 0, len(msgs))
+	for i, msg := range msgs {
+		err := bus.publisher.reserve()
+		endSpan(spans[i], err)
+		// 进入发送队列后消息由 publisher worker 放回 msgPool，先保存结果
+		results = append(results, PublishResult{UUID: msg.UUID, Err: err})
+		if err != nil {
+			bus.msgPool.Put(msg)
+			continue
+		}
+		bus.publisher.enqueue(msg)
+	}
+	return results, nil
+}
+
 func (bus *Bus) WithTx(tx *sql.Tx) *TxBus {
 	txBus := &TxBus{
 		bus:  bus,
@@ -206,30 +358,110 @@ func (bus *Bus) Transaction(tx *sql.Tx, fc func(txBus *TxBus) error) error {
 	return txBus.Commit()
 }
 
+// Publish 在事务中暂存消息到 outbox，事务提交后发送到消息队列中
 func (txBus *TxBus) Publish(topic string, payload []byte, opts ...message.PolicyOption) error {
+	return txBus.PublishCtx(context.Background(), topic, payload, opts...)
+}
+
+// PublishCtx 在事务中暂存消息到 outbox，ctx 中的 trace 作为 producer span 的 parent
+func (txBus *TxBus) PublishCtx(ctx context.Context, topic string, payload []byte, opts ...message.PolicyOption) error {
 	txBus.mutex.Lock()
 	defer txBus.mutex.Unlock()
 
+	var err error
+
 	msg := txBus.bus.msgPool.Get().(*message.Message)
 	msg.Reset("", topic, payload, opts...)
 
-	err := txBus.bus.outbox.staging(txBus.tx, msg)
+	_, span := txBus.bus.tracing.startProducer(ctx, msg)
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	err = txBus.bus.outbox.staging(txBus.tx, msg)
 	if err != nil {
+		txBus.bus.msgPool.Put(msg)
 		return err
 	}
 	txBus.msgs = append(txBus.msgs, msg)
 	return nil
 }
 
+// PublishBatch 使用一条多行 INSERT 在事务中暂存多条消息，事务提交后发送到消息队列中
+func (txBus *TxBus) PublishBatch(topic string, payloads [][]byte, opts ...message.PolicyOption) error {
+	return txBus.PublishBatchCtx(context.Background(), topic, payloads, opts...)
+}
+
+// PublishBatchCtx 在事务中批量暂存消息，ctx 中的 trace 作为每条消息 producer span 的 parent
+func (txBus *TxBus) PublishBatchCtx(ctx context.Context, topic string, payloads [][]byte, opts ...message.PolicyOption) error {
+	_, err := txBus.publishBatch(ctx, topic, payloads, opts...)
+	return err
+}
+
+// publishBatch 在事务中批量暂存消息，返回与 payloads 一一对应的结果
+func (txBus *TxBus) publishBatch(ctx context.Context, topic string, payloads [][]byte, opts ...message.PolicyOption) ([]PublishResult, error) {
+	txBus.mutex.Lock()
+	defer txBus.mutex.Unlock()
+
+	msgs := make([]*message.Message, 0, len(payloads))
+	spans := make([]trace.Span, 0, len(payloads))
+	for _, payload := range payloads {
+		msg := txBus.bus.msgPool.Get().(*message.Message)
+		msg.Reset("", topic, payload, opts...)
+		_, span := txBus.bus.tracing.startProducer(ctx, msg)
+		msgs = append(msgs, msg)
+		spans = append(spans, span)
+	}
+
+	err := txBus.bus.outbox.stagingBatch(txBus.tx, msgs...)
+	results := make([]PublishResult, 0, len(msgs))
+	for i, msg := range msgs {
+		endSpan(spans[i], err)
+		results = append(results, PublishResult{UUID: msg.UUID})
+		if err != nil {
+			txBus.bus.msgPool.Put(msg)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	txBus.msgs = append(txBus.msgs, msgs...)
+	return results, nil
+}
+
+// Commit 提交事务后发送事务中暂存的消息
 func (txBus *TxBus) Commit() error {
 	err := txBus.tx.Commit()
 	if err != nil {
 		return err
 	}
-	txBus.publish()
+	txBus.AfterCommit()
 	return nil
 }
 
+// AfterCommit 通过发送队列发送事务中暂存的消息，用于事务由 ORM 等调用者提交的场景
+// 发送队列已满的消息以及没有调用 AfterCommit 的消息保留在 outbox 中，由扫描发送
+func (txBus *TxBus) AfterCommit() {
+	txBus.mutex.Lock()
+	defer txBus.mutex.Unlock()
+
+	for _, msg := range txBus.msgs {
+		txBus.bus.hooks.staged(msg)
+		if err := txBus.bus.publisher.reserve(); err != nil {
+			txBus.bus.logger.WithError(err).WithField("uuid", msg.UUID).Warn("message is left in outbox for scanning")
+			txBus.bus.msgPool.Put(msg)
+			continue
+		}
+		txBus.bus.publisher.enqueue(msg)
+	}
+	txBus.msgs = txBus.msgs[:0]
+}
+
+// Tx 返回 TxBus 使用的事务，在同一个事务中修改业务数据
+func (txBus *TxBus) Tx() *sql.Tx {
+	return txBus.tx
+}
+
 func (txBus *TxBus) RollBack() error {
 	err := txBus.tx.Rollback()
 	if err != nil {
@@ -239,15 +471,6 @@ func (txBus *TxBus) RollBack() error {
 
 }
 
-func (txBus *TxBus) publish() {
-	go func() {
-		txBus.bus.publisher.publish(txBus.msgs...)
-		for _, msg := range txBus.msgs {
-			txBus.bus.msgPool.Put(msg)
-		}
-	}()
-}
-
 func (bus *Bus) initProvider(ctx context.Context) error {
 	var err error
 
@@ -272,6 +495,25 @@ func (bus *Bus) initProvider(ctx context.Context) error {
 	return nil
 }
 
+// newLogger 使用 Options.Logger 输出日志，未设置时输出到 os.Stdout
+// 低于 Options.LogLevel 的日志会被过滤
+func newLogger(opt Options) logger.Logger {
+	l := opt.Logger
+	if l == nil {
+		l = logger.NewLogrus(&logrus.Logger{
+			Out: os.Stdout,
+			Formatter: &logrus.TextFormatter{
+				FullTimestamp: true,
+			},
+			Hooks:        make(logrus.LevelHooks),
+			Level:        logrus.TraceLevel,
+			ExitFunc:     os.Exit,
+			ReportCaller: false,
+		})
+	}
+	return logger.WithLevel(l, opt.LogLevel)
+}
+
 func (bus *Bus) allocateMessage() *message.Message {
 	return &message.Message{
 		AckChan:    make(chan struct{}),
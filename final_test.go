@@ -1,6 +1,7 @@
 package final
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"testing"
@@ -10,6 +11,8 @@ import (
 	"github.com/vmihailenco/msgpack/v5"
 	"github.com/xyctruth/final/_example"
 	"github.com/xyctruth/final/message"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	"gorm.io/gorm"
 )
 
@@ -47,6 +50,61 @@ func TestGeneral(t *testing.T) {
 	require.Equal(t, 2, count)
 }
 
+func TestPublishBatch(t *testing.T) {
+	bus := New("test_svc", _example.NewDB(), _example.NewAmqp(), DefaultOptions().WithNumAcker(1).WithNumSubscriber(1).WithPurgeOnStartup(true))
+
+	count := 0
+	bus.Subscribe("PublishBatch").Handler(func(c *Context) error {
+		count++
+		return nil
+	})
+
+	err := bus.Start()
+	require.Equal(t, nil, err)
+
+	payloads := [][]byte{
+		NewDemoMessage("message", 1),
+		NewDemoMessage("message", 2),
+		NewDemoMessage("message", 3),
+	}
+	results, err := bus.PublishBatch("PublishBatch", payloads, message.WithConfirm(true))
+	require.Equal(t, nil, err)
+	require.Equal(t, 3, len(results))
+	for _, result := range results {
+		require.Equal(t, nil, result.Err)
+		require.NotEqual(t, "", result.UUID)
+	}
+
+	time.Sleep(1 * time.Second)
+	err = bus.Shutdown()
+	require.Equal(t, nil, err)
+	require.Equal(t, 3, count)
+}
+
+func TestPublishBatchQueueFull(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	bus := New("test_svc", nil, &fakeProvider{}, DefaultOptions().WithPublishQueueSize(2).WithPublishBlocking(false).WithTracerProvider(tp))
+
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "parent")
+	payloads := [][]byte{[]byte("1"), []byte("2"), []byte("3")}
+	// 批量发布与 Publish 一样进入发送队列，队列已满的消息返回 ErrPublishQueueFull
+	results, err := bus.PublishBatchCtx(ctx, "PublishBatch", payloads, message.WithConfirm(false))
+	parent.End()
+	require.Equal(t, nil, err)
+	require.Equal(t, 3, len(results))
+	require.Equal(t, nil, results[0].Err)
+	require.Equal(t, nil, results[1].Err)
+	require.Equal(t, ErrPublishQueueFull, results[2].Err)
+	require.Equal(t, 2, len(bus.publisher.queue))
+
+	spans := recorder.Ended()
+	require.Equal(t, 4, len(spans))
+	for _, span := range spans[:3] {
+		require.Equal(t, parent.SpanContext().SpanID(), span.Parent().SpanID())
+	}
+}
+
 func TestRetry(t *testing.T) {
 
 	tests := []struct {
@@ -0,0 +1,155 @@
+package final
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/xyctruth/final/mq"
+)
+
+const healthCheckTimeout = 3 * time.Second
+
+// HealthStatus 健康状态
+type HealthStatus string
+
+const (
+	HealthUp       HealthStatus = "up"       // 正常
+	HealthDegraded HealthStatus = "degraded" // 可用，但 outbox 的延迟超过 Options.HealthMaxOutboxLag
+	HealthDown     HealthStatus = "down"     // 不可用
+)
+
+type (
+	// Health Bus 的健康状态
+	Health struct {
+		// Live Bus 的 goroutine 都在运行
+		Live bool `json:"live"`
+		// Status db、mq、Bus 的 goroutine 以及 outbox 延迟的汇总状态
+		Status     HealthStatus      `json:"status"`
+		Components []ComponentHealth `json:"components"`
+		// OutboxBacklog outbox 中待发送的消息数量
+		OutboxBacklog int64 `json:"outbox_backlog"`
+		// OutboxLag outbox 中最早的待发送消息的等待时间
+		OutboxLag time.Duration `json:"outbox_lag"`
+	}
+
+	// ComponentHealth 单个组件的健康状态
+	ComponentHealth struct {
+		Name   string       `json:"name"`
+		Status HealthStatus `json:"status"`
+		Error  string       `json:"error,omitempty"`
+	}
+)
+
+// Health 检查 db、mq 驱动、subscriber、publisher、acker 以及 outbox 扫描的健康状态
+// mq 驱动实现 mq.IHealthChecker 时包含 mq 连接和 channel 的状态
+func (bus *Bus) Health() Health {
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+
+	h := Health{Live: true, Status: HealthUp}
+
+	// goroutines
+	bus.subMutex.RLock()
+	subscribers := bus.subscribers
+	bus.subMutex.RUnlock()
+	for _, subscriber := range subscribers {
+		h.addGoroutine("subscriber."+subscriber.id, subscriber.isRunning())
+	}
+	h.addGoroutine("publisher", atomic.LoadInt32(&bus.publisher.running) == 1)
+	for _, acker := range bus.ackers {
+		h.addGoroutine("acker."+acker.id, atomic.LoadInt32(&acker.running) == 1)
+	}
+	h.addGoroutine("outbox.scanner", atomic.LoadInt32(&bus.outbox.running) == 1)
+	if _, err := bus.outbox.lastScan(); err != nil {
+		h.add("outbox.scanner.last_scan", err)
+	}
+
+	// db
+	if bus.db == nil {
+		h.add("db", errors.New("db is nil"))
+	} else {
+		h.add("db", bus.db.PingContext(ctx))
+	}
+
+	// mq
+	if checker, ok := bus.mqProvider.(mq.IHealthChecker); ok {
+		components := checker.Health()
+		names := make([]string, 0, len(components))
+		for name := range components {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			h.add("mq."+name, components[name])
+		}
+	}
+
+	// outbox lag
+	if bus.db != nil {
+		backlog, oldest, err := bus.outbox.statContext(ctx)
+		h.add("outbox", err)
+		h.OutboxBacklog = backlog
+		if oldest.Valid {
+			h.OutboxLag = time.Since(oldest.Time)
+		}
+		if h.Status == HealthUp && bus.opt.HealthMaxOutboxLag > 0 && h.OutboxLag > bus.opt.HealthMaxOutboxLag {
+			h.Status = HealthDegraded
+		}
+	}
+
+	return h
+}
+
+func (h *Health) add(name string, err error) {
+	component := ComponentHealth{Name: name, Status: HealthUp}
+	if err != nil {
+		component.Status = HealthDown
+		component.Error = err.Error()
+		h.Status = HealthDown
+	}
+	h.Components = append(h.Components, component)
+}
+
+func (h *Health) addGoroutine(name string, running bool) {
+	if running {
+		h.add(name, nil)
+		return
+	}
+	h.add(name, errors.New("not running"))
+	h.Live = false
+}
+
+// HealthHandler 返回输出健康状态 JSON 的 http.Handler
+//   .../livez  存活检查，Bus 的 goroutine 没有运行时返回 503
+//   .../readyz 就绪检查，状态不是 up 时返回 503，包括 outbox 延迟超过 Options.HealthMaxOutboxLag 的 degraded 状态
+//   其它路径返回完整的健康状态
+func (bus *Bus) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := bus.Health()
+
+		code := http.StatusOK
+		switch path.Base(r.URL.Path) {
+		case "livez":
+			if !h.Live {
+				code = http.StatusServiceUnavailable
+			}
+		case "readyz":
+			if h.Status != HealthUp {
+				code = http.StatusServiceUnavailable
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		err := json.NewEncoder(w).Encode(h)
+		if err != nil {
+			bus.logger.WithError(err).Error("write health response failure")
+		}
+	})
+}
@@ -0,0 +1,57 @@
+package final
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/xyctruth/final/_example"
+)
+
+func TestHealth(t *testing.T) {
+	bus := New("test_svc", _example.NewDB(), _example.NewAmqp(), DefaultOptions().WithNumAcker(1).WithNumSubscriber(1).WithPurgeOnStartup(true))
+	bus.Subscribe("Health").Handler(func(c *Context) error {
+		return nil
+	})
+
+	err := bus.Start()
+	require.Equal(t, nil, err)
+
+	h := bus.Health()
+	require.Equal(t, true, h.Live)
+	require.Equal(t, HealthUp, h.Status)
+	require.Equal(t, int64(0), h.OutboxBacklog)
+
+	err = bus.Shutdown()
+	require.Equal(t, nil, err)
+}
+
+func TestHealthHandler(t *testing.T) {
+	bus := New("test_svc", nil, nil, DefaultOptions().WithNumAcker(1).WithNumSubscriber(1))
+	handler := bus.HealthHandler()
+
+	tests := []struct {
+		path string
+		want int
+	}{
+		{path: "/health/livez", want: http.StatusServiceUnavailable},
+		{path: "/health/readyz", want: http.StatusServiceUnavailable},
+		{path: "/health", want: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			require.Equal(t, tt.want, rec.Code)
+
+			h := Health{}
+			err := json.Unmarshal(rec.Body.Bytes(), &h)
+			require.Equal(t, nil, err)
+			require.Equal(t, false, h.Live)
+			require.Equal(t, HealthDown, h.Status)
+		})
+	}
+}
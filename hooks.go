@@ -0,0 +1,152 @@
+package final
+
+import (
+	"sync"
+
+	"github.com/xyctruth/final/message"
+)
+
+// Hook 消息生命周期的回调，未设置的回调会被忽略
+// 回调在 Bus 的 goroutine 中同步执行，不应该长时间阻塞，也不应该修改 msg
+type Hook struct {
+	// OnStaged 消息暂存到 outbox 中，并且暂存消息的事务已经提交
+	// TxBus 中的消息在 Commit 或者 AfterCommit 时回调，回滚的消息不会回调
+	OnStaged func(msg *message.Message)
+	// OnPublished 消息发送到消息队列中，err 不为 nil 表示发送失败
+	OnPublished func(msg *message.Message, err error)
+	// OnConfirmed 消息队列确认收到消息，outbox 中的消息记录被删除
+	OnConfirmed func(msg *message.Message)
+	// OnNacked 消息队列拒绝了消息，outbox 中的消息记录保留，等待扫描重新发送
+	OnNacked func(msg *message.Message)
+	// OnRepublished outbox 扫描到没有收到 ack 的消息，重新发送
+	OnRepublished func(msg *message.Message)
+	// OnReturned 消息没有路由到任何队列，被消息队列退回，outbox 中的消息记录标记为 unroutable，等待扫描重新发送
+	OnReturned func(msg *message.Message)
+
+	// OnReceived 从消息队列中收到消息
+	OnReceived func(msg *message.Message)
+	// OnHandled 每次 handler 处理完成，err 为 handler 返回的错误
+	OnHandled func(msg *message.Message, err error)
+	// OnRetried handler 处理失败后重试，attempt 从 2 开始
+	OnRetried func(msg *message.Message, attempt uint, err error)
+	// OnRejected 重试次数用完后仍然失败，消息被 reject
+	OnRejected func(msg *message.Message, err error)
+
+	// OnBreakerStateChanged topic 的熔断器状态改变
+	OnBreakerStateChanged func(topic string, from, to BreakerState)
+}
+
+// hooks 保存通过 Bus.AddHook 添加的回调
+type hooks struct {
+	mutex sync.RWMutex
+	hooks []Hook
+}
+
+// AddHook 添加消息生命周期的回调
+func (bus *Bus) AddHook(hook Hook) {
+	bus.hooks.mutex.Lock()
+	defer bus.hooks.mutex.Unlock()
+	bus.hooks.hooks = append(bus.hooks.hooks, hook)
+}
+
+func (h *hooks) empty() bool {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return len(h.hooks) == 0
+}
+
+func (h *hooks) each(fn func(hook *Hook)) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	for i := range h.hooks {
+		fn(&h.hooks[i])
+	}
+}
+
+func (h *hooks) staged(msg *message.Message) {
+	h.each(func(hook *Hook) {
+		if hook.OnStaged != nil {
+			hook.OnStaged(msg)
+		}
+	})
+}
+
+func (h *hooks) published(msg *message.Message, err error) {
+	h.each(func(hook *Hook) {
+		if hook.OnPublished != nil {
+			hook.OnPublished(msg, err)
+		}
+	})
+}
+
+func (h *hooks) confirmed(msg *message.Message) {
+	h.each(func(hook *Hook) {
+		if hook.OnConfirmed != nil {
+			hook.OnConfirmed(msg)
+		}
+	})
+}
+
+func (h *hooks) nacked(msg *message.Message) {
+	h.each(func(hook *Hook) {
+		if hook.OnNacked != nil {
+			hook.OnNacked(msg)
+		}
+	})
+}
+
+func (h *hooks) republished(msg *message.Message) {
+	h.each(func(hook *Hook) {
+		if hook.OnRepublished != nil {
+			hook.OnRepublished(msg)
+		}
+	})
+}
+
+func (h *hooks) returned(msg *message.Message) {
+	h.each(func(hook *Hook) {
+		if hook.OnReturned != nil {
+			hook.OnReturned(msg)
+		}
+	})
+}
+
+func (h *hooks) received(msg *message.Message) {
+	h.each(func(hook *Hook) {
+		if hook.OnReceived != nil {
+			hook.OnReceived(msg)
+		}
+	})
+}
+
+func (h *hooks) handled(msg *message.Message, err error) {
+	h.each(func(hook *Hook) {
+		if hook.OnHandled != nil {
+			hook.OnHandled(msg, err)
+		}
+	})
+}
+
+func (h *hooks) retried(msg *message.Message, attempt uint, err error) {
+	h.each(func(hook *Hook) {
+		if hook.OnRetried != nil {
+			hook.OnRetried(msg, attempt, err)
+		}
+	})
+}
+
+func (h *hooks) rejected(msg *message.Message, err error) {
+	h.each(func(hook *Hook) {
+		if hook.OnRejected != nil {
+			hook.OnRejected(msg, err)
+		}
+	})
+}
+
+func (h *hooks) breakerStateChanged(topic string, from, to BreakerState) {
+	h.each(func(hook *Hook) {
+		if hook.OnBreakerStateChanged != nil {
+			hook.OnBreakerStateChanged(topic, from, to)
+		}
+	})
+}
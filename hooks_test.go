@@ -0,0 +1,87 @@
+package final
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/xyctruth/final/_example"
+	"github.com/xyctruth/final/message"
+)
+
+func TestHooks(t *testing.T) {
+	bus := New("test_svc", _example.NewDB(), _example.NewAmqp(), DefaultOptions().WithNumAcker(1).WithNumSubscriber(1).WithRetryCount(1).WithPurgeOnStartup(true))
+
+	events := make(chan string, 100)
+	bus.AddHook(Hook{
+		OnStaged:    func(msg *message.Message) { events <- "staged" },
+		OnPublished: func(msg *message.Message, err error) { events <- "published" },
+		OnConfirmed: func(msg *message.Message) { events <- "confirmed" },
+		OnReceived:  func(msg *message.Message) { events <- "received" },
+		OnHandled:   func(msg *message.Message, err error) { events <- "handled" },
+		OnRetried:   func(msg *message.Message, attempt uint, err error) { events <- "retried" },
+		OnRejected:  func(msg *message.Message, err error) { events <- "rejected" },
+	})
+
+	bus.Subscribe("Hooks").Handler(func(c *Context) error {
+		return errors.New("error")
+	})
+
+	err := bus.Start()
+	require.Equal(t, nil, err)
+
+	err = bus.Publish("Hooks", NewDemoMessage("message", 100), message.WithConfirm(true))
+	require.Equal(t, nil, err)
+
+	time.Sleep(1 * time.Second)
+	err = bus.Shutdown()
+	require.Equal(t, nil, err)
+	close(events)
+
+	counts := make(map[string]int)
+	for event := range events {
+		counts[event]++
+	}
+	require.Equal(t, map[string]int{
+		"staged":    1,
+		"published": 1,
+		"confirmed": 1,
+		"received":  1,
+		"handled":   2,
+		"retried":   1,
+		"rejected":  1,
+	}, counts)
+}
+
+func TestHooksPublish(t *testing.T) {
+	provider := &fakeProvider{}
+	bus := New("test_svc", nil, provider, DefaultOptions())
+
+	var published, nacked []*message.Message
+	var publishErr error
+	bus.AddHook(Hook{
+		OnPublished: func(msg *message.Message, err error) {
+			published = append(published, msg)
+			publishErr = err
+		},
+		OnNacked: func(msg *message.Message) { nacked = append(nacked, msg) },
+	})
+
+	msg := message.NewMessage("1", "HooksPublish", nil)
+	msg.Header.Set("record_id", int64(1))
+	errs := bus.publisher.publish(msg)
+	require.Equal(t, []error{nil}, errs)
+	require.Equal(t, 1, len(published))
+	require.Equal(t, nil, publishErr)
+
+	bus.publisher.nacked(1)
+	require.Equal(t, 1, len(nacked))
+	require.Equal(t, "1", nacked[0].UUID)
+	require.Equal(t, int64(1), nacked[0].Header.Get("record_id"))
+
+	provider.err = errors.New("publish error")
+	errs = bus.publisher.publish(message.NewMessage("2", "HooksPublish", nil))
+	require.Equal(t, provider.err, errs[0])
+	require.Equal(t, provider.err, publishErr)
+}
@@ -0,0 +1,73 @@
+package final
+
+import (
+	"context"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimit 使用令牌桶限制 topic 每秒处理的消息数量，burst 为令牌桶的容量
+// 每次调用 handler 之前等待令牌，重试也会消耗令牌，BatchHandler 每条消息消耗一个令牌
+// perSecond 不大于 0 时不限制，burst 不大于 0 时使用 1
+func (topic *routerTopic) RateLimit(perSecond float64, burst int) *routerTopic {
+	if perSecond <= 0 {
+		topic.limiter = nil
+		return topic
+	}
+	if burst <= 0 {
+		burst = 1
+	}
+	topic.limiter = rate.NewLimiter(rate.Limit(perSecond), burst)
+	return topic
+}
+
+// MaxInFlight 限制 topic 同时处理的消息数量，所有 subscriber 共享，BatchHandler 每批消息算作一条
+// 需要 mq 驱动为每个 topic 使用独立的队列（mq.ITopicSubscriber），Prefetch 的默认值不超过 MaxInFlight，超出的消息保留在 mq 中，
+// 否则 Bus.Start 返回 ErrTopicQueuesRequired
+func (topic *routerTopic) MaxInFlight(val int) *routerTopic {
+	topic.maxInFlight = val
+	topic.inflight = nil
+	if val > 0 {
+		topic.inflight = make(chan struct{}, val)
+	}
+	return topic
+}
+
+// acquire 占用一个处理消息的位置，ctx 结束时返回 ctx 的错误
+func (topic *routerTopic) acquire(ctx context.Context) error {
+	if topic == nil || topic.inflight == nil {
+		return nil
+	}
+	select {
+	case topic.inflight <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release 释放 acquire 占用的位置
+func (topic *routerTopic) release() {
+	if topic == nil || topic.inflight == nil {
+		return
+	}
+	<-topic.inflight
+}
+
+// wait 等待处理 n 条消息的令牌，n 超过令牌桶的容量时分多次等待
+func (topic *routerTopic) wait(ctx context.Context, n int) error {
+	if topic == nil || topic.limiter == nil {
+		return nil
+	}
+	for n > 0 {
+		k := n
+		if burst := topic.limiter.Burst(); k > burst {
+			k = burst
+		}
+		if err := topic.limiter.WaitN(ctx, k); err != nil {
+			return err
+		}
+		n -= k
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package final
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/xyctruth/final/message"
+)
+
+func TestTopicMaxInFlight(t *testing.T) {
+	provider := &topicProvider{prefetch: make(map[string]int), msgs: make(map[string]chan *message.Message)}
+	bus := New("test_svc", nil, provider, DefaultOptions().WithRetryCount(0))
+
+	var (
+		inflight    int32
+		maxInflight int32
+		wg          sync.WaitGroup
+	)
+	bus.Subscribe("topic1").Concurrency(3).MaxInFlight(1).Handler(func(c *Context) error {
+		defer wg.Done()
+		n := atomic.AddInt32(&inflight, 1)
+		if n > atomic.LoadInt32(&maxInflight) {
+			atomic.StoreInt32(&maxInflight, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&inflight, -1)
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	subscribers, err := bus.newSubscribers()
+	require.Equal(t, nil, err)
+	bus.subscribers = subscribers
+	require.Equal(t, nil, bus.subscribers[0].Start(ctx))
+	// prefetch 不超过 MaxInFlight
+	require.Equal(t, 1, provider.prefetch["topic1"])
+
+	wg.Add(6)
+	for i := 0; i < 6; i++ {
+		provider.msgs["topic1"] <- message.NewMessage("", "topic1", nil)
+	}
+	wg.Wait()
+	require.Equal(t, int32(1), atomic.LoadInt32(&maxInflight))
+}
+
+func TestTopicRateLimit(t *testing.T) {
+	provider := &topicProvider{prefetch: make(map[string]int), msgs: make(map[string]chan *message.Message)}
+	bus := New("test_svc", nil, provider, DefaultOptions().WithRetryCount(0))
+
+	var wg sync.WaitGroup
+	bus.Subscribe("topic1").Concurrency(3).RateLimit(50, 1).Handler(func(c *Context) error {
+		wg.Done()
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	subscribers, err := bus.newSubscribers()
+	require.Equal(t, nil, err)
+	bus.subscribers = subscribers
+	require.Equal(t, nil, bus.subscribers[0].Start(ctx))
+
+	start := time.Now()
+	wg.Add(6)
+	for i := 0; i < 6; i++ {
+		provider.msgs["topic1"] <- message.NewMessage("", "topic1", nil)
+	}
+	wg.Wait()
+	// 第一条消息使用令牌桶中已有的令牌，之后每 20ms 处理一条消息
+	require.GreaterOrEqual(t, time.Since(start), 90*time.Millisecond)
+}
+
+func TestTopicRateLimitStopped(t *testing.T) {
+	provider := &topicProvider{prefetch: make(map[string]int), msgs: make(map[string]chan *message.Message)}
+	bus := New("test_svc", nil, provider, DefaultOptions().WithRetryCount(0))
+	bus.Subscribe("topic1").RateLimit(0.001, 1).Handler(func(c *Context) error {
+		return nil
+	})
+	topic := bus.router.topics["topic1"]
+
+	ctx, cancel := context.WithCancel(context.Background())
+	require.Equal(t, nil, topic.wait(ctx, 1))
+	cancel()
+
+	// 等待限流时停止，消息既不 Ack 也不 Reject
+	msg := message.NewMessage("", "topic1", nil)
+	subscribers, err := bus.newSubscribers()
+	require.Equal(t, nil, err)
+	bus.subscribers = subscribers
+	bus.subscribers[0].processMessage(ctx, msg)
+	select {
+	case <-msg.Acked():
+		t.Fatal("message should not be acked")
+	case <-msg.Rejected():
+		t.Fatal("message should not be rejected")
+	default:
+	}
+}
+
+func TestTopicRateLimitInvalid(t *testing.T) {
+	bus := New("test_svc", nil, nil, DefaultOptions())
+
+	// perSecond 不大于 0 时不限制
+	topic := bus.Subscribe("topic1").RateLimit(0, 1)
+	require.Nil(t, topic.limiter)
+	topic.RateLimit(-1, 10)
+	require.Nil(t, topic.limiter)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	require.Equal(t, nil, topic.wait(ctx, 100))
+
+	// burst 不大于 0 时使用 1
+	topic.RateLimit(10, 0)
+	require.Equal(t, 1, topic.limiter.Burst())
+	require.Equal(t, nil, topic.wait(ctx, 1))
+}
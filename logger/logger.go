@@ -0,0 +1,98 @@
+// Package logger 定义 final 使用的日志接口，并提供 logrus、zap 和 log/slog 的适配
+package logger
+
+// Level 日志级别，零值为 InfoLevel
+type Level int32
+
+const (
+	TraceLevel Level = iota - 2
+	DebugLevel
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+// Fields 日志的结构化字段
+type Fields map[string]interface{}
+
+// Logger final 使用的日志接口
+type Logger interface {
+	WithField(key string, value interface{}) Logger
+	WithFields(fields Fields) Logger
+	WithError(err error) Logger
+
+	Trace(args ...interface{})
+	Debug(args ...interface{})
+	Info(args ...interface{})
+	Warn(args ...interface{})
+	Error(args ...interface{})
+}
+
+// Discard 丢弃所有日志
+var Discard Logger = discard{}
+
+type discard struct{}
+
+func (d discard) WithField(string, interface{}) Logger { return d }
+func (d discard) WithFields(Fields) Logger             { return d }
+func (d discard) WithError(error) Logger               { return d }
+func (d discard) Trace(...interface{})                 {}
+func (d discard) Debug(...interface{})                 {}
+func (d discard) Info(...interface{})                  {}
+func (d discard) Warn(...interface{})                  {}
+func (d discard) Error(...interface{})                 {}
+
+// WithLevel 过滤低于 level 的日志
+func WithLevel(l Logger, level Level) Logger {
+	if l, ok := l.(*leveled); ok {
+		return &leveled{Logger: l.Logger, level: level}
+	}
+	return &leveled{Logger: l, level: level}
+}
+
+type leveled struct {
+	Logger
+	level Level
+}
+
+func (l *leveled) WithField(key string, value interface{}) Logger {
+	return &leveled{Logger: l.Logger.WithField(key, value), level: l.level}
+}
+
+func (l *leveled) WithFields(fields Fields) Logger {
+	return &leveled{Logger: l.Logger.WithFields(fields), level: l.level}
+}
+
+func (l *leveled) WithError(err error) Logger {
+	return &leveled{Logger: l.Logger.WithError(err), level: l.level}
+}
+
+func (l *leveled) Trace(args ...interface{}) {
+	if l.level <= TraceLevel {
+		l.Logger.Trace(args...)
+	}
+}
+
+func (l *leveled) Debug(args ...interface{}) {
+	if l.level <= DebugLevel {
+		l.Logger.Debug(args...)
+	}
+}
+
+func (l *leveled) Info(args ...interface{}) {
+	if l.level <= InfoLevel {
+		l.Logger.Info(args...)
+	}
+}
+
+func (l *leveled) Warn(args ...interface{}) {
+	if l.level <= WarnLevel {
+		l.Logger.Warn(args...)
+	}
+}
+
+func (l *leveled) Error(args ...interface{}) {
+	if l.level <= ErrorLevel {
+		l.Logger.Error(args...)
+	}
+}
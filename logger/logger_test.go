@@ -0,0 +1,61 @@
+package logger
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestWithLevel(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := WithLevel(NewLogrus(&logrus.Logger{
+		Out:       buf,
+		Formatter: &logrus.TextFormatter{DisableTimestamp: true},
+		Hooks:     make(logrus.LevelHooks),
+		Level:     logrus.TraceLevel,
+	}), WarnLevel)
+
+	l.WithField("module", "test").Info("info message")
+	require.Equal(t, "", buf.String())
+
+	l.WithField("module", "test").WithError(errors.New("boom")).Warn("warn message")
+	require.Contains(t, buf.String(), "warn message")
+	require.Contains(t, buf.String(), "module=test")
+	require.Contains(t, buf.String(), "error=boom")
+
+	buf.Reset()
+	WithLevel(l, TraceLevel).Trace("trace message")
+	require.Contains(t, buf.String(), "trace message")
+
+	// 零值为 InfoLevel
+	var level Level
+	require.Equal(t, InfoLevel, level)
+	buf.Reset()
+	WithLevel(l, level).Debug("debug message")
+	require.Equal(t, "", buf.String())
+	WithLevel(l, level).Info("info message")
+	require.Contains(t, buf.String(), "info message")
+}
+
+func TestZap(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+	l := NewZap(zap.New(core))
+
+	l.WithFields(Fields{"module": "test"}).Info("info message")
+	l.Trace("trace message")
+
+	entries := logs.All()
+	require.Equal(t, 2, len(entries))
+	require.Equal(t, "info message", entries[0].Message)
+	require.Equal(t, "test", entries[0].ContextMap()["module"])
+	require.Equal(t, zap.DebugLevel, entries[1].Level)
+}
+
+func TestDiscard(t *testing.T) {
+	Discard.WithField("module", "test").WithError(errors.New("boom")).Error("discard")
+}
@@ -0,0 +1,35 @@
+package logger
+
+import "github.com/sirupsen/logrus"
+
+// NewLogrus 使用 logrus.Logger 输出日志
+func NewLogrus(l *logrus.Logger) Logger {
+	return &logrusLogger{entry: logrus.NewEntry(l)}
+}
+
+// NewLogrusEntry 使用 logrus.Entry 输出日志，保留 entry 已有的字段
+func NewLogrusEntry(entry *logrus.Entry) Logger {
+	return &logrusLogger{entry: entry}
+}
+
+type logrusLogger struct {
+	entry *logrus.Entry
+}
+
+func (l *logrusLogger) WithField(key string, value interface{}) Logger {
+	return &logrusLogger{entry: l.entry.WithField(key, value)}
+}
+
+func (l *logrusLogger) WithFields(fields Fields) Logger {
+	return &logrusLogger{entry: l.entry.WithFields(logrus.Fields(fields))}
+}
+
+func (l *logrusLogger) WithError(err error) Logger {
+	return &logrusLogger{entry: l.entry.WithError(err)}
+}
+
+func (l *logrusLogger) Trace(args ...interface{}) { l.entry.Trace(args...) }
+func (l *logrusLogger) Debug(args ...interface{}) { l.entry.Debug(args...) }
+func (l *logrusLogger) Info(args ...interface{})  { l.entry.Info(args...) }
+func (l *logrusLogger) Warn(args ...interface{})  { l.entry.Warn(args...) }
+func (l *logrusLogger) Error(args ...interface{}) { l.entry.Error(args...) }
@@ -0,0 +1,48 @@
+//go:build go1.21
+// +build go1.21
+
+package logger
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// LevelTrace slog 中 Trace 级别对应的 Level
+const LevelTrace = slog.LevelDebug - 4
+
+// NewSlog 使用 log/slog 输出日志
+func NewSlog(l *slog.Logger) Logger {
+	return &slogLogger{logger: l}
+}
+
+type slogLogger struct {
+	logger *slog.Logger
+}
+
+func (l *slogLogger) WithField(key string, value interface{}) Logger {
+	return &slogLogger{logger: l.logger.With(key, value)}
+}
+
+func (l *slogLogger) WithFields(fields Fields) Logger {
+	args := make([]interface{}, 0, len(fields)*2)
+	for k, v := range fields {
+		args = append(args, k, v)
+	}
+	return &slogLogger{logger: l.logger.With(args...)}
+}
+
+func (l *slogLogger) WithError(err error) Logger {
+	return &slogLogger{logger: l.logger.With("error", err)}
+}
+
+func (l *slogLogger) Trace(args ...interface{}) { l.log(LevelTrace, args...) }
+func (l *slogLogger) Debug(args ...interface{}) { l.log(slog.LevelDebug, args...) }
+func (l *slogLogger) Info(args ...interface{})  { l.log(slog.LevelInfo, args...) }
+func (l *slogLogger) Warn(args ...interface{})  { l.log(slog.LevelWarn, args...) }
+func (l *slogLogger) Error(args ...interface{}) { l.log(slog.LevelError, args...) }
+
+func (l *slogLogger) log(level slog.Level, args ...interface{}) {
+	l.logger.Log(context.Background(), level, fmt.Sprint(args...))
+}
@@ -0,0 +1,25 @@
+//go:build go1.21
+// +build go1.21
+
+package logger
+
+import (
+	"bytes"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSlog(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := NewSlog(slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{Level: LevelTrace})))
+
+	l.WithFields(Fields{"module": "test"}).Info("info message")
+	require.Contains(t, buf.String(), "info message")
+	require.Contains(t, buf.String(), "module=test")
+
+	buf.Reset()
+	l.Trace("trace message")
+	require.Contains(t, buf.String(), "trace message")
+}
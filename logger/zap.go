@@ -0,0 +1,34 @@
+package logger
+
+import "go.uber.org/zap"
+
+// NewZap 使用 zap.Logger 输出日志，Trace 级别输出为 Debug
+func NewZap(l *zap.Logger) Logger {
+	return &zapLogger{sugar: l.Sugar()}
+}
+
+type zapLogger struct {
+	sugar *zap.SugaredLogger
+}
+
+func (l *zapLogger) WithField(key string, value interface{}) Logger {
+	return &zapLogger{sugar: l.sugar.With(key, value)}
+}
+
+func (l *zapLogger) WithFields(fields Fields) Logger {
+	args := make([]interface{}, 0, len(fields)*2)
+	for k, v := range fields {
+		args = append(args, k, v)
+	}
+	return &zapLogger{sugar: l.sugar.With(args...)}
+}
+
+func (l *zapLogger) WithError(err error) Logger {
+	return &zapLogger{sugar: l.sugar.With(zap.Error(err))}
+}
+
+func (l *zapLogger) Trace(args ...interface{}) { l.sugar.Debug(args...) }
+func (l *zapLogger) Debug(args ...interface{}) { l.sugar.Debug(args...) }
+func (l *zapLogger) Info(args ...interface{})  { l.sugar.Info(args...) }
+func (l *zapLogger) Warn(args ...interface{})  { l.sugar.Warn(args...) }
+func (l *zapLogger) Error(args ...interface{}) { l.sugar.Error(args...) }
@@ -24,6 +24,27 @@ type (
 	Header map[string]interface{}
 )
 
+const (
+	// KeyHeader 保存消息 key 的 Header
+	KeyHeader = "x-final-key"
+	// ReplyToHeader 保存 request 回复地址的 Header
+	ReplyToHeader = "x-final-reply-to"
+	// CorrelationIDHeader 关联 request 和 reply 的 Header，值为 request 消息的 UUID
+	CorrelationIDHeader = "x-final-correlation-id"
+
+	// RecordIDHeader 消息在 outbox 中的记录id，只在发送方进程内使用
+	RecordIDHeader = "record_id"
+	// DeferredHeader 标记 OrderedOutbox 模式下暂缓发送的消息，只在发送方进程内使用
+	DeferredHeader = "deferred"
+	// DelayedHeader 保存延时消息的发送时间，只在发送方进程内使用
+	DelayedHeader = "delayed"
+)
+
+// IsInternalHeader key 是否为只在发送方进程内使用的 Header，mq 驱动发送消息时过滤掉这些 Header
+func IsInternalHeader(key string) bool {
+	return key == RecordIDHeader || key == DeferredHeader || key == DelayedHeader
+}
+
 func NewMessage(uuid, topic string, payload []byte, opts ...PolicyOption) *Message {
 	if uuid == "" {
 		uuid = uuidtools.NewV4().String()
@@ -42,6 +63,7 @@ func NewMessage(uuid, topic string, payload []byte, opts ...PolicyOption) *Messa
 		opt(messagePolicy)
 	}
 	msg.Policy = messagePolicy
+	msg.setPolicyHeader()
 	return msg
 }
 
@@ -52,12 +74,71 @@ func (m *Message) Reset(uuid, topic string, payload []byte, opts ...PolicyOption
 	m.UUID = uuid
 	m.Topic = topic
 	m.Payload = payload
+	if m.Header == nil {
+		m.Header = make(Header)
+	}
+	for k := range m.Header {
+		delete(m.Header, k)
+	}
 
 	messagePolicy := DefaultMessagePolicy()
 	for _, opt := range opts {
 		opt(messagePolicy)
 	}
 	m.Policy = messagePolicy
+	m.setPolicyHeader()
+}
+
+// setPolicyHeader 把 Policy 中的 Header 和 key 添加到消息 Header 中
+func (m *Message) setPolicyHeader() {
+	for k, v := range m.Policy.Header {
+		m.Header.Set(k, v)
+	}
+	if m.Policy.Key != "" {
+		m.Header.Set(KeyHeader, m.Policy.Key)
+	}
+}
+
+// Key 返回消息的 key，发布时为 Policy.Key，消费时从 KeyHeader 中读取
+func (m *Message) Key() string {
+	if m.Policy != nil && m.Policy.Key != "" {
+		return m.Policy.Key
+	}
+	key, _ := m.Header[KeyHeader].(string)
+	return key
+}
+
+// ReplyTo 返回 request 消息的回复地址，不是 request 时为空
+func (m *Message) ReplyTo() string {
+	replyTo, _ := m.Header[ReplyToHeader].(string)
+	return replyTo
+}
+
+// CorrelationID 返回 request 或 reply 消息的关联 id
+func (m *Message) CorrelationID() string {
+	id, _ := m.Header[CorrelationIDHeader].(string)
+	return id
+}
+
+// Clone 复制消息，Header 和 Policy 为新的副本，Payload 与原消息共享
+func (m *Message) Clone() *Message {
+	c := &Message{
+		UUID:       m.UUID,
+		Topic:      m.Topic,
+		SvcName:    m.SvcName,
+		Payload:    m.Payload,
+		Header:     make(Header, len(m.Header)),
+		AckChan:    make(chan struct{}),
+		RejectChan: make(chan struct{}),
+	}
+	for k, v := range m.Header {
+		c.Header[k] = v
+	}
+	if m.Policy != nil {
+		policy := *m.Policy
+		c.Policy = &policy
+	}
+	return c
 }
 
 func (m *Message) Ack() {
@@ -10,6 +10,12 @@ type Policy struct {
 	Durable bool
 	TTL     time.Duration
 	Delay   int64
+	// Priority 消息优先级，需要 mq 驱动和队列支持优先级，例如 AMQP 的 x-max-priority
+	Priority uint8
+	// Key 消息的 key，例如聚合根的 id，相同 key 的消息可以按照顺序处理
+	Key string
+	// Header 发布时添加到消息 Header 中的值
+	Header map[string]interface{}
 }
 
 func DefaultMessagePolicy() *Policy {
@@ -45,7 +51,32 @@ func WithTTL(duration time.Duration) PolicyOption {
 	}
 }
 
-// WithDelay 延时队列
+// WithPriority 消息优先级，数值越大优先级越高，默认 0
+func WithPriority(priority uint8) PolicyOption {
+	return func(c *Policy) {
+		c.Priority = priority
+	}
+}
+
+// WithKey 设置消息的 key，key 保存在消息 Header 的 KeyHeader 中传递给消费者
+func WithKey(key string) PolicyOption {
+	return func(c *Policy) {
+		c.Key = key
+	}
+}
+
+// WithHeader 发布时在消息 Header 中添加 key 和 value
+func WithHeader(key string, value interface{}) PolicyOption {
+	return func(c *Policy) {
+		if c.Header == nil {
+			c.Header = make(map[string]interface{})
+		}
+		c.Header[key] = value
+	}
+}
+
+// WithDelay 延时发送，单位毫秒
+// 只对暂存在 outbox 中的消息（开启 Confirm）生效，消息到期后发送，进程重启后由 outbox 扫描发送
 func WithDelay(delay int64) PolicyOption {
 	return func(c *Policy) {
 		c.Delay = delay
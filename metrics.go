@@ -0,0 +1,221 @@
+package final
+
+import (
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "final"
+
+// metrics Bus 的 Prometheus 指标
+// 未设置 Options.MetricsRegisterer 时为 nil，所有方法都是空操作
+type metrics struct {
+	publishedTotal     *prometheus.CounterVec
+	publishFailedTotal *prometheus.CounterVec
+	confirmedTotal     *prometheus.CounterVec
+	nackedTotal        *prometheus.CounterVec
+	returnedTotal      *prometheus.CounterVec
+	consumedTotal      *prometheus.CounterVec
+	retriedTotal       *prometheus.CounterVec
+	rejectedTotal      *prometheus.CounterVec
+	handleDuration     *prometheus.HistogramVec
+	breakerState       *prometheus.GaugeVec
+}
+
+func newMetrics(bus *Bus) *metrics {
+	reg := bus.opt.MetricsRegisterer
+	if reg == nil {
+		return nil
+	}
+
+	constLabels := prometheus.Labels{"svc": bus.svcName}
+	counterVec := func(name, help string) *prometheus.CounterVec {
+		return prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   metricsNamespace,
+			Name:        name,
+			Help:        help,
+			ConstLabels: constLabels,
+		}, []string{"topic"})
+	}
+
+	m := &metrics{
+		publishedTotal:     counterVec("published_total", "Number of messages published to the mq."),
+		publishFailedTotal: counterVec("publish_failed_total", "Number of messages failed to publish to the mq."),
+		confirmedTotal:     counterVec("confirmed_total", "Number of published messages confirmed by the mq."),
+		nackedTotal:        counterVec("nacked_total", "Number of published messages nacked by the mq."),
+		returnedTotal:      counterVec("returned_total", "Number of published messages returned as unroutable by the mq."),
+		consumedTotal:      counterVec("consumed_total", "Number of messages received from the mq."),
+		retriedTotal:       counterVec("retried_total", "Number of handler retries."),
+		rejectedTotal:      counterVec("rejected_total", "Number of messages rejected after all retries failed."),
+		handleDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   metricsNamespace,
+			Name:        "handle_duration_seconds",
+			Help:        "Latency of handling a message, including middlewares.",
+			ConstLabels: constLabels,
+			Buckets:     prometheus.DefBuckets,
+		}, []string{"topic"}),
+		breakerState: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   metricsNamespace,
+			Name:        "breaker_state",
+			Help:        "State of the topic circuit breaker, 0 closed, 1 open, 2 half-open.",
+			ConstLabels: constLabels,
+		}, []string{"topic"}),
+	}
+
+	m.publishedTotal = registerCollector(bus, reg, m.publishedTotal).(*prometheus.CounterVec)
+	m.publishFailedTotal = registerCollector(bus, reg, m.publishFailedTotal).(*prometheus.CounterVec)
+	m.confirmedTotal = registerCollector(bus, reg, m.confirmedTotal).(*prometheus.CounterVec)
+	m.nackedTotal = registerCollector(bus, reg, m.nackedTotal).(*prometheus.CounterVec)
+	m.returnedTotal = registerCollector(bus, reg, m.returnedTotal).(*prometheus.CounterVec)
+	m.consumedTotal = registerCollector(bus, reg, m.consumedTotal).(*prometheus.CounterVec)
+	m.retriedTotal = registerCollector(bus, reg, m.retriedTotal).(*prometheus.CounterVec)
+	m.rejectedTotal = registerCollector(bus, reg, m.rejectedTotal).(*prometheus.CounterVec)
+	m.handleDuration = registerCollector(bus, reg, m.handleDuration).(*prometheus.HistogramVec)
+	m.breakerState = registerCollector(bus, reg, m.breakerState).(*prometheus.GaugeVec)
+
+	registerCollector(bus, reg, prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   metricsNamespace,
+		Name:        "pending_confirms",
+		Help:        "Number of published messages waiting for the mq confirm.",
+		ConstLabels: constLabels,
+	}, func() float64 {
+		return float64(bus.publisher.numPending())
+	}))
+	registerCollector(bus, reg, newOutboxCollector(bus.outbox, constLabels))
+
+	return m
+}
+
+// registerCollector 注册 collector，已经注册过相同的 collector 时返回已注册的 collector
+func registerCollector(bus *Bus, reg prometheus.Registerer, c prometheus.Collector) prometheus.Collector {
+	err := reg.Register(c)
+	if err == nil {
+		return c
+	}
+
+	var are prometheus.AlreadyRegisteredError
+	if errors.As(err, &are) {
+		return are.ExistingCollector
+	}
+	bus.logger.WithError(err).Error("register metrics collector failure")
+	return c
+}
+
+func (m *metrics) published(topic string) {
+	if m == nil {
+		return
+	}
+	m.publishedTotal.WithLabelValues(topic).Inc()
+}
+
+func (m *metrics) publishFailed(topic string) {
+	if m == nil {
+		return
+	}
+	m.publishFailedTotal.WithLabelValues(topic).Inc()
+}
+
+func (m *metrics) confirmed(topic string) {
+	if m == nil {
+		return
+	}
+	m.confirmedTotal.WithLabelValues(topic).Inc()
+}
+
+func (m *metrics) nacked(topic string) {
+	if m == nil {
+		return
+	}
+	m.nackedTotal.WithLabelValues(topic).Inc()
+}
+
+func (m *metrics) returned(topic string) {
+	if m == nil {
+		return
+	}
+	m.returnedTotal.WithLabelValues(topic).Inc()
+}
+
+func (m *metrics) consumed(topic string) {
+	if m == nil {
+		return
+	}
+	m.consumedTotal.WithLabelValues(topic).Inc()
+}
+
+func (m *metrics) retried(topic string) {
+	if m == nil {
+		return
+	}
+	m.retriedTotal.WithLabelValues(topic).Inc()
+}
+
+func (m *metrics) rejected(topic string) {
+	if m == nil {
+		return
+	}
+	m.rejectedTotal.WithLabelValues(topic).Inc()
+}
+
+func (m *metrics) observeHandle(topic string, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.handleDuration.WithLabelValues(topic).Observe(duration.Seconds())
+}
+
+// outboxCollector 采集最近一次 outbox 扫描时统计的积压数量、最早的待发送消息和 parked 数量，采集时不查询数据库
+type outboxCollector struct {
+	outbox     *outbox
+	backlog    *prometheus.Desc
+	oldestAge  *prometheus.Desc
+	parked     *prometheus.Desc
+	scrapeFail *prometheus.Desc
+}
+
+func newOutboxCollector(outbox *outbox, constLabels prometheus.Labels) *outboxCollector {
+	return &outboxCollector{
+		outbox: outbox,
+		backlog: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "outbox", "backlog"),
+			"Number of pending records in the outbox.", nil, constLabels),
+		oldestAge: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "outbox", "oldest_pending_age_seconds"),
+			"Age of the oldest pending record in the outbox.", nil, constLabels),
+		parked: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "outbox", "parked"),
+			"Number of parked records in the outbox, which block later records with the same key when OrderedOutbox is enabled.", nil, constLabels),
+		scrapeFail: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "outbox", "scrape_error"),
+			"1 if querying the outbox stat failed during the last outbox scan.", nil, constLabels),
+	}
+}
+
+func (c *outboxCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.backlog
+	ch <- c.oldestAge
+	ch <- c.parked
+	ch <- c.scrapeFail
+}
+
+func (c *outboxCollector) Collect(ch chan<- prometheus.Metric) {
+	stat := c.outbox.cachedStat()
+	if stat.err != nil {
+		ch <- prometheus.MustNewConstMetric(c.scrapeFail, prometheus.GaugeValue, 1)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(c.scrapeFail, prometheus.GaugeValue, 0)
+	ch <- prometheus.MustNewConstMetric(c.backlog, prometheus.GaugeValue, float64(stat.backlog))
+	ch <- prometheus.MustNewConstMetric(c.parked, prometheus.GaugeValue, float64(stat.parked))
+
+	var age float64
+	if stat.oldest.Valid {
+		age = time.Since(stat.oldest.Time).Seconds()
+	}
+	ch <- prometheus.MustNewConstMetric(c.oldestAge, prometheus.GaugeValue, age)
+}
+
+func (m *metrics) setBreakerState(topic string, state BreakerState) {
+	if m == nil {
+		return
+	}
+	m.breakerState.WithLabelValues(topic).Set(float64(state))
+}
@@ -0,0 +1,81 @@
+package final
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"github.com/xyctruth/final/_example"
+)
+
+func TestMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	bus := New("test_svc", _example.NewDB(), _example.NewAmqp(), DefaultOptions().WithMetrics(reg))
+
+	bus.metrics.published("Metrics")
+	bus.metrics.published("Metrics")
+	bus.metrics.confirmed("Metrics")
+	bus.metrics.observeHandle("Metrics", time.Millisecond)
+	bus.publisher.storePending(1, &pendingConfirm{recordID: int64(1), topic: "Metrics"})
+
+	require.Equal(t, float64(2), testutil.ToFloat64(bus.metrics.publishedTotal.WithLabelValues("Metrics")))
+	require.Equal(t, float64(1), testutil.ToFloat64(bus.metrics.confirmedTotal.WithLabelValues("Metrics")))
+
+	families, err := reg.Gather()
+	require.Equal(t, nil, err)
+	names := make(map[string]float64)
+	for _, family := range families {
+		if family.GetMetric()[0].GetGauge() != nil {
+			names[family.GetName()] = family.GetMetric()[0].GetGauge().GetValue()
+		} else {
+			names[family.GetName()] = 0
+		}
+	}
+	require.Contains(t, names, "final_handle_duration_seconds")
+	require.Contains(t, names, "final_outbox_scrape_error")
+	require.Equal(t, float64(1), names["final_pending_confirms"])
+
+	bus.publisher.deletePending(1)
+	require.Equal(t, int64(0), bus.publisher.numPending())
+}
+
+func TestOutboxCollectorCached(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	bus := New("test_svc", nil, nil, DefaultOptions().WithMetrics(reg))
+
+	gather := func() map[string]float64 {
+		families, err := reg.Gather()
+		require.Equal(t, nil, err)
+		values := make(map[string]float64)
+		for _, family := range families {
+			if gauge := family.GetMetric()[0].GetGauge(); gauge != nil {
+				values[family.GetName()] = gauge.GetValue()
+			}
+		}
+		return values
+	}
+
+	// 采集最近一次扫描统计的状态，不查询数据库
+	bus.outbox.lastStat = outboxStat{backlog: 3, parked: 1, oldest: sql.NullTime{Time: time.Now().Add(-time.Minute), Valid: true}}
+	values := gather()
+	require.Equal(t, float64(0), values["final_outbox_scrape_error"])
+	require.Equal(t, float64(3), values["final_outbox_backlog"])
+	require.Equal(t, float64(1), values["final_outbox_parked"])
+	require.GreaterOrEqual(t, values["final_outbox_oldest_pending_age_seconds"], float64(60))
+
+	bus.outbox.lastStat = outboxStat{err: errors.New("stat failure")}
+	values = gather()
+	require.Equal(t, float64(1), values["final_outbox_scrape_error"])
+	require.NotContains(t, values, "final_outbox_backlog")
+}
+
+func TestMetricsDisabled(t *testing.T) {
+	bus := New("test_svc", nil, nil, DefaultOptions())
+	require.Nil(t, bus.metrics)
+	bus.metrics.published("Metrics")
+	bus.metrics.observeHandle("Metrics", time.Millisecond)
+}
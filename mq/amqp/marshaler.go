@@ -8,27 +8,62 @@ import (
 	"github.com/xyctruth/final/message"
 )
 
+const topicHeader = "x-final-msg-topic"
+
 func NewMessageFromDelivery(delivery amqp.Delivery) *message.Message {
 	msg := message.NewMessage(
 		delivery.MessageId,
-		castToString(delivery.Headers["x-final-msg-topic"]),
+		castToString(delivery.Headers[topicHeader]),
 		delivery.Body,
 	)
 
+	for k, v := range delivery.Headers {
+		if k == topicHeader {
+			continue
+		}
+		msg.Header.Set(k, v)
+	}
+	// 非 final 客户端发送的 request 使用 AMQP 的 reply_to 和 correlation_id 属性
+	if delivery.ReplyTo != "" && msg.ReplyTo() == "" && delivery.CorrelationId != "" {
+		msg.Header.Set(message.ReplyToHeader, delivery.ReplyTo)
+	}
+	if delivery.CorrelationId != "" && msg.CorrelationID() == "" {
+		msg.Header.Set(message.CorrelationIDHeader, delivery.CorrelationId)
+	}
+
 	return msg
 }
 
+// NewMessageFromReturn 使用被 broker 退回的消息创建消息
+func NewMessageFromReturn(ret amqp.Return) *message.Message {
+	return NewMessageFromDelivery(amqp.Delivery{
+		MessageId: ret.MessageId,
+		Headers:   ret.Headers,
+		Body:      ret.Body,
+	})
+}
+
 func NewPublishingFromMessage(msg *message.Message) amqp.Publishing {
-	headers := amqp.Table{
-		"x-final-msg-topic": msg.Topic,
+	headers := amqp.Table{}
+	// 传递消息 Header（例如 trace context），内部 Header 和 amqp.Table 不支持的类型会被忽略
+	for k, v := range msg.Header {
+		if !message.IsInternalHeader(k) && isHeaderValue(v) {
+			headers[k] = v
+		}
 	}
+	headers[topicHeader] = msg.Topic
 
 	publishing := amqp.Publishing{
-		Body:        msg.Payload,
-		ReplyTo:     msg.SvcName,
-		MessageId:   msg.UUID,
-		ContentType: "string",
-		Headers:     headers,
+		Body:          msg.Payload,
+		ReplyTo:       msg.SvcName,
+		CorrelationId: msg.CorrelationID(),
+		MessageId:     msg.UUID,
+		ContentType:   "string",
+		Headers:       headers,
+		Priority:      msg.Policy.Priority,
+	}
+	if replyTo := msg.ReplyTo(); replyTo != "" {
+		publishing.ReplyTo = replyTo
 	}
 
 	if msg.Policy.Durable {
@@ -45,6 +80,14 @@ func NewPublishingFromMessage(msg *message.Message) amqp.Publishing {
 	return publishing
 }
 
+func isHeaderValue(v interface{}) bool {
+	switch v.(type) {
+	case string, []byte, bool, byte, int, int16, int32, int64, float32, float64, time.Time:
+		return true
+	}
+	return false
+}
+
 func castToString(i interface{}) string {
 	v, ok := i.(string)
 	if !ok {
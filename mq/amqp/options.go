@@ -0,0 +1,238 @@
+package amqp
+
+import (
+	"crypto/tls"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// 队列类型，对应队列参数 x-queue-type
+const (
+	QueueTypeClassic = "classic"
+	QueueTypeQuorum  = "quorum"
+	QueueTypeStream  = "stream"
+)
+
+// 队列超过最大长度时的处理方式，对应队列参数 x-overflow
+const (
+	OverflowDropHead         = "drop-head"
+	OverflowRejectPublish    = "reject-publish"
+	OverflowRejectPublishDlx = "reject-publish-dlx"
+)
+
+// Options AMQP 驱动的配置
+type Options struct {
+	// TopicQueues 是否为每个 topic 声明独立的队列 <QueueName>_<topic>，每个队列使用独立的 consumer
+	// 为 false 时所有 topic 绑定到同一个队列 <QueueName>
+	TopicQueues bool
+
+	// Mandatory 是否强制消息投递，没有路由到任何队列的消息会被 broker 退回，并保留在 outbox 中
+	Mandatory bool
+
+	// QueueType 队列类型，QueueTypeClassic、QueueTypeQuorum 或 QueueTypeStream
+	// quorum 队列不支持 Lazy 和 MaxPriority，stream 队列不支持死信
+	QueueType string
+	// MaxLength 队列的最大消息数量，0 表示不限制
+	MaxLength int64
+	// MaxLengthBytes 队列的最大字节数，0 表示不限制
+	MaxLengthBytes int64
+	// Overflow 队列超过最大长度时的处理方式，为空时使用 broker 的默认值 drop-head
+	Overflow string
+	// Lazy 是否使用 lazy 模式，消息尽量保存在磁盘上，只对 classic 队列生效
+	Lazy bool
+	// MaxPriority 队列支持的最大优先级，0 表示不支持优先级，消息优先级使用 message.WithPriority 设置
+	MaxPriority uint8
+	// QueueArgs 其它队列参数，会覆盖上面的设置
+	QueueArgs amqp.Table
+
+	// QueueName 服务的队列名称，为空时使用 svcName
+	QueueName string
+	// DlxQueueName 死信队列名称，为空时使用 <svcName>_dlx
+	DlxQueueName string
+	// DlxExchangeName 死信 exchange 名称，为空时使用 <svcName>_exchange_dlx
+	DlxExchangeName string
+	// ExchangeName 返回 topic 对应的 exchange 名称，为 nil 时使用 topic
+	ExchangeName func(topic string) string
+	// ExchangeKind topic 对应的 exchange 类型，routing key 为 topic
+	ExchangeKind string
+
+	// Heartbeat 连接的心跳间隔
+	Heartbeat time.Duration
+	// TLSConfig amqps 连接的 TLS 配置
+	TLSConfig *tls.Config
+	// ConnectionName 连接名称，显示在 RabbitMQ 管理界面中
+	ConnectionName string
+}
+
+// DefaultOptions AMQP 驱动的默认配置
+func DefaultOptions() Options {
+	return Options{
+		TopicQueues:  false,
+		Mandatory:    true,
+		QueueType:    QueueTypeClassic,
+		ExchangeKind: amqp.ExchangeTopic,
+		Heartbeat:    10 * time.Minute,
+	}
+}
+
+// WithTopicQueues 设置是否为每个 topic 声明独立的队列
+// The default value of TopicQueues is false.
+func (opt Options) WithTopicQueues(val bool) Options {
+	opt.TopicQueues = val
+	return opt
+}
+
+// WithMandatory 设置是否强制消息投递
+// The default value of Mandatory is true.
+func (opt Options) WithMandatory(val bool) Options {
+	opt.Mandatory = val
+	return opt
+}
+
+// WithQueueType 设置队列类型
+// The default value of QueueType is QueueTypeClassic.
+func (opt Options) WithQueueType(val string) Options {
+	opt.QueueType = val
+	return opt
+}
+
+// WithMaxLength 设置队列的最大消息数量
+// The default value of MaxLength is 0, no limit.
+func (opt Options) WithMaxLength(val int64) Options {
+	opt.MaxLength = val
+	return opt
+}
+
+// WithMaxLengthBytes 设置队列的最大字节数
+// The default value of MaxLengthBytes is 0, no limit.
+func (opt Options) WithMaxLengthBytes(val int64) Options {
+	opt.MaxLengthBytes = val
+	return opt
+}
+
+// WithOverflow 设置队列超过最大长度时的处理方式
+// The default value of Overflow is empty, the broker default drop-head.
+func (opt Options) WithOverflow(val string) Options {
+	opt.Overflow = val
+	return opt
+}
+
+// WithLazy 设置是否使用 lazy 模式
+// The default value of Lazy is false.
+func (opt Options) WithLazy(val bool) Options {
+	opt.Lazy = val
+	return opt
+}
+
+// WithMaxPriority 设置队列支持的最大优先级
+// The default value of MaxPriority is 0, priority is not supported.
+func (opt Options) WithMaxPriority(val uint8) Options {
+	opt.MaxPriority = val
+	return opt
+}
+
+// WithQueueArgs 设置其它队列参数
+// The default value of QueueArgs is nil.
+func (opt Options) WithQueueArgs(val amqp.Table) Options {
+	opt.QueueArgs = val
+	return opt
+}
+
+// WithQueueName 设置服务的队列名称
+// The default value of QueueName is empty, svcName is used.
+func (opt Options) WithQueueName(val string) Options {
+	opt.QueueName = val
+	return opt
+}
+
+// WithDlxQueueName 设置死信队列名称
+// The default value of DlxQueueName is empty, <svcName>_dlx is used.
+func (opt Options) WithDlxQueueName(val string) Options {
+	opt.DlxQueueName = val
+	return opt
+}
+
+// WithDlxExchangeName 设置死信 exchange 名称
+// The default value of DlxExchangeName is empty, <svcName>_exchange_dlx is used.
+func (opt Options) WithDlxExchangeName(val string) Options {
+	opt.DlxExchangeName = val
+	return opt
+}
+
+// WithExchangeName 设置 topic 对应的 exchange 名称
+// The default value of ExchangeName is nil, topic is used.
+func (opt Options) WithExchangeName(val func(topic string) string) Options {
+	opt.ExchangeName = val
+	return opt
+}
+
+// WithExchangeKind 设置 topic 对应的 exchange 类型
+// The default value of ExchangeKind is topic.
+func (opt Options) WithExchangeKind(val string) Options {
+	opt.ExchangeKind = val
+	return opt
+}
+
+// WithHeartbeat 设置连接的心跳间隔
+// The default value of Heartbeat is 10 minute.
+func (opt Options) WithHeartbeat(val time.Duration) Options {
+	opt.Heartbeat = val
+	return opt
+}
+
+// WithTLSConfig 设置 amqps 连接的 TLS 配置
+// The default value of TLSConfig is nil.
+func (opt Options) WithTLSConfig(val *tls.Config) Options {
+	opt.TLSConfig = val
+	return opt
+}
+
+// WithConnectionName 设置连接名称
+// The default value of ConnectionName is empty.
+func (opt Options) WithConnectionName(val string) Options {
+	opt.ConnectionName = val
+	return opt
+}
+
+// queueArgs 使用配置生成队列参数，dlxExchange 不为空时设置死信 exchange
+func (opt Options) queueArgs(dlxExchange string) amqp.Table {
+	args := amqp.Table{}
+	if dlxExchange != "" {
+		args["x-dead-letter-exchange"] = dlxExchange
+	}
+	if opt.QueueType != "" && opt.QueueType != QueueTypeClassic {
+		args["x-queue-type"] = opt.QueueType
+	}
+	if opt.MaxLength > 0 {
+		args["x-max-length"] = opt.MaxLength
+	}
+	if opt.MaxLengthBytes > 0 {
+		args["x-max-length-bytes"] = opt.MaxLengthBytes
+	}
+	if opt.Overflow != "" {
+		args["x-overflow"] = opt.Overflow
+	}
+	if opt.Lazy {
+		args["x-queue-mode"] = "lazy"
+	}
+	if opt.MaxPriority > 0 {
+		args["x-max-priority"] = int32(opt.MaxPriority)
+	}
+	for k, v := range opt.QueueArgs {
+		args[k] = v
+	}
+	return args
+}
+
+// config 使用配置生成连接配置
+func (opt Options) config() amqp.Config {
+	config := amqp.Config{
+		Heartbeat:       opt.Heartbeat,
+		TLSClientConfig: opt.TLSConfig,
+	}
+	if opt.ConnectionName != "" {
+		config.Properties = amqp.Table{"connection_name": opt.ConnectionName}
+	}
+	return config
+}
@@ -0,0 +1,69 @@
+package amqp
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/require"
+	"github.com/xyctruth/final/message"
+)
+
+func TestQueueArgs(t *testing.T) {
+	opt := DefaultOptions()
+	require.Equal(t, amqp.Table{"x-dead-letter-exchange": "dlx"}, opt.queueArgs("dlx"))
+
+	opt = opt.
+		WithQueueType(QueueTypeQuorum).
+		WithMaxLength(100).
+		WithMaxLengthBytes(1024).
+		WithOverflow(OverflowRejectPublishDlx).
+		WithQueueArgs(amqp.Table{"x-delivery-limit": int32(5)})
+	require.Equal(t, amqp.Table{
+		"x-dead-letter-exchange": "dlx",
+		"x-queue-type":           QueueTypeQuorum,
+		"x-max-length":           int64(100),
+		"x-max-length-bytes":     int64(1024),
+		"x-overflow":             OverflowRejectPublishDlx,
+		"x-delivery-limit":       int32(5),
+	}, opt.queueArgs("dlx"))
+
+	opt = DefaultOptions().WithLazy(true).WithMaxPriority(10)
+	require.Equal(t, amqp.Table{
+		"x-queue-mode":   "lazy",
+		"x-max-priority": int32(10),
+	}, opt.queueArgs(""))
+	require.Equal(t, nil, opt.queueArgs("").Validate())
+}
+
+func TestConfig(t *testing.T) {
+	config := DefaultOptions().config()
+	require.Equal(t, 10*time.Minute, config.Heartbeat)
+	require.Nil(t, config.Properties)
+
+	tlsConfig := &tls.Config{ServerName: "rabbitmq"}
+	config = DefaultOptions().
+		WithHeartbeat(10 * time.Second).
+		WithTLSConfig(tlsConfig).
+		WithConnectionName("test_svc").
+		config()
+	require.Equal(t, 10*time.Second, config.Heartbeat)
+	require.Equal(t, tlsConfig, config.TLSClientConfig)
+	require.Equal(t, "test_svc", config.Properties["connection_name"])
+}
+
+func TestExchangeName(t *testing.T) {
+	provider := NewProvider("").(*Provider)
+	require.Equal(t, "topic1", provider.exchangeName("topic1"))
+
+	provider = NewProviderWithOptions("", DefaultOptions().WithExchangeName(func(topic string) string {
+		return "final." + topic
+	})).(*Provider)
+	require.Equal(t, "final.topic1", provider.exchangeName("topic1"))
+}
+
+func TestPublishingPriority(t *testing.T) {
+	publishing := NewPublishingFromMessage(message.NewMessage("1", "topic1", nil, message.WithPriority(5)))
+	require.Equal(t, uint8(5), publishing.Priority)
+}
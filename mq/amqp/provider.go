@@ -2,18 +2,20 @@ package amqp
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"runtime/debug"
-	"time"
+	"sync"
 
-	"github.com/sirupsen/logrus"
 	"github.com/streadway/amqp"
+	"github.com/xyctruth/final/logger"
 	"github.com/xyctruth/final/message"
 	"github.com/xyctruth/final/mq"
 )
 
 type Provider struct {
-	log *logrus.Entry
+	log logger.Logger
+	opt Options
 
 	connStr string
 	// conn
@@ -36,23 +38,55 @@ type Provider struct {
 	queueName       string
 	dlxQueueName    string
 	dlxExchangeName string
+
+	// 连接阻塞状态的监听者
+	blockMutex     sync.RWMutex
+	blockListeners []chan bool
+
+	// channel 的健康状态，nil 表示正常
+	healthMutex    sync.RWMutex
+	channelHealths map[string]error
+
+	// publishMutex 保证 publishChannel 的 delivery tag 与 sequence 一致
+	publishMutex sync.Mutex
+	sequence     uint64
+	// confirmMutex 保护 published、returned 和 confirm、return 的监听者
+	confirmMutex sync.Mutex
+	// published delivery tag -> 消息的 UUID
+	published map[uint64]string
+	// returned 被 broker 退回，等待 confirm 的消息 UUID
+	returned        map[string]bool
+	acks            []chan uint64
+	nacks           []chan uint64
+	unroutables     []chan uint64
+	returnListeners []chan *message.Message
 }
 
 func NewProvider(connStr string) mq.IProvider {
-	log := &logrus.Logger{}
+	return NewProviderWithOptions(connStr, DefaultOptions())
+}
+
+// NewProviderWithOptions 创建 AMQP 驱动
+func NewProviderWithOptions(connStr string, opt Options) mq.IProvider {
 	return &Provider{
-		log: log.WithFields(logrus.Fields{
-			"module": "amqp_provider",
-		}),
-		connStr: connStr,
+		log:       logger.Discard,
+		opt:       opt,
+		connStr:   connStr,
+		published: make(map[uint64]string),
+		returned:  make(map[string]bool),
 	}
 }
 
+// SetLogger 设置日志输出，未设置时丢弃所有日志
+func (provider *Provider) SetLogger(l logger.Logger) {
+	provider.log = l.WithFields(logger.Fields{
+		"module": "amqp_provider",
+	})
+}
+
 func (provider *Provider) Init(ctx context.Context, svcName string, purge bool, topics []string) error {
 	var err error
-	conn, err := amqp.DialConfig(provider.connStr, amqp.Config{
-		Heartbeat: 10 * time.Minute,
-	})
+	conn, err := amqp.DialConfig(provider.connStr, provider.opt.config())
 	if err != nil {
 		return err
 	}
@@ -61,26 +95,34 @@ func (provider *Provider) Init(ctx context.Context, svcName string, purge bool,
 	provider.purge = purge
 	provider.topics = topics
 	provider.svcName = svcName
-	provider.queueName = svcName
-	provider.dlxQueueName = fmt.Sprintf("%s_dlx", svcName)
-	provider.dlxExchangeName = fmt.Sprintf("%s_exchange_dlx", svcName)
+	provider.queueName = withDefault(provider.opt.QueueName, svcName)
+	provider.dlxQueueName = withDefault(provider.opt.DlxQueueName, fmt.Sprintf("%s_dlx", svcName))
+	provider.dlxExchangeName = withDefault(provider.opt.DlxExchangeName, fmt.Sprintf("%s_exchange_dlx", svcName))
 
 	if provider.initChannel, err = provider.conn.Channel(); err != nil {
 		return err
 	}
+	provider.watchChannel("channel.init", provider.initChannel)
 
 	if provider.publishChannel, err = provider.conn.Channel(); err != nil {
 		return err
 	}
+	provider.watchChannel("channel.publish", provider.publishChannel)
 
 	err = provider.publishChannel.Confirm(false)
 	if err != nil {
 		return err
 	}
+	// 使用无缓冲的 channel，broker 先发送 basic.return 再发送 basic.ack，保证退回的消息先于 confirm 处理
+	go provider.handleConfirms(
+		provider.publishChannel.NotifyPublish(make(chan amqp.Confirmation)),
+		provider.publishChannel.NotifyReturn(make(chan amqp.Return)))
 
 	if provider.publishNoWaitChannel, err = provider.conn.Channel(); err != nil {
 		return err
 	}
+	provider.watchChannel("channel.publish_nowait", provider.publishNoWaitChannel)
+	go provider.handleReturns(provider.publishNoWaitChannel.NotifyReturn(make(chan amqp.Return)))
 
 	err = provider.initQueue()
 	if err != nil {
@@ -120,29 +162,169 @@ func (provider *Provider) Publish(message *message.Message) error {
 
 	if message.Policy.Confirm {
 		channel = provider.publishChannel
+
+		// 发送之前先记录 delivery tag，confirm 可能在 Publish 返回之前到达
+		provider.publishMutex.Lock()
+		defer provider.publishMutex.Unlock()
+		seq := provider.sequence + 1
+		provider.storePublished(seq, message.UUID)
+		defer func() {
+			if seq != provider.sequence {
+				provider.deletePublished(seq)
+			}
+		}()
 	} else {
 		channel = provider.publishNoWaitChannel
 	}
 
-	return channel.Publish(
-		message.Topic, // exchange
-		message.Topic, // key
-		false,         // 开启强制消息投递（mandatory为设置为true），但消息未被路由至任何一个queue，则回退一条消息到channel.NotifyReturn
-		false,         // 当immediate标志位设置为true时，如果exchange在将消息路由到queue(s)时发现对于的queue上么有消费者，那么这条消息不会放入队列中。当与消息routeKey关联的所有queue（一个或者多个）都没有消费者时，该消息会通过basic.return方法返还给生产者。
-		publishing,    // msg
+	exchange := provider.exchangeName(message.Topic)
+	err := channel.Publish(
+		exchange,               // exchange
+		message.Topic,          // key
+		provider.opt.Mandatory, // 开启强制消息投递（mandatory为设置为true），但消息未被路由至任何一个queue，则回退一条消息到channel.NotifyReturn
+		false,                  // 当immediate标志位设置为true时，如果exchange在将消息路由到queue(s)时发现对于的queue上么有消费者，那么这条消息不会放入队列中。当与消息routeKey关联的所有queue（一个或者多个）都没有消费者时，该消息会通过basic.return方法返还给生产者。
+		publishing,             // msg
 	)
+	if err == nil && message.Policy.Confirm {
+		provider.sequence++
+	}
+	return err
+}
+
+func (provider *Provider) storePublished(seq uint64, uuid string) {
+	provider.confirmMutex.Lock()
+	defer provider.confirmMutex.Unlock()
+	provider.published[seq] = uuid
+}
+
+func (provider *Provider) deletePublished(seq uint64) {
+	provider.confirmMutex.Lock()
+	defer provider.confirmMutex.Unlock()
+	delete(provider.published, seq)
 }
 
 func (provider *Provider) NotifyConfirm(ack, nack chan uint64) {
-	provider.publishChannel.NotifyConfirm(ack, nack)
+	provider.confirmMutex.Lock()
+	defer provider.confirmMutex.Unlock()
+	provider.acks = append(provider.acks, ack)
+	provider.nacks = append(provider.nacks, nack)
+}
+
+// NotifyReturn 注册监听被 broker 退回的消息，开启 Options.Mandatory 时没有路由到任何队列的消息会被退回
+// 被退回的消息的 confirm 会作为 nack 通知，消息保留在 outbox 中
+func (provider *Provider) NotifyReturn(returned chan *message.Message) {
+	provider.confirmMutex.Lock()
+	defer provider.confirmMutex.Unlock()
+	provider.returnListeners = append(provider.returnListeners, returned)
+}
+
+// NotifyUnroutable 注册监听被 broker 退回的消息的 confirm，注册后被退回的消息的 confirm 不再作为 nack 通知
+func (provider *Provider) NotifyUnroutable(unroutable chan uint64) {
+	provider.confirmMutex.Lock()
+	defer provider.confirmMutex.Unlock()
+	provider.unroutables = append(provider.unroutables, unroutable)
+}
+
+// handleConfirms 处理 publishChannel 的 confirm 和退回的消息，被退回的消息的 confirm 转换为 unroutable 或者 nack
+// broker 在 basic.ack 之前发送 basic.return，returns 没有缓冲，amqp 库把 return 交给当前 goroutine 之后才会发送 confirm
+func (provider *Provider) handleConfirms(confirms chan amqp.Confirmation, returns chan amqp.Return) {
+	for {
+		select {
+		case ret, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			provider.confirmMutex.Lock()
+			provider.returned[ret.MessageId] = true
+			provider.confirmMutex.Unlock()
+			provider.notifyReturn(ret)
+		case confirm, ok := <-confirms:
+			if !ok {
+				return
+			}
+
+			provider.confirmMutex.Lock()
+			uuid := provider.published[confirm.DeliveryTag]
+			delete(provider.published, confirm.DeliveryTag)
+			chs := provider.nacks
+			switch {
+			case provider.returned[uuid]:
+				delete(provider.returned, uuid)
+				if len(provider.unroutables) > 0 {
+					chs = provider.unroutables
+				}
+			case confirm.Ack:
+				chs = provider.acks
+			}
+			provider.confirmMutex.Unlock()
+
+			for _, ch := range chs {
+				ch <- confirm.DeliveryTag
+			}
+		}
+	}
+}
+
+// handleReturns 处理 publishNoWaitChannel 退回的消息
+func (provider *Provider) handleReturns(returns chan amqp.Return) {
+	for ret := range returns {
+		provider.notifyReturn(ret)
+	}
+}
+
+func (provider *Provider) notifyReturn(ret amqp.Return) {
+	provider.log.
+		WithField("uuid", ret.MessageId).
+		WithField("exchange", ret.Exchange).
+		WithField("reply_text", ret.ReplyText).
+		Warn("message returned")
+
+	provider.confirmMutex.Lock()
+	listeners := provider.returnListeners
+	provider.confirmMutex.Unlock()
+
+	for _, listener := range listeners {
+		listener <- NewMessageFromReturn(ret)
+	}
+}
+
+// NotifyBlocked 注册监听连接的阻塞状态，连接被 broker 阻塞时发送 true，解除阻塞时发送 false
+func (provider *Provider) NotifyBlocked(blocked chan bool) {
+	provider.blockMutex.Lock()
+	defer provider.blockMutex.Unlock()
+	provider.blockListeners = append(provider.blockListeners, blocked)
+}
+
+func (provider *Provider) notifyBlocked(ctx context.Context, active bool) {
+	provider.blockMutex.RLock()
+	defer provider.blockMutex.RUnlock()
+	for _, listener := range provider.blockListeners {
+		select {
+		case <-ctx.Done():
+			return
+		case listener <- active:
+		}
+	}
 }
 
 func (provider *Provider) Subscribe(ctx context.Context, consumerTag string, msgs chan *message.Message) error {
+	if provider.opt.TopicQueues {
+		for _, topic := range provider.topics {
+			err := provider.SubscribeTopic(ctx, consumerTag+"_"+topic, topic, 1, msgs)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
 	channel, err := provider.conn.Channel()
 	if err != nil {
 		provider.log.WithError(err).Error("Failed to get initChannel")
 		return err
 	}
+	provider.watchChannel("channel.consumer."+consumerTag, channel)
 
 	channelErrors := make(chan *amqp.Error)
 	provider.initChannel.NotifyClose(channelErrors)
@@ -199,6 +381,162 @@ func (provider *Provider) Subscribe(ctx context.Context, consumerTag string, msg
 	return nil
 }
 
+// SubscribeReply 使用独立的 channel 声明当前实例独占、自动删除的回复队列，队列名称由 broker 生成
+// 回复消息自动 Ack，channel 关闭后回复队列被删除，同时关闭 msgs
+func (provider *Provider) SubscribeReply(ctx context.Context, msgs chan *message.Message) (string, error) {
+	channel, err := provider.conn.Channel()
+	if err != nil {
+		provider.log.WithError(err).Error("Failed to get channel")
+		return "", err
+	}
+	provider.watchChannel("channel.reply", channel)
+
+	queue, err := channel.QueueDeclare("", /*name*/
+		false, /*durable*/
+		true,  /*autoDelete*/
+		true,  /*exclusive*/
+		false, /*noWait*/
+		nil /*args*/)
+	if err != nil {
+		provider.log.WithError(err).Error("Failed to declare reply queue")
+		return "", err
+	}
+
+	deliveries, err := channel.Consume(queue.Name, /*queue*/
+		"",    /*consumer*/
+		true,  /*autoAck*/
+		true,  /*exclusive*/
+		false, /*noLocal*/
+		false, /*noWait*/
+		nil /*args* amqp.Table*/)
+	if err != nil {
+		provider.log.WithError(err).Error("Failed to consume reply queue")
+		return "", err
+	}
+
+	go func() {
+		defer channel.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case delivery, ok := <-deliveries:
+				if !ok {
+					provider.log.Error("reply deliveries closed")
+					close(msgs)
+					return
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case msgs <- NewMessageFromDelivery(delivery):
+				}
+			}
+		}
+	}()
+	return queue.Name, nil
+}
+
+// PublishReply 通过默认 exchange 发送回复消息到 replyTo 队列
+func (provider *Provider) PublishReply(replyTo string, msg *message.Message) error {
+	return provider.publishNoWaitChannel.Publish(
+		"",      // exchange
+		replyTo, // key
+		false,   // mandatory
+		false,   // immediate
+		NewPublishingFromMessage(msg),
+	)
+}
+
+// TopicQueues 是否为每个 topic 使用独立的队列，见 Options.TopicQueues
+func (provider *Provider) TopicQueues() bool {
+	return provider.opt.TopicQueues
+}
+
+// SubscribeTopic 使用独立的 channel 消费 topic 的队列，channel 的 Qos 为 prefetch
+// 消息交给 subscriber 后异步等待 Ack、Reject，不阻塞后续消息的投递
+func (provider *Provider) SubscribeTopic(ctx context.Context, consumerTag, topic string, prefetch int, msgs chan *message.Message) error {
+	log := provider.log.WithField("consumer_tag", consumerTag).WithField("topic", topic)
+
+	channel, err := provider.conn.Channel()
+	if err != nil {
+		log.WithError(err).Error("Failed to get channel")
+		return err
+	}
+	provider.watchChannel("channel.consumer."+consumerTag, channel)
+
+	err = channel.Qos(prefetch, 0, false)
+	if err != nil {
+		log.WithError(err).Error("Failed to set channel qos")
+		return err
+	}
+
+	deliveries, err := channel.Consume(provider.topicQueueName(topic), /*queue*/
+		consumerTag, /*consumer*/
+		false,       /*autoAck*/
+		false,       /*exclusive*/
+		false,       /*noLocal*/
+		false,       /*noWait*/
+		nil /*args* amqp.Table*/)
+	if err != nil {
+		log.WithError(err).Error("Failed to init consumer")
+		return err
+	}
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case delivery, ok := <-deliveries:
+				if !ok {
+					log.Error("deliveries closed")
+					return
+				}
+				msg := NewMessageFromDelivery(delivery)
+				select {
+				case <-ctx.Done():
+					return
+				case msgs <- msg:
+					log.WithField("uuid", msg.UUID).Trace("HandlerName sent to consumer")
+				}
+				go provider.waitAck(ctx, log, delivery, msg)
+			}
+		}
+	}()
+	return nil
+}
+
+// waitAck 等待 subscriber 处理完消息后 Ack 或 Reject，ctx 结束时未处理完的消息在 channel 关闭后重新入队
+func (provider *Provider) waitAck(ctx context.Context, log logger.Logger, delivery amqp.Delivery, msg *message.Message) {
+	select {
+	case <-ctx.Done():
+	case <-msg.Acked():
+		log.WithField("uuid", msg.UUID).Trace("HandlerName Ack")
+		if err := delivery.Ack(false); err != nil {
+			log.WithError(err).Error("Failed ack message")
+		}
+	case <-msg.Rejected():
+		log.WithField("uuid", msg.UUID).Trace("HandlerName reject")
+		if err := delivery.Reject(false); err != nil {
+			log.WithError(err).Error("Failed reject message")
+		}
+	}
+}
+
+// exchangeName topic 对应的 exchange 名称，见 Options.ExchangeName
+func (provider *Provider) exchangeName(topic string) string {
+	if provider.opt.ExchangeName == nil {
+		return topic
+	}
+	return provider.opt.ExchangeName(topic)
+}
+
+// topicQueueName topic 的独立队列名称
+func (provider *Provider) topicQueueName(topic string) string {
+	return fmt.Sprintf("%s_%s", provider.queueName, topic)
+}
+
 func (provider *Provider) initConsumer(consumerTag string, channel *amqp.Channel) (<-chan amqp.Delivery, error) {
 	deliveries, e := channel.Consume(provider.queueName, /*queue*/
 		consumerTag, /*consumer*/
@@ -213,42 +551,65 @@ func (provider *Provider) initConsumer(consumerTag string, channel *amqp.Channel
 func (provider *Provider) initQueue() error {
 	var err error
 
+	if provider.opt.TopicQueues {
+		for _, topic := range provider.topics {
+			_, err = provider.declareQueue(provider.topicQueueName(topic))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	provider.queue, err = provider.declareQueue(provider.queueName)
+	return err
+}
+
+// declareQueue 声明队列，被 Reject 的消息发送到 dlx exchange
+func (provider *Provider) declareQueue(name string) (amqp.Queue, error) {
 	if provider.purge {
 		_, err := provider.initChannel.QueueDelete(
-			provider.queueName,
+			name,
 			false, /*ifUnused*/
 			false, /*ifEmpty*/
 			false /*noWait*/)
 		if err != nil {
-			return err
+			return amqp.Queue{}, err
 		}
 	}
 
-	args := amqp.Table{"x-dead-letter-exchange": provider.dlxExchangeName}
-	provider.queue, err = provider.initChannel.QueueDeclare(
-		provider.queueName,
+	dlxExchange := provider.dlxExchangeName
+	if provider.opt.QueueType == QueueTypeStream {
+		// stream 队列不支持死信
+		dlxExchange = ""
+	}
+	return provider.initChannel.QueueDeclare(
+		name,
 		true,  /*durable*/
 		false, /*autoDelete*/
 		false, /*exclusive*/
 		false, /*noWait*/
-		args /*args*/)
-
-	return err
+		provider.opt.queueArgs(dlxExchange) /*args*/)
 }
 
 func (provider *Provider) initExchange() error {
 	for _, topic := range provider.topics {
-		err := provider.initChannel.ExchangeDeclare(topic, /*name*/
-			"topic", /*kind*/
-			true,    //设置是否持久
-			false,   //设置是否自动删除
-			false,   /*internal*/
-			false,   // 当noWait为true时，声明时无需等待服务器的确认
+		exchange := provider.exchangeName(topic)
+		err := provider.initChannel.ExchangeDeclare(exchange, /*name*/
+			provider.opt.ExchangeKind, /*kind*/
+			true,                      //设置是否持久
+			false,                     //设置是否自动删除
+			false,                     /*internal*/
+			false,                     // 当noWait为true时，声明时无需等待服务器的确认
 			nil /*args amqp.Table*/)
 		if err != nil {
 			return err
 		}
-		err = provider.bindQueue(provider.queueName, topic, topic)
+		queueName := provider.queueName
+		if provider.opt.TopicQueues {
+			queueName = provider.topicQueueName(topic)
+		}
+		err = provider.bindQueue(queueName, topic, exchange)
 		if err != nil {
 			return err
 		}
@@ -314,6 +675,7 @@ func (provider *Provider) monitorAMQPErrors(ctx context.Context, connErrors chan
 			return
 		case blocked := <-connBlocks:
 			provider.log.WithField("reason", blocked.Reason).WithField("active", blocked.Active).Warn("connBlocks warn")
+			provider.notifyBlocked(ctx, blocked.Active)
 		case amqpErr, ok := <-connErrors:
 			provider.log.WithField("amqp_error", amqpErr).Error("connErrors error")
 			if !ok {
@@ -328,6 +690,56 @@ func (provider *Provider) monitorAMQPErrors(ctx context.Context, connErrors chan
 	}
 }
 
+// Health 返回连接和各个 channel 的健康状态
+func (provider *Provider) Health() map[string]error {
+	health := make(map[string]error)
+	if provider.conn == nil {
+		health["connection"] = errors.New("connection is not initialized")
+		return health
+	}
+	if provider.conn.IsClosed() {
+		health["connection"] = errors.New("connection is closed")
+	} else {
+		health["connection"] = nil
+	}
+
+	provider.healthMutex.RLock()
+	defer provider.healthMutex.RUnlock()
+	for name, err := range provider.channelHealths {
+		health[name] = err
+	}
+	return health
+}
+
+// watchChannel 记录 channel 的关闭状态
+func (provider *Provider) watchChannel(name string, channel *amqp.Channel) {
+	provider.healthMutex.Lock()
+	if provider.channelHealths == nil {
+		provider.channelHealths = make(map[string]error)
+	}
+	provider.channelHealths[name] = nil
+	provider.healthMutex.Unlock()
+
+	closed := channel.NotifyClose(make(chan *amqp.Error, 1))
+	go func() {
+		amqpErr, ok := <-closed
+		var err error = errors.New("channel is closed")
+		if ok && amqpErr != nil {
+			err = amqpErr
+		}
+		provider.healthMutex.Lock()
+		provider.channelHealths[name] = err
+		provider.healthMutex.Unlock()
+	}()
+}
+
+func withDefault(val, def string) string {
+	if val == "" {
+		return def
+	}
+	return val
+}
+
 func (provider *Provider) Exit() error {
 	err := provider.initChannel.Close()
 	if err != nil {
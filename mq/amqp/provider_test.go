@@ -0,0 +1,96 @@
+package amqp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/require"
+	"github.com/xyctruth/final/message"
+)
+
+func TestHandleConfirmsReturned(t *testing.T) {
+	provider := NewProvider("").(*Provider)
+	ack := make(chan uint64, 10)
+	nack := make(chan uint64, 10)
+	provider.NotifyConfirm(ack, nack)
+	returned := make(chan *message.Message, 10)
+	provider.NotifyReturn(returned)
+
+	confirms := make(chan amqp.Confirmation)
+	returns := make(chan amqp.Return)
+	go provider.handleConfirms(confirms, returns)
+	defer close(confirms)
+
+	provider.storePublished(1, "1")
+	provider.storePublished(2, "2")
+	provider.storePublished(3, "3")
+
+	confirms <- amqp.Confirmation{DeliveryTag: 1, Ack: true}
+	require.Equal(t, uint64(1), <-ack)
+
+	// broker 先发送 basic.return 再发送 basic.ack，被退回的消息的 ack 转换为 nack
+	returns <- amqp.Return{MessageId: "2", Headers: amqp.Table{topicHeader: "topic1"}}
+	confirms <- amqp.Confirmation{DeliveryTag: 2, Ack: true}
+	require.Equal(t, uint64(2), <-nack)
+
+	msg := <-returned
+	require.Equal(t, "2", msg.UUID)
+	require.Equal(t, "topic1", msg.Topic)
+
+	confirms <- amqp.Confirmation{DeliveryTag: 3, Ack: false}
+	require.Equal(t, uint64(3), <-nack)
+
+	select {
+	case <-ack:
+		t.Fatal("unexpected ack")
+	case <-time.After(10 * time.Millisecond):
+	}
+	require.Equal(t, 0, len(provider.published))
+	require.Equal(t, 0, len(provider.returned))
+}
+
+func TestHandleConfirmsUnroutable(t *testing.T) {
+	provider := NewProvider("").(*Provider)
+	ack := make(chan uint64, 10)
+	nack := make(chan uint64, 10)
+	provider.NotifyConfirm(ack, nack)
+	unroutable := make(chan uint64, 10)
+	provider.NotifyUnroutable(unroutable)
+
+	confirms := make(chan amqp.Confirmation)
+	returns := make(chan amqp.Return)
+	go provider.handleConfirms(confirms, returns)
+	defer close(confirms)
+
+	provider.storePublished(1, "1")
+	provider.storePublished(2, "2")
+
+	// 注册了 unroutable 后，被退回的消息的 confirm 不再作为 nack 通知
+	returns <- amqp.Return{MessageId: "1", Headers: amqp.Table{topicHeader: "topic1"}}
+	confirms <- amqp.Confirmation{DeliveryTag: 1, Ack: true}
+	require.Equal(t, uint64(1), <-unroutable)
+
+	confirms <- amqp.Confirmation{DeliveryTag: 2, Ack: false}
+	require.Equal(t, uint64(2), <-nack)
+
+	select {
+	case <-ack:
+		t.Fatal("unexpected ack")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestPublishingInternalHeader(t *testing.T) {
+	msg := message.NewMessage("1", "topic1", nil)
+	msg.Header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	msg.Header.Set(message.RecordIDHeader, int64(1))
+	msg.Header.Set(message.DeferredHeader, true)
+
+	publishing := NewPublishingFromMessage(msg)
+	require.Equal(t, msg.Header.Get("traceparent"), publishing.Headers["traceparent"])
+	_, ok := publishing.Headers[message.RecordIDHeader]
+	require.Equal(t, false, ok)
+	_, ok = publishing.Headers[message.DeferredHeader]
+	require.Equal(t, false, ok)
+}
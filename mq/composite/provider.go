@@ -0,0 +1,555 @@
+package composite
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/xyctruth/final/logger"
+	"github.com/xyctruth/final/message"
+	"github.com/xyctruth/final/mq"
+)
+
+// DefaultName 默认驱动的名称
+const DefaultName = "default"
+
+// replyAddress SubscribeReply 返回的回复地址，Publish 时替换为 topic 对应驱动的回复地址
+const replyAddress = "final.composite.reply"
+
+// Route topic 到 mq 驱动的路由
+type Route struct {
+	// Name 驱动的名称，用于日志和健康检查
+	Name string
+	// Provider 发送和订阅 Topics 的驱动
+	Provider mq.IProvider
+	// Topics 使用 Provider 的 topic
+	Topics []string
+}
+
+// Provider 按照 topic 把消息路由到不同 mq 驱动的 mq.IProvider 实现，一个 Bus 可以同时使用多个 mq 驱动和同一个 outbox
+//   Publish 根据 topic 选择驱动，没有路由的 topic 使用默认驱动
+//   Init、Subscribe 只把每个驱动负责的 topic 传递给对应的驱动
+//   每个驱动使用自己的 confirm channel，驱动的 sequence 映射为全局 sequence 后转发到 NotifyConfirm 的 ack、nack channel
+//   任意一个驱动的连接被阻塞时通知 NotifyBlocked，所有驱动都解除阻塞后通知解除阻塞
+//   所有订阅了 topic 的驱动都为每个 topic 使用独立的队列时 TopicQueues 返回 true，SubscribeTopic 交给 topic 对应的驱动
+//   SubscribeReply 为每个实现了 mq.IReplier 的驱动订阅回复队列，request 使用 topic 对应驱动的回复地址，回复由 topic 对应的驱动发送
+type Provider struct {
+	log logger.Logger
+
+	fallback *member
+	members  []*member
+	routes   map[string]*member
+
+	// mutex 保证全局 sequence 的递增顺序与发送顺序一致
+	mutex    sync.Mutex
+	sequence uint64
+
+	confirmMutex sync.Mutex
+	acks         []chan uint64
+	nacks        []chan uint64
+	unroutables  []chan uint64
+	// notified、unroutableNotified 驱动的 confirm、unroutable channel 是否已经注册
+	notified           bool
+	unroutableNotified bool
+
+	// blockMutex 保护 blocks 和 blocked，blocked 为连接被阻塞的驱动
+	blockMutex sync.Mutex
+	blocks     []chan bool
+	blocked    map[*member]bool
+
+	// replyMutex 保护 replies、replyReady 和驱动的 replyTo
+	// replies 为 SubscribeReply 的 msgs，任意一个驱动的回复队列失效时关闭并置为 nil，重新订阅之前收到的回复等待 replyReady
+	replyMutex sync.Mutex
+	replies    chan *message.Message
+	replyReady chan struct{}
+
+	done chan struct{}
+	once sync.Once
+}
+
+// member 一个 mq 驱动
+type member struct {
+	name     string
+	provider mq.IProvider
+	topics   []string
+
+	// sequence 驱动的 sequence，与驱动自己的计数方式一致
+	sequence uint64
+	// seqMutex 保护 seqs，seqs 为驱动的 sequence 到全局 sequence 的映射
+	seqMutex sync.Mutex
+	seqs     map[uint64]uint64
+
+	// replyTo 驱动的回复地址，没有订阅回复队列时为空
+	replyTo string
+}
+
+// NewProvider 创建路由驱动，fallback 为默认驱动，可以为 nil，此时没有路由的 topic 发送失败
+// 同一个驱动可以出现在多个 Route 中，同名的 Route 使用相同的驱动
+func NewProvider(fallback mq.IProvider, routes ...Route) mq.IProvider {
+	provider := &Provider{
+		log:        logger.Discard,
+		routes:     make(map[string]*member),
+		blocked:    make(map[*member]bool),
+		replyReady: make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+
+	if fallback != nil {
+		provider.fallback = provider.member(DefaultName, fallback)
+	}
+	for _, route := range routes {
+		m := provider.member(route.Name, route.Provider)
+		for _, topic := range route.Topics {
+			provider.routes[topic] = m
+		}
+	}
+	return provider
+}
+
+// member 返回驱动对应的 member，相同的驱动只创建一个 member
+func (provider *Provider) member(name string, p mq.IProvider) *member {
+	for _, m := range provider.members {
+		if m.provider == p {
+			return m
+		}
+	}
+	m := &member{name: name, provider: p, seqs: make(map[uint64]uint64)}
+	provider.members = append(provider.members, m)
+	return m
+}
+
+// SetLogger 设置日志输出，并传递给实现了 mq.ILoggerSetter 的驱动
+func (provider *Provider) SetLogger(l logger.Logger) {
+	provider.log = l.WithFields(logger.Fields{
+		"module": "composite_provider",
+	})
+	for _, m := range provider.members {
+		if setter, ok := m.provider.(mq.ILoggerSetter); ok {
+			setter.SetLogger(l)
+		}
+	}
+}
+
+func (provider *Provider) Init(ctx context.Context, svcName string, purge bool, topics []string) error {
+	for _, m := range provider.members {
+		m.topics = m.topics[:0]
+	}
+	for _, topic := range topics {
+		m, err := provider.route(topic)
+		if err != nil {
+			return err
+		}
+		m.topics = append(m.topics, topic)
+	}
+
+	for _, m := range provider.members {
+		err := m.provider.Init(ctx, svcName, purge, m.topics)
+		if err != nil {
+			return fmt.Errorf("init provider %s: %w", m.name, err)
+		}
+	}
+	return nil
+}
+
+// route 返回 topic 对应的驱动
+func (provider *Provider) route(topic string) (*member, error) {
+	if m, ok := provider.routes[topic]; ok {
+		return m, nil
+	}
+	if provider.fallback != nil {
+		return provider.fallback, nil
+	}
+	return nil, fmt.Errorf("no provider for topic %s", topic)
+}
+
+func (provider *Provider) Publish(msg *message.Message) error {
+	m, err := provider.route(msg.Topic)
+	if err != nil {
+		return err
+	}
+
+	if msg.ReplyTo() == replyAddress {
+		replyTo, err := provider.memberReplyTo(m)
+		if err != nil {
+			return err
+		}
+		msg.Header.Set(message.ReplyToHeader, replyTo)
+	}
+
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+
+	// 发送之前先记录映射，驱动可能在 Publish 返回之前就发送了 ack
+	local, global := m.sequence+1, provider.sequence+1
+	if msg.Policy.Confirm {
+		m.storeSeq(local, global)
+	}
+
+	err = m.provider.Publish(msg)
+	if err != nil {
+		if msg.Policy.Confirm {
+			m.loadAndDeleteSeq(local)
+		}
+		return err
+	}
+
+	if msg.Policy.Confirm {
+		m.sequence = local
+		provider.sequence = global
+	}
+	return nil
+}
+
+// NotifyConfirm 第一次调用时为每个驱动注册 confirm channel，并启动转发 goroutine
+func (provider *Provider) NotifyConfirm(ack, nack chan uint64) {
+	provider.confirmMutex.Lock()
+	defer provider.confirmMutex.Unlock()
+
+	provider.acks = append(provider.acks, ack)
+	provider.nacks = append(provider.nacks, nack)
+	if provider.notified {
+		return
+	}
+	provider.notified = true
+
+	for _, m := range provider.members {
+		memberAck := make(chan uint64, cap(ack))
+		memberNack := make(chan uint64, cap(nack))
+		m.provider.NotifyConfirm(memberAck, memberNack)
+		go provider.forward(m, memberAck, memberNack, nil)
+	}
+}
+
+// NotifyReturn 注册监听实现了 mq.IReturnNotifier 的驱动退回的消息
+func (provider *Provider) NotifyReturn(returned chan *message.Message) {
+	for _, m := range provider.members {
+		if notifier, ok := m.provider.(mq.IReturnNotifier); ok {
+			notifier.NotifyReturn(returned)
+		}
+	}
+}
+
+// NotifyUnroutable 第一次调用时为实现了 mq.IUnroutableNotifier 的驱动注册 unroutable channel，并启动转发 goroutine
+func (provider *Provider) NotifyUnroutable(unroutable chan uint64) {
+	provider.confirmMutex.Lock()
+	defer provider.confirmMutex.Unlock()
+
+	provider.unroutables = append(provider.unroutables, unroutable)
+	if provider.unroutableNotified {
+		return
+	}
+	provider.unroutableNotified = true
+
+	for _, m := range provider.members {
+		if notifier, ok := m.provider.(mq.IUnroutableNotifier); ok {
+			memberUnroutable := make(chan uint64, cap(unroutable))
+			notifier.NotifyUnroutable(memberUnroutable)
+			go provider.forward(m, nil, nil, memberUnroutable)
+		}
+	}
+}
+
+// forward 把驱动的 sequence 映射为全局 sequence 后转发，为 nil 的 channel 不转发
+func (provider *Provider) forward(m *member, ack, nack, unroutable chan uint64) {
+	log := provider.log.WithField("provider", m.name)
+	for {
+		var (
+			local uint64
+			ok    bool
+			chs   *[]chan uint64
+		)
+		select {
+		case <-provider.done:
+			return
+		case local, ok = <-ack:
+			chs = &provider.acks
+		case local, ok = <-nack:
+			chs = &provider.nacks
+		case local, ok = <-unroutable:
+			chs = &provider.unroutables
+		}
+		if !ok {
+			log.Error("confirm channel closed")
+			return
+		}
+
+		global, found := m.loadAndDeleteSeq(local)
+		if !found {
+			log.WithField("seq", local).Warn("unknown confirm received")
+			continue
+		}
+
+		provider.confirmMutex.Lock()
+		listeners := *chs
+		provider.confirmMutex.Unlock()
+
+		for _, ch := range listeners {
+			select {
+			case ch <- global:
+			case <-provider.done:
+				return
+			}
+		}
+	}
+}
+
+// NotifyBlocked 第一次调用时为实现了 mq.IBlockNotifier 的驱动注册 blocked channel，并启动转发 goroutine
+func (provider *Provider) NotifyBlocked(blocked chan bool) {
+	provider.blockMutex.Lock()
+	defer provider.blockMutex.Unlock()
+
+	provider.blocks = append(provider.blocks, blocked)
+	if len(provider.blocks) > 1 {
+		return
+	}
+
+	for _, m := range provider.members {
+		if notifier, ok := m.provider.(mq.IBlockNotifier); ok {
+			memberBlocked := make(chan bool, 1)
+			notifier.NotifyBlocked(memberBlocked)
+			go provider.forwardBlocked(m, memberBlocked)
+		}
+	}
+}
+
+// forwardBlocked 汇总驱动的阻塞状态，阻塞的驱动数量在 0 和非 0 之间变化时通知
+func (provider *Provider) forwardBlocked(m *member, memberBlocked chan bool) {
+	for {
+		select {
+		case <-provider.done:
+			return
+		case active, ok := <-memberBlocked:
+			if !ok {
+				return
+			}
+
+			provider.blockMutex.Lock()
+			before := len(provider.blocked) > 0
+			if active {
+				provider.blocked[m] = true
+			} else {
+				delete(provider.blocked, m)
+			}
+			after := len(provider.blocked) > 0
+			listeners := provider.blocks
+			provider.blockMutex.Unlock()
+
+			if before == after {
+				continue
+			}
+			provider.log.WithField("provider", m.name).WithField("blocked", after).Warn("connection blocked changed")
+			for _, ch := range listeners {
+				select {
+				case ch <- after:
+				case <-provider.done:
+					return
+				}
+			}
+		}
+	}
+}
+
+// TopicQueues 所有订阅了 topic 的驱动都为每个 topic 使用独立的队列时返回 true，需要在 Init 之后调用
+func (provider *Provider) TopicQueues() bool {
+	for _, m := range provider.members {
+		if len(m.topics) == 0 {
+			continue
+		}
+		ts, ok := m.provider.(mq.ITopicSubscriber)
+		if !ok || !ts.TopicQueues() {
+			return false
+		}
+	}
+	return true
+}
+
+// SubscribeTopic 使用 topic 对应的驱动订阅 topic 的独立队列
+func (provider *Provider) SubscribeTopic(ctx context.Context, consumerTag, topic string, prefetch int, msgs chan *message.Message) error {
+	m, err := provider.route(topic)
+	if err != nil {
+		return err
+	}
+	ts, ok := m.provider.(mq.ITopicSubscriber)
+	if !ok || !ts.TopicQueues() {
+		return fmt.Errorf("provider %s does not support topic queues", m.name)
+	}
+	return ts.SubscribeTopic(ctx, consumerTag, topic, prefetch, msgs)
+}
+
+// SubscribeReply 为实现了 mq.IReplier 并且还没有订阅回复队列的驱动订阅回复队列，返回组合驱动的回复地址
+// 没有驱动实现 mq.IReplier 时返回 mq.ErrReplyNotSupported
+func (provider *Provider) SubscribeReply(ctx context.Context, msgs chan *message.Message) (string, error) {
+	provider.replyMutex.Lock()
+	defer provider.replyMutex.Unlock()
+
+	supported := false
+	for _, m := range provider.members {
+		replier, ok := m.provider.(mq.IReplier)
+		if !ok {
+			continue
+		}
+		supported = true
+		if m.replyTo != "" {
+			continue
+		}
+
+		memberMsgs := make(chan *message.Message)
+		replyTo, err := replier.SubscribeReply(ctx, memberMsgs)
+		if err != nil {
+			return "", fmt.Errorf("subscribe reply provider %s: %w", m.name, err)
+		}
+		m.replyTo = replyTo
+		go provider.forwardReplies(ctx, m, memberMsgs)
+	}
+	if !supported {
+		return "", mq.ErrReplyNotSupported
+	}
+
+	if provider.replies == nil {
+		close(provider.replyReady)
+	}
+	provider.replies = msgs
+	return replyAddress, nil
+}
+
+// PublishReply 使用回复消息 topic 对应的驱动发送回复，回复消息的 topic 为 request 的 topic
+func (provider *Provider) PublishReply(replyTo string, msg *message.Message) error {
+	m, err := provider.route(msg.Topic)
+	if err != nil {
+		return err
+	}
+	replier, ok := m.provider.(mq.IReplier)
+	if !ok {
+		return fmt.Errorf("provider %s: %w", m.name, mq.ErrReplyNotSupported)
+	}
+	return replier.PublishReply(replyTo, msg)
+}
+
+// memberReplyTo 返回驱动的回复地址
+func (provider *Provider) memberReplyTo(m *member) (string, error) {
+	provider.replyMutex.Lock()
+	defer provider.replyMutex.Unlock()
+	if m.replyTo == "" {
+		return "", fmt.Errorf("provider %s: %w", m.name, mq.ErrReplyNotSupported)
+	}
+	return m.replyTo, nil
+}
+
+// forwardReplies 把驱动收到的回复转发到 SubscribeReply 的 msgs
+// 驱动的回复队列失效时关闭 msgs，Bus 重新调用 SubscribeReply 后只重新订阅失效的驱动
+func (provider *Provider) forwardReplies(ctx context.Context, m *member, memberMsgs chan *message.Message) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case reply, ok := <-memberMsgs:
+			if !ok {
+				provider.closeReplies(m)
+				return
+			}
+			if err := provider.deliverReply(ctx, reply); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// deliverReply 发送回复到当前的 msgs，msgs 已经关闭时等待重新订阅
+// 持有 replyMutex 发送，closeReplies 不会关闭正在发送的 msgs，Bus 在看到 msgs 关闭之前一直接收回复
+func (provider *Provider) deliverReply(ctx context.Context, reply *message.Message) error {
+	for {
+		provider.replyMutex.Lock()
+		if provider.replies != nil {
+			var err error
+			select {
+			case provider.replies <- reply:
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+			provider.replyMutex.Unlock()
+			return err
+		}
+		ready := provider.replyReady
+		provider.replyMutex.Unlock()
+
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// closeReplies 驱动的回复队列失效，清除驱动的回复地址并关闭 msgs，通知 Bus 重新订阅
+func (provider *Provider) closeReplies(m *member) {
+	provider.replyMutex.Lock()
+	defer provider.replyMutex.Unlock()
+
+	provider.log.WithField("provider", m.name).Warn("reply queue closed")
+	m.replyTo = ""
+	if provider.replies != nil {
+		close(provider.replies)
+		provider.replies = nil
+		provider.replyReady = make(chan struct{})
+	}
+}
+
+func (provider *Provider) Subscribe(ctx context.Context, consumerTag string, msgs chan *message.Message) error {
+	for _, m := range provider.members {
+		if len(m.topics) == 0 {
+			continue
+		}
+		err := m.provider.Subscribe(ctx, consumerTag, msgs)
+		if err != nil {
+			return fmt.Errorf("subscribe provider %s: %w", m.name, err)
+		}
+	}
+	return nil
+}
+
+// Health 汇总实现了 mq.IHealthChecker 的驱动的健康状态，名称为 <驱动名称>.<组件名称>
+func (provider *Provider) Health() map[string]error {
+	health := make(map[string]error)
+	for _, m := range provider.members {
+		checker, ok := m.provider.(mq.IHealthChecker)
+		if !ok {
+			continue
+		}
+		for name, err := range checker.Health() {
+			health[m.name+"."+name] = err
+		}
+	}
+	return health
+}
+
+// Exit 退出所有驱动，返回第一个错误
+func (provider *Provider) Exit() error {
+	provider.once.Do(func() {
+		close(provider.done)
+	})
+
+	var first error
+	for _, m := range provider.members {
+		if err := m.provider.Exit(); err != nil {
+			provider.log.WithError(err).WithField("provider", m.name).Error("provider exit failure")
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+func (m *member) storeSeq(local, global uint64) {
+	m.seqMutex.Lock()
+	defer m.seqMutex.Unlock()
+	m.seqs[local] = global
+}
+
+func (m *member) loadAndDeleteSeq(local uint64) (uint64, bool) {
+	m.seqMutex.Lock()
+	defer m.seqMutex.Unlock()
+	global, ok := m.seqs[local]
+	delete(m.seqs, local)
+	return global, ok
+}
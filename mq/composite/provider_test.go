@@ -0,0 +1,357 @@
+package composite
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/xyctruth/final/message"
+	"github.com/xyctruth/final/mq"
+)
+
+// fakeProvider Publish 成功时同步发送 ack，topic 在 nackTopics 中时发送 nack，topic 为 unroutable 时发送 unroutable
+type fakeProvider struct {
+	mutex       sync.Mutex
+	sequence    uint64
+	acks        []chan uint64
+	nacks       []chan uint64
+	unroutables []chan uint64
+	nackTopics  map[string]bool
+	published   []string
+	replyTos    []string
+	topics      []string
+	msgs        chan *message.Message
+	exited      bool
+	health      map[string]error
+}
+
+func newFakeProvider(nackTopics ...string) *fakeProvider {
+	p := &fakeProvider{nackTopics: make(map[string]bool), msgs: make(chan *message.Message)}
+	for _, topic := range nackTopics {
+		p.nackTopics[topic] = true
+	}
+	return p
+}
+
+func (p *fakeProvider) Init(ctx context.Context, svcName string, purge bool, topics []string) error {
+	p.topics = append([]string(nil), topics...)
+	return nil
+}
+
+func (p *fakeProvider) Publish(msg *message.Message) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if msg.Topic == "error" {
+		return errors.New("publish error")
+	}
+	p.published = append(p.published, msg.UUID)
+	p.replyTos = append(p.replyTos, msg.ReplyTo())
+	if !msg.Policy.Confirm {
+		return nil
+	}
+	p.sequence++
+	chs := p.acks
+	if p.nackTopics[msg.Topic] {
+		chs = p.nacks
+	}
+	if msg.Topic == "unroutable" {
+		chs = p.unroutables
+	}
+	for _, ch := range chs {
+		ch <- p.sequence
+	}
+	return nil
+}
+
+func (p *fakeProvider) Subscribe(ctx context.Context, consumerTag string, msgs chan *message.Message) error {
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg := <-p.msgs:
+				msgs <- msg
+			}
+		}
+	}()
+	return nil
+}
+
+func (p *fakeProvider) NotifyConfirm(ack, nack chan uint64) {
+	p.acks = append(p.acks, ack)
+	p.nacks = append(p.nacks, nack)
+}
+
+func (p *fakeProvider) NotifyUnroutable(unroutable chan uint64) {
+	p.unroutables = append(p.unroutables, unroutable)
+}
+
+func (p *fakeProvider) Health() map[string]error {
+	return p.health
+}
+
+func (p *fakeProvider) Exit() error {
+	p.exited = true
+	return nil
+}
+
+// featureProvider 实现了 mq.IBlockNotifier、mq.ITopicSubscriber 和 mq.IReplier 的 fakeProvider
+type featureProvider struct {
+	*fakeProvider
+	blocked    chan bool
+	subscribed []string
+	replyTo    string
+	replies    chan *message.Message
+	subscribes int
+	replied    []string
+}
+
+func newFeatureProvider(replyTo string) *featureProvider {
+	return &featureProvider{fakeProvider: newFakeProvider(), replyTo: replyTo}
+}
+
+func (p *featureProvider) NotifyBlocked(blocked chan bool) {
+	p.blocked = blocked
+}
+
+func (p *featureProvider) TopicQueues() bool {
+	return true
+}
+
+func (p *featureProvider) SubscribeTopic(ctx context.Context, consumerTag, topic string, prefetch int, msgs chan *message.Message) error {
+	p.subscribed = append(p.subscribed, topic)
+	return nil
+}
+
+func (p *featureProvider) SubscribeReply(ctx context.Context, msgs chan *message.Message) (string, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.replies = msgs
+	p.subscribes++
+	return p.replyTo, nil
+}
+
+func (p *featureProvider) PublishReply(replyTo string, msg *message.Message) error {
+	p.replied = append(p.replied, replyTo)
+	return nil
+}
+
+func TestRoute(t *testing.T) {
+	amqp := newFakeProvider()
+	kafka := newFakeProvider()
+	provider := NewProvider(amqp, Route{Name: "kafka", Provider: kafka, Topics: []string{"topic2", "topic3"}})
+
+	err := provider.Init(context.Background(), "test_svc", false, []string{"topic1", "topic2"})
+	require.Equal(t, nil, err)
+	require.Equal(t, []string{"topic1"}, amqp.topics)
+	require.Equal(t, []string{"topic2"}, kafka.topics)
+
+	require.Equal(t, nil, provider.Publish(message.NewMessage("1", "topic1", nil)))
+	require.Equal(t, nil, provider.Publish(message.NewMessage("2", "topic2", nil)))
+	require.Equal(t, nil, provider.Publish(message.NewMessage("3", "topic3", nil)))
+	require.Equal(t, nil, provider.Publish(message.NewMessage("4", "other", nil)))
+	require.Equal(t, []string{"1", "4"}, amqp.published)
+	require.Equal(t, []string{"2", "3"}, kafka.published)
+
+	require.Equal(t, nil, provider.Exit())
+	require.True(t, amqp.exited)
+	require.True(t, kafka.exited)
+}
+
+func TestNoRoute(t *testing.T) {
+	provider := NewProvider(nil, Route{Name: "kafka", Provider: newFakeProvider(), Topics: []string{"topic1"}})
+	require.NotEqual(t, nil, provider.Init(context.Background(), "test_svc", false, []string{"topic2"}))
+	require.NotEqual(t, nil, provider.Publish(message.NewMessage("1", "topic2", nil)))
+}
+
+func TestConfirm(t *testing.T) {
+	amqp := newFakeProvider()
+	kafka := newFakeProvider("nack")
+	provider := NewProvider(amqp, Route{Name: "kafka", Provider: kafka, Topics: []string{"topic2", "nack"}})
+	require.Equal(t, nil, provider.Init(context.Background(), "test_svc", false, nil))
+	defer provider.Exit()
+
+	ack := make(chan uint64, 10)
+	nack := make(chan uint64, 10)
+	provider.NotifyConfirm(ack, nack)
+
+	require.Equal(t, nil, provider.Publish(message.NewMessage("1", "topic1", nil)))                             // global 1, amqp 1
+	require.Equal(t, nil, provider.Publish(message.NewMessage("2", "topic2", nil)))                             // global 2, kafka 1
+	require.Equal(t, nil, provider.Publish(message.NewMessage("3", "topic2", nil, message.WithConfirm(false)))) // no confirm
+	require.NotEqual(t, nil, provider.Publish(message.NewMessage("4", "error", nil)))                           // failure, no sequence
+	require.Equal(t, nil, provider.Publish(message.NewMessage("5", "nack", nil)))                               // global 3, kafka 2
+	require.Equal(t, nil, provider.Publish(message.NewMessage("6", "topic1", nil)))                             // global 4, amqp 2
+
+	acks := make([]uint64, 0, 3)
+	for i := 0; i < 3; i++ {
+		select {
+		case seq := <-ack:
+			acks = append(acks, seq)
+		case <-time.After(time.Second):
+			t.Fatal("ack timeout")
+		}
+	}
+	require.ElementsMatch(t, []uint64{1, 2, 4}, acks)
+	require.Equal(t, uint64(3), <-nack)
+}
+
+func TestUnroutable(t *testing.T) {
+	amqp := newFakeProvider()
+	kafka := newFakeProvider()
+	provider := NewProvider(amqp, Route{Name: "kafka", Provider: kafka, Topics: []string{"topic2"}})
+	require.Equal(t, nil, provider.Init(context.Background(), "test_svc", false, nil))
+	defer provider.Exit()
+
+	ack := make(chan uint64, 10)
+	nack := make(chan uint64, 10)
+	provider.NotifyConfirm(ack, nack)
+	unroutable := make(chan uint64, 10)
+	provider.(*Provider).NotifyUnroutable(unroutable)
+
+	require.Equal(t, nil, provider.Publish(message.NewMessage("1", "topic2", nil)))     // global 1, kafka 1
+	require.Equal(t, nil, provider.Publish(message.NewMessage("2", "unroutable", nil))) // global 2, amqp 1
+	require.Equal(t, uint64(1), <-ack)
+
+	// 驱动的 sequence 映射为全局 sequence 后转发
+	select {
+	case seq := <-unroutable:
+		require.Equal(t, uint64(2), seq)
+	case <-time.After(time.Second):
+		t.Fatal("unroutable timeout")
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	amqp := newFakeProvider()
+	kafka := newFakeProvider()
+	unused := newFakeProvider()
+	provider := NewProvider(amqp,
+		Route{Name: "kafka", Provider: kafka, Topics: []string{"topic2"}},
+		Route{Name: "unused", Provider: unused, Topics: []string{"topic3"}},
+	)
+	require.Equal(t, nil, provider.Init(context.Background(), "test_svc", false, []string{"topic1", "topic2"}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	msgs := make(chan *message.Message)
+	require.Equal(t, nil, provider.Subscribe(ctx, "consumer_0", msgs))
+
+	go func() { amqp.msgs <- message.NewMessage("1", "topic1", nil) }()
+	require.Equal(t, "1", (<-msgs).UUID)
+	go func() { kafka.msgs <- message.NewMessage("2", "topic2", nil) }()
+	require.Equal(t, "2", (<-msgs).UUID)
+}
+
+func TestHealth(t *testing.T) {
+	amqp := newFakeProvider()
+	amqp.health = map[string]error{"connection": nil}
+	kafka := newFakeProvider()
+	kafka.health = map[string]error{"producer": errors.New("closed")}
+	provider := NewProvider(amqp, Route{Name: "kafka", Provider: kafka, Topics: []string{"topic2"}}).(*Provider)
+
+	health := provider.Health()
+	require.Equal(t, 2, len(health))
+	require.Equal(t, nil, health["default.connection"])
+	require.EqualError(t, health["kafka.producer"], "closed")
+}
+
+func TestBlocked(t *testing.T) {
+	amqp := newFeatureProvider("")
+	kafka := newFeatureProvider("")
+	provider := NewProvider(amqp, Route{Name: "kafka", Provider: kafka, Topics: []string{"topic2"}}).(*Provider)
+	defer provider.Exit()
+
+	blocked := make(chan bool, 1)
+	provider.NotifyBlocked(blocked)
+
+	// 任意一个驱动被阻塞时阻塞，所有驱动都解除阻塞后解除阻塞
+	amqp.blocked <- true
+	require.Equal(t, true, <-blocked)
+	kafka.blocked <- true
+	require.Eventually(t, func() bool {
+		provider.blockMutex.Lock()
+		defer provider.blockMutex.Unlock()
+		return len(provider.blocked) == 2
+	}, time.Second, 10*time.Millisecond)
+	amqp.blocked <- false
+	select {
+	case <-blocked:
+		t.Fatal("kafka is still blocked")
+	case <-time.After(100 * time.Millisecond):
+	}
+	kafka.blocked <- false
+	require.Equal(t, false, <-blocked)
+}
+
+func TestTopicQueues(t *testing.T) {
+	amqp := newFeatureProvider("")
+	kafka := newFakeProvider()
+	provider := NewProvider(amqp, Route{Name: "kafka", Provider: kafka, Topics: []string{"topic2"}}).(*Provider)
+
+	// 没有订阅 topic 的驱动不影响 TopicQueues
+	require.Equal(t, nil, provider.Init(context.Background(), "test_svc", false, []string{"topic1"}))
+	require.Equal(t, true, provider.TopicQueues())
+	require.Equal(t, nil, provider.SubscribeTopic(context.Background(), "consumer_0", "topic1", 1, nil))
+	require.Equal(t, []string{"topic1"}, amqp.subscribed)
+
+	require.Equal(t, nil, provider.Init(context.Background(), "test_svc", false, []string{"topic1", "topic2"}))
+	require.Equal(t, false, provider.TopicQueues())
+	require.NotEqual(t, nil, provider.SubscribeTopic(context.Background(), "consumer_0", "topic2", 1, nil))
+}
+
+func TestReply(t *testing.T) {
+	amqp := newFeatureProvider("amqp.reply")
+	kafka := newFeatureProvider("kafka.reply")
+	plain := newFakeProvider()
+	provider := NewProvider(amqp,
+		Route{Name: "kafka", Provider: kafka, Topics: []string{"topic2"}},
+		Route{Name: "plain", Provider: plain, Topics: []string{"topic3"}},
+	).(*Provider)
+	defer provider.Exit()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	msgs := make(chan *message.Message)
+	replyTo, err := provider.SubscribeReply(ctx, msgs)
+	require.Equal(t, nil, err)
+
+	// request 使用 topic 对应驱动的回复地址
+	request := message.NewMessage("1", "topic2", nil, message.WithConfirm(false))
+	request.Header.Set(message.ReplyToHeader, replyTo)
+	require.Equal(t, nil, provider.Publish(request))
+	require.Equal(t, []string{"kafka.reply"}, kafka.replyTos)
+
+	request = message.NewMessage("2", "topic3", nil, message.WithConfirm(false))
+	request.Header.Set(message.ReplyToHeader, replyTo)
+	require.ErrorIs(t, provider.Publish(request), mq.ErrReplyNotSupported)
+
+	// 回复由 topic 对应的驱动发送
+	require.Equal(t, nil, provider.PublishReply("kafka.reply", message.NewMessage("", "topic2", nil)))
+	require.Equal(t, []string{"kafka.reply"}, kafka.replied)
+	require.ErrorIs(t, provider.PublishReply("kafka.reply", message.NewMessage("", "topic3", nil)), mq.ErrReplyNotSupported)
+
+	go func() { kafka.replies <- message.NewMessage("3", "topic2", nil) }()
+	require.Equal(t, "3", (<-msgs).UUID)
+
+	// 驱动的回复队列失效时关闭 msgs，重新订阅时只订阅失效的驱动
+	close(kafka.replies)
+	_, ok := <-msgs
+	require.Equal(t, false, ok)
+
+	msgs = make(chan *message.Message)
+	_, err = provider.SubscribeReply(ctx, msgs)
+	require.Equal(t, nil, err)
+	require.Equal(t, 1, amqp.subscribes)
+	require.Equal(t, 2, kafka.subscribes)
+	go func() { amqp.replies <- message.NewMessage("4", "topic1", nil) }()
+	require.Equal(t, "4", (<-msgs).UUID)
+}
+
+func TestReplyNotSupported(t *testing.T) {
+	provider := NewProvider(newFakeProvider()).(*Provider)
+	_, err := provider.SubscribeReply(context.Background(), make(chan *message.Message))
+	require.Equal(t, mq.ErrReplyNotSupported, err)
+}
@@ -0,0 +1,88 @@
+package dbqueue
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Dialect 数据库方言，数据库需要支持 SELECT ... FOR UPDATE SKIP LOCKED（MySQL 8.0+、PostgreSQL 9.5+）
+type Dialect int
+
+const (
+	MySQL Dialect = iota
+	Postgres
+)
+
+// rebind 把 ? 占位符转换为数据库方言的占位符
+func (d Dialect) rebind(query string) string {
+	if d != Postgres {
+		return query
+	}
+
+	var (
+		b strings.Builder
+		n int
+	)
+	b.Grow(len(query) + 8)
+	for _, c := range query {
+		if c != '?' {
+			b.WriteRune(c)
+			continue
+		}
+		n++
+		b.WriteByte('$')
+		b.WriteString(strconv.Itoa(n))
+	}
+	return b.String()
+}
+
+// createTableSQL 创建队列表和订阅表的 SQL
+func (d Dialect) createTableSQL(queue, subscription string) []string {
+	if d == Postgres {
+		return []string{
+			`CREATE TABLE IF NOT EXISTS ` + subscription + `
+			(
+				svc_name varchar(255) not null,
+				topic    varchar(255) not null,
+				primary key (svc_name, topic)
+			)`,
+			`CREATE TABLE IF NOT EXISTS ` + queue + `
+			(
+				id         bigserial primary key,
+				svc_name   varchar(255) not null,
+				topic      varchar(255) not null,
+				uuid       varchar(255) not null,
+				header     bytea        null,
+				payload    bytea        null,
+				status     smallint     not null,
+				attempts   bigint       not null,
+				visible_at bigint       not null,
+				create_at  bigint       not null
+			)`,
+			`CREATE INDEX IF NOT EXISTS ` + queue + `_consume ON ` + queue + ` (svc_name, status, visible_at)`,
+		}
+	}
+
+	return []string{
+		`CREATE TABLE IF NOT EXISTS ` + subscription + `
+		(
+			svc_name varchar(255) not null,
+			topic    varchar(255) not null,
+			primary key (svc_name, topic)
+		)`,
+		`CREATE TABLE IF NOT EXISTS ` + queue + `
+		(
+			id         bigint auto_increment primary key,
+			svc_name   varchar(255) not null,
+			topic      varchar(255) not null,
+			uuid       varchar(255) not null,
+			header     longblob     null,
+			payload    longblob     null,
+			status     tinyint      not null,
+			attempts   bigint       not null,
+			visible_at bigint       not null,
+			create_at  bigint       not null,
+			index consume (svc_name, status, visible_at)
+		)`,
+	}
+}
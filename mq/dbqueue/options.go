@@ -0,0 +1,72 @@
+package dbqueue
+
+import "time"
+
+// Options 数据库队列驱动的配置
+type Options struct {
+	// Dialect 数据库方言
+	Dialect Dialect
+	// TablePrefix 队列表和订阅表的前缀，表名为 <TablePrefix>_queue 和 <TablePrefix>_subscription
+	TablePrefix string
+	// PollInterval 队列中没有消息时，再次查询的间隔
+	PollInterval time.Duration
+	// VisibilityTimeout 消息取出后在该时间内对其它 consumer 不可见，超时仍未 Ack 的消息会被重新投递
+	VisibilityTimeout time.Duration
+	// Listener 可选，收到通知时立即查询队列，不等待 PollInterval，例如 PostgreSQL 的 LISTEN
+	Listener Listener
+	// NotifyChannel PostgreSQL 发送消息后 NOTIFY 的 channel，为空时不发送通知
+	NotifyChannel string
+}
+
+// DefaultOptions 数据库队列驱动的默认配置
+func DefaultOptions() Options {
+	return Options{
+		Dialect:           MySQL,
+		TablePrefix:       "final_mq",
+		PollInterval:      time.Second,
+		VisibilityTimeout: time.Minute,
+		NotifyChannel:     "final_mq",
+	}
+}
+
+// WithDialect 设置数据库方言
+// The default value of Dialect is MySQL.
+func (opt Options) WithDialect(val Dialect) Options {
+	opt.Dialect = val
+	return opt
+}
+
+// WithTablePrefix 设置队列表和订阅表的前缀
+// The default value of TablePrefix is final_mq.
+func (opt Options) WithTablePrefix(val string) Options {
+	opt.TablePrefix = val
+	return opt
+}
+
+// WithPollInterval 设置队列中没有消息时，再次查询的间隔
+// The default value of PollInterval is 1 second.
+func (opt Options) WithPollInterval(val time.Duration) Options {
+	opt.PollInterval = val
+	return opt
+}
+
+// WithVisibilityTimeout 设置消息取出后对其它 consumer 不可见的时间
+// The default value of VisibilityTimeout is 1 minute.
+func (opt Options) WithVisibilityTimeout(val time.Duration) Options {
+	opt.VisibilityTimeout = val
+	return opt
+}
+
+// WithListener 设置新消息的通知
+// The default value of Listener is nil, only polling.
+func (opt Options) WithListener(val Listener) Options {
+	opt.Listener = val
+	return opt
+}
+
+// WithNotifyChannel 设置 PostgreSQL 发送消息后 NOTIFY 的 channel
+// The default value of NotifyChannel is final_mq.
+func (opt Options) WithNotifyChannel(val string) Options {
+	opt.NotifyChannel = val
+	return opt
+}
@@ -0,0 +1,368 @@
+package dbqueue
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"github.com/xyctruth/final/logger"
+	"github.com/xyctruth/final/message"
+	"github.com/xyctruth/final/mq"
+)
+
+const (
+	statusPending uint8 = iota // 等待消费
+	statusDead                 // 被 Reject 的消息，保留在队列表中，相当于死信队列
+)
+
+// Listener 新消息的通知，收到通知后立即查询队列
+// 例如使用 lib/pq 的 pq.Listener 监听 Options.NotifyChannel
+type Listener interface {
+	Listen(ctx context.Context, channel string) (<-chan struct{}, error)
+}
+
+// Provider 只使用数据库的 mq.IProvider 实现，不需要部署 mq
+//   订阅表记录每个服务订阅的 topic，Publish 为每个订阅了 topic 的服务在队列表中插入一条消息，插入成功后通知 NotifyConfirm 的 ack channel
+//   Subscribe 使用 SELECT ... FOR UPDATE SKIP LOCKED 轮询队列表，取出的消息在 Options.VisibilityTimeout 内对其它 consumer 不可见
+//   msg.Ack() 时删除消息，msg.Reject() 时消息标记为死信，Bus 退出时未处理完的消息立即恢复可见
+type Provider struct {
+	log logger.Logger
+	opt Options
+
+	db *sql.DB
+
+	svcName      string
+	topics       []string
+	queue        string
+	subscription string
+
+	//启动时是否清除
+	purge bool
+
+	// mutex 保证 sequence 的递增顺序与发送顺序一致
+	mutex    sync.Mutex
+	sequence uint64
+	acks     []chan uint64
+}
+
+// NewProvider 使用默认配置创建数据库队列驱动，db 可以与 Bus 的 outbox 使用同一个 *sql.DB
+func NewProvider(db *sql.DB) mq.IProvider {
+	return NewProviderWithOptions(db, DefaultOptions())
+}
+
+// NewProviderWithOptions 创建数据库队列驱动
+func NewProviderWithOptions(db *sql.DB, opt Options) mq.IProvider {
+	return &Provider{
+		log:          logger.Discard,
+		opt:          opt,
+		db:           db,
+		queue:        opt.TablePrefix + "_queue",
+		subscription: opt.TablePrefix + "_subscription",
+	}
+}
+
+// SetLogger 设置日志输出，未设置时丢弃所有日志
+func (provider *Provider) SetLogger(l logger.Logger) {
+	provider.log = l.WithFields(logger.Fields{
+		"module": "db_queue_provider",
+	})
+}
+
+func (provider *Provider) Init(ctx context.Context, svcName string, purge bool, topics []string) error {
+	provider.svcName = svcName
+	provider.purge = purge
+	provider.topics = topics
+
+	for _, createSQL := range provider.opt.Dialect.createTableSQL(provider.queue, provider.subscription) {
+		if _, err := provider.db.ExecContext(ctx, createSQL); err != nil {
+			provider.log.WithError(err).Error("create table error")
+			return err
+		}
+	}
+
+	return provider.transaction(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, provider.rebind("DELETE FROM "+provider.subscription+" WHERE svc_name = ?"), svcName)
+		if err != nil {
+			return err
+		}
+		for _, topic := range topics {
+			_, err = tx.ExecContext(ctx, provider.rebind("INSERT INTO "+provider.subscription+" (svc_name,topic) VALUES (?,?)"), svcName, topic)
+			if err != nil {
+				return err
+			}
+		}
+
+		if purge {
+			n, err := tx.ExecContext(ctx, provider.rebind("DELETE FROM "+provider.queue+" WHERE svc_name = ?"), svcName)
+			if err != nil {
+				provider.log.WithError(err).Error("Purge error")
+				return err
+			}
+			count, _ := n.RowsAffected()
+			provider.log.WithField("count", count).Info("Applied purge!")
+		}
+		return nil
+	})
+}
+
+func (provider *Provider) Publish(msg *message.Message) error {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+
+	external := make(message.Header, len(msg.Header))
+	for k, v := range msg.Header {
+		if !message.IsInternalHeader(k) {
+			external[k] = v
+		}
+	}
+	header, err := msgpack.Marshal(external)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	err = provider.transaction(ctx, func(tx *sql.Tx) error {
+		svcNames, err := provider.subscribers(ctx, tx, msg.Topic)
+		if err != nil {
+			return err
+		}
+		if len(svcNames) == 0 {
+			// 没有服务订阅 topic，不确认消息，避免 outbox 删除消息记录
+			return mq.ErrUnroutable
+		}
+
+		now := unixMilli(time.Now())
+		placeholders := make([]string, 0, len(svcNames))
+		args := make([]interface{}, 0, len(svcNames)*9)
+		for _, svcName := range svcNames {
+			placeholders = append(placeholders, "(?,?,?,?,?,?,?,?,?)")
+			args = append(args, svcName, msg.Topic, msg.UUID, header, msg.Payload, statusPending, 0, now, now)
+		}
+		_, err = tx.ExecContext(ctx, provider.rebind("INSERT INTO "+provider.queue+
+			" (svc_name,topic,uuid,header,payload,status,attempts,visible_at,create_at) VALUES "+strings.Join(placeholders, ",")), args...)
+		if err != nil {
+			return err
+		}
+		return provider.notify(ctx, tx)
+	})
+	if err != nil {
+		return err
+	}
+
+	if msg.Policy.Confirm {
+		provider.sequence++
+		for _, ack := range provider.acks {
+			ack <- provider.sequence
+		}
+	}
+	return nil
+}
+
+// subscribers 返回订阅了 topic 的服务
+func (provider *Provider) subscribers(ctx context.Context, tx *sql.Tx, topic string) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, provider.rebind("SELECT svc_name FROM "+provider.subscription+" WHERE topic = ?"), topic)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	svcNames := make([]string, 0)
+	for rows.Next() {
+		var svcName string
+		if err := rows.Scan(&svcName); err != nil {
+			return nil, err
+		}
+		svcNames = append(svcNames, svcName)
+	}
+	return svcNames, rows.Err()
+}
+
+// notify PostgreSQL 在事务提交后通知 Listener
+func (provider *Provider) notify(ctx context.Context, tx *sql.Tx) error {
+	if provider.opt.Dialect != Postgres || provider.opt.NotifyChannel == "" {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, "SELECT pg_notify($1, '')", provider.opt.NotifyChannel)
+	return err
+}
+
+// NotifyConfirm 插入失败时 Publish 直接返回错误，不会发送 nack
+func (provider *Provider) NotifyConfirm(ack, nack chan uint64) {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	provider.acks = append(provider.acks, ack)
+}
+
+func (provider *Provider) Subscribe(ctx context.Context, consumerTag string, msgs chan *message.Message) error {
+	if len(provider.topics) == 0 {
+		return nil
+	}
+
+	var notified <-chan struct{}
+	if provider.opt.Listener != nil {
+		var err error
+		notified, err = provider.opt.Listener.Listen(ctx, provider.opt.NotifyChannel)
+		if err != nil {
+			provider.log.WithError(err).Error("Failed to listen")
+			return err
+		}
+	}
+
+	go func() {
+		log := provider.log.WithField("consumer_tag", consumerTag)
+		for {
+			if ctx.Err() != nil {
+				return
+			}
+
+			record, err := provider.take(ctx)
+			if err != nil && ctx.Err() == nil {
+				log.WithError(err).Error("take message error")
+			}
+			if record != nil {
+				if !provider.deliver(ctx, log, record, msgs) {
+					return
+				}
+				continue
+			}
+
+			// 队列中没有消息，等待 PollInterval 或者新消息的通知
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(provider.opt.PollInterval):
+			case <-notified:
+			}
+		}
+	}()
+	return nil
+}
+
+type queueRecord struct {
+	id  int64
+	msg *message.Message
+}
+
+// take 取出一条可见的消息，并在 Options.VisibilityTimeout 内对其它 consumer 不可见
+func (provider *Provider) take(ctx context.Context) (*queueRecord, error) {
+	var record *queueRecord
+	err := provider.transaction(ctx, func(tx *sql.Tx) error {
+		now := time.Now()
+		querySQL := "SELECT id,topic,uuid,header,payload FROM " + provider.queue +
+			" WHERE svc_name = ? AND status = ? AND visible_at <= ? ORDER BY id ASC LIMIT 1 FOR UPDATE SKIP LOCKED"
+		var (
+			id      int64
+			topic   string
+			uuid    string
+			header  []byte
+			payload []byte
+		)
+		err := tx.QueryRowContext(ctx, provider.rebind(querySQL), provider.svcName, statusPending, unixMilli(now)).
+			Scan(&id, &topic, &uuid, &header, &payload)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil
+			}
+			return err
+		}
+
+		updateSQL := "UPDATE " + provider.queue + " SET visible_at = ?, attempts = attempts + 1 WHERE id = ?"
+		_, err = tx.ExecContext(ctx, provider.rebind(updateSQL), unixMilli(now.Add(provider.opt.VisibilityTimeout)), id)
+		if err != nil {
+			return err
+		}
+
+		msg := message.NewMessage(uuid, topic, payload)
+		if len(header) > 0 {
+			if err := msgpack.Unmarshal(header, &msg.Header); err != nil {
+				return err
+			}
+		}
+		record = &queueRecord{id: id, msg: msg}
+		return nil
+	})
+	return record, err
+}
+
+// deliver 把消息交给 subscriber 处理，等待 Ack 或 Reject，ctx 结束时返回 false
+func (provider *Provider) deliver(ctx context.Context, log logger.Logger, record *queueRecord, msgs chan *message.Message) bool {
+	msg := record.msg
+
+	select {
+	case <-ctx.Done():
+		provider.release(log, record)
+		return false
+	case msgs <- msg:
+		log.WithField("uuid", msg.UUID).Trace("HandlerName sent to consumer")
+	}
+
+	var (
+		execSQL string
+		args    []interface{}
+	)
+	select {
+	case <-ctx.Done():
+		provider.release(log, record)
+		return false
+	case <-msg.Acked():
+		log.WithField("uuid", msg.UUID).Trace("HandlerName Ack")
+		execSQL = "DELETE FROM " + provider.queue + " WHERE id = ?"
+		args = []interface{}{record.id}
+	case <-msg.Rejected():
+		log.WithField("uuid", msg.UUID).Trace("HandlerName reject")
+		execSQL = "UPDATE " + provider.queue + " SET status = ? WHERE id = ?"
+		args = []interface{}{statusDead, record.id}
+	}
+
+	if _, err := provider.db.Exec(provider.rebind(execSQL), args...); err != nil {
+		// 没有删除的消息会在超过 Options.VisibilityTimeout 后重新投递
+		log.WithError(err).Error("Failed ack message")
+	}
+	return true
+}
+
+// release 未处理完的消息立即恢复可见
+func (provider *Provider) release(log logger.Logger, record *queueRecord) {
+	updateSQL := "UPDATE " + provider.queue + " SET visible_at = ? WHERE id = ?"
+	if _, err := provider.db.Exec(provider.rebind(updateSQL), unixMilli(time.Now()), record.id); err != nil {
+		log.WithError(err).Error("Failed release message")
+	}
+}
+
+// Health 数据库连接的健康状态
+func (provider *Provider) Health() map[string]error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return map[string]error{"db": provider.db.PingContext(ctx)}
+}
+
+func (provider *Provider) Exit() error {
+	return nil
+}
+
+func (provider *Provider) rebind(query string) string {
+	return provider.opt.Dialect.rebind(query)
+}
+
+func (provider *Provider) transaction(ctx context.Context, fc func(tx *sql.Tx) error) error {
+	tx, err := provider.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if err = fc(tx); err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			provider.log.WithError(rollbackErr).Error("tx rollback error")
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+func unixMilli(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
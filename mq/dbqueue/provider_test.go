@@ -0,0 +1,122 @@
+package dbqueue
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/xyctruth/final/_example"
+	"github.com/xyctruth/final/message"
+	"github.com/xyctruth/final/mq"
+)
+
+func newTestProvider(t *testing.T, svcName string, topics []string) *Provider {
+	opt := DefaultOptions().
+		WithTablePrefix("final_mq_test").
+		WithPollInterval(10 * time.Millisecond).
+		WithVisibilityTimeout(100 * time.Millisecond)
+	provider := NewProviderWithOptions(_example.NewDB(), opt).(*Provider)
+	err := provider.Init(context.Background(), svcName, true, topics)
+	require.Equal(t, nil, err)
+	return provider
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	provider := newTestProvider(t, "test_svc", []string{"topic1"})
+	other := newTestProvider(t, "test_svc_other", []string{"topic1"})
+
+	ack := make(chan uint64, 10)
+	provider.NotifyConfirm(ack, make(chan uint64, 10))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	msgs := make(chan *message.Message)
+	otherMsgs := make(chan *message.Message)
+	require.Equal(t, nil, provider.Subscribe(ctx, "consumer_0", msgs))
+	require.Equal(t, nil, other.Subscribe(ctx, "consumer_0", otherMsgs))
+
+	msg := message.NewMessage("1", "topic1", []byte("payload1"))
+	msg.Header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	require.Equal(t, nil, provider.Publish(msg))
+	require.Equal(t, uint64(1), <-ack)
+
+	// 每个订阅了 topic 的服务都收到消息
+	for _, ch := range []chan *message.Message{msgs, otherMsgs} {
+		received := <-ch
+		require.Equal(t, "1", received.UUID)
+		require.Equal(t, "topic1", received.Topic)
+		require.Equal(t, []byte("payload1"), received.Payload)
+		require.Equal(t, msg.Header.Get("traceparent"), received.Header.Get("traceparent"))
+		received.Ack()
+	}
+
+	require.Equal(t, nil, provider.Publish(message.NewMessage("2", "topic1", nil)))
+	received := <-msgs
+	require.Equal(t, "2", received.UUID)
+	received.Reject()
+	(<-otherMsgs).Ack()
+
+	require.Eventually(t, func() bool {
+		var pending, dead int
+		err := provider.db.QueryRow("SELECT "+
+			"COUNT(CASE WHEN status = ? THEN 1 END), COUNT(CASE WHEN status = ? THEN 1 END) "+
+			"FROM "+provider.queue+" WHERE svc_name = ?", statusPending, statusDead, "test_svc").Scan(&pending, &dead)
+		return err == nil && pending == 0 && dead == 1
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestVisibilityTimeout(t *testing.T) {
+	provider := newTestProvider(t, "test_svc", []string{"topic1"})
+	require.Equal(t, nil, provider.Publish(message.NewMessage("1", "topic1", nil)))
+
+	// 取出后没有 Ack 的消息，超过 VisibilityTimeout 后重新投递
+	record, err := provider.take(context.Background())
+	require.Equal(t, nil, err)
+	require.Equal(t, "1", record.msg.UUID)
+
+	record, err = provider.take(context.Background())
+	require.Equal(t, nil, err)
+	require.Nil(t, record)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	msgs := make(chan *message.Message)
+	require.Equal(t, nil, provider.Subscribe(ctx, "consumer_0", msgs))
+
+	select {
+	case msg := <-msgs:
+		require.Equal(t, "1", msg.UUID)
+		msg.Ack()
+	case <-time.After(2 * time.Second):
+		t.Fatal("message is not redelivered")
+	}
+}
+
+func TestPurge(t *testing.T) {
+	provider := newTestProvider(t, "test_svc", []string{"topic1"})
+	require.Equal(t, nil, provider.Publish(message.NewMessage("1", "topic1", nil)))
+
+	provider = newTestProvider(t, "test_svc", []string{"topic1"})
+	record, err := provider.take(context.Background())
+	require.Equal(t, nil, err)
+	require.Nil(t, record)
+}
+
+func TestRebind(t *testing.T) {
+	query := "SELECT id FROM q WHERE svc_name = ? AND status = ?"
+	require.Equal(t, query, MySQL.rebind(query))
+	require.Equal(t, "SELECT id FROM q WHERE svc_name = $1 AND status = $2", Postgres.rebind(query))
+}
+
+func TestPublishUnroutable(t *testing.T) {
+	provider := newTestProvider(t, "test_svc", []string{"topic1"})
+
+	ack := make(chan uint64, 10)
+	provider.NotifyConfirm(ack, make(chan uint64, 10))
+
+	// 没有服务订阅 topic2，消息不能被确认
+	err := provider.Publish(message.NewMessage("1", "topic2", nil))
+	require.Equal(t, mq.ErrUnroutable, err)
+	require.Equal(t, 0, len(ack))
+}
@@ -0,0 +1,69 @@
+package kafka
+
+import (
+	"fmt"
+
+	"github.com/Shopify/sarama"
+	"github.com/xyctruth/final/message"
+)
+
+// uuidHeader 保存消息 UUID 的 record header
+const uuidHeader = "x-final-uuid"
+
+// NewMessageFromRecord 使用 Kafka record 创建消息，消息的 UUID 从 uuidHeader 中读取，没有时使用 record 的 key
+func NewMessageFromRecord(record *sarama.ConsumerMessage) *message.Message {
+	uuid := string(record.Key)
+	for _, header := range record.Headers {
+		if string(header.Key) == uuidHeader {
+			uuid = string(header.Value)
+		}
+	}
+
+	msg := message.NewMessage(uuid, record.Topic, record.Value)
+	for _, header := range record.Headers {
+		if string(header.Key) == uuidHeader {
+			continue
+		}
+		msg.Header.Set(string(header.Key), string(header.Value))
+	}
+	return msg
+}
+
+// NewProducerMessageFromMessage 使用消息创建 Kafka record，消息的 key 作为 record 的 key，相同 key 的消息发送到同一个分区
+// 没有 key 的消息使用 UUID 作为 record 的 key，消息 Header 的值转换为字符串
+func NewProducerMessageFromMessage(msg *message.Message) *sarama.ProducerMessage {
+	headers := make([]sarama.RecordHeader, 0, len(msg.Header)+1)
+	for k, v := range msg.Header {
+		if message.IsInternalHeader(k) {
+			continue
+		}
+		headers = append(headers, sarama.RecordHeader{
+			Key:   []byte(k),
+			Value: []byte(castToString(v)),
+		})
+	}
+	headers = append(headers, sarama.RecordHeader{Key: []byte(uuidHeader), Value: []byte(msg.UUID)})
+
+	key := msg.Key()
+	if key == "" {
+		key = msg.UUID
+	}
+
+	return &sarama.ProducerMessage{
+		Topic:   msg.Topic,
+		Key:     sarama.StringEncoder(key),
+		Value:   sarama.ByteEncoder(msg.Payload),
+		Headers: headers,
+	}
+}
+
+func castToString(i interface{}) string {
+	switch v := i.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
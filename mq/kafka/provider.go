@@ -0,0 +1,258 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/xyctruth/final/logger"
+	"github.com/xyctruth/final/message"
+	"github.com/xyctruth/final/mq"
+)
+
+// Provider Kafka 的 mq.IProvider 实现
+//   topic 对应 Kafka topic
+//   svcName 对应 consumer group，每次 Subscribe 加入一个 consumer group 成员
+//   开启 Confirm 的消息使用 acks=all 同步发送，发送成功后通知 NotifyConfirm 的 ack channel
+//   消息的 UUID 作为 record 的 key
+//   Reject 的消息发送到 svcName_dlx topic
+type Provider struct {
+	log logger.Logger
+
+	brokers []string
+	config  *sarama.Config
+
+	newProducer      func(brokers []string, config *sarama.Config) (sarama.SyncProducer, error)
+	newConsumerGroup func(brokers []string, group string, config *sarama.Config) (sarama.ConsumerGroup, error)
+
+	producer sarama.SyncProducer
+
+	groupMutex sync.Mutex
+	groups     []sarama.ConsumerGroup
+
+	svcName   string
+	topics    []string
+	dlxTopic  string
+	startedAt time.Time
+
+	//启动时是否清除
+	purge bool
+
+	// mutex 保证 sequence 的递增顺序与发送顺序一致
+	mutex    sync.Mutex
+	sequence uint64
+	acks     []chan uint64
+}
+
+// NewProvider 创建 Kafka 驱动，config 为 nil 时使用 sarama.NewConfig()
+func NewProvider(brokers []string, config *sarama.Config) mq.IProvider {
+	if config == nil {
+		config = sarama.NewConfig()
+	}
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
+	config.Consumer.Return.Errors = true
+
+	return &Provider{
+		log:              logger.Discard,
+		brokers:          brokers,
+		config:           config,
+		newProducer:      sarama.NewSyncProducer,
+		newConsumerGroup: sarama.NewConsumerGroup,
+	}
+}
+
+// SetLogger 设置日志输出，未设置时丢弃所有日志
+func (provider *Provider) SetLogger(l logger.Logger) {
+	provider.log = l.WithFields(logger.Fields{
+		"module": "kafka_provider",
+	})
+}
+
+func (provider *Provider) Init(ctx context.Context, svcName string, purge bool, topics []string) error {
+	var err error
+
+	provider.svcName = svcName
+	provider.purge = purge
+	provider.topics = topics
+	provider.dlxTopic = fmt.Sprintf("%s_dlx", svcName)
+	provider.startedAt = time.Now()
+
+	provider.producer, err = provider.newProducer(provider.brokers, provider.config)
+	return err
+}
+
+func (provider *Provider) Publish(msg *message.Message) error {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+
+	_, _, err := provider.producer.SendMessage(NewProducerMessageFromMessage(msg))
+	if err != nil {
+		return err
+	}
+
+	if msg.Policy.Confirm {
+		provider.sequence++
+		for _, ack := range provider.acks {
+			ack <- provider.sequence
+		}
+	}
+	return nil
+}
+
+// NotifyConfirm Kafka 同步发送失败时 Publish 直接返回错误，不会发送 nack
+func (provider *Provider) NotifyConfirm(ack, nack chan uint64) {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	provider.acks = append(provider.acks, ack)
+}
+
+func (provider *Provider) Subscribe(ctx context.Context, consumerTag string, msgs chan *message.Message) error {
+	if len(provider.topics) == 0 {
+		return nil
+	}
+
+	group, err := provider.newConsumerGroup(provider.brokers, provider.svcName, provider.config)
+	if err != nil {
+		provider.log.WithError(err).Error("Failed to create consumer group")
+		return err
+	}
+
+	provider.groupMutex.Lock()
+	provider.groups = append(provider.groups, group)
+	provider.groupMutex.Unlock()
+
+	handler := &consumerGroupHandler{
+		provider:    provider,
+		consumerTag: consumerTag,
+		msgs:        msgs,
+	}
+
+	go func() {
+		for {
+			err := group.Consume(ctx, provider.topics, handler)
+			if err != nil && !errors.Is(err, sarama.ErrClosedConsumerGroup) {
+				provider.log.WithError(err).WithField("consumer_tag", consumerTag).Error("Consume error")
+			}
+			if ctx.Err() != nil || errors.Is(err, sarama.ErrClosedConsumerGroup) {
+				return
+			}
+		}
+	}()
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case err, ok := <-group.Errors():
+				if !ok {
+					return
+				}
+				provider.log.WithError(err).WithField("consumer_tag", consumerTag).Error("Consumer group error")
+			}
+		}
+	}()
+
+	return nil
+}
+
+// reject 发送消息到 dlx topic
+func (provider *Provider) reject(record *sarama.ConsumerMessage) error {
+	_, _, err := provider.producer.SendMessage(&sarama.ProducerMessage{
+		Topic:   provider.dlxTopic,
+		Key:     sarama.ByteEncoder(record.Key),
+		Value:   sarama.ByteEncoder(record.Value),
+		Headers: recordHeaders(record.Headers),
+	})
+	return err
+}
+
+func recordHeaders(headers []*sarama.RecordHeader) []sarama.RecordHeader {
+	result := make([]sarama.RecordHeader, 0, len(headers))
+	for _, header := range headers {
+		result = append(result, *header)
+	}
+	return result
+}
+
+func (provider *Provider) Exit() error {
+	provider.groupMutex.Lock()
+	groups := provider.groups
+	provider.groups = nil
+	provider.groupMutex.Unlock()
+
+	for _, group := range groups {
+		if err := group.Close(); err != nil {
+			return err
+		}
+	}
+
+	if provider.producer != nil {
+		return provider.producer.Close()
+	}
+	return nil
+}
+
+// consumerGroupHandler 把 claim 中的 record 交给 subscriber 处理，处理完成后提交 offset
+type consumerGroupHandler struct {
+	provider    *Provider
+	consumerTag string
+	msgs        chan *message.Message
+}
+
+func (h *consumerGroupHandler) Setup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+func (h *consumerGroupHandler) Cleanup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+func (h *consumerGroupHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	log := h.provider.log.WithField("consumer_tag", h.consumerTag)
+	ctx := session.Context()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case record, ok := <-claim.Messages():
+			if !ok {
+				return nil
+			}
+
+			// Kafka 无法删除遗留的消息，启动时清除表示跳过启动之前发送的消息
+			if h.provider.purge && record.Timestamp.Before(h.provider.startedAt) {
+				session.MarkMessage(record, "")
+				continue
+			}
+
+			msg := NewMessageFromRecord(record)
+			select {
+			case <-ctx.Done():
+				return nil
+			case h.msgs <- msg:
+				log.WithField("uuid", msg.UUID).Trace("HandlerName sent to consumer")
+			}
+
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-msg.Acked():
+				log.WithField("uuid", msg.UUID).Trace("HandlerName Ack")
+			case <-msg.Rejected():
+				log.WithField("uuid", msg.UUID).Trace("HandlerName reject")
+				if err := h.provider.reject(record); err != nil {
+					log.WithError(err).Error("Failed reject message")
+					return err
+				}
+			}
+			session.MarkMessage(record, "")
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/stretchr/testify/require"
+	"github.com/xyctruth/final/message"
+)
+
+func newTestProvider(t *testing.T, producer *mocks.SyncProducer, group *fakeConsumerGroup) *Provider {
+	provider := NewProvider([]string{"localhost:9092"}, nil).(*Provider)
+	provider.newProducer = func([]string, *sarama.Config) (sarama.SyncProducer, error) {
+		return producer, nil
+	}
+	provider.newConsumerGroup = func(brokers []string, groupID string, config *sarama.Config) (sarama.ConsumerGroup, error) {
+		require.Equal(t, "test_svc", groupID)
+		return group, nil
+	}
+	return provider
+}
+
+func TestPublishConfirm(t *testing.T) {
+	producer := mocks.NewSyncProducer(t, nil)
+	provider := newTestProvider(t, producer, nil)
+
+	err := provider.Init(context.Background(), "test_svc", false, []string{"topic1"})
+	require.Equal(t, nil, err)
+
+	ack := make(chan uint64, 10)
+	nack := make(chan uint64, 10)
+	provider.NotifyConfirm(ack, nack)
+
+	producer.ExpectSendMessageWithCheckerFunctionAndSucceed(func(val []byte) error {
+		if string(val) != "payload1" {
+			return errors.New("unexpected payload")
+		}
+		return nil
+	})
+	producer.ExpectSendMessageAndSucceed()
+	producer.ExpectSendMessageAndFail(sarama.ErrNotEnoughReplicas)
+	producer.ExpectSendMessageAndSucceed()
+
+	require.Equal(t, nil, provider.Publish(message.NewMessage("1", "topic1", []byte("payload1"))))
+	require.Equal(t, nil, provider.Publish(message.NewMessage("2", "topic1", nil, message.WithConfirm(false))))
+	require.Equal(t, sarama.ErrNotEnoughReplicas, provider.Publish(message.NewMessage("3", "topic1", nil)))
+	require.Equal(t, nil, provider.Publish(message.NewMessage("4", "topic1", nil)))
+
+	require.Equal(t, uint64(1), <-ack)
+	require.Equal(t, uint64(2), <-ack)
+	require.Equal(t, 0, len(ack))
+	require.Equal(t, 0, len(nack))
+
+	require.Equal(t, nil, provider.Exit())
+}
+
+func TestProducerMessage(t *testing.T) {
+	msg := message.NewMessage("uuid", "topic1", []byte("payload"))
+	msg.Header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	msg.Header.Set("record_id", int64(1))
+
+	record := NewProducerMessageFromMessage(msg)
+	require.Equal(t, "topic1", record.Topic)
+	require.Equal(t, sarama.StringEncoder("uuid"), record.Key)
+
+	headers := make([]*sarama.RecordHeader, 0, len(record.Headers))
+	for i := range record.Headers {
+		headers = append(headers, &record.Headers[i])
+	}
+	received := NewMessageFromRecord(&sarama.ConsumerMessage{
+		Topic:   record.Topic,
+		Key:     []byte("uuid"),
+		Value:   []byte("payload"),
+		Headers: headers,
+	})
+	require.Equal(t, "uuid", received.UUID)
+	require.Equal(t, "topic1", received.Topic)
+	require.Equal(t, []byte("payload"), received.Payload)
+	require.Equal(t, msg.Header.Get("traceparent"), received.Header.Get("traceparent"))
+	_, ok := received.Header["record_id"]
+	require.Equal(t, false, ok)
+}
+
+func TestSubscribe(t *testing.T) {
+	producer := mocks.NewSyncProducer(t, nil)
+	group := newFakeConsumerGroup()
+	provider := newTestProvider(t, producer, group)
+
+	err := provider.Init(context.Background(), "test_svc", false, []string{"topic1"})
+	require.Equal(t, nil, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	msgs := make(chan *message.Message)
+	err = provider.Subscribe(ctx, "consumer_0", msgs)
+	require.Equal(t, nil, err)
+
+	// ack 的消息提交 offset
+	group.claim.messages <- &sarama.ConsumerMessage{Topic: "topic1", Key: []byte("1"), Value: []byte("payload1"), Offset: 10}
+	msg := <-msgs
+	require.Equal(t, "1", msg.UUID)
+	msg.Ack()
+	require.Equal(t, int64(10), <-group.session.marked)
+
+	// reject 的消息发送到 dlx topic 后提交 offset
+	var dlxTopic string
+	producer.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(func(record *sarama.ProducerMessage) error {
+		dlxTopic = record.Topic
+		return nil
+	})
+	group.claim.messages <- &sarama.ConsumerMessage{Topic: "topic1", Key: []byte("2"), Value: []byte("payload2"), Offset: 11}
+	msg = <-msgs
+	require.Equal(t, "2", msg.UUID)
+	msg.Reject()
+	require.Equal(t, int64(11), <-group.session.marked)
+	require.Equal(t, "test_svc_dlx", dlxTopic)
+
+	cancel()
+	require.Equal(t, nil, provider.Exit())
+}
+
+// fakeConsumerGroup 单个分区的 sarama.ConsumerGroup
+type fakeConsumerGroup struct {
+	claim   *fakeClaim
+	session *fakeSession
+	errors  chan error
+	closed  chan struct{}
+}
+
+func newFakeConsumerGroup() *fakeConsumerGroup {
+	return &fakeConsumerGroup{
+		claim:   &fakeClaim{messages: make(chan *sarama.ConsumerMessage)},
+		session: &fakeSession{marked: make(chan int64, 10)},
+		errors:  make(chan error),
+		closed:  make(chan struct{}),
+	}
+}
+
+func (g *fakeConsumerGroup) Consume(ctx context.Context, topics []string, handler sarama.ConsumerGroupHandler) error {
+	select {
+	case <-g.closed:
+		return sarama.ErrClosedConsumerGroup
+	default:
+	}
+	g.session.ctx = ctx
+	if err := handler.Setup(g.session); err != nil {
+		return err
+	}
+	err := handler.ConsumeClaim(g.session, g.claim)
+	if cleanupErr := handler.Cleanup(g.session); cleanupErr != nil {
+		return cleanupErr
+	}
+	<-ctx.Done()
+	return err
+}
+
+func (g *fakeConsumerGroup) Errors() <-chan error {
+	return g.errors
+}
+
+func (g *fakeConsumerGroup) Close() error {
+	close(g.closed)
+	return nil
+}
+
+type fakeSession struct {
+	ctx    context.Context
+	marked chan int64
+}
+
+func (s *fakeSession) Claims() map[string][]int32                        { return map[string][]int32{"topic1": {0}} }
+func (s *fakeSession) MemberID() string                                  { return "member" }
+func (s *fakeSession) GenerationID() int32                               { return 1 }
+func (s *fakeSession) MarkOffset(string, int32, int64, string)           {}
+func (s *fakeSession) Commit()                                           {}
+func (s *fakeSession) ResetOffset(string, int32, int64, string)          {}
+func (s *fakeSession) MarkMessage(msg *sarama.ConsumerMessage, _ string) { s.marked <- msg.Offset }
+func (s *fakeSession) Context() context.Context                          { return s.ctx }
+
+type fakeClaim struct {
+	messages chan *sarama.ConsumerMessage
+}
+
+func (c *fakeClaim) Topic() string                            { return "topic1" }
+func (c *fakeClaim) Partition() int32                         { return 0 }
+func (c *fakeClaim) InitialOffset() int64                     { return 0 }
+func (c *fakeClaim) HighWaterMarkOffset() int64               { return 0 }
+func (c *fakeClaim) Messages() <-chan *sarama.ConsumerMessage { return c.messages }
+
+func TestMessageKey(t *testing.T) {
+	msg := message.NewMessage("1", "topic1", []byte("payload1"), message.WithKey("order-1"))
+	record := NewProducerMessageFromMessage(msg)
+	key, err := record.Key.Encode()
+	require.Equal(t, nil, err)
+	require.Equal(t, "order-1", string(key))
+
+	value, err := record.Value.Encode()
+	require.Equal(t, nil, err)
+	received := NewMessageFromRecord(&sarama.ConsumerMessage{
+		Topic:   record.Topic,
+		Key:     key,
+		Value:   value,
+		Headers: consumerHeaders(record.Headers),
+	})
+	require.Equal(t, "1", received.UUID)
+	require.Equal(t, "order-1", received.Key())
+	require.Equal(t, "", received.Header.Get(uuidHeader))
+
+	// 没有 key 的消息使用 UUID 作为 record 的 key
+	key, err = NewProducerMessageFromMessage(message.NewMessage("2", "topic1", nil)).Key.Encode()
+	require.Equal(t, nil, err)
+	require.Equal(t, "2", string(key))
+}
+
+func consumerHeaders(headers []sarama.RecordHeader) []*sarama.RecordHeader {
+	result := make([]*sarama.RecordHeader, 0, len(headers))
+	for i := range headers {
+		result = append(result, &headers[i])
+	}
+	return result
+}
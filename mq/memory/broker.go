@@ -0,0 +1,161 @@
+package memory
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/xyctruth/final/message"
+	"github.com/xyctruth/final/mq"
+)
+
+// defaultQueueSize 每个队列最多保存的消息数量
+const defaultQueueSize = 10000
+
+var (
+	// ErrQueueFull 队列中的消息数量达到上限
+	ErrQueueFull = errors.New("memory queue is full")
+	// ErrNoReplyQueue 回复地址对应的回复队列不存在，发送 request 的实例已经停止
+	ErrNoReplyQueue = errors.New("reply queue not found")
+)
+
+// Broker 进程内的消息代理，共享同一个 Broker 的 Provider 之间可以互相收发消息
+//   与 AMQP 驱动相同，每个服务一个队列，订阅的 topic 绑定到队列上，相同服务的多个实例竞争消费同一个队列
+//   消息只保存在内存中，进程退出后丢失，适用于测试和单进程部署
+type Broker struct {
+	mutex   sync.RWMutex
+	queues  map[string]*queue
+	replies map[string]chan *message.Message
+}
+
+type queue struct {
+	mutex  sync.RWMutex
+	topics map[string]bool
+	msgs   chan *message.Message
+}
+
+// NewBroker 创建进程内的消息代理
+func NewBroker() *Broker {
+	return &Broker{
+		queues:  make(map[string]*queue),
+		replies: make(map[string]chan *message.Message),
+	}
+}
+
+// declare 声明服务的队列并绑定 topics，purge 为 true 时清除队列中遗留的消息
+func (broker *Broker) declare(svcName string, topics []string, purge bool) *queue {
+	broker.mutex.Lock()
+	q, ok := broker.queues[svcName]
+	if !ok {
+		q = &queue{
+			topics: make(map[string]bool),
+			msgs:   make(chan *message.Message, defaultQueueSize),
+		}
+		broker.queues[svcName] = q
+	}
+	broker.mutex.Unlock()
+
+	q.mutex.Lock()
+	for _, topic := range topics {
+		q.topics[topic] = true
+	}
+	q.mutex.Unlock()
+
+	if purge {
+		q.purge()
+	}
+	return q
+}
+
+// route 把消息的副本发送到所有绑定了 topic 的队列，没有队列绑定 topic 时返回 mq.ErrUnroutable
+// 所有队列都有空间时才发送，任意一个队列已满时不发送到任何队列，重新发送时不会重复
+// 持有写锁，检查和发送之间其它 route 和 requeue 不会写入队列
+func (broker *Broker) route(msg *message.Message) error {
+	broker.mutex.Lock()
+	defer broker.mutex.Unlock()
+
+	bound := make([]*queue, 0, len(broker.queues))
+	for _, q := range broker.queues {
+		if q.bound(msg.Topic) {
+			bound = append(bound, q)
+		}
+	}
+	if len(bound) == 0 {
+		return mq.ErrUnroutable
+	}
+	for _, q := range bound {
+		if len(q.msgs) >= cap(q.msgs) {
+			return ErrQueueFull
+		}
+	}
+
+	for _, q := range bound {
+		c := msg.Clone()
+		for k := range c.Header {
+			if message.IsInternalHeader(k) {
+				delete(c.Header, k)
+			}
+		}
+		q.msgs <- c
+	}
+	return nil
+}
+
+// requeue 未处理完的消息重新放回队列，队列已满时丢弃并返回 false
+func (broker *Broker) requeue(q *queue, msg *message.Message) bool {
+	broker.mutex.Lock()
+	defer broker.mutex.Unlock()
+	select {
+	case q.msgs <- msg.Clone():
+		return true
+	default:
+		return false
+	}
+}
+
+// subscribeReply 创建回复队列
+func (broker *Broker) subscribeReply(replyTo string) chan *message.Message {
+	broker.mutex.Lock()
+	defer broker.mutex.Unlock()
+	replies := make(chan *message.Message, defaultQueueSize)
+	broker.replies[replyTo] = replies
+	return replies
+}
+
+// deleteReply 删除回复队列
+func (broker *Broker) deleteReply(replyTo string) {
+	broker.mutex.Lock()
+	defer broker.mutex.Unlock()
+	delete(broker.replies, replyTo)
+}
+
+// reply 发送回复消息的副本到回复队列
+func (broker *Broker) reply(replyTo string, msg *message.Message) error {
+	broker.mutex.RLock()
+	replies, ok := broker.replies[replyTo]
+	broker.mutex.RUnlock()
+	if !ok {
+		return ErrNoReplyQueue
+	}
+	select {
+	case replies <- msg.Clone():
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+func (q *queue) bound(topic string) bool {
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+	return q.topics[topic]
+}
+
+func (q *queue) purge() {
+	for {
+		select {
+		case <-q.msgs:
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	uuidtools "github.com/satori/go.uuid"
+	"github.com/xyctruth/final/logger"
+	"github.com/xyctruth/final/message"
+	"github.com/xyctruth/final/mq"
+)
+
+// ErrClosed 驱动已经退出
+var ErrClosed = errors.New("memory provider is closed")
+
+// Provider 使用进程内 Broker 的 mq.IProvider 实现，支持 request/reply（mq.IReplier）
+//   开启 Confirm 的消息进入队列后立即 ack，被 Reject 的消息直接丢弃
+//   没有队列绑定 topic 时 Publish 返回 mq.ErrUnroutable，消息记录保留在 outbox 中
+type Provider struct {
+	log    logger.Logger
+	broker *Broker
+
+	svcName string
+	queue   *queue
+
+	// mutex 保证 sequence 的递增顺序与发送顺序一致
+	mutex    sync.Mutex
+	sequence uint64
+	acks     []chan uint64
+
+	done chan struct{}
+	once sync.Once
+}
+
+// NewProvider 创建使用 broker 收发消息的驱动
+func NewProvider(broker *Broker) mq.IProvider {
+	return &Provider{
+		log:    logger.Discard,
+		broker: broker,
+		done:   make(chan struct{}),
+	}
+}
+
+// SetLogger 设置日志输出，未设置时丢弃所有日志
+func (provider *Provider) SetLogger(l logger.Logger) {
+	provider.log = l.WithFields(logger.Fields{
+		"module": "memory_provider",
+	})
+}
+
+func (provider *Provider) Init(ctx context.Context, svcName string, purge bool, topics []string) error {
+	provider.svcName = svcName
+	provider.queue = provider.broker.declare(svcName, topics, purge)
+	return nil
+}
+
+func (provider *Provider) Publish(msg *message.Message) error {
+	select {
+	case <-provider.done:
+		return ErrClosed
+	default:
+	}
+
+	if !msg.Policy.Confirm {
+		return provider.broker.route(msg)
+	}
+
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	if err := provider.broker.route(msg); err != nil {
+		return err
+	}
+	provider.sequence++
+	for _, ack := range provider.acks {
+		go func(ack chan uint64, seq uint64) {
+			select {
+			case ack <- seq:
+			case <-provider.done:
+			}
+		}(ack, provider.sequence)
+	}
+	return nil
+}
+
+// Subscribe 依次把队列中的消息发送到 msgs，等待 Ack 或 Reject 后发送下一条消息
+// ctx 结束时未处理完的消息重新放回队列
+func (provider *Provider) Subscribe(ctx context.Context, consumerTag string, msgs chan *message.Message) error {
+	log := provider.log.WithField("consumer_tag", consumerTag)
+	go func() {
+		for {
+			var msg *message.Message
+			select {
+			case <-ctx.Done():
+				return
+			case msg = <-provider.queue.msgs:
+			}
+
+			select {
+			case <-ctx.Done():
+				provider.broker.requeue(provider.queue, msg)
+				return
+			case msgs <- msg:
+			}
+
+			select {
+			case <-ctx.Done():
+				provider.broker.requeue(provider.queue, msg)
+				return
+			case <-msg.Acked():
+				log.WithField("uuid", msg.UUID).Trace("HandlerName Ack")
+			case <-msg.Rejected():
+				log.WithField("uuid", msg.UUID).Warn("message rejected, dropped")
+			}
+		}
+	}()
+	return nil
+}
+
+// NotifyConfirm 消息进入队列后通知 ack，内存驱动不会 nack
+func (provider *Provider) NotifyConfirm(ack, nack chan uint64) {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	provider.acks = append(provider.acks, ack)
+}
+
+// SubscribeReply 创建当前实例的回复队列，ctx 结束时删除
+func (provider *Provider) SubscribeReply(ctx context.Context, msgs chan *message.Message) (string, error) {
+	replyTo := "reply." + provider.svcName + "." + uuidtools.NewV4().String()
+	replies := provider.broker.subscribeReply(replyTo)
+	go func() {
+		defer provider.broker.deleteReply(replyTo)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case reply := <-replies:
+				select {
+				case <-ctx.Done():
+					return
+				case msgs <- reply:
+				}
+			}
+		}
+	}()
+	return replyTo, nil
+}
+
+func (provider *Provider) PublishReply(replyTo string, msg *message.Message) error {
+	return provider.broker.reply(replyTo, msg)
+}
+
+func (provider *Provider) Exit() error {
+	provider.once.Do(func() {
+		close(provider.done)
+	})
+	return nil
+}
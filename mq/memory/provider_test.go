@@ -0,0 +1,124 @@
+package memory
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/xyctruth/final/message"
+	"github.com/xyctruth/final/mq"
+)
+
+func TestProvider(t *testing.T) {
+	broker := NewBroker()
+	sender := NewProvider(broker)
+	receiver := NewProvider(broker)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	require.Equal(t, nil, sender.Init(ctx, "send_svc", true, nil))
+	require.Equal(t, nil, receiver.Init(ctx, "receive_svc", true, []string{"topic1"}))
+
+	ack := make(chan uint64, 10)
+	sender.NotifyConfirm(ack, make(chan uint64, 10))
+
+	msgs := make(chan *message.Message)
+	require.Equal(t, nil, receiver.Subscribe(ctx, "consumer", msgs))
+
+	require.Equal(t, nil, sender.Publish(message.NewMessage("1", "topic1", []byte("payload1"), message.WithConfirm(true))))
+	require.Equal(t, nil, sender.Publish(message.NewMessage("2", "topic1", []byte("payload2"), message.WithConfirm(false))))
+	// 没有队列绑定的 topic 返回 ErrUnroutable
+	require.Equal(t, mq.ErrUnroutable, sender.Publish(message.NewMessage("3", "topic2", nil, message.WithConfirm(false))))
+
+	select {
+	case seq := <-ack:
+		require.Equal(t, uint64(1), seq)
+	case <-time.After(time.Second):
+		t.Fatal("ack not received")
+	}
+
+	msg := <-msgs
+	require.Equal(t, "1", msg.UUID)
+	require.Equal(t, []byte("payload1"), msg.Payload)
+
+	// Ack 之前不会收到下一条消息
+	select {
+	case <-msgs:
+		t.Fatal("next message delivered before ack")
+	case <-time.After(50 * time.Millisecond):
+	}
+	msg.Ack()
+	msg = <-msgs
+	require.Equal(t, "2", msg.UUID)
+	msg.Reject()
+
+	require.Equal(t, nil, sender.Exit())
+	require.Equal(t, ErrClosed, sender.Publish(message.NewMessage("4", "topic1", nil)))
+}
+
+func TestProviderRequeue(t *testing.T) {
+	broker := NewBroker()
+	provider := NewProvider(broker)
+	require.Equal(t, nil, provider.Init(context.Background(), "svc", true, []string{"topic1"}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	msgs := make(chan *message.Message)
+	require.Equal(t, nil, provider.Subscribe(ctx, "consumer", msgs))
+	require.Equal(t, nil, provider.Publish(message.NewMessage("1", "topic1", nil)))
+	<-msgs
+	cancel()
+
+	// 没有处理完的消息重新放回队列
+	msgs = make(chan *message.Message)
+	require.Equal(t, nil, provider.Subscribe(context.Background(), "consumer", msgs))
+	select {
+	case msg := <-msgs:
+		require.Equal(t, "1", msg.UUID)
+	case <-time.After(time.Second):
+		t.Fatal("message not requeued")
+	}
+}
+
+func TestProviderReply(t *testing.T) {
+	broker := NewBroker()
+	provider := NewProvider(broker).(*Provider)
+	ctx, cancel := context.WithCancel(context.Background())
+	require.Equal(t, nil, provider.Init(ctx, "svc", false, nil))
+
+	replies := make(chan *message.Message)
+	replyTo, err := provider.SubscribeReply(ctx, replies)
+	require.Equal(t, nil, err)
+
+	reply := message.NewMessage("", "topic1", []byte("pong"))
+	reply.Header.Set(message.CorrelationIDHeader, "1")
+	require.Equal(t, nil, provider.PublishReply(replyTo, reply))
+	received := <-replies
+	require.Equal(t, "1", received.CorrelationID())
+	require.Equal(t, []byte("pong"), received.Payload)
+
+	cancel()
+	require.Eventually(t, func() bool {
+		return provider.PublishReply(replyTo, reply) == ErrNoReplyQueue
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestBrokerRoute(t *testing.T) {
+	broker := NewBroker()
+	full := &queue{topics: map[string]bool{"topic1": true}, msgs: make(chan *message.Message, 1)}
+	empty := &queue{topics: map[string]bool{"topic1": true}, msgs: make(chan *message.Message, 1)}
+	broker.queues["full"] = full
+	broker.queues["empty"] = empty
+	full.msgs <- message.NewMessage("0", "topic1", nil)
+
+	// 任意一个队列已满时不发送到任何队列
+	require.Equal(t, ErrQueueFull, broker.route(message.NewMessage("1", "topic1", nil)))
+	require.Equal(t, 0, len(empty.msgs))
+
+	<-full.msgs
+	require.Equal(t, nil, broker.route(message.NewMessage("1", "topic1", nil)))
+	require.Equal(t, 1, len(full.msgs))
+	require.Equal(t, 1, len(empty.msgs))
+
+	require.Equal(t, mq.ErrUnroutable, broker.route(message.NewMessage("2", "topic2", nil)))
+}
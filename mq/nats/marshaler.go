@@ -0,0 +1,44 @@
+package nats
+
+import (
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+	"github.com/xyctruth/final/message"
+)
+
+// NewMessageFromMsg 使用 JetStream 消息创建消息，Nats-Msg-Id 为消息的 UUID
+func NewMessageFromMsg(m *nats.Msg) *message.Message {
+	msg := message.NewMessage(m.Header.Get(nats.MsgIdHdr), m.Subject, m.Data)
+	for k := range m.Header {
+		if k == nats.MsgIdHdr {
+			continue
+		}
+		msg.Header.Set(k, m.Header.Get(k))
+	}
+	return msg
+}
+
+// NewMsgFromMessage 使用消息创建 JetStream 消息，消息 Header 的值转换为字符串
+func NewMsgFromMessage(msg *message.Message) *nats.Msg {
+	m := nats.NewMsg(msg.Topic)
+	m.Data = msg.Payload
+	for k, v := range msg.Header {
+		if message.IsInternalHeader(k) {
+			continue
+		}
+		m.Header.Set(k, castToString(v))
+	}
+	return m
+}
+
+func castToString(i interface{}) string {
+	switch v := i.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,96 @@
+package nats
+
+import (
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Options NATS JetStream 驱动的配置
+type Options struct {
+	// Storage stream 的存储类型
+	Storage nats.StorageType
+	// Replicas stream 的副本数量
+	Replicas int
+	// MaxAge stream 中消息的最长保留时间，0 表示不限制
+	MaxAge time.Duration
+	// Duplicates 根据 Nats-Msg-Id 去重的时间窗口
+	Duplicates time.Duration
+	// AckWait 消息投递后等待 Ack 的时间，超时后重新投递
+	AckWait time.Duration
+	// MaxAckPending consumer 等待 Ack 的最大消息数量
+	MaxAckPending int
+	// FetchTimeout 拉取消息的等待时间
+	FetchTimeout time.Duration
+	// MaxPendingPublish 等待 PubAck 的最大消息数量
+	MaxPendingPublish int
+}
+
+// DefaultOptions NATS JetStream 驱动的默认配置
+func DefaultOptions() Options {
+	return Options{
+		Storage:           nats.FileStorage,
+		Replicas:          1,
+		Duplicates:        2 * time.Minute,
+		AckWait:           30 * time.Second,
+		MaxAckPending:     1000,
+		FetchTimeout:      time.Second,
+		MaxPendingPublish: 4000,
+	}
+}
+
+// WithStorage 设置 stream 的存储类型
+// The default value of Storage is nats.FileStorage.
+func (opt Options) WithStorage(val nats.StorageType) Options {
+	opt.Storage = val
+	return opt
+}
+
+// WithReplicas 设置 stream 的副本数量
+// The default value of Replicas is 1.
+func (opt Options) WithReplicas(val int) Options {
+	opt.Replicas = val
+	return opt
+}
+
+// WithMaxAge 设置 stream 中消息的最长保留时间
+// The default value of MaxAge is 0, no limit.
+func (opt Options) WithMaxAge(val time.Duration) Options {
+	opt.MaxAge = val
+	return opt
+}
+
+// WithDuplicates 设置根据 Nats-Msg-Id 去重的时间窗口
+// The default value of Duplicates is 2 minute.
+func (opt Options) WithDuplicates(val time.Duration) Options {
+	opt.Duplicates = val
+	return opt
+}
+
+// WithAckWait 设置消息投递后等待 Ack 的时间
+// The default value of AckWait is 30 second.
+func (opt Options) WithAckWait(val time.Duration) Options {
+	opt.AckWait = val
+	return opt
+}
+
+// WithMaxAckPending 设置 consumer 等待 Ack 的最大消息数量
+// The default value of MaxAckPending is 1000.
+func (opt Options) WithMaxAckPending(val int) Options {
+	opt.MaxAckPending = val
+	return opt
+}
+
+// WithFetchTimeout 设置拉取消息的等待时间
+// The default value of FetchTimeout is 1 second.
+func (opt Options) WithFetchTimeout(val time.Duration) Options {
+	opt.FetchTimeout = val
+	return opt
+}
+
+// WithMaxPendingPublish 设置等待 PubAck 的最大消息数量
+// The default value of MaxPendingPublish is 4000.
+func (opt Options) WithMaxPendingPublish(val int) Options {
+	opt.MaxPendingPublish = val
+	return opt
+}
@@ -0,0 +1,313 @@
+package nats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/xyctruth/final/logger"
+	"github.com/xyctruth/final/message"
+	"github.com/xyctruth/final/mq"
+)
+
+// Provider NATS JetStream 的 mq.IProvider 实现
+//   每个 topic 对应一个 stream，subject 为 topic
+//   svcName 对应每个 stream 上的 durable pull consumer
+//   Publish 使用异步发布，JetStream 的 PubAck 通知 NotifyConfirm 的 ack channel，发布失败通知 nack channel
+//   Nats-Msg-Id 为消息的 UUID，由 JetStream 去重
+//   msg.Ack() 对应 Ack，msg.Reject() 发送到 svcName_dlx 后 Term，Bus 退出时未处理完的消息 Nak
+type Provider struct {
+	log logger.Logger
+	opt Options
+
+	url  string
+	conn *nats.Conn
+	js   nats.JetStreamContext
+
+	svcName    string
+	topics     []string
+	dlxSubject string
+
+	//启动时是否清除
+	purge bool
+
+	streamMutex sync.Mutex
+	streams     map[string]bool
+
+	// mutex 保证 sequence 的递增顺序与发送顺序一致
+	mutex    sync.Mutex
+	sequence uint64
+	acks     []chan uint64
+	nacks    []chan uint64
+}
+
+// NewProvider 使用默认配置创建 NATS JetStream 驱动
+func NewProvider(url string) mq.IProvider {
+	return NewProviderWithOptions(url, DefaultOptions())
+}
+
+// NewProviderWithOptions 创建 NATS JetStream 驱动
+func NewProviderWithOptions(url string, opt Options) mq.IProvider {
+	return &Provider{
+		log:     logger.Discard,
+		opt:     opt,
+		url:     url,
+		streams: make(map[string]bool),
+	}
+}
+
+// SetLogger 设置日志输出，未设置时丢弃所有日志
+func (provider *Provider) SetLogger(l logger.Logger) {
+	provider.log = l.WithFields(logger.Fields{
+		"module": "nats_provider",
+	})
+}
+
+func (provider *Provider) Init(ctx context.Context, svcName string, purge bool, topics []string) error {
+	var err error
+
+	provider.svcName = svcName
+	provider.purge = purge
+	provider.topics = topics
+	provider.dlxSubject = fmt.Sprintf("%s_dlx", svcName)
+
+	provider.conn, err = nats.Connect(provider.url, nats.Name(svcName))
+	if err != nil {
+		return err
+	}
+
+	provider.js, err = provider.conn.JetStream(nats.PublishAsyncMaxPending(provider.opt.MaxPendingPublish))
+	if err != nil {
+		return err
+	}
+
+	err = provider.ensureStream(provider.dlxSubject)
+	if err != nil {
+		return err
+	}
+
+	for _, topic := range topics {
+		err = provider.ensureStream(topic)
+		if err != nil {
+			return err
+		}
+		err = provider.initConsumer(topic)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensureStream 创建 topic 对应的 stream
+func (provider *Provider) ensureStream(topic string) error {
+	provider.streamMutex.Lock()
+	defer provider.streamMutex.Unlock()
+
+	if provider.streams[topic] {
+		return nil
+	}
+
+	name := StreamName(topic)
+	_, err := provider.js.StreamInfo(name)
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		_, err = provider.js.AddStream(&nats.StreamConfig{
+			Name:       name,
+			Subjects:   []string{topic},
+			Storage:    provider.opt.Storage,
+			Replicas:   provider.opt.Replicas,
+			MaxAge:     provider.opt.MaxAge,
+			Duplicates: provider.opt.Duplicates,
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	provider.streams[topic] = true
+	return nil
+}
+
+// initConsumer 创建 svcName 在 topic stream 上的 durable consumer，新建的 consumer 只接收之后发送的消息
+func (provider *Provider) initConsumer(topic string) error {
+	stream := StreamName(topic)
+	durable := provider.durableName()
+
+	if provider.purge {
+		err := provider.js.DeleteConsumer(stream, durable)
+		if err != nil && !errors.Is(err, nats.ErrConsumerNotFound) {
+			return err
+		}
+	}
+
+	_, err := provider.js.ConsumerInfo(stream, durable)
+	if errors.Is(err, nats.ErrConsumerNotFound) {
+		_, err = provider.js.AddConsumer(stream, &nats.ConsumerConfig{
+			Durable:       durable,
+			DeliverPolicy: nats.DeliverNewPolicy,
+			AckPolicy:     nats.AckExplicitPolicy,
+			AckWait:       provider.opt.AckWait,
+			MaxAckPending: provider.opt.MaxAckPending,
+		})
+	}
+	return err
+}
+
+func (provider *Provider) durableName() string {
+	return StreamName(provider.svcName)
+}
+
+func (provider *Provider) Publish(msg *message.Message) error {
+	err := provider.ensureStream(msg.Topic)
+	if err != nil {
+		return err
+	}
+
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+
+	future, err := provider.js.PublishMsgAsync(NewMsgFromMessage(msg), nats.MsgId(msg.UUID))
+	if err != nil {
+		return err
+	}
+
+	if msg.Policy.Confirm {
+		provider.sequence++
+		go provider.waitConfirm(provider.sequence, future)
+	}
+	return nil
+}
+
+// waitConfirm 等待 JetStream 的 PubAck，通知 ack 或 nack channel
+func (provider *Provider) waitConfirm(seq uint64, future nats.PubAckFuture) {
+	provider.mutex.Lock()
+	acks, nacks := provider.acks, provider.nacks
+	provider.mutex.Unlock()
+
+	select {
+	case <-future.Ok():
+		for _, ack := range acks {
+			ack <- seq
+		}
+	case err := <-future.Err():
+		provider.log.WithError(err).WithField("seq", seq).Error("JetStream publish failure")
+		for _, nack := range nacks {
+			nack <- seq
+		}
+	}
+}
+
+func (provider *Provider) NotifyConfirm(ack, nack chan uint64) {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	provider.acks = append(provider.acks, ack)
+	provider.nacks = append(provider.nacks, nack)
+}
+
+func (provider *Provider) Subscribe(ctx context.Context, consumerTag string, msgs chan *message.Message) error {
+	for _, topic := range provider.topics {
+		sub, err := provider.js.PullSubscribe(topic, provider.durableName(), nats.Bind(StreamName(topic), provider.durableName()))
+		if err != nil {
+			provider.log.WithError(err).Error("Failed to subscribe")
+			return err
+		}
+		go provider.consume(ctx, consumerTag, sub, msgs)
+	}
+	return nil
+}
+
+func (provider *Provider) consume(ctx context.Context, consumerTag string, sub *nats.Subscription, msgs chan *message.Message) {
+	log := provider.log.WithField("consumer_tag", consumerTag)
+	defer func() {
+		if err := sub.Unsubscribe(); err != nil && !errors.Is(err, nats.ErrConnectionClosed) {
+			log.WithError(err).Error("Failed to unsubscribe")
+		}
+	}()
+
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+
+		fetched, err := sub.Fetch(1, nats.MaxWait(provider.opt.FetchTimeout))
+		if err != nil {
+			if errors.Is(err, nats.ErrTimeout) || ctx.Err() != nil {
+				continue
+			}
+			log.WithError(err).Error("Fetch error")
+			if errors.Is(err, nats.ErrConnectionClosed) || errors.Is(err, nats.ErrBadSubscription) {
+				return
+			}
+			select {
+			case <-ctx.Done():
+			case <-time.After(provider.opt.FetchTimeout):
+			}
+			continue
+		}
+
+		for _, m := range fetched {
+			provider.deliver(ctx, log, m, msgs)
+		}
+	}
+}
+
+func (provider *Provider) deliver(ctx context.Context, log logger.Logger, m *nats.Msg, msgs chan *message.Message) {
+	msg := NewMessageFromMsg(m)
+
+	select {
+	case <-ctx.Done():
+		provider.nak(log, m)
+		return
+	case msgs <- msg:
+		log.WithField("uuid", msg.UUID).Trace("HandlerName sent to consumer")
+	}
+
+	select {
+	case <-ctx.Done():
+		provider.nak(log, m)
+	case <-msg.Acked():
+		log.WithField("uuid", msg.UUID).Trace("HandlerName Ack")
+		if err := m.Ack(); err != nil {
+			log.WithError(err).Error("Failed ack message")
+		}
+	case <-msg.Rejected():
+		log.WithField("uuid", msg.UUID).Trace("HandlerName reject")
+		dlx := nats.NewMsg(provider.dlxSubject)
+		dlx.Data = m.Data
+		dlx.Header = m.Header
+		if _, err := provider.js.PublishMsg(dlx); err != nil {
+			// 没有 Term 的消息在 AckWait 后重新投递
+			log.WithError(err).Error("Failed reject message")
+			return
+		}
+		if err := m.Term(); err != nil {
+			log.WithError(err).Error("Failed term message")
+		}
+	}
+}
+
+func (provider *Provider) nak(log logger.Logger, m *nats.Msg) {
+	if err := m.Nak(); err != nil {
+		log.WithError(err).Error("Failed nak message")
+	}
+}
+
+func (provider *Provider) Exit() error {
+	if provider.conn == nil {
+		return nil
+	}
+	err := provider.conn.Drain()
+	if err != nil && !errors.Is(err, nats.ErrConnectionClosed) {
+		return err
+	}
+	return nil
+}
+
+// StreamName 使用 topic 生成 stream 名称，stream 名称中不能包含 . * > 和空白
+func StreamName(topic string) string {
+	return strings.NewReplacer(".", "_", "*", "_", ">", "_", " ", "_").Replace(topic)
+}
@@ -0,0 +1,13 @@
+package nats
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamName(t *testing.T) {
+	require.Equal(t, "order_created", StreamName("order.created"))
+	require.Equal(t, "order__", StreamName("order.*"))
+	require.Equal(t, "order_", StreamName("order>"))
+}
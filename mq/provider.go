@@ -2,10 +2,18 @@ package mq
 
 import (
 	"context"
+	"errors"
 
+	"github.com/xyctruth/final/logger"
 	"github.com/xyctruth/final/message"
 )
 
+// ErrUnroutable 消息没有路由到任何队列，mq 驱动 Publish 时返回，消息保留在 outbox 中
+var ErrUnroutable = errors.New("message is not routed to any queue")
+
+// ErrReplyNotSupported 实现了 IReplier 的驱动不支持 request/reply 时 SubscribeReply 返回，例如组合驱动的成员都不支持
+var ErrReplyNotSupported = errors.New("mq provider does not support request/reply")
+
 type IProvider interface {
 	Init(ctx context.Context, svcName string, purge bool, topics []string) error
 	Publish(messages *message.Message) error
@@ -13,3 +21,50 @@ type IProvider interface {
 	NotifyConfirm(ack, nack chan uint64)
 	Exit() error
 }
+
+// ILoggerSetter 可选接口，Bus 把 Options.Logger 传递给 mq 驱动
+type ILoggerSetter interface {
+	SetLogger(logger logger.Logger)
+}
+
+// IHealthChecker 可选接口，返回 mq 驱动各个组件（连接、channel 等）的健康状态，nil 表示正常
+type IHealthChecker interface {
+	Health() map[string]error
+}
+
+// IBlockNotifier 可选接口，mq 驱动在连接被 broker 阻塞或解除阻塞时通知 publisher
+// 例如 AMQP 的 connection.blocked / connection.unblocked
+type IBlockNotifier interface {
+	NotifyBlocked(blocked chan bool)
+}
+
+// IReturnNotifier 可选接口，mq 驱动通知没有路由到任何队列、被 broker 退回的消息
+// 被退回的消息的 confirm 必须作为 nack 通知（实现了 IUnroutableNotifier 时通过 unroutable 通知），例如 AMQP 的 mandatory 和 basic.return
+type IReturnNotifier interface {
+	NotifyReturn(returned chan *message.Message)
+}
+
+// IUnroutableNotifier 可选接口，被退回的消息的 confirm 通过 unroutable 通知，而不是作为 nack 通知
+// unroutable 与 NotifyConfirm 的 ack、nack 使用相同的 sequence，Bus 在处理 confirm 时标记 outbox 中的消息记录，
+// 不依赖退回的消息与 confirm 到达 Bus 的顺序
+type IUnroutableNotifier interface {
+	NotifyUnroutable(unroutable chan uint64)
+}
+
+// ITopicSubscriber 可选接口，mq 驱动为每个 topic 使用独立的队列和 consumer
+// TopicQueues 返回 true 时，Bus 为每个 topic 调用一次 SubscribeTopic，不再调用 Subscribe
+// prefetch 为 consumer 未 Ack 的最大消息数量，驱动等待 Ack 时不能阻塞后续消息的投递
+type ITopicSubscriber interface {
+	TopicQueues() bool
+	SubscribeTopic(ctx context.Context, consumerTag, topic string, prefetch int, msgs chan *message.Message) error
+}
+
+// IReplier 可选接口，mq 驱动支持 request/reply
+// SubscribeReply 为当前实例声明独占的回复队列，返回回复地址，收到的回复发送到 msgs，回复消息不需要 Ack
+// 回复队列失效时（例如 channel 被关闭）驱动关闭 msgs，调用方重新调用 SubscribeReply 获取新的回复地址
+// SubscribeReply 返回 ErrReplyNotSupported 时 Bus 不支持 Request，不影响启动
+// PublishReply 发送回复消息到 replyTo 地址
+type IReplier interface {
+	SubscribeReply(ctx context.Context, msgs chan *message.Message) (string, error)
+	PublishReply(replyTo string, msg *message.Message) error
+}
@@ -0,0 +1,56 @@
+package redisstream
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/xyctruth/final/message"
+)
+
+const (
+	uuidField    = "uuid"
+	payloadField = "payload"
+	topicField   = "topic"
+	// headerPrefix 消息 Header 保存为 h:<key> 字段，值转换为字符串
+	headerPrefix = "h:"
+)
+
+// NewValuesFromMessage 使用消息创建 XADD 的字段
+func NewValuesFromMessage(msg *message.Message) map[string]interface{} {
+	values := make(map[string]interface{}, len(msg.Header)+3)
+	for k, v := range msg.Header {
+		if message.IsInternalHeader(k) {
+			continue
+		}
+		values[headerPrefix+k] = castToString(v)
+	}
+	values[uuidField] = msg.UUID
+	values[topicField] = msg.Topic
+	values[payloadField] = msg.Payload
+	return values
+}
+
+// NewMessageFromXMessage 使用 stream 中的消息创建消息
+func NewMessageFromXMessage(stream string, xmsg redis.XMessage) *message.Message {
+	msg := message.NewMessage(castToString(xmsg.Values[uuidField]), stream, []byte(castToString(xmsg.Values[payloadField])))
+	for k, v := range xmsg.Values {
+		if strings.HasPrefix(k, headerPrefix) {
+			msg.Header.Set(strings.TrimPrefix(k, headerPrefix), castToString(v))
+		}
+	}
+	return msg
+}
+
+func castToString(i interface{}) string {
+	switch v := i.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,53 @@
+package redisstream
+
+import "time"
+
+// Options Redis Streams 驱动的配置
+type Options struct {
+	// BlockTimeout XREADGROUP 阻塞等待新消息的时间
+	BlockTimeout time.Duration
+	// ClaimInterval 使用 XAUTOCLAIM 认领卡住消息的间隔
+	ClaimInterval time.Duration
+	// ClaimMinIdle 消息投递后超过该时间仍未 XACK 时，可以被其它 consumer 认领
+	ClaimMinIdle time.Duration
+	// MaxLen stream 的最大长度（近似），0 表示不限制
+	MaxLen int64
+}
+
+// DefaultOptions Redis Streams 驱动的默认配置
+func DefaultOptions() Options {
+	return Options{
+		BlockTimeout:  time.Second,
+		ClaimInterval: 30 * time.Second,
+		ClaimMinIdle:  time.Minute,
+		MaxLen:        0,
+	}
+}
+
+// WithBlockTimeout 设置 XREADGROUP 阻塞等待新消息的时间
+// The default value of BlockTimeout is 1 second.
+func (opt Options) WithBlockTimeout(val time.Duration) Options {
+	opt.BlockTimeout = val
+	return opt
+}
+
+// WithClaimInterval 设置使用 XAUTOCLAIM 认领卡住消息的间隔
+// The default value of ClaimInterval is 30 second.
+func (opt Options) WithClaimInterval(val time.Duration) Options {
+	opt.ClaimInterval = val
+	return opt
+}
+
+// WithClaimMinIdle 设置消息可以被其它 consumer 认领的最小空闲时间
+// The default value of ClaimMinIdle is 1 minute.
+func (opt Options) WithClaimMinIdle(val time.Duration) Options {
+	opt.ClaimMinIdle = val
+	return opt
+}
+
+// WithMaxLen 设置 stream 的最大长度（近似）
+// The default value of MaxLen is 0, no limit.
+func (opt Options) WithMaxLen(val int64) Options {
+	opt.MaxLen = val
+	return opt
+}
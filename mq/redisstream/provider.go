@@ -0,0 +1,256 @@
+package redisstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/xyctruth/final/logger"
+	"github.com/xyctruth/final/message"
+	"github.com/xyctruth/final/mq"
+)
+
+// Provider Redis Streams 的 mq.IProvider 实现
+//   topic 对应 stream，Publish 使用 XADD，XADD 成功后通知 NotifyConfirm 的 ack channel
+//   svcName 对应 consumer group，Subscribe 使用 XREADGROUP 读取消息
+//   msg.Ack() 时 XACK，msg.Reject() 时发送到 svcName_dlx stream 后 XACK
+//   超过 Options.ClaimMinIdle 仍未 XACK 的消息使用 XAUTOCLAIM 认领后重新处理
+type Provider struct {
+	log logger.Logger
+	opt Options
+
+	client redis.UniversalClient
+
+	svcName   string
+	topics    []string
+	dlxStream string
+
+	//启动时是否清除
+	purge bool
+
+	// mutex 保证 sequence 的递增顺序与发送顺序一致
+	mutex    sync.Mutex
+	sequence uint64
+	acks     []chan uint64
+}
+
+// NewProvider 使用默认配置创建 Redis Streams 驱动
+func NewProvider(client redis.UniversalClient) mq.IProvider {
+	return NewProviderWithOptions(client, DefaultOptions())
+}
+
+// NewProviderWithOptions 创建 Redis Streams 驱动
+func NewProviderWithOptions(client redis.UniversalClient, opt Options) mq.IProvider {
+	return &Provider{
+		log:    logger.Discard,
+		opt:    opt,
+		client: client,
+	}
+}
+
+// SetLogger 设置日志输出，未设置时丢弃所有日志
+func (provider *Provider) SetLogger(l logger.Logger) {
+	provider.log = l.WithFields(logger.Fields{
+		"module": "redis_stream_provider",
+	})
+}
+
+func (provider *Provider) Init(ctx context.Context, svcName string, purge bool, topics []string) error {
+	provider.svcName = svcName
+	provider.purge = purge
+	provider.topics = topics
+	provider.dlxStream = fmt.Sprintf("%s_dlx", svcName)
+
+	for _, topic := range topics {
+		if purge {
+			// 删除 consumer group 会同时删除未 XACK 的消息记录
+			err := provider.client.XGroupDestroy(ctx, topic, svcName).Err()
+			if err != nil && !isNoGroupErr(err) {
+				return err
+			}
+		}
+
+		// 新建的 consumer group 从 stream 的最新位置开始消费
+		err := provider.client.XGroupCreateMkStream(ctx, topic, svcName, "$").Err()
+		if err != nil && !isBusyGroupErr(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (provider *Provider) Publish(msg *message.Message) error {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+
+	args := &redis.XAddArgs{
+		Stream: msg.Topic,
+		Values: NewValuesFromMessage(msg),
+	}
+	if provider.opt.MaxLen > 0 {
+		args.MaxLen = provider.opt.MaxLen
+		args.Approx = true
+	}
+
+	err := provider.client.XAdd(context.Background(), args).Err()
+	if err != nil {
+		return err
+	}
+
+	if msg.Policy.Confirm {
+		provider.sequence++
+		for _, ack := range provider.acks {
+			ack <- provider.sequence
+		}
+	}
+	return nil
+}
+
+// NotifyConfirm XADD 失败时 Publish 直接返回错误，不会发送 nack
+func (provider *Provider) NotifyConfirm(ack, nack chan uint64) {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	provider.acks = append(provider.acks, ack)
+}
+
+func (provider *Provider) Subscribe(ctx context.Context, consumerTag string, msgs chan *message.Message) error {
+	if len(provider.topics) == 0 {
+		return nil
+	}
+
+	streams := make([]string, 0, len(provider.topics)*2)
+	streams = append(streams, provider.topics...)
+	for range provider.topics {
+		streams = append(streams, ">")
+	}
+
+	go func() {
+		lastClaim := time.Now()
+		for {
+			if ctx.Err() != nil {
+				return
+			}
+
+			if time.Since(lastClaim) >= provider.opt.ClaimInterval {
+				provider.claim(ctx, consumerTag, msgs)
+				lastClaim = time.Now()
+			}
+
+			result, err := provider.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+				Group:    provider.svcName,
+				Consumer: consumerTag,
+				Streams:  streams,
+				Count:    1,
+				Block:    provider.opt.BlockTimeout,
+			}).Result()
+			if err != nil {
+				if errors.Is(err, redis.Nil) || ctx.Err() != nil {
+					continue
+				}
+				provider.log.WithError(err).WithField("consumer_tag", consumerTag).Error("XREADGROUP error")
+				select {
+				case <-ctx.Done():
+				case <-time.After(provider.opt.BlockTimeout):
+				}
+				continue
+			}
+
+			for _, stream := range result {
+				for _, xmsg := range stream.Messages {
+					if !provider.deliver(ctx, consumerTag, stream.Stream, xmsg, msgs) {
+						return
+					}
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// claim 使用 XAUTOCLAIM 认领其它 consumer 超过 Options.ClaimMinIdle 仍未 XACK 的消息
+func (provider *Provider) claim(ctx context.Context, consumerTag string, msgs chan *message.Message) {
+	for _, topic := range provider.topics {
+		start := "0-0"
+		for {
+			claimed, next, err := provider.client.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+				Stream:   topic,
+				Group:    provider.svcName,
+				Consumer: consumerTag,
+				MinIdle:  provider.opt.ClaimMinIdle,
+				Start:    start,
+				Count:    10,
+			}).Result()
+			if err != nil {
+				if ctx.Err() == nil {
+					provider.log.WithError(err).WithField("consumer_tag", consumerTag).Error("XAUTOCLAIM error")
+				}
+				break
+			}
+
+			for _, xmsg := range claimed {
+				provider.log.WithField("id", xmsg.ID).WithField("consumer_tag", consumerTag).Warn("claimed stuck message")
+				if !provider.deliver(ctx, consumerTag, topic, xmsg, msgs) {
+					return
+				}
+			}
+
+			if next == "0-0" || len(claimed) == 0 {
+				break
+			}
+			start = next
+		}
+	}
+}
+
+// deliver 把消息交给 subscriber 处理，等待 Ack 或 Reject，ctx 结束时返回 false
+func (provider *Provider) deliver(ctx context.Context, consumerTag, stream string, xmsg redis.XMessage, msgs chan *message.Message) bool {
+	log := provider.log.WithField("consumer_tag", consumerTag)
+	msg := NewMessageFromXMessage(stream, xmsg)
+
+	select {
+	case <-ctx.Done():
+		return false
+	case msgs <- msg:
+		log.WithField("uuid", msg.UUID).Trace("HandlerName sent to consumer")
+	}
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-msg.Acked():
+		log.WithField("uuid", msg.UUID).Trace("HandlerName Ack")
+	case <-msg.Rejected():
+		log.WithField("uuid", msg.UUID).Trace("HandlerName reject")
+		err := provider.client.XAdd(ctx, &redis.XAddArgs{
+			Stream: provider.dlxStream,
+			Values: xmsg.Values,
+		}).Err()
+		if err != nil {
+			// 没有 XACK 的消息会在超过 Options.ClaimMinIdle 后被重新认领
+			log.WithError(err).Error("Failed reject message")
+			return true
+		}
+	}
+
+	err := provider.client.XAck(ctx, stream, provider.svcName, xmsg.ID).Err()
+	if err != nil {
+		log.WithError(err).Error("Failed ack message")
+	}
+	return true
+}
+
+func (provider *Provider) Exit() error {
+	return nil
+}
+
+func isBusyGroupErr(err error) bool {
+	return strings.HasPrefix(err.Error(), "BUSYGROUP")
+}
+
+func isNoGroupErr(err error) bool {
+	return strings.Contains(err.Error(), "no such key") || strings.HasPrefix(err.Error(), "NOGROUP") || strings.Contains(err.Error(), "requires the key to exist")
+}
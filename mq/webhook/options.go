@@ -0,0 +1,89 @@
+package webhook
+
+import (
+	"net/http"
+	"time"
+)
+
+// Options webhook 驱动的配置
+type Options struct {
+	// Endpoints topic 对应的 webhook 地址
+	Endpoints map[string]string
+	// Secret 签名的密钥，为空时不签名
+	Secret []byte
+	// Client 发送请求的 http.Client
+	Client *http.Client
+	// Timeout 单次请求的超时时间
+	Timeout time.Duration
+	// ContentType 请求的 Content-Type
+	ContentType string
+	// MaxConcurrency 同时发送的最大请求数量
+	MaxConcurrency int
+}
+
+// DefaultOptions webhook 驱动的默认配置
+func DefaultOptions() Options {
+	return Options{
+		Endpoints:      make(map[string]string),
+		Client:         http.DefaultClient,
+		Timeout:        10 * time.Second,
+		ContentType:    "application/json",
+		MaxConcurrency: 100,
+	}
+}
+
+// clamp 把必须大于 0 的配置恢复为默认值，返回被修改的配置名称
+func (opt Options) clamp() (Options, []string) {
+	clamped := make([]string, 0)
+	if opt.MaxConcurrency <= 0 {
+		opt.MaxConcurrency = DefaultOptions().MaxConcurrency
+		clamped = append(clamped, "MaxConcurrency")
+	}
+	return opt, clamped
+}
+
+// WithEndpoint 设置 topic 对应的 webhook 地址
+func (opt Options) WithEndpoint(topic, url string) Options {
+	endpoints := make(map[string]string, len(opt.Endpoints)+1)
+	for k, v := range opt.Endpoints {
+		endpoints[k] = v
+	}
+	endpoints[topic] = url
+	opt.Endpoints = endpoints
+	return opt
+}
+
+// WithSecret 设置签名的密钥
+// The default value of Secret is nil, requests are not signed.
+func (opt Options) WithSecret(val []byte) Options {
+	opt.Secret = val
+	return opt
+}
+
+// WithClient 设置发送请求的 http.Client
+// The default value of Client is http.DefaultClient.
+func (opt Options) WithClient(val *http.Client) Options {
+	opt.Client = val
+	return opt
+}
+
+// WithTimeout 设置单次请求的超时时间
+// The default value of Timeout is 10 second.
+func (opt Options) WithTimeout(val time.Duration) Options {
+	opt.Timeout = val
+	return opt
+}
+
+// WithContentType 设置请求的 Content-Type
+// The default value of ContentType is application/json.
+func (opt Options) WithContentType(val string) Options {
+	opt.ContentType = val
+	return opt
+}
+
+// WithMaxConcurrency 设置同时发送的最大请求数量，小于等于 0 时使用默认值
+// The default value of MaxConcurrency is 100.
+func (opt Options) WithMaxConcurrency(val int) Options {
+	opt.MaxConcurrency = val
+	return opt
+}
@@ -0,0 +1,226 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/xyctruth/final/logger"
+	"github.com/xyctruth/final/message"
+	"github.com/xyctruth/final/mq"
+)
+
+var (
+	// ErrNoEndpoint topic 没有配置 webhook 地址
+	ErrNoEndpoint = errors.New("webhook endpoint not found")
+	// ErrSubscribeNotSupported webhook 驱动只能发送消息
+	ErrSubscribeNotSupported = errors.New("webhook provider does not support subscribe")
+)
+
+// Provider 通过 HTTP POST 把消息发送到外部 webhook 的 mq.IProvider 实现，只能发送消息
+//   每个 topic 对应 Options.Endpoints 中的一个地址，请求体为消息的 Payload，消息 Header 作为请求头发送
+//   响应 2xx 时通知 NotifyConfirm 的 ack channel，其它响应或请求失败时通知 nack channel
+//   nack 的消息保留在 outbox 中，由 outbox 扫描按照 Options.OutboxScanInterval 重新发送，接收方需要根据 X-Final-Id 去重
+type Provider struct {
+	log logger.Logger
+	opt Options
+	// clamped 被恢复为默认值的配置，设置日志输出时输出警告
+	clamped []string
+
+	svcName string
+
+	// mutex 保证 sequence 的递增顺序与发送顺序一致
+	mutex    sync.Mutex
+	sequence uint64
+	acks     []chan uint64
+	nacks    []chan uint64
+
+	// slots 限制同时发送的请求数量
+	slots chan struct{}
+	wg    sync.WaitGroup
+	done  chan struct{}
+	once  sync.Once
+}
+
+// NewProvider 创建 webhook 驱动，endpoints 为 topic 对应的 webhook 地址，secret 为空时不签名
+func NewProvider(endpoints map[string]string, secret []byte) mq.IProvider {
+	opt := DefaultOptions().WithSecret(secret)
+	for topic, url := range endpoints {
+		opt = opt.WithEndpoint(topic, url)
+	}
+	return NewProviderWithOptions(opt)
+}
+
+// NewProviderWithOptions 创建 webhook 驱动，MaxConcurrency 小于等于 0 时使用默认值
+func NewProviderWithOptions(opt Options) mq.IProvider {
+	opt, clamped := opt.clamp()
+	return &Provider{
+		log:     logger.Discard,
+		opt:     opt,
+		clamped: clamped,
+		slots:   make(chan struct{}, opt.MaxConcurrency),
+		done:    make(chan struct{}),
+	}
+}
+
+// SetLogger 设置日志输出，未设置时丢弃所有日志
+func (provider *Provider) SetLogger(l logger.Logger) {
+	provider.log = l.WithFields(logger.Fields{
+		"module": "webhook_provider",
+	})
+	for _, name := range provider.clamped {
+		provider.log.WithField("option", name).Warn("option must be greater than 0, using the default value")
+	}
+}
+
+// Init webhook 驱动不能订阅 topic，topics 不为空时返回 ErrSubscribeNotSupported
+func (provider *Provider) Init(ctx context.Context, svcName string, purge bool, topics []string) error {
+	if len(topics) > 0 {
+		return ErrSubscribeNotSupported
+	}
+	provider.svcName = svcName
+	return nil
+}
+
+// Publish 异步发送请求，topic 没有配置地址时返回 ErrNoEndpoint
+func (provider *Provider) Publish(msg *message.Message) error {
+	endpoint, ok := provider.opt.Endpoints[msg.Topic]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNoEndpoint, msg.Topic)
+	}
+
+	req, err := provider.newRequest(endpoint, msg)
+	if err != nil {
+		return err
+	}
+
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+
+	select {
+	case provider.slots <- struct{}{}:
+	case <-provider.done:
+		return errors.New("webhook provider is exited")
+	}
+
+	var seq uint64
+	if msg.Policy.Confirm {
+		provider.sequence++
+		seq = provider.sequence
+	}
+
+	provider.wg.Add(1)
+	go func() {
+		defer provider.wg.Done()
+		err := provider.send(req)
+		<-provider.slots
+
+		log := provider.log.WithField("uuid", req.Header.Get(HeaderID)).WithField("endpoint", endpoint)
+		if err != nil {
+			log.WithError(err).Error("webhook delivery failure")
+		}
+		if seq == 0 {
+			return
+		}
+
+		provider.mutex.Lock()
+		acks, nacks := provider.acks, provider.nacks
+		provider.mutex.Unlock()
+		if err != nil {
+			provider.notify(nacks, seq)
+			return
+		}
+		provider.notify(acks, seq)
+	}()
+	return nil
+}
+
+func (provider *Provider) newRequest(endpoint string, msg *message.Message) (*http.Request, error) {
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(msg.Payload))
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range msg.Header {
+		if message.IsInternalHeader(k) {
+			continue
+		}
+		req.Header.Set(k, castToString(v))
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", provider.opt.ContentType)
+	req.Header.Set(HeaderID, msg.UUID)
+	req.Header.Set(HeaderTopic, msg.Topic)
+	req.Header.Set(HeaderTimestamp, timestamp)
+	if len(provider.opt.Secret) > 0 {
+		req.Header.Set(HeaderSignature, Sign(provider.opt.Secret, timestamp, msg.Payload))
+	}
+	return req, nil
+}
+
+// send 发送请求，响应不是 2xx 时返回错误
+func (provider *Provider) send(req *http.Request) error {
+	ctx, cancel := context.WithTimeout(context.Background(), provider.opt.Timeout)
+	defer cancel()
+
+	resp, err := provider.opt.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook response status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (provider *Provider) notify(chs []chan uint64, seq uint64) {
+	for _, ch := range chs {
+		select {
+		case ch <- seq:
+		case <-provider.done:
+			return
+		}
+	}
+}
+
+func (provider *Provider) NotifyConfirm(ack, nack chan uint64) {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	provider.acks = append(provider.acks, ack)
+	provider.nacks = append(provider.nacks, nack)
+}
+
+// Subscribe webhook 驱动不接收消息
+func (provider *Provider) Subscribe(ctx context.Context, consumerTag string, msgs chan *message.Message) error {
+	return nil
+}
+
+// Exit 等待发送中的请求完成
+func (provider *Provider) Exit() error {
+	provider.once.Do(func() {
+		close(provider.done)
+	})
+	provider.wg.Wait()
+	return nil
+}
+
+func castToString(i interface{}) string {
+	switch v := i.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,123 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/xyctruth/final/message"
+)
+
+func TestPublishConfirm(t *testing.T) {
+	secret := []byte("secret")
+	received := make(chan *http.Request, 10)
+	bodies := make(chan []byte, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if !Verify(secret, r.Header, body, time.Minute) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		received <- r
+		bodies <- body
+	}))
+	defer server.Close()
+
+	provider := NewProvider(map[string]string{"topic1": server.URL + "/hook"}, secret).(*Provider)
+	require.Equal(t, nil, provider.Init(context.Background(), "test_svc", false, nil))
+	defer provider.Exit()
+
+	ack := make(chan uint64, 10)
+	nack := make(chan uint64, 10)
+	provider.NotifyConfirm(ack, nack)
+
+	msg := message.NewMessage("1", "topic1", []byte(`{"id":1}`))
+	msg.Header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	msg.Header.Set("record_id", int64(1))
+	require.Equal(t, nil, provider.Publish(msg))
+	require.Equal(t, uint64(1), <-ack)
+
+	r := <-received
+	require.Equal(t, "/hook", r.URL.Path)
+	require.Equal(t, "1", r.Header.Get(HeaderID))
+	require.Equal(t, "topic1", r.Header.Get(HeaderTopic))
+	require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+	require.Equal(t, msg.Header.Get("traceparent"), r.Header.Get("traceparent"))
+	require.Equal(t, "", r.Header.Get("record_id"))
+	require.Equal(t, []byte(`{"id":1}`), <-bodies)
+
+	require.Equal(t, nil, provider.Publish(message.NewMessage("2", "topic1", nil, message.WithConfirm(false))))
+	<-received
+	require.Equal(t, nil, provider.Publish(message.NewMessage("3", "topic1", nil)))
+	require.Equal(t, uint64(2), <-ack)
+	require.Equal(t, 0, len(nack))
+}
+
+func TestPublishNack(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	provider := NewProviderWithOptions(DefaultOptions().WithEndpoint("topic1", server.URL)).(*Provider)
+	require.Equal(t, nil, provider.Init(context.Background(), "test_svc", false, nil))
+	defer provider.Exit()
+
+	ack := make(chan uint64, 10)
+	nack := make(chan uint64, 10)
+	provider.NotifyConfirm(ack, nack)
+
+	require.Equal(t, nil, provider.Publish(message.NewMessage("1", "topic1", nil)))
+	require.Equal(t, uint64(1), <-nack)
+
+	// outbox 扫描重新发送
+	require.Equal(t, nil, provider.Publish(message.NewMessage("1", "topic1", nil)))
+	require.Equal(t, uint64(2), <-ack)
+}
+
+func TestPublishNoEndpoint(t *testing.T) {
+	provider := NewProvider(nil, nil)
+	err := provider.Publish(message.NewMessage("1", "topic1", nil))
+	require.True(t, errors.Is(err, ErrNoEndpoint))
+}
+
+func TestMaxConcurrency(t *testing.T) {
+	// 0 会阻塞所有请求，负数会 panic，都使用默认值
+	for _, val := range []int{0, -1} {
+		provider := NewProviderWithOptions(DefaultOptions().WithMaxConcurrency(val)).(*Provider)
+		require.Equal(t, DefaultOptions().MaxConcurrency, cap(provider.slots))
+		require.Equal(t, []string{"MaxConcurrency"}, provider.clamped)
+	}
+	provider := NewProviderWithOptions(DefaultOptions().WithMaxConcurrency(1)).(*Provider)
+	require.Equal(t, 1, cap(provider.slots))
+}
+
+func TestInitSubscribe(t *testing.T) {
+	provider := NewProvider(nil, nil)
+	require.Equal(t, ErrSubscribeNotSupported, provider.Init(context.Background(), "test_svc", false, []string{"topic1"}))
+}
+
+func TestVerify(t *testing.T) {
+	secret := []byte("secret")
+	body := []byte("payload")
+	timestamp := "1600000000"
+
+	header := http.Header{}
+	header.Set(HeaderTimestamp, timestamp)
+	header.Set(HeaderSignature, Sign(secret, timestamp, body))
+	require.True(t, Verify(secret, header, body, 0))
+	require.False(t, Verify(secret, header, body, time.Minute))
+	require.False(t, Verify([]byte("other"), header, body, 0))
+	require.False(t, Verify(secret, header, []byte("other"), 0))
+}
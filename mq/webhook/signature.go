@@ -0,0 +1,55 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// HeaderID 消息的 UUID，接收方可以用于去重
+	HeaderID = "X-Final-Id"
+	// HeaderTopic 消息的 topic
+	HeaderTopic = "X-Final-Topic"
+	// HeaderTimestamp 请求的 unix 时间戳（秒），参与签名
+	HeaderTimestamp = "X-Final-Timestamp"
+	// HeaderSignature 请求的签名，格式为 sha256=<hex>
+	HeaderSignature = "X-Final-Signature"
+
+	signaturePrefix = "sha256="
+)
+
+// Sign 使用 HMAC-SHA256 计算 "<timestamp>.<body>" 的签名
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify 接收方校验请求的签名，tolerance 大于 0 时拒绝时间戳与当前时间相差超过 tolerance 的请求
+func Verify(secret []byte, header http.Header, body []byte, tolerance time.Duration) bool {
+	timestamp := header.Get(HeaderTimestamp)
+	signature := header.Get(HeaderSignature)
+	if timestamp == "" || !strings.HasPrefix(signature, signaturePrefix) {
+		return false
+	}
+
+	if tolerance > 0 {
+		sec, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return false
+		}
+		diff := time.Since(time.Unix(sec, 0))
+		if diff > tolerance || diff < -tolerance {
+			return false
+		}
+	}
+
+	return hmac.Equal([]byte(signature), []byte(Sign(secret, timestamp, body)))
+}
@@ -1,6 +1,13 @@
 package final
 
-import "time"
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/xyctruth/final/logger"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
 
 type Options struct {
 	PurgeOnStartup bool // 启动Bus时是否清除遗留的消息，包含（mq遗留的消息，和本地消息表遗留的消息）
@@ -15,25 +22,83 @@ type Options struct {
 	OutboxScanInterval time.Duration // 扫描outbox没有收到ack的消息间隔
 	OutboxScanOffset   int64         // 扫描outbox没有收到ack的消息偏移量
 	OutboxScanAgoTime  time.Duration // 扫描多久之前的消息
+	// OutboxMaxUnroutable 消息被 mq 退回的最大次数，达到后消息记录标记为 parked，不再扫描发送，0 表示不限制
+	OutboxMaxUnroutable uint
+	// OrderedOutbox 开启后相同 key 的 Confirm 消息通过 outbox 依次发送
+	// 同一个 key 存在更早的待发送消息时，新消息只暂存在 outbox 中，等待前一条消息 ack 后再发送
+	OrderedOutbox bool
 
-	NumSubscriber int // subscriber number
+	NumSubscriber int // subscriber number，mq 驱动为每个 topic 使用独立的队列时为 topic 默认的 concurrency
 	NumAcker      int // acker number
+
+	// publisher opt
+	NumPublisher      int  // publisher worker number
+	PublishQueueSize  int  // 等待发送的消息队列长度
+	PublishBlocking   bool // 发送队列已满时 Publish 是否阻塞等待，false 时立即返回 ErrPublishQueueFull
+	ConfirmBufferSize int  // 接收 mq ack/nack 的 channel 长度
+
+	// MetricsRegisterer 注册 Prometheus 指标，为 nil 时不收集指标
+	MetricsRegisterer prometheus.Registerer
+
+	// TracerProvider 创建发布和消费消息的 span，为 nil 时使用 otel.GetTracerProvider()
+	TracerProvider trace.TracerProvider
+	// Propagator 在消息 Header 中传递 trace context，为 nil 时使用 W3C propagation.TraceContext
+	Propagator propagation.TextMapPropagator
+
+	// Logger Bus 和 mq 驱动的日志输出，为 nil 时使用 logrus 输出到 os.Stdout
+	Logger logger.Logger
+	// LogLevel 日志级别，低于 LogLevel 的日志会被过滤，零值为 logger.InfoLevel
+	LogLevel logger.Level
+
+	// RequestTimeout Bus.Request 等待回复的超时时间，ctx 设置了 deadline 时使用 ctx 的 deadline
+	RequestTimeout time.Duration
+
+	// HealthMaxOutboxLag outbox 中最早的待发送消息等待超过该时间时，健康状态为 degraded，0 表示不检查
+	HealthMaxOutboxLag time.Duration
 }
 
 // DefaultOptions bus 默认配置
 func DefaultOptions() Options {
 	return Options{
-		PurgeOnStartup:     false,
-		NumSubscriber:      5,
-		RetryCount:         3,
-		RetryInterval:      10 * time.Millisecond,
-		NumAcker:           5,
-		OutboxScanOffset:   500,
-		OutboxScanInterval: 1 * time.Minute,
-		OutboxScanAgoTime:  1 * time.Minute,
+		PurgeOnStartup:      false,
+		NumSubscriber:       5,
+		RetryCount:          3,
+		RetryInterval:       10 * time.Millisecond,
+		NumAcker:            5,
+		OutboxScanOffset:    500,
+		OutboxScanInterval:  1 * time.Minute,
+		OutboxScanAgoTime:   1 * time.Minute,
+		OutboxMaxUnroutable: 10,
+		NumPublisher:        5,
+		PublishQueueSize:    10000,
+		PublishBlocking:     true,
+		ConfirmBufferSize:   10000,
+		LogLevel:            logger.InfoLevel,
+		HealthMaxOutboxLag:  5 * time.Minute,
+		RequestTimeout:      30 * time.Second,
 	}
 }
 
+// clamp 把小于等于 0 的 NumPublisher、PublishQueueSize、ConfirmBufferSize 替换为默认值，返回被替换的字段
+// NumPublisher 为 0 时发送队列中的消息永远不会被发送
+func (opt Options) clamp() (Options, []string) {
+	def := DefaultOptions()
+	clamped := make([]string, 0)
+	if opt.NumPublisher <= 0 {
+		opt.NumPublisher = def.NumPublisher
+		clamped = append(clamped, "NumPublisher")
+	}
+	if opt.PublishQueueSize <= 0 {
+		opt.PublishQueueSize = def.PublishQueueSize
+		clamped = append(clamped, "PublishQueueSize")
+	}
+	if opt.ConfirmBufferSize <= 0 {
+		opt.ConfirmBufferSize = def.ConfirmBufferSize
+		clamped = append(clamped, "ConfirmBufferSize")
+	}
+	return opt, clamped
+}
+
 // WithRetryCount sets the retry count of message processing failed
 // Does not include the first attempt
 // The default value of RetryCount is 3.
@@ -51,6 +116,7 @@ func (opt Options) WithRetryInterval(val time.Duration) Options {
 
 // WithNumSubscriber sets the number of subscriber
 // Each subscriber runs in an independent goroutine
+// When the mq provider uses a queue per topic, it is the default concurrency of each topic, see routerTopic.Concurrency
 // The default value of NumSubscriber is 5.
 func (opt Options) WithNumSubscriber(val int) Options {
 	opt.NumSubscriber = val
@@ -65,6 +131,94 @@ func (opt Options) WithNumAcker(val int) Options {
 	return opt
 }
 
+// WithNumPublisher sets the number of publisher worker
+// Each publisher worker runs in an independent goroutine
+// The default value of NumPublisher is 5.
+func (opt Options) WithNumPublisher(val int) Options {
+	opt.NumPublisher = val
+	return opt
+}
+
+// WithPublishQueueSize 设置等待发送的消息队列长度
+// The default value of PublishQueueSize is 10000.
+func (opt Options) WithPublishQueueSize(val int) Options {
+	opt.PublishQueueSize = val
+	return opt
+}
+
+// WithPublishBlocking 设置发送队列已满时 Publish 是否阻塞等待
+// false 时立即返回 ErrPublishQueueFull
+// The default value of PublishBlocking is true.
+func (opt Options) WithPublishBlocking(val bool) Options {
+	opt.PublishBlocking = val
+	return opt
+}
+
+// WithConfirmBufferSize 设置接收 mq ack/nack 的 channel 长度
+// The default value of ConfirmBufferSize is 10000.
+func (opt Options) WithConfirmBufferSize(val int) Options {
+	opt.ConfirmBufferSize = val
+	return opt
+}
+
+// WithMetrics 设置注册 Prometheus 指标的 Registerer
+// The default value of MetricsRegisterer is nil, metrics are disabled.
+func (opt Options) WithMetrics(reg prometheus.Registerer) Options {
+	opt.MetricsRegisterer = reg
+	return opt
+}
+
+// WithTracerProvider 设置创建发布和消费消息 span 的 TracerProvider
+// The default value of TracerProvider is nil, otel.GetTracerProvider() is used.
+func (opt Options) WithTracerProvider(tp trace.TracerProvider) Options {
+	opt.TracerProvider = tp
+	return opt
+}
+
+// WithPropagator 设置在消息 Header 中传递 trace context 的 Propagator
+// The default value of Propagator is nil, W3C propagation.TraceContext is used.
+func (opt Options) WithPropagator(propagator propagation.TextMapPropagator) Options {
+	opt.Propagator = propagator
+	return opt
+}
+
+// WithLogger 设置 Bus 和 mq 驱动的日志输出
+// logger 包提供了 logrus、zap 和 log/slog 的适配
+// The default value of Logger is nil, logrus is used to write to os.Stdout.
+func (opt Options) WithLogger(l logger.Logger) Options {
+	opt.Logger = l
+	return opt
+}
+
+// WithLogLevel 设置日志级别
+// The default value of LogLevel is logger.InfoLevel.
+func (opt Options) WithLogLevel(level logger.Level) Options {
+	opt.LogLevel = level
+	return opt
+}
+
+// WithHealthMaxOutboxLag 设置 outbox 的最大延迟，超过时健康状态为 degraded
+// 0 表示不检查 outbox 延迟
+// The default value of HealthMaxOutboxLag is 5 minute.
+func (opt Options) WithHealthMaxOutboxLag(val time.Duration) Options {
+	opt.HealthMaxOutboxLag = val
+	return opt
+}
+
+// WithRequestTimeout 设置 Bus.Request 等待回复的超时时间
+// The default value of RequestTimeout is 30 second.
+func (opt Options) WithRequestTimeout(val time.Duration) Options {
+	opt.RequestTimeout = val
+	return opt
+}
+
+// WithOutboxMaxUnroutable 设置消息被 mq 退回的最大次数，达到后不再扫描发送，0 表示不限制
+// The default value of OutboxMaxUnroutable is 10.
+func (opt Options) WithOutboxMaxUnroutable(val uint) Options {
+	opt.OutboxMaxUnroutable = val
+	return opt
+}
+
 // WithOutboxScanInterval 设置扫描outbox没有收到ack的消息间隔
 // The default value of OutboxScanInterval is 1 minute.
 func (opt Options) WithOutboxScanInterval(val time.Duration) Options {
@@ -86,6 +240,14 @@ func (opt Options) WithOutboxScanAgoTime(val int64) Options {
 	return opt
 }
 
+// WithOrderedOutbox 设置是否通过 outbox 按 key 顺序发送消息
+// 只对设置了 message.WithKey 并且开启 Confirm 的消息生效
+// The default value of OrderedOutbox is false.
+func (opt Options) WithOrderedOutbox(val bool) Options {
+	opt.OrderedOutbox = val
+	return opt
+}
+
 // WithPurgeOnStartup  设置启动Bus时是否清除遗留的消息
 // 包含（mq遗留的消息，和本地消息表遗留的消息）
 // The default value of PurgeOnStartup is false.
@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/require"
+	"github.com/xyctruth/final/logger"
 )
 
 func TestOptions(t *testing.T) {
@@ -34,7 +35,55 @@ func TestOptions(t *testing.T) {
 	opt = opt.WithOutboxScanOffset(1)
 	require.Equal(t, int64(1), opt.OutboxScanOffset)
 
+	require.Equal(t, uint(10), opt.OutboxMaxUnroutable)
+	opt = opt.WithOutboxMaxUnroutable(0)
+	require.Equal(t, uint(0), opt.OutboxMaxUnroutable)
+
+	require.Equal(t, 5, opt.NumPublisher)
+	opt = opt.WithNumPublisher(1)
+	require.Equal(t, 1, opt.NumPublisher)
+
+	require.Equal(t, 10000, opt.PublishQueueSize)
+	opt = opt.WithPublishQueueSize(10)
+	require.Equal(t, 10, opt.PublishQueueSize)
+
+	require.Equal(t, true, opt.PublishBlocking)
+	opt = opt.WithPublishBlocking(false)
+	require.Equal(t, false, opt.PublishBlocking)
+
+	require.Equal(t, 10000, opt.ConfirmBufferSize)
+	opt = opt.WithConfirmBufferSize(100)
+	require.Equal(t, 100, opt.ConfirmBufferSize)
+
+	require.Equal(t, logger.InfoLevel, opt.LogLevel)
+	opt = opt.WithLogLevel(logger.DebugLevel)
+	require.Equal(t, logger.DebugLevel, opt.LogLevel)
+
+	require.Equal(t, nil, opt.Logger)
+	opt = opt.WithLogger(logger.Discard)
+	require.Equal(t, logger.Discard, opt.Logger)
+
+	require.Equal(t, 5*time.Minute, opt.HealthMaxOutboxLag)
+	opt = opt.WithHealthMaxOutboxLag(time.Minute)
+	require.Equal(t, time.Minute, opt.HealthMaxOutboxLag)
+
 	require.Equal(t, false, opt.PurgeOnStartup)
 	opt = opt.WithPurgeOnStartup(true)
 	require.Equal(t, true, opt.PurgeOnStartup)
 }
+
+func TestOptionsClamp(t *testing.T) {
+	opt, clamped := DefaultOptions().clamp()
+	require.Equal(t, 0, len(clamped))
+	require.Equal(t, DefaultOptions().NumPublisher, opt.NumPublisher)
+
+	opt, clamped = DefaultOptions().WithNumPublisher(0).WithPublishQueueSize(-1).WithConfirmBufferSize(0).clamp()
+	require.Equal(t, []string{"NumPublisher", "PublishQueueSize", "ConfirmBufferSize"}, clamped)
+	require.Equal(t, 5, opt.NumPublisher)
+	require.Equal(t, 10000, opt.PublishQueueSize)
+	require.Equal(t, 10000, opt.ConfirmBufferSize)
+
+	bus := New("test_svc", nil, &fakeProvider{}, Options{})
+	require.Equal(t, 5, bus.opt.NumPublisher)
+	require.Equal(t, 10000, cap(bus.publisher.queue))
+}
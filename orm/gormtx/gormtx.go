@@ -0,0 +1,59 @@
+package gormtx
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/xyctruth/final"
+	"gorm.io/gorm"
+)
+
+// ErrNotSQLTx gorm 事务的连接池不是 *sql.Tx，无法在同一个事务中暂存消息
+var ErrNotSQLTx = errors.New("connection pool of gorm transaction is not *sql.Tx")
+
+// Transaction 使用 db.Transaction 打开事务执行 fc，fc 返回 nil 时提交事务，否则回滚
+// tx.Statement.Context 中携带 final.TxBus，使用它调用 Bus.PublishCtx 发布的消息与 gorm 的修改在同一个事务中提交，
+// 事务提交后一次性发送到消息队列中
+//   db 已经在事务中时，gorm 使用 SavePoint 嵌套事务，消息在外层事务提交后由 outbox 扫描发送
+//   db 注册了 bus 的 Plugin 时使用事务绑定的 TxBus，由 Plugin 在事务提交后发送消息
+func Transaction(bus *final.Bus, db *gorm.DB, fc func(tx *gorm.DB) error, opts ...*sql.TxOptions) error {
+	_, nested := db.Statement.ConnPool.(gorm.TxCommitter)
+
+	var (
+		txBus   *final.TxBus
+		managed bool
+	)
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if pool, ok := tx.Statement.ConnPool.(*txConnPool); ok && pool.bus == bus {
+			txBus, managed = pool.getTxBus(), true
+		} else {
+			sqlTx, err := SQLTx(tx)
+			if err != nil {
+				return err
+			}
+			txBus = bus.WithTx(sqlTx)
+		}
+		return fc(tx.WithContext(final.ContextWithTxBus(tx.Statement.Context, txBus)))
+	}, opts...)
+	if err != nil {
+		return err
+	}
+
+	if !nested && !managed {
+		txBus.AfterCommit()
+	}
+	return nil
+}
+
+// SQLTx 返回 gorm 事务使用的 *sql.Tx，兼容 PrepareStmt 模式
+func SQLTx(tx *gorm.DB) (*sql.Tx, error) {
+	switch pool := tx.Statement.ConnPool.(type) {
+	case *sql.Tx:
+		return pool, nil
+	case *txConnPool:
+		return pool.Tx, nil
+	case *gorm.PreparedStmtTX:
+		return pool.Tx, nil
+	}
+	return nil, ErrNotSQLTx
+}
@@ -0,0 +1,69 @@
+package gormtx
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/xyctruth/final"
+	"github.com/xyctruth/final/_example"
+	"gorm.io/gorm"
+)
+
+func TestTransaction(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		wantErr   error
+		wantCount int32
+	}{
+		{name: "tx_error", err: errors.New("unknown"), wantErr: gorm.ErrRecordNotFound, wantCount: 0},
+		{name: "tx_no_error", err: nil, wantErr: nil, wantCount: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bus := final.New("test_svc", _example.NewDB(), _example.NewAmqp(), final.DefaultOptions().WithNumAcker(1).WithNumSubscriber(1).WithPurgeOnStartup(true))
+
+			var count int32
+			bus.Subscribe("GormTxCtxMessage").Handler(func(c *final.Context) error {
+				atomic.AddInt32(&count, 1)
+				return nil
+			})
+
+			err := bus.Start()
+			require.Equal(t, nil, err)
+
+			_example.InitLocalBusiness()
+			gormDB := _example.NewGormDB()
+
+			localBusiness := _example.LocalBusiness{
+				Remark: "gorm tx ctx message",
+			}
+
+			err = Transaction(bus, gormDB, func(tx *gorm.DB) error {
+				result := tx.Create(&localBusiness)
+				if result.Error != nil {
+					return result.Error
+				}
+
+				err := bus.PublishCtx(tx.Statement.Context, "GormTxCtxMessage", []byte("message"))
+				if err != nil {
+					return err
+				}
+				return tt.err
+			})
+			require.Equal(t, tt.err, err)
+
+			queryLocalBusiness := _example.LocalBusiness{}
+			err = gormDB.First(&queryLocalBusiness, localBusiness.Id).Error
+			require.Equal(t, tt.wantErr, err)
+			time.Sleep(1 * time.Second)
+			err = bus.Shutdown()
+			require.Equal(t, nil, err)
+			require.Equal(t, tt.wantCount, atomic.LoadInt32(&count))
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package gormtx
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+
+	"github.com/xyctruth/final"
+	"gorm.io/gorm"
+)
+
+// ErrUnsupportedConnPool gorm 的连接池不能开启 *sql.Tx 事务，例如开启了 PrepareStmt
+var ErrUnsupportedConnPool = errors.New("connection pool of gorm does not begin *sql.Tx")
+
+// Plugin gorm 插件，db 开启的每一个事务绑定一个 final.TxBus，TxBus 在事务中第一次使用时创建
+//   事务中 create、update、delete、query 语句的 Statement.Context 携带 TxBus，
+//   在模型的 hook（例如 AfterCreate）中使用 tx.Statement.Context 调用 Bus.PublishCtx 发布的消息与 gorm 的修改在同一个事务中提交
+//   事务提交后自动调用 TxBus.AfterCommit 发送暂存的消息，db.Transaction 和 db.Begin/Commit 都适用
+//   插件替换 db 的连接池，不支持 PrepareStmt
+type Plugin struct {
+	bus *final.Bus
+}
+
+// NewPlugin 创建 gorm 插件，使用 db.Use 注册
+func NewPlugin(bus *final.Bus) *Plugin {
+	return &Plugin{bus: bus}
+}
+
+func (p *Plugin) Name() string {
+	return "final:gormtx"
+}
+
+// Initialize 替换 db 的连接池并注册把 TxBus 放到 Statement.Context 中的 callback
+func (p *Plugin) Initialize(db *gorm.DB) error {
+	if _, ok := db.ConnPool.(gorm.TxBeginner); !ok {
+		return ErrUnsupportedConnPool
+	}
+	db.ConnPool = &connPool{ConnPool: db.ConnPool, bus: p.bus}
+	db.Statement.ConnPool = db.ConnPool
+
+	callback := db.Callback()
+	if err := callback.Create().After("gorm:begin_transaction").Before("gorm:before_create").Register("final:tx_bus", withTxBus); err != nil {
+		return err
+	}
+	if err := callback.Update().After("gorm:begin_transaction").Before("gorm:before_update").Register("final:tx_bus", withTxBus); err != nil {
+		return err
+	}
+	if err := callback.Delete().After("gorm:begin_transaction").Before("gorm:before_delete").Register("final:tx_bus", withTxBus); err != nil {
+		return err
+	}
+	return callback.Query().Before("gorm:query").Register("final:tx_bus", withTxBus)
+}
+
+// TxBusFromDB 返回 gorm 事务绑定的 TxBus，tx 不在 Plugin 开启的事务中时返回 false
+func TxBusFromDB(tx *gorm.DB) (*final.TxBus, bool) {
+	if pool, ok := tx.Statement.ConnPool.(*txConnPool); ok {
+		return pool.getTxBus(), true
+	}
+	return nil, false
+}
+
+// withTxBus 语句在 Plugin 开启的事务中执行时，把事务绑定的 TxBus 放到 Statement.Context 中
+// 从 Statement.Context 中取出 TxBus 时才创建，不发布消息的语句不创建 TxBus
+func withTxBus(db *gorm.DB) {
+	pool, ok := db.Statement.ConnPool.(*txConnPool)
+	if !ok {
+		return
+	}
+	if db.Statement.Context.Value(txConnPoolKey{}) == pool {
+		return
+	}
+	if _, ok := final.TxBusFromContext(db.Statement.Context); !ok {
+		ctx := context.WithValue(db.Statement.Context, txConnPoolKey{}, pool)
+		db.Statement.Context = final.ContextWithTxBusFunc(ctx, pool.getTxBus)
+	}
+}
+
+// txConnPoolKey Statement.Context 已经携带了 txConnPool 的 TxBus
+type txConnPoolKey struct{}
+
+// connPool 开启事务时为 *sql.Tx 绑定 TxBus
+type connPool struct {
+	gorm.ConnPool
+	bus *final.Bus
+}
+
+func (pool *connPool) BeginTx(ctx context.Context, opts *sql.TxOptions) (gorm.ConnPool, error) {
+	tx, err := pool.ConnPool.(gorm.TxBeginner).BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &txConnPool{Tx: tx, bus: pool.bus}, nil
+}
+
+// GetDBConn 返回被替换的 *sql.DB，db.DB() 仍然可用
+func (pool *connPool) GetDBConn() (*sql.DB, error) {
+	if connector, ok := pool.ConnPool.(gorm.GetDBConnector); ok {
+		return connector.GetDBConn()
+	}
+	if sqlDB, ok := pool.ConnPool.(*sql.DB); ok {
+		return sqlDB, nil
+	}
+	return nil, gorm.ErrInvalidDB
+}
+
+// txConnPool 提交事务后发送 TxBus 中暂存的消息
+type txConnPool struct {
+	*sql.Tx
+	bus   *final.Bus
+	mutex sync.Mutex
+	txBus *final.TxBus
+}
+
+// getTxBus 返回事务绑定的 TxBus，第一次调用时创建
+func (pool *txConnPool) getTxBus() *final.TxBus {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	if pool.txBus == nil {
+		pool.txBus = pool.bus.WithTx(pool.Tx)
+	}
+	return pool.txBus
+}
+
+// Commit 提交事务，没有使用过 TxBus 的事务（例如 gorm 的默认事务）不调用 AfterCommit
+func (pool *txConnPool) Commit() error {
+	if err := pool.Tx.Commit(); err != nil {
+		return err
+	}
+	pool.mutex.Lock()
+	txBus := pool.txBus
+	pool.mutex.Unlock()
+	if txBus != nil {
+		txBus.AfterCommit()
+	}
+	return nil
+}
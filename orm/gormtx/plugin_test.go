@@ -0,0 +1,138 @@
+package gormtx
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/xyctruth/final"
+	"github.com/xyctruth/final/_example"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+)
+
+// hookBusiness 在 AfterCreate 中使用 Statement.Context 携带的 TxBus 发布消息
+type hookBusiness struct {
+	_example.LocalBusiness
+}
+
+func (b *hookBusiness) AfterCreate(tx *gorm.DB) error {
+	txBus, ok := final.TxBusFromContext(tx.Statement.Context)
+	if !ok {
+		return errors.New("no TxBus in statement context")
+	}
+	return txBus.PublishCtx(tx.Statement.Context, "GormPluginMessage", []byte(b.Remark))
+}
+
+func openGormDB(t *testing.T, config *gorm.Config) (*sql.DB, *gorm.DB) {
+	sqlDB, err := sql.Open("mysql", _example.DefaultMysqlConnStr)
+	require.Equal(t, nil, err)
+	config.DisableAutomaticPing = true
+	db, err := gorm.Open(mysql.New(mysql.Config{Conn: sqlDB, SkipInitializeWithVersion: true}), config)
+	require.Equal(t, nil, err)
+	return sqlDB, db
+}
+
+func TestPluginInitialize(t *testing.T) {
+	bus := final.New("test_svc", nil, nil, final.DefaultOptions())
+
+	sqlDB, db := openGormDB(t, &gorm.Config{})
+	require.Equal(t, nil, db.Use(NewPlugin(bus)))
+	require.Equal(t, gorm.ErrRegistered, db.Use(NewPlugin(bus)))
+	got, err := db.DB()
+	require.Equal(t, nil, err)
+	require.Equal(t, sqlDB, got)
+
+	// PrepareStmt 的连接池不能开启 *sql.Tx 事务
+	_, db = openGormDB(t, &gorm.Config{PrepareStmt: true})
+	require.Equal(t, ErrUnsupportedConnPool, db.Use(NewPlugin(bus)))
+}
+
+func TestPluginWithTxBus(t *testing.T) {
+	bus := final.New("test_svc", nil, nil, final.DefaultOptions())
+	txBus := bus.WithTx(nil)
+
+	// 不在事务中的语句不携带 TxBus
+	db := &gorm.DB{Statement: &gorm.Statement{Context: context.Background()}}
+	withTxBus(db)
+	_, ok := final.TxBusFromContext(db.Statement.Context)
+	require.Equal(t, false, ok)
+
+	db = &gorm.DB{Statement: &gorm.Statement{Context: context.Background(), ConnPool: &txConnPool{bus: bus, txBus: txBus}}}
+	withTxBus(db)
+	got, ok := final.TxBusFromContext(db.Statement.Context)
+	require.Equal(t, true, ok)
+	require.Equal(t, txBus, got)
+
+	got, ok = TxBusFromDB(db)
+	require.Equal(t, true, ok)
+	require.Equal(t, txBus, got)
+
+	// TxBus 在第一次使用时创建，没有使用的事务提交时不调用 AfterCommit
+	pool := &txConnPool{bus: bus}
+	db = &gorm.DB{Statement: &gorm.Statement{Context: context.Background(), ConnPool: pool}}
+	withTxBus(db)
+	withTxBus(db)
+	require.Nil(t, pool.txBus)
+	got, ok = final.TxBusFromContext(db.Statement.Context)
+	require.Equal(t, true, ok)
+	require.NotNil(t, got)
+	require.Equal(t, pool.txBus, got)
+	got, ok = TxBusFromDB(db)
+	require.Equal(t, true, ok)
+	require.Equal(t, pool.txBus, got)
+}
+
+func TestPlugin(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		wantCount int32
+	}{
+		{name: "tx_error", err: errors.New("unknown"), wantCount: 0},
+		{name: "tx_no_error", err: nil, wantCount: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bus := final.New("test_svc", _example.NewDB(), _example.NewAmqp(), final.DefaultOptions().WithNumAcker(1).WithNumSubscriber(1).WithPurgeOnStartup(true))
+
+			var count int32
+			bus.Subscribe("GormPluginMessage").Handler(func(c *final.Context) error {
+				atomic.AddInt32(&count, 1)
+				return nil
+			})
+
+			err := bus.Start()
+			require.Equal(t, nil, err)
+
+			_example.InitLocalBusiness()
+			gormDB := _example.NewGormDB()
+			require.Equal(t, nil, gormDB.Use(NewPlugin(bus)))
+
+			// 没有使用 gormtx.Transaction，消息在 AfterCreate 和 TxBusFromDB 中发布
+			err = gormDB.Transaction(func(tx *gorm.DB) error {
+				if err := tx.Create(&hookBusiness{_example.LocalBusiness{Remark: "gorm plugin message"}}).Error; err != nil {
+					return err
+				}
+
+				txBus, ok := TxBusFromDB(tx)
+				require.Equal(t, true, ok)
+				if err := txBus.Publish("GormPluginMessage", []byte("message")); err != nil {
+					return err
+				}
+				return tt.err
+			})
+			require.Equal(t, tt.err, err)
+
+			time.Sleep(1 * time.Second)
+			err = bus.Shutdown()
+			require.Equal(t, nil, err)
+			require.Equal(t, tt.wantCount, atomic.LoadInt32(&count))
+		})
+	}
+}
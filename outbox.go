@@ -7,25 +7,53 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/lopezator/migrator"
-	"github.com/sirupsen/logrus"
 	"github.com/vmihailenco/msgpack/v5"
+	"github.com/xyctruth/final/logger"
 	"github.com/xyctruth/final/message"
 )
 
 const (
-	OutBoxRecordStatusPending uint8 = iota // 客户端发送消息，消息表中的默认状态， 等待 mq 的 confirm ack
+	OutBoxRecordStatusPending    uint8 = iota // 客户端发送消息，消息表中的默认状态， 等待 mq 的 confirm ack
+	OutBoxRecordStatusUnroutable              // 消息没有路由到任何队列，被 mq 退回，等待扫描重新发送
+	OutBoxRecordStatusParked                  // 消息被 mq 退回的次数达到 Options.OutboxMaxUnroutable，不再扫描发送，开启 OrderedOutbox 时阻塞相同 key 的后续消息
 )
 
+// outboxKeyMaxLen outbox 中消息 key 的最大长度
+const outboxKeyMaxLen = 255
+
+// deferredHeader 标记 OrderedOutbox 模式下暂缓发送的消息，消息只暂存在 outbox 中，由 relay 按顺序发送
+const deferredHeader = message.DeferredHeader
+
+// delayedHeader 保存延时消息的发送时间，消息到期后由 publisher 发送
+const delayedHeader = message.DelayedHeader
+
+// ErrKeyTooLong 开启 OrderedOutbox 时消息的 key 超过 outbox 的最大长度
+var ErrKeyTooLong = errors.New("message key is too long")
+
 // db发件箱，在未收到ack前消息会保存在 outbox 中
 type outbox struct {
 	db      *sql.DB
-	logger  *logrus.Entry
+	logger  logger.Logger
 	svcName string
 	name    string
 	bus     *Bus
+
+	// running 扫描 goroutine 是否在运行
+	running int32
+	// 最近一次扫描的时间和错误
+	scanMutex   sync.RWMutex
+	lastScanAt  time.Time
+	lastScanErr error
+	// lastStat 开启 metrics 时，最近一次扫描统计的 outbox 状态，由 outboxCollector 读取
+	lastStat outboxStat
+
+	// relay 前一条消息 ack 后，需要发送下一条消息的 key
+	relay chan string
 }
 
 // 初始化db发件箱
@@ -33,11 +61,12 @@ func newOutBox(svcName string, bus *Bus) *outbox {
 	outbox := &outbox{
 		db:  bus.db,
 		bus: bus,
-		logger: bus.logger.WithFields(logrus.Fields{
+		logger: bus.logger.WithFields(logger.Fields{
 			"module": "outbox",
 		}),
 		svcName: svcName,
 		name:    "final_" + svcName + "_outbox",
+		relay:   make(chan string, bus.opt.ConfirmBufferSize),
 	}
 	return outbox
 }
@@ -46,8 +75,14 @@ func (outbox *outbox) Start(ctx context.Context) error {
 	outbox.scanning()
 
 	outbox.logger.Info("outbox start success")
+	atomic.StoreInt32(&outbox.running, 1)
+	if outbox.bus.opt.OrderedOutbox {
+		go outbox.relaying(ctx)
+	}
 	go func() {
+		defer atomic.StoreInt32(&outbox.running, 0)
 		loop := time.NewTicker(outbox.bus.opt.OutboxScanInterval)
+		defer loop.Stop()
 		for {
 			select {
 			case <-ctx.Done():
@@ -82,6 +117,47 @@ func (outbox *outbox) init() error {
 					return err
 				},
 			},
+			&migrator.Migration{
+				Name: "add outbox msg_key",
+				Func: func(tx *sql.Tx) error {
+					alterSQL := `ALTER TABLE ` + outbox.name + `
+								ADD COLUMN msg_key varchar(255) NOT NULL DEFAULT '',
+								ADD INDEX idx_msg_key (msg_key, id);`
+
+					_, err := tx.Exec(alterSQL)
+					return err
+				},
+			},
+			&migrator.Migration{
+				Name: "add outbox msg_uuid",
+				Func: func(tx *sql.Tx) error {
+					alterSQL := `ALTER TABLE ` + outbox.name + `
+								ADD COLUMN msg_uuid varchar(64) NOT NULL DEFAULT '';`
+
+					_, err := tx.Exec(alterSQL)
+					return err
+				},
+			},
+			&migrator.Migration{
+				Name: "add outbox unroutable",
+				Func: func(tx *sql.Tx) error {
+					alterSQL := `ALTER TABLE ` + outbox.name + `
+								ADD COLUMN unroutable int NOT NULL DEFAULT 0;`
+
+					_, err := tx.Exec(alterSQL)
+					return err
+				},
+			},
+			&migrator.Migration{
+				Name: "add outbox deliver_at",
+				Func: func(tx *sql.Tx) error {
+					alterSQL := `ALTER TABLE ` + outbox.name + `
+								ADD COLUMN deliver_at datetime(3) null;`
+
+					_, err := tx.Exec(alterSQL)
+					return err
+				},
+			},
 		),
 	)
 
@@ -102,7 +178,7 @@ func (outbox *outbox) init() error {
 			return err
 		}
 		count, _ := n.RowsAffected()
-		outbox.logger.Infof("Applied %d purge!", count)
+		outbox.logger.WithField("count", count).Info("Applied purge!")
 	}
 
 	return nil
@@ -111,7 +187,7 @@ func (outbox *outbox) init() error {
 // scanning scan omission message
 func (outbox *outbox) scanning() {
 	outbox.logger.
-		WithFields(logrus.Fields{
+		WithFields(logger.Fields{
 			"offset":   outbox.bus.opt.OutboxScanOffset,
 			"interval": outbox.bus.opt.OutboxScanInterval}).
 		Info("scanning")
@@ -120,32 +196,181 @@ func (outbox *outbox) scanning() {
 	if err != nil {
 		outbox.logger.WithError(err).Error("outbox take record failure")
 	}
+
+	// 统计随扫描进行，采集 metrics 时不查询数据库
+	var stat outboxStat
+	if outbox.bus.metrics != nil {
+		stat = outbox.collectStat()
+	}
+
+	outbox.scanMutex.Lock()
+	outbox.lastScanAt = time.Now()
+	outbox.lastScanErr = err
+	outbox.lastStat = stat
+	outbox.scanMutex.Unlock()
+
 	if len(msgs) > 0 {
+		for _, msg := range msgs {
+			outbox.bus.hooks.republished(msg)
+		}
 		outbox.bus.publisher.publish(msgs...)
 	}
 }
 
 // 暂存消息到db发件箱中
 func (outbox *outbox) staging(tx *sql.Tx, message *message.Message) error {
+	return outbox.stagingBatch(tx, message)
+}
+
+// stagingBatch 使用一条多行 INSERT 暂存多条消息到db发件箱中
+// tx 为 nil 时在新的事务中暂存并提交，否则由 tx 的调用者提交，提交后回调 OnStaged
+func (outbox *outbox) stagingBatch(tx *sql.Tx, msgs ...*message.Message) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+
 	err := outbox.transaction(tx, func(tx *sql.Tx) error {
-		record, err := newOutBoxRecord(message)
-		if err != nil {
-			return err
+		placeholders := make([]string, 0, len(msgs))
+		args := make([]interface{}, 0, len(msgs)*7)
+		for _, msg := range msgs {
+			record, err := newOutBoxRecord(msg)
+			if err != nil {
+				return err
+			}
+			if outbox.bus.opt.OrderedOutbox {
+				record.Key = msg.Key()
+				if len(record.Key) > outboxKeyMaxLen {
+					return ErrKeyTooLong
+				}
+			}
+			// 延时消息没有发送过，last_send_at 为 NULL，到期后由 publisher 或者扫描发送
+			if record.DeliverAt.Valid {
+				msg.Header.Set(delayedHeader, record.DeliverAt.Time)
+			}
+			lastSendAt := sql.NullTime{Time: record.CreateAt, Valid: !record.DeliverAt.Valid}
+			placeholders = append(placeholders, "(?,?,?,?,?,?,?)")
+			args = append(args, record.Message, record.Status, record.CreateAt, lastSendAt, record.DeliverAt, record.Key, msg.UUID)
 		}
-		result, err := tx.Exec("INSERT INTO "+outbox.name+" (message,status,create_at,last_send_at) VALUES (?,?,?,?)",
-			record.Message, record.Status, record.CreateAt, record.CreateAt)
+
+		result, err := tx.Exec("INSERT INTO "+outbox.name+" (message,status,create_at,last_send_at,deliver_at,msg_key,msg_uuid) VALUES "+strings.Join(placeholders, ","), args...)
 		if err != nil {
 			return err
 		}
-		id, err := result.LastInsertId()
+		ids, err := outbox.insertedIDs(tx, result, msgs)
 		if err != nil {
 			return err
 		}
 
-		message.Header.Set("record_id", id)
+		for i, msg := range msgs {
+			msg.Header.Set("record_id", ids[i])
+		}
+
+		if outbox.bus.opt.OrderedOutbox {
+			return outbox.deferOrdered(tx, ids, msgs)
+		}
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+
+	if tx == nil {
+		for _, msg := range msgs {
+			outbox.bus.hooks.staged(msg)
+		}
+	}
+	return nil
+}
+
+// insertedIDs 返回多行 INSERT 中每条消息记录的id
+// auto_increment_increment 大于 1 或者 innodb_autoinc_lock_mode 为 2 时，同一条 INSERT 的自增id不一定连续，
+// 多行时使用消息的 uuid 查询，LastInsertId 是这条 INSERT 分配的最小id
+func (outbox *outbox) insertedIDs(tx *sql.Tx, result sql.Result, msgs []*message.Message) ([]int64, error) {
+	firstID, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) == 1 {
+		return []int64{firstID}, nil
+	}
+
+	placeholders := make([]string, 0, len(msgs))
+	args := make([]interface{}, 0, len(msgs)+1)
+	args = append(args, firstID)
+	for _, msg := range msgs {
+		placeholders = append(placeholders, "?")
+		args = append(args, msg.UUID)
+	}
+	querySQL := fmt.Sprintf("SELECT id,msg_uuid FROM %s WHERE id >= ? AND msg_uuid IN (%s)", outbox.name, strings.Join(placeholders, ","))
+	rows, err := tx.Query(querySQL, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	uuidIDs := make(map[string]int64, len(msgs))
+	for rows.Next() {
+		var (
+			id   int64
+			uuid string
+		)
+		if err = rows.Scan(&id, &uuid); err != nil {
+			return nil, err
+		}
+		uuidIDs[uuid] = id
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	ids := make([]int64, 0, len(msgs))
+	for _, msg := range msgs {
+		id, ok := uuidIDs[msg.UUID]
+		if !ok {
+			return nil, fmt.Errorf("outbox record of message %s not found", msg.UUID)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
 
+// deferOrdered 同一个 key 存在更早的消息记录时，标记消息暂缓发送
+// 锁定读会等待其它事务中更早的同 key 消息记录提交，保证相同 key 的消息按 id 顺序发送
+// 暂缓发送的消息记录 last_send_at 为 NULL，表示消息还没有发送过，前一条消息记录删除后可以立即发送
+func (outbox *outbox) deferOrdered(tx *sql.Tx, ids []int64, msgs []*message.Message) error {
+	checked := make(map[string]struct{})
+	deferredIDs := make([]string, 0)
+	for i, msg := range msgs {
+		key := msg.Key()
+		if key == "" {
+			continue
+		}
+		if _, ok := checked[key]; ok {
+			// 同一批中更早的消息使用了相同的 key
+			msg.Header.Set(deferredHeader, true)
+			deferredIDs = append(deferredIDs, strconv.FormatInt(ids[i], 10))
+			continue
+		}
+		checked[key] = struct{}{}
+
+		var olderID int64
+		querySQL := fmt.Sprintf("SELECT id FROM %s WHERE msg_key = ? AND id < ? ORDER BY id ASC LIMIT 1 FOR UPDATE", outbox.name)
+		err := tx.QueryRow(querySQL, key, ids[i]).Scan(&olderID)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		msg.Header.Set(deferredHeader, true)
+		deferredIDs = append(deferredIDs, strconv.FormatInt(ids[i], 10))
+	}
+
+	if len(deferredIDs) == 0 {
+		return nil
+	}
+	updateSQL := fmt.Sprintf("UPDATE %s SET last_send_at = NULL WHERE ID IN (%s)", outbox.name, strings.Join(deferredIDs, ","))
+	_, err := tx.Exec(updateSQL)
 	return err
 }
 
@@ -162,15 +387,49 @@ func (outbox *outbox) done(tx *sql.Tx, id interface{}) error {
 	return err
 }
 
-// 获取没有收到ack的消息，准备重新发送到mq中
+// unroutable 消息被 mq 退回后，标记消息记录为 unroutable
+// 退回次数达到 Options.OutboxMaxUnroutable 时标记为 parked，不再扫描发送
+func (outbox *outbox) unroutable(tx *sql.Tx, id interface{}) error {
+	return outbox.transaction(tx, func(tx *sql.Tx) error {
+		var count uint
+		err := tx.QueryRow("SELECT unroutable FROM "+outbox.name+" WHERE ID = ? FOR UPDATE", id).Scan(&count)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		count++
+		status := OutBoxRecordStatusUnroutable
+		if max := outbox.bus.opt.OutboxMaxUnroutable; max > 0 && count >= max {
+			status = OutBoxRecordStatusParked
+			outbox.logger.WithField("recordID", id).WithField("unroutable", count).Warn("record parked, message returned too many times")
+		}
+		_, err = tx.Exec("UPDATE "+outbox.name+" SET status = ?, unroutable = ? WHERE ID = ?", status, count, id)
+		return err
+	})
+}
+
+// 获取没有收到ack的消息，包括被 mq 退回的消息和暂缓发送的消息，准备重新发送到mq中
 func (outbox *outbox) take(tx *sql.Tx, offset int64, ago time.Duration) ([]*message.Message, error) {
 	msgs := make([]*message.Message, 0)
 
-	var datetime = time.Now().Add(-ago)
+	var now = time.Now()
+	var datetime = now.Add(-ago)
 
 	err := outbox.transaction(tx, func(tx *sql.Tx) error {
-		querySQL := fmt.Sprintf("SELECT id,message,status,create_at FROM %s WHERE  status = ? AND last_send_at < ? ORDER BY id ASC LIMIT ? FOR UPDATE", outbox.name)
-		rows, err := tx.Query(querySQL, OutBoxRecordStatusPending, datetime, offset)
+		querySQL := fmt.Sprintf("SELECT id,message,status,create_at FROM %s WHERE  status IN (?,?) AND (last_send_at IS NULL OR last_send_at < ?) "+
+			"AND (deliver_at IS NULL OR deliver_at <= ?) ORDER BY id ASC LIMIT ? FOR UPDATE", outbox.name)
+		if outbox.bus.opt.OrderedOutbox {
+			// 相同 key 的消息只发送最早的一条，其余的消息等待前一条 ack 后由 relay 发送
+			// 更早的消息记录不论状态，parked 的消息记录同样阻塞相同 key 的后续消息，直到被 Bus.ReleaseParked 或 Bus.DeleteParked 处理
+			querySQL = fmt.Sprintf("SELECT id,message,status,create_at FROM %[1]s o WHERE o.status IN (?,?) AND (o.last_send_at IS NULL OR o.last_send_at < ?) "+
+				"AND (o.deliver_at IS NULL OR o.deliver_at <= ?) "+
+				"AND (o.msg_key = '' OR NOT EXISTS (SELECT 1 FROM %[1]s p WHERE p.msg_key = o.msg_key AND p.id < o.id)) "+
+				"ORDER BY o.id ASC LIMIT ? FOR UPDATE", outbox.name)
+		}
+		rows, err := tx.Query(querySQL, OutBoxRecordStatusPending, OutBoxRecordStatusUnroutable, datetime, now, offset)
 
 		if err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
@@ -203,8 +462,8 @@ func (outbox *outbox) take(tx *sql.Tx, offset int64, ago time.Duration) ([]*mess
 
 		if len(ids) > 0 {
 			whereStr := strings.Join(ids, ",")
-			updateSQL := fmt.Sprintf("UPDATE %s SET last_send_at = ? WHERE ID IN (%s)", outbox.name, whereStr)
-			_, err = tx.Exec(updateSQL, time.Now())
+			updateSQL := fmt.Sprintf("UPDATE %s SET last_send_at = ?, status = ? WHERE ID IN (%s)", outbox.name, whereStr)
+			_, err = tx.Exec(updateSQL, now, OutBoxRecordStatusPending)
 			if err != nil {
 				return err
 			}
@@ -215,6 +474,230 @@ func (outbox *outbox) take(tx *sql.Tx, offset int64, ago time.Duration) ([]*mess
 	return msgs, err
 }
 
+// next 获取 key 最早的一条消息记录，准备发送到mq中
+// 没有消息记录、最早的消息记录已经 parked、没有到延时发送的时间或者已经发送并且还在等待 confirm（OutboxScanAgoTime 内发送过）时返回 nil
+func (outbox *outbox) next(tx *sql.Tx, key string) (*message.Message, error) {
+	var msg *message.Message
+	err := outbox.transaction(tx, func(tx *sql.Tx) error {
+		var (
+			id       int64
+			msgBytes []byte
+			status   uint8
+			sendable bool
+		)
+		now := time.Now()
+		querySQL := fmt.Sprintf("SELECT id,message,status,(last_send_at IS NULL OR last_send_at < ?) AND (deliver_at IS NULL OR deliver_at <= ?) "+
+			"FROM %s WHERE msg_key = ? ORDER BY id ASC LIMIT 1 FOR UPDATE", outbox.name)
+		err := tx.QueryRow(querySQL, now.Add(-outbox.bus.opt.OutboxScanAgoTime), now, key).Scan(&id, &msgBytes, &status, &sendable)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if status == OutBoxRecordStatusParked {
+			outbox.logger.WithField("key", key).WithField("recordID", id).Warn("key is blocked by parked record")
+			return nil
+		}
+		if status != OutBoxRecordStatusPending && status != OutBoxRecordStatusUnroutable || !sendable {
+			// 消息记录在等待 confirm、被退回后等待扫描重新发送，或者等待延时发送
+			return nil
+		}
+
+		msg = &message.Message{}
+		if err = msgpack.Unmarshal(msgBytes, msg); err != nil {
+			return err
+		}
+		msg.Header.Set("record_id", id)
+
+		updateSQL := fmt.Sprintf("UPDATE %s SET last_send_at = ?, status = ? WHERE ID = ?", outbox.name)
+		_, err = tx.Exec(updateSQL, time.Now(), OutBoxRecordStatusPending, id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// claim 延时消息到期后标记消息记录为已发送，消息记录已经被扫描发送或者已经删除时返回 false
+func (outbox *outbox) claim(tx *sql.Tx, id interface{}) (bool, error) {
+	var claimed bool
+	err := outbox.transaction(tx, func(tx *sql.Tx) error {
+		updateSQL := fmt.Sprintf("UPDATE %s SET last_send_at = ? WHERE ID = ? AND status = ? AND last_send_at IS NULL", outbox.name)
+		result, err := tx.Exec(updateSQL, time.Now(), id, OutBoxRecordStatusPending)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		claimed = n > 0
+		return err
+	})
+	return claimed, err
+}
+
+// notify 前一条消息 ack 后通知 relay 发送 key 的下一条消息
+// relay 繁忙时丢弃通知，消息等待扫描发送
+func (outbox *outbox) notify(key string) {
+	select {
+	case outbox.relay <- key:
+	default:
+		outbox.logger.WithField("key", key).Warn("outbox relay is busy, waiting for scanning")
+	}
+}
+
+// relaying 依次发送前一条消息已经 ack 的 key 的下一条消息
+func (outbox *outbox) relaying(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case key := <-outbox.relay:
+			msg, err := outbox.next(nil, key)
+			if err != nil {
+				outbox.logger.WithError(err).WithField("key", key).Error("outbox relay take record failure")
+				continue
+			}
+			if msg != nil {
+				outbox.bus.publisher.publish(msg)
+			}
+		}
+	}
+}
+
+// stat 返回 outbox 中待发送消息（包括被 mq 退回的消息，不包括没有到期的延时消息）的数量和最早的创建时间，outbox 为空时 oldest 无效
+// 延时消息的创建时间为到期的时间
+func (outbox *outbox) stat() (int64, sql.NullTime, error) {
+	return outbox.statContext(context.Background())
+}
+
+func (outbox *outbox) statContext(ctx context.Context) (int64, sql.NullTime, error) {
+	var (
+		count  int64
+		oldest sql.NullTime
+	)
+	querySQL := fmt.Sprintf("SELECT COUNT(*), MIN(COALESCE(deliver_at, create_at)) FROM %s WHERE status IN (?,?) AND (deliver_at IS NULL OR deliver_at <= ?)", outbox.name)
+	err := outbox.db.QueryRowContext(ctx, querySQL, OutBoxRecordStatusPending, OutBoxRecordStatusUnroutable, time.Now()).Scan(&count, &oldest)
+	return count, oldest, err
+}
+
+// parked 返回 outbox 中 parked 的消息记录数量
+func (outbox *outbox) parked() (int64, error) {
+	var count int64
+	err := outbox.db.QueryRow("SELECT COUNT(*) FROM "+outbox.name+" WHERE status = ?", OutBoxRecordStatusParked).Scan(&count)
+	return count, err
+}
+
+// outboxStat outbox 的积压数量、最早的待发送消息和 parked 数量
+type outboxStat struct {
+	backlog int64
+	oldest  sql.NullTime
+	parked  int64
+	err     error
+}
+
+// collectStat 查询 outbox 的状态
+func (outbox *outbox) collectStat() outboxStat {
+	var stat outboxStat
+	stat.backlog, stat.oldest, stat.err = outbox.stat()
+	if stat.err == nil {
+		stat.parked, stat.err = outbox.parked()
+	}
+	if stat.err != nil {
+		outbox.logger.WithError(stat.err).Error("outbox stat failure")
+	}
+	return stat
+}
+
+// cachedStat 返回最近一次扫描统计的 outbox 状态
+func (outbox *outbox) cachedStat() outboxStat {
+	outbox.scanMutex.RLock()
+	defer outbox.scanMutex.RUnlock()
+	return outbox.lastStat
+}
+
+// ParkedRecord outbox 中被 mq 退回次数达到 Options.OutboxMaxUnroutable 的消息记录
+type ParkedRecord struct {
+	ID         int64
+	UUID       string
+	Topic      string
+	Key        string
+	Unroutable uint
+	CreateAt   time.Time
+}
+
+// ParkedRecords 按 id 顺序返回最多 limit 条 parked 的消息记录
+// 开启 OrderedOutbox 时，parked 的消息记录阻塞相同 key 的后续消息，需要使用 ReleaseParked 重新发送或者 DeleteParked 删除
+func (bus *Bus) ParkedRecords(limit int) ([]ParkedRecord, error) {
+	querySQL := fmt.Sprintf("SELECT id,message,unroutable,create_at FROM %s WHERE status = ? ORDER BY id ASC LIMIT ?", bus.outbox.name)
+	rows, err := bus.db.Query(querySQL, OutBoxRecordStatusParked, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := make([]ParkedRecord, 0)
+	for rows.Next() {
+		var (
+			record   ParkedRecord
+			msgBytes []byte
+		)
+		if err = rows.Scan(&record.ID, &msgBytes, &record.Unroutable, &record.CreateAt); err != nil {
+			return nil, err
+		}
+		msg := &message.Message{}
+		if err = msgpack.Unmarshal(msgBytes, msg); err != nil {
+			return nil, err
+		}
+		record.UUID = msg.UUID
+		record.Topic = msg.Topic
+		record.Key = msg.Key()
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+// ReleaseParked 把 parked 的消息记录恢复为待发送并清零退回次数，由下一次扫描重新发送，返回恢复的消息记录数量
+func (bus *Bus) ReleaseParked(ids ...int64) (int64, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	updateSQL := fmt.Sprintf("UPDATE %s SET status = ?, unroutable = 0, last_send_at = NULL WHERE status = ? AND ID IN (%s)", bus.outbox.name, joinIDs(ids))
+	result, err := bus.db.Exec(updateSQL, OutBoxRecordStatusPending, OutBoxRecordStatusParked)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// DeleteParked 删除 parked 的消息记录，相同 key 的后续消息由下一次扫描发送，返回删除的消息记录数量
+func (bus *Bus) DeleteParked(ids ...int64) (int64, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	deleteSQL := fmt.Sprintf("DELETE FROM %s WHERE status = ? AND ID IN (%s)", bus.outbox.name, joinIDs(ids))
+	result, err := bus.db.Exec(deleteSQL, OutBoxRecordStatusParked)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func joinIDs(ids []int64) string {
+	strs := make([]string, 0, len(ids))
+	for _, id := range ids {
+		strs = append(strs, strconv.FormatInt(id, 10))
+	}
+	return strings.Join(strs, ",")
+}
+
+// lastScan 返回最近一次扫描的时间和错误
+func (outbox *outbox) lastScan() (time.Time, error) {
+	outbox.scanMutex.RLock()
+	defer outbox.scanMutex.RUnlock()
+	return outbox.lastScanAt, outbox.lastScanErr
+}
+
 func (outbox *outbox) transaction(tx *sql.Tx, fc func(tx *sql.Tx) error) error {
 	needCommit := false
 	if tx == nil {
@@ -246,6 +729,9 @@ type outBoxRecord struct {
 	Message  []byte    `gorm:"message"`
 	Status   uint8     `gorm:"status"`
 	CreateAt time.Time `gorm:"create_at"`
+	Key      string    `gorm:"msg_key"`
+	// DeliverAt 延时消息的发送时间
+	DeliverAt sql.NullTime `gorm:"deliver_at"`
 }
 
 func newOutBoxRecord(message *message.Message) (*outBoxRecord, error) {
@@ -253,9 +739,13 @@ func newOutBoxRecord(message *message.Message) (*outBoxRecord, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &outBoxRecord{
+	record := &outBoxRecord{
 		Message:  messageByte,
 		Status:   OutBoxRecordStatusPending,
 		CreateAt: time.Now(),
-	}, nil
+	}
+	if message.Policy.Delay > 0 {
+		record.DeliverAt = sql.NullTime{Time: record.CreateAt.Add(time.Duration(message.Policy.Delay) * time.Millisecond), Valid: true}
+	}
+	return record, nil
 }
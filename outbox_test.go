@@ -1,6 +1,7 @@
 package final
 
 import (
+	"strings"
 	"testing"
 	"time"
 
@@ -48,3 +49,136 @@ func TestOutBox(t *testing.T) {
 	require.Equal(t, nil, err)
 	require.Equal(t, 4, len(msgs))
 }
+
+func TestOutBoxStagingBatch(t *testing.T) {
+	bus := New("test_svc", _example.NewDB(), _example.NewAmqp(), DefaultOptions().WithPurgeOnStartup(true))
+
+	err := bus.outbox.init()
+	require.Equal(t, nil, err)
+
+	msgs := []*message.Message{
+		message.NewMessage("0", "", nil),
+		message.NewMessage("1", "", nil),
+		message.NewMessage("2", "", nil),
+	}
+	err = bus.outbox.stagingBatch(nil, msgs...)
+	require.Equal(t, nil, err)
+
+	// 同一条 INSERT 的自增id递增，但不一定连续
+	require.Less(t, msgs[0].Header.Get("record_id").(int64), msgs[1].Header.Get("record_id").(int64))
+	require.Less(t, msgs[1].Header.Get("record_id").(int64), msgs[2].Header.Get("record_id").(int64))
+
+	time.Sleep(time.Second)
+
+	taken, err := bus.outbox.take(nil, 100, time.Second)
+	require.Equal(t, nil, err)
+	require.Equal(t, 3, len(taken))
+	for i, msg := range taken {
+		require.Equal(t, msgs[i].UUID, msg.UUID)
+		require.Equal(t, msgs[i].Header.Get("record_id"), msg.Header.Get("record_id"))
+	}
+}
+
+func TestOutBoxOrdered(t *testing.T) {
+	bus := New("test_svc", _example.NewDB(), _example.NewAmqp(), DefaultOptions().WithPurgeOnStartup(true).WithOrderedOutbox(true))
+
+	err := bus.outbox.init()
+	require.Equal(t, nil, err)
+
+	msgs := []*message.Message{
+		message.NewMessage("0", "", nil, message.WithKey("a")),
+		message.NewMessage("1", "", nil, message.WithKey("b")),
+		message.NewMessage("2", "", nil, message.WithKey("a")),
+		message.NewMessage("3", "", nil),
+	}
+	err = bus.outbox.stagingBatch(nil, msgs...)
+	require.Equal(t, nil, err)
+	_, deferred := msgs[2].Header[deferredHeader]
+	require.Equal(t, true, deferred)
+
+	msg := message.NewMessage("4", "", nil, message.WithKey("b"))
+	err = bus.outbox.staging(nil, msg)
+	require.Equal(t, nil, err)
+	_, deferred = msg.Header[deferredHeader]
+	require.Equal(t, true, deferred)
+
+	time.Sleep(time.Second)
+
+	// 相同 key 的消息只扫描最早的一条
+	taken, err := bus.outbox.take(nil, 100, time.Second)
+	require.Equal(t, nil, err)
+	require.Equal(t, 3, len(taken))
+	require.Equal(t, "0", taken[0].UUID)
+	require.Equal(t, "1", taken[1].UUID)
+	require.Equal(t, "3", taken[2].UUID)
+
+	err = bus.outbox.done(nil, taken[0].Header.Get("record_id"))
+	require.Equal(t, nil, err)
+	next, err := bus.outbox.next(nil, "a")
+	require.Equal(t, nil, err)
+	require.Equal(t, "2", next.UUID)
+
+	err = bus.outbox.staging(nil, message.NewMessage("5", "", nil, message.WithKey(strings.Repeat("k", outboxKeyMaxLen+1))))
+	require.Equal(t, ErrKeyTooLong, err)
+}
+
+func TestOutBoxOrderedParked(t *testing.T) {
+	bus := New("test_svc", _example.NewDB(), _example.NewAmqp(), DefaultOptions().WithPurgeOnStartup(true).WithOrderedOutbox(true).WithOutboxMaxUnroutable(1))
+
+	err := bus.outbox.init()
+	require.Equal(t, nil, err)
+
+	first := message.NewMessage("0", "", nil, message.WithKey("a"))
+	second := message.NewMessage("1", "", nil, message.WithKey("a"))
+	err = bus.outbox.stagingBatch(nil, first, second)
+	require.Equal(t, nil, err)
+
+	// 最早的消息记录等待 confirm 时不重复发送
+	next, err := bus.outbox.next(nil, "a")
+	require.Equal(t, nil, err)
+	require.Nil(t, next)
+
+	firstID := first.Header.Get("record_id").(int64)
+	err = bus.outbox.unroutable(nil, firstID)
+	require.Equal(t, nil, err)
+	parked, err := bus.outbox.parked()
+	require.Equal(t, nil, err)
+	require.Equal(t, int64(1), parked)
+
+	// parked 的消息记录阻塞相同 key 的后续消息
+	time.Sleep(time.Second)
+	taken, err := bus.outbox.take(nil, 100, time.Second)
+	require.Equal(t, nil, err)
+	require.Equal(t, 0, len(taken))
+	next, err = bus.outbox.next(nil, "a")
+	require.Equal(t, nil, err)
+	require.Nil(t, next)
+
+	records, err := bus.ParkedRecords(10)
+	require.Equal(t, nil, err)
+	require.Equal(t, 1, len(records))
+	require.Equal(t, firstID, records[0].ID)
+	require.Equal(t, "a", records[0].Key)
+
+	n, err := bus.ReleaseParked(firstID)
+	require.Equal(t, nil, err)
+	require.Equal(t, int64(1), n)
+	taken, err = bus.outbox.take(nil, 100, time.Second)
+	require.Equal(t, nil, err)
+	require.Equal(t, 1, len(taken))
+	require.Equal(t, "0", taken[0].UUID)
+
+	err = bus.outbox.unroutable(nil, firstID)
+	require.Equal(t, nil, err)
+	n, err = bus.DeleteParked(firstID)
+	require.Equal(t, nil, err)
+	require.Equal(t, int64(1), n)
+
+	// 暂缓发送的消息没有发送过，前一条消息记录删除后立即发送
+	next, err = bus.outbox.next(nil, "a")
+	require.Equal(t, nil, err)
+	require.Equal(t, "1", next.UUID)
+	next, err = bus.outbox.next(nil, "a")
+	require.Equal(t, nil, err)
+	require.Nil(t, next)
+}
@@ -2,83 +2,418 @@ package final
 
 import (
 	"context"
+	"errors"
 	"sync"
 	"sync/atomic"
+	"time"
 
-	"github.com/sirupsen/logrus"
+	"github.com/xyctruth/final/logger"
 	"github.com/xyctruth/final/message"
+	"github.com/xyctruth/final/mq"
 )
 
+// ErrPublishQueueFull 发送队列已满，并且 Options.PublishBlocking 为 false
+var ErrPublishQueueFull = errors.New("publish queue is full")
+
 // publisher 发送消息到消息队列中
+// 启动 Options.NumPublisher 个 goroutine 从长度为 Options.PublishQueueSize 的队列中取出消息发送
 type publisher struct {
-	logger   *logrus.Entry
-	ack      chan uint64
-	nack     chan uint64
-	pending  sync.Map
+	logger  logger.Logger
+	ack     chan uint64
+	nack    chan uint64
+	// unroutable 被 mq 退回的消息的 confirm，mq 驱动没有实现 mq.IUnroutableNotifier 时为 nil
+	unroutable chan uint64
+	pending sync.Map // sequence -> *pendingConfirm
+	// pendingCount 等待 confirm 的消息数量
+	pendingCount int64
+
+	// mutex 保证 mqProvider.Publish 的顺序与 sequence 的递增顺序一致
+	mutex    sync.Mutex
 	sequence uint64
-	bus      *Bus
+
+	// slots 限制等待发送的消息数量，queue 中的每条消息都占用一个 slot
+	slots chan struct{}
+	queue chan *message.Message
+
+	// unblocked 在连接被 broker 阻塞时为未关闭的 channel
+	blockMutex sync.RWMutex
+	unblocked  chan struct{}
+
+	done <-chan struct{}
+	bus  *Bus
+	// running publisher worker 是否在运行
+	running int32
+}
+
+// pendingConfirm 等待 mq confirm 的消息
+type pendingConfirm struct {
+	recordID interface{}
+	uuid     string
+	topic    string
+	// key 消息的 key，OrderedOutbox 模式下 ack 后发送相同 key 的下一条消息
+	key string
+	// msg 消息的副本，只在 Bus 添加了 Hook 时保存
+	msg *message.Message
 }
 
 func newPublisher(bus *Bus) *publisher {
+	unblocked := make(chan struct{})
+	close(unblocked)
+
 	return &publisher{
-		logger: bus.logger.WithFields(logrus.Fields{
+		logger: bus.logger.WithFields(logger.Fields{
 			"module": "publisher",
 		}),
-
-		bus: bus,
+		slots:     make(chan struct{}, bus.opt.PublishQueueSize),
+		queue:     make(chan *message.Message, bus.opt.PublishQueueSize),
+		unblocked: unblocked,
+		bus:       bus,
 	}
 }
 
 func (p *publisher) Start(ctx context.Context) error {
-	p.ack = make(chan uint64, 10000)
-	p.nack = make(chan uint64, 10000)
+	p.done = ctx.Done()
+	p.ack = make(chan uint64, p.bus.opt.ConfirmBufferSize)
+	p.nack = make(chan uint64, p.bus.opt.ConfirmBufferSize)
 	p.bus.mqProvider.NotifyConfirm(p.ack, p.nack)
+
+	if notifier, ok := p.bus.mqProvider.(mq.IReturnNotifier); ok {
+		returned := make(chan *message.Message, p.bus.opt.ConfirmBufferSize)
+		notifier.NotifyReturn(returned)
+		go p.watchReturned(ctx, returned)
+	}
+
+	if notifier, ok := p.bus.mqProvider.(mq.IUnroutableNotifier); ok {
+		p.unroutable = make(chan uint64, p.bus.opt.ConfirmBufferSize)
+		notifier.NotifyUnroutable(p.unroutable)
+	}
+
+	if notifier, ok := p.bus.mqProvider.(mq.IBlockNotifier); ok {
+		blocked := make(chan bool, 1)
+		notifier.NotifyBlocked(blocked)
+		go p.watchBlocked(ctx, blocked)
+	}
+
+	for i := 0; i < p.bus.opt.NumPublisher; i++ {
+		go p.work(ctx)
+	}
 	p.logger.Info("Publisher start success")
 
+	atomic.StoreInt32(&p.running, 1)
 	go func() {
 		<-ctx.Done()
+		atomic.StoreInt32(&p.running, 0)
 		p.logger.Info("Publisher stop success")
 	}()
 
 	return nil
 }
 
-func (p *publisher) publish(msgs ...*message.Message) {
-	for _, msg := range msgs {
-		err := p.bus.mqProvider.Publish(msg)
+// reserve 占用发送队列中的一个位置
+// 队列已满时根据 Options.PublishBlocking 阻塞等待或者返回 ErrPublishQueueFull
+func (p *publisher) reserve() error {
+	if !p.bus.opt.PublishBlocking {
+		select {
+		case p.slots <- struct{}{}:
+			return nil
+		default:
+			return ErrPublishQueueFull
+		}
+	}
+
+	select {
+	case p.slots <- struct{}{}:
+		return nil
+	case <-p.done:
+		return errors.New("publisher is stopped")
+	}
+}
+
+// release 释放 reserve 占用的位置
+func (p *publisher) release() {
+	<-p.slots
+}
+
+// enqueue 添加消息到发送队列中，调用前必须先 reserve
+func (p *publisher) enqueue(msg *message.Message) {
+	p.queue <- msg
+}
+
+func (p *publisher) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-p.queue:
+			p.publish(msg)
+			p.bus.msgPool.Put(msg)
+			p.release()
+		}
+	}
+}
+
+func (p *publisher) watchBlocked(ctx context.Context, blocked chan bool) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case active, ok := <-blocked:
+			if !ok {
+				return
+			}
+			p.setBlocked(active)
+		}
+	}
+}
+
+func (p *publisher) watchReturned(ctx context.Context, returned chan *message.Message) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-returned:
+			if !ok {
+				return
+			}
+			p.returned(msg)
+		}
+	}
+}
+
+// returned 消息被 mq 退回，只输出日志、指标和 Hook
+// outbox 中的消息记录在处理 unroutable confirm 时标记（见 unrouted），不依赖退回的消息与 confirm 的到达顺序
+func (p *publisher) returned(msg *message.Message) {
+	p.logger.
+		WithField("uuid", msg.UUID).
+		WithField("topic", msg.Topic).
+		Warn("message returned")
+	p.bus.metrics.returned(msg.Topic)
+	p.bus.hooks.returned(msg)
+}
+
+// markUnroutable outbox 中的消息记录标记为 unroutable，等待扫描重新发送
+func (p *publisher) markUnroutable(recordID interface{}) {
+	if err := p.bus.outbox.unroutable(nil, recordID); err != nil {
+		p.logger.WithError(err).
+			WithField("recordID", recordID).
+			Error("Failed to mark record unroutable")
+	}
+}
+
+// setBlocked 连接被阻塞时暂停发送，解除阻塞后继续发送
+func (p *publisher) setBlocked(active bool) {
+	p.blockMutex.Lock()
+	defer p.blockMutex.Unlock()
+
+	select {
+	case <-p.unblocked:
+		if active {
+			p.unblocked = make(chan struct{})
+			p.logger.Warn("Publisher paused, connection blocked")
+		}
+	default:
+		if !active {
+			close(p.unblocked)
+			p.logger.Info("Publisher resumed, connection unblocked")
+		}
+	}
+}
+
+// waitUnblocked 等待连接解除阻塞
+func (p *publisher) waitUnblocked() error {
+	p.blockMutex.RLock()
+	unblocked := p.unblocked
+	p.blockMutex.RUnlock()
+
+	select {
+	case <-unblocked:
+		return nil
+	case <-p.done:
+		return errors.New("publisher is stopped")
+	}
+}
+
+// publish 依次发送消息到消息队列中，返回与 msgs 一一对应的发送结果
+func (p *publisher) publish(msgs ...*message.Message) []error {
+	errs := make([]error, len(msgs))
+	for i, msg := range msgs {
+		if _, ok := msg.Header[deferredHeader]; ok {
+			// 相同 key 存在更早的待发送消息，由 outbox relay 按顺序发送
+			continue
+		}
+		if deliverAt, ok := msg.Header[delayedHeader].(time.Time); ok {
+			p.delay(msg.Clone(), deliverAt)
+			continue
+		}
+		if err := p.waitUnblocked(); err != nil {
+			errs[i] = err
+			continue
+		}
+
+		err := p.publishOne(msg)
+		if errors.Is(err, mq.ErrUnroutable) {
+			p.returned(msg)
+			if recordID, ok := msg.Header[message.RecordIDHeader]; ok && msg.Policy.Confirm {
+				p.markUnroutable(recordID)
+			}
+			p.bus.hooks.published(msg, err)
+			errs[i] = err
+			continue
+		}
 		if err != nil {
 			p.logger.WithError(err).Error("mqProvider publish failure")
+			p.bus.metrics.publishFailed(msg.Topic)
+			p.bus.hooks.published(msg, err)
+			errs[i] = err
 			continue
 		}
+		p.bus.metrics.published(msg.Topic)
+		p.bus.hooks.published(msg, nil)
+	}
+	return errs
+}
 
-		if msg.Policy.Confirm {
-			atomic.AddUint64(&p.sequence, 1)
-			seq := atomic.LoadUint64(&p.sequence)
-			p.pending.Store(seq, msg.Header.Get("record_id"))
+// delay 延时消息到期后标记 outbox 中的消息记录为已发送并发送
+// 消息记录已经被扫描发送时不再发送，Bus 停止时消息记录保留在 outbox 中，由扫描发送
+func (p *publisher) delay(msg *message.Message, deliverAt time.Time) {
+	delete(msg.Header, delayedHeader)
+	time.AfterFunc(time.Until(deliverAt), func() {
+		select {
+		case <-p.done:
+			return
+		default:
 		}
+
+		recordID := msg.Header.Get(message.RecordIDHeader)
+		claimed, err := p.bus.outbox.claim(nil, recordID)
+		if err != nil {
+			p.logger.WithError(err).
+				WithField("recordID", recordID).
+				Error("Failed to claim delayed record, waiting for scanning")
+			return
+		}
+		if claimed {
+			p.publish(msg)
+		}
+	})
+}
+
+// publishOne 发送之前先占用下一个 sequence，确保 ack 到达时 pending 中已经存在对应的记录
+func (p *publisher) publishOne(msg *message.Message) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	seq := p.sequence + 1
+	if msg.Policy.Confirm {
+		pending := &pendingConfirm{recordID: msg.Header.Get(message.RecordIDHeader), uuid: msg.UUID, topic: msg.Topic, key: msg.Key()}
+		if !p.bus.hooks.empty() {
+			pending.msg = msg.Clone()
+		}
+		p.storePending(seq, pending)
 	}
+
+	err := p.bus.mqProvider.Publish(msg)
+	if err != nil {
+		p.deletePending(seq)
+		return err
+	}
+
+	if msg.Policy.Confirm {
+		p.sequence = seq
+	}
+	return nil
 }
 
 func (p *publisher) confirm(ack uint64) error {
-	recordID, _ := p.pending.Load(ack)
+	pending, ok := p.loadPending(ack)
+	if !ok {
+		p.logger.WithField("ack", ack).Warn("unknown ack received")
+		return nil
+	}
+
 	p.logger.
 		WithField("ack", ack).
-		WithField("recordID", recordID).
+		WithField("recordID", pending.recordID).
 		Info("ack received")
-
-	if recordID == nil {
-		go func() {
-			p.ack <- ack
-		}()
+	p.bus.metrics.confirmed(pending.topic)
+	if pending.msg != nil {
+		p.bus.hooks.confirmed(pending.msg)
 	}
 
-	if err := p.bus.outbox.done(nil, recordID); err != nil {
+	if err := p.bus.outbox.done(nil, pending.recordID); err != nil {
 		p.logger.WithError(err).
 			WithField("ack", ack).
-			WithField("recordID", recordID).
+			WithField("recordID", pending.recordID).
 			Error("Failed to delete record")
+	} else if p.bus.opt.OrderedOutbox && pending.key != "" {
+		p.bus.outbox.notify(pending.key)
 	}
 
-	p.pending.Delete(ack)
+	p.deletePending(ack)
 	return nil
 }
+
+// nacked mq 拒绝了消息，outbox 中的消息记录保留，等待扫描重新发送
+func (p *publisher) nacked(nack uint64) {
+	pending, ok := p.loadPending(nack)
+	if !ok {
+		p.logger.WithField("nack", nack).Warn("unknown nack received")
+		return
+	}
+
+	p.logger.
+		WithField("nack", nack).
+		WithField("recordID", pending.recordID).
+		Error("nack received")
+	p.bus.metrics.nacked(pending.topic)
+	if pending.msg != nil {
+		p.bus.hooks.nacked(pending.msg)
+	}
+
+	p.deletePending(nack)
+}
+
+// unrouted mq 退回了消息，在删除等待 confirm 的记录之前把 outbox 中的消息记录标记为 unroutable
+func (p *publisher) unrouted(seq uint64) {
+	pending, ok := p.loadPending(seq)
+	if !ok {
+		p.logger.WithField("seq", seq).Warn("unknown unroutable confirm received")
+		return
+	}
+
+	p.logger.
+		WithField("seq", seq).
+		WithField("recordID", pending.recordID).
+		Warn("unroutable confirm received")
+	p.markUnroutable(pending.recordID)
+	p.bus.metrics.nacked(pending.topic)
+	if pending.msg != nil {
+		p.bus.hooks.nacked(pending.msg)
+	}
+
+	p.deletePending(seq)
+}
+
+func (p *publisher) storePending(seq uint64, pending *pendingConfirm) {
+	p.pending.Store(seq, pending)
+	atomic.AddInt64(&p.pendingCount, 1)
+}
+
+func (p *publisher) loadPending(seq uint64) (*pendingConfirm, bool) {
+	v, ok := p.pending.Load(seq)
+	if !ok {
+		return nil, false
+	}
+	return v.(*pendingConfirm), true
+}
+
+func (p *publisher) deletePending(seq uint64) {
+	if _, loaded := p.pending.LoadAndDelete(seq); loaded {
+		atomic.AddInt64(&p.pendingCount, -1)
+	}
+}
+
+// numPending 返回等待 confirm 的消息数量
+func (p *publisher) numPending() int64 {
+	return atomic.LoadInt64(&p.pendingCount)
+}
@@ -0,0 +1,164 @@
+package final
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"github.com/xyctruth/final/_example"
+	"github.com/xyctruth/final/message"
+	"github.com/xyctruth/final/mq"
+)
+
+func TestPublisherQueueFull(t *testing.T) {
+	bus := New("test_svc", nil, nil, DefaultOptions().WithPublishQueueSize(2).WithPublishBlocking(false))
+
+	require.Equal(t, nil, bus.publisher.reserve())
+	require.Equal(t, nil, bus.publisher.reserve())
+	require.Equal(t, ErrPublishQueueFull, bus.publisher.reserve())
+
+	bus.publisher.release()
+	require.Equal(t, nil, bus.publisher.reserve())
+}
+
+func TestPublisherBlocked(t *testing.T) {
+	bus := New("test_svc", nil, nil, DefaultOptions())
+	ctx, cancel := context.WithCancel(context.Background())
+	bus.publisher.done = ctx.Done()
+
+	require.Equal(t, nil, bus.publisher.waitUnblocked())
+
+	bus.publisher.setBlocked(true)
+	resumed := make(chan error)
+	go func() {
+		resumed <- bus.publisher.waitUnblocked()
+	}()
+
+	select {
+	case <-resumed:
+		t.Fatal("publisher should be paused while connection blocked")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	bus.publisher.setBlocked(false)
+	require.Equal(t, nil, <-resumed)
+
+	bus.publisher.setBlocked(true)
+	cancel()
+	require.NotEqual(t, nil, bus.publisher.waitUnblocked())
+}
+
+func TestPublisherReturned(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	bus := New("test_svc", nil, nil, DefaultOptions().WithMetrics(reg))
+
+	returned := make([]string, 0)
+	bus.AddHook(Hook{OnReturned: func(msg *message.Message) {
+		returned = append(returned, msg.UUID)
+	}})
+
+	// 退回的消息只输出日志、指标和 Hook，不修改等待 confirm 的记录
+	bus.publisher.storePending(1, &pendingConfirm{recordID: int64(10), uuid: "1", topic: "topic1"})
+	bus.publisher.returned(message.NewMessage("1", "topic1", nil))
+	require.Equal(t, []string{"1"}, returned)
+	require.Equal(t, float64(1), testutil.ToFloat64(bus.metrics.returnedTotal.WithLabelValues("topic1")))
+	require.Equal(t, int64(1), bus.publisher.numPending())
+}
+
+func TestPublisherUnroutableOrder(t *testing.T) {
+	bus := New("test_svc", _example.NewDB(), &fakeProvider{}, DefaultOptions().WithPurgeOnStartup(true))
+	require.Equal(t, nil, bus.outbox.init())
+
+	// 退回的消息和 unroutable confirm 以任意顺序到达，消息记录都被标记为 unroutable
+	for i, returnFirst := range []bool{true, false} {
+		msg := message.NewMessage("", "topic1", nil)
+		require.Equal(t, nil, bus.outbox.staging(nil, msg))
+		recordID := msg.Header.Get(message.RecordIDHeader)
+		seq := uint64(i + 1)
+		bus.publisher.storePending(seq, &pendingConfirm{recordID: recordID, uuid: msg.UUID, topic: "topic1"})
+
+		// broker 退回的消息不带内部 header
+		ret := message.NewMessage(msg.UUID, "topic1", nil)
+		if returnFirst {
+			bus.publisher.returned(ret)
+			bus.publisher.unrouted(seq)
+		} else {
+			bus.publisher.unrouted(seq)
+			bus.publisher.returned(ret)
+		}
+
+		var status uint8
+		var count int
+		err := bus.db.QueryRow("SELECT status, unroutable FROM "+bus.outbox.name+" WHERE id = ?", recordID).Scan(&status, &count)
+		require.Equal(t, nil, err)
+		require.Equal(t, OutBoxRecordStatusUnroutable, status)
+		require.Equal(t, 1, count)
+		require.Equal(t, int64(0), bus.publisher.numPending())
+	}
+}
+
+func TestPublisherUnroutable(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	provider := &fakeProvider{err: mq.ErrUnroutable}
+	bus := New("test_svc", nil, provider, DefaultOptions().WithMetrics(reg))
+
+	returned := make([]string, 0)
+	bus.AddHook(Hook{OnReturned: func(msg *message.Message) {
+		returned = append(returned, msg.UUID)
+	}})
+
+	// mq 驱动 Publish 时返回 ErrUnroutable，与 broker 退回消息相同处理
+	errs := bus.publisher.publish(message.NewMessage("1", "topic1", nil, message.WithConfirm(false)))
+	require.Equal(t, []error{mq.ErrUnroutable}, errs)
+	require.Equal(t, []string{"1"}, returned)
+	require.Equal(t, float64(1), testutil.ToFloat64(bus.metrics.returnedTotal.WithLabelValues("topic1")))
+	require.Equal(t, float64(1), testutil.ToFloat64(bus.metrics.returnedTotal.WithLabelValues("topic1")))
+}
+
+func TestPublisherDeferred(t *testing.T) {
+	provider := &fakeProvider{}
+	bus := New("test_svc", nil, provider, DefaultOptions().WithOrderedOutbox(true))
+
+	deferred := message.NewMessage("2", "topic1", nil, message.WithKey("order-1"))
+	deferred.Header.Set(deferredHeader, true)
+	errs := bus.publisher.publish(message.NewMessage("1", "topic1", nil, message.WithKey("order-1")), deferred)
+	require.Equal(t, []error{nil, nil}, errs)
+
+	require.Equal(t, 1, len(provider.published))
+	require.Equal(t, "1", provider.published[0].UUID)
+}
+
+func TestPublisherDelayed(t *testing.T) {
+	provider := &fakeProvider{}
+	bus := New("test_svc", _example.NewDB(), provider, DefaultOptions().WithPurgeOnStartup(true))
+	require.Equal(t, nil, bus.outbox.init())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bus.publisher.done = ctx.Done()
+
+	msg := message.NewMessage("", "topic1", nil, message.WithDelay(300))
+	require.Equal(t, nil, bus.outbox.staging(nil, msg))
+	errs := bus.publisher.publish(msg)
+	require.Equal(t, []error{nil}, errs)
+
+	// 没有到期的延时消息不发送，也不会被扫描
+	taken, err := bus.outbox.take(nil, 100, 0)
+	require.Equal(t, nil, err)
+	require.Equal(t, 0, len(taken))
+
+	require.Eventually(t, func() bool {
+		provider.mutex.Lock()
+		defer provider.mutex.Unlock()
+		return len(provider.published) == 1
+	}, time.Second, 20*time.Millisecond)
+	_, ok := provider.published[0].Header[delayedHeader]
+	require.Equal(t, false, ok)
+
+	// 到期后由 publisher 发送的消息记录不再被扫描
+	taken, err = bus.outbox.take(nil, 100, time.Second)
+	require.Equal(t, nil, err)
+	require.Equal(t, 0, len(taken))
+}
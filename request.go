@@ -0,0 +1,213 @@
+package final
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/xyctruth/final/logger"
+	"github.com/xyctruth/final/message"
+	"github.com/xyctruth/final/mq"
+)
+
+var (
+	// ErrRequestNotSupported mq 驱动没有实现 mq.IReplier，或者 Bus 还没有启动
+	ErrRequestNotSupported = errors.New("mq provider does not support request/reply")
+	// ErrNoReplyTo 消息不是 request，没有回复地址
+	ErrNoReplyTo = errors.New("message has no reply address")
+)
+
+// requester 订阅当前实例的回复队列，把收到的回复按照 correlation id 交给等待的 Request
+type requester struct {
+	logger logger.Logger
+	bus    *Bus
+
+	// resubscribeInterval 回复队列失效后重新订阅的间隔
+	resubscribeInterval time.Duration
+
+	mutex   sync.RWMutex
+	replyTo string
+	// waiting correlation id -> 等待回复的 channel
+	waiting map[string]chan *message.Message
+}
+
+func newRequester(bus *Bus) *requester {
+	return &requester{
+		logger: bus.logger.WithFields(logger.Fields{
+			"module": "requester",
+		}),
+		bus:                 bus,
+		resubscribeInterval: time.Second,
+		waiting:             make(map[string]chan *message.Message),
+	}
+}
+
+// Start mq 驱动实现了 mq.IReplier 时订阅回复队列，否则 Request 返回 ErrRequestNotSupported
+func (r *requester) Start(ctx context.Context) error {
+	replier, ok := r.bus.mqProvider.(mq.IReplier)
+	if !ok {
+		return nil
+	}
+
+	replies, err := r.subscribe(ctx, replier)
+	if errors.Is(err, mq.ErrReplyNotSupported) {
+		r.logger.Info("mq provider does not support request/reply")
+		return nil
+	}
+	if err != nil {
+		r.logger.WithError(err).Error("Requester start failure")
+		return err
+	}
+
+	go func() {
+		defer r.setReplyTo("")
+		for {
+			select {
+			case <-ctx.Done():
+				r.logger.Info("Requester stop success")
+				return
+			case reply, ok := <-replies:
+				if ok {
+					r.dispatch(reply)
+					continue
+				}
+				// 回复队列失效，清除回复地址后重新订阅，期间 Request 返回 ErrRequestNotSupported
+				r.setReplyTo("")
+				r.logger.Warn("reply queue closed, resubscribing")
+				if replies = r.resubscribe(ctx, replier); replies == nil {
+					return
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// subscribe 订阅回复队列并设置回复地址
+func (r *requester) subscribe(ctx context.Context, replier mq.IReplier) (chan *message.Message, error) {
+	replies := make(chan *message.Message)
+	replyTo, err := replier.SubscribeReply(ctx, replies)
+	if err != nil {
+		return nil, err
+	}
+	r.setReplyTo(replyTo)
+	r.logger.WithField("reply_to", replyTo).Info("Requester start success")
+	return replies, nil
+}
+
+// resubscribe 每隔 resubscribeInterval 重新订阅回复队列直到成功，ctx 结束时返回 nil
+func (r *requester) resubscribe(ctx context.Context, replier mq.IReplier) chan *message.Message {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(r.resubscribeInterval):
+		}
+		replies, err := r.subscribe(ctx, replier)
+		if err == nil {
+			return replies
+		}
+		r.logger.WithError(err).Error("Requester resubscribe failure")
+	}
+}
+
+func (r *requester) setReplyTo(replyTo string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.replyTo = replyTo
+}
+
+// dispatch 把回复交给等待的 Request，Request 已经超时的回复被丢弃
+func (r *requester) dispatch(reply *message.Message) {
+	id := reply.CorrelationID()
+	r.mutex.RLock()
+	waiting, ok := r.waiting[id]
+	r.mutex.RUnlock()
+	if !ok {
+		r.logger.WithField("correlation_id", id).Warn("unknown reply received")
+		return
+	}
+	select {
+	case waiting <- reply:
+	default:
+		r.logger.WithField("correlation_id", id).Warn("duplicate reply received")
+	}
+}
+
+// wait 注册等待 id 的回复，返回当前实例的回复地址
+func (r *requester) wait(id string) (string, chan *message.Message, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.replyTo == "" {
+		return "", nil, ErrRequestNotSupported
+	}
+	waiting := make(chan *message.Message, 1)
+	r.waiting[id] = waiting
+	return r.replyTo, waiting, nil
+}
+
+func (r *requester) done(id string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.waiting, id)
+}
+
+// Request 发送 request 消息并等待回复，handler 使用 Context.Reply 回复
+// ctx 没有设置 deadline 时使用 Options.RequestTimeout 作为超时时间，超时返回 context.DeadlineExceeded
+// request 消息不会暂存到 outbox 中，Confirm 被忽略
+func (bus *Bus) Request(ctx context.Context, topic string, payload []byte, opts ...message.PolicyOption) (*message.Message, error) {
+	if _, ok := ctx.Deadline(); !ok && bus.opt.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, bus.opt.RequestTimeout)
+		defer cancel()
+	}
+
+	msg := message.NewMessage("", topic, payload, opts...)
+	msg.SvcName = bus.svcName
+	msg.Policy.Confirm = false
+
+	replyTo, waiting, err := bus.requester.wait(msg.UUID)
+	if err != nil {
+		return nil, err
+	}
+	defer bus.requester.done(msg.UUID)
+	msg.Header.Set(message.ReplyToHeader, replyTo)
+	msg.Header.Set(message.CorrelationIDHeader, msg.UUID)
+
+	_, span := bus.tracing.startProducer(ctx, msg)
+	err = bus.publisher.publish(msg)[0]
+	endSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case reply := <-waiting:
+		return reply, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Reply 回复 request 消息，回复消息直接发送到 request 的回复地址，不经过 outbox
+// 消息不是 request 时返回 ErrNoReplyTo
+func (c *Context) Reply(payload []byte, opts ...message.PolicyOption) error {
+	replyTo := c.Message.ReplyTo()
+	if replyTo == "" {
+		return ErrNoReplyTo
+	}
+	replier, ok := c.bus.mqProvider.(mq.IReplier)
+	if !ok {
+		return ErrRequestNotSupported
+	}
+
+	reply := message.NewMessage("", c.Topic, payload, opts...)
+	reply.SvcName = c.bus.svcName
+	reply.Header.Set(message.CorrelationIDHeader, c.Message.CorrelationID())
+
+	_, span := c.bus.tracing.startProducer(c.Context(), reply)
+	err := replier.PublishReply(replyTo, reply)
+	endSpan(span, err)
+	return err
+}
@@ -0,0 +1,122 @@
+package final
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/xyctruth/final/message"
+	"github.com/xyctruth/final/mq/composite"
+	"github.com/xyctruth/final/mq/memory"
+)
+
+// startMemoryBus 使用内存驱动启动 Bus，不需要数据库
+func startMemoryBus(t *testing.T, ctx context.Context, bus *Bus) {
+	topics := make([]string, 0, len(bus.router.topics))
+	for topic := range bus.router.topics {
+		topics = append(topics, topic)
+	}
+	require.Equal(t, nil, bus.mqProvider.Init(ctx, bus.svcName, true, topics))
+	subscribers, err := bus.newSubscribers()
+	require.Equal(t, nil, err)
+	bus.subscribers = subscribers
+	for _, subscriber := range bus.subscribers {
+		require.Equal(t, nil, subscriber.Start(ctx))
+	}
+	require.Equal(t, nil, bus.publisher.Start(ctx))
+	require.Equal(t, nil, bus.requester.Start(ctx))
+}
+
+func TestRequest(t *testing.T) {
+	broker := memory.NewBroker()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := New("server_svc", nil, memory.NewProvider(broker), DefaultOptions().WithNumSubscriber(1))
+	server.Subscribe("ping").Handler(func(c *Context) error {
+		return c.Reply(append([]byte("pong "), c.Message.Payload...))
+	})
+	server.Subscribe("ignore").Handler(func(c *Context) error {
+		return nil
+	})
+	startMemoryBus(t, ctx, server)
+
+	client := New("client_svc", nil, memory.NewProvider(broker), DefaultOptions().WithRequestTimeout(100*time.Millisecond))
+	startMemoryBus(t, ctx, client)
+
+	reply, err := client.Request(context.Background(), "ping", []byte("1"))
+	require.Equal(t, nil, err)
+	require.Equal(t, []byte("pong 1"), reply.Payload)
+	require.Equal(t, "ping", reply.Topic)
+
+	// 没有回复时超时
+	_, err = client.Request(context.Background(), "ignore", nil)
+	require.Equal(t, context.DeadlineExceeded, err)
+	require.Equal(t, 0, len(client.requester.waiting))
+
+	// 不是 request 的消息不能回复
+	c := &Context{Message: message.NewMessage("", "ping", nil), bus: server}
+	require.Equal(t, ErrNoReplyTo, c.Reply(nil))
+}
+
+func TestRequestNotSupported(t *testing.T) {
+	bus := New("test_svc", nil, &fakeProvider{}, DefaultOptions())
+	require.Equal(t, nil, bus.requester.Start(context.Background()))
+	_, err := bus.Request(context.Background(), "ping", nil)
+	require.Equal(t, ErrRequestNotSupported, err)
+
+	// 实现了 mq.IReplier 但是不支持 request/reply 的驱动（例如组合驱动）不影响启动
+	bus = New("test_svc", nil, composite.NewProvider(&fakeProvider{}), DefaultOptions())
+	require.Equal(t, nil, bus.requester.Start(context.Background()))
+	_, err = bus.Request(context.Background(), "ping", nil)
+	require.Equal(t, ErrRequestNotSupported, err)
+}
+
+// replyProvider 每次 SubscribeReply 返回新的回复地址，close 关闭最近一次订阅的回复队列
+type replyProvider struct {
+	fakeProvider
+	mutex   sync.Mutex
+	count   int
+	replies chan *message.Message
+}
+
+func (p *replyProvider) SubscribeReply(ctx context.Context, msgs chan *message.Message) (string, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.count++
+	p.replies = msgs
+	return fmt.Sprintf("reply.%d", p.count), nil
+}
+
+func (p *replyProvider) PublishReply(replyTo string, msg *message.Message) error {
+	return nil
+}
+
+func (p *replyProvider) close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	close(p.replies)
+}
+
+func TestRequestResubscribe(t *testing.T) {
+	provider := &replyProvider{}
+	bus := New("test_svc", nil, provider, DefaultOptions())
+	bus.requester.resubscribeInterval = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	require.Equal(t, nil, bus.requester.Start(ctx))
+
+	replyTo, _, err := bus.requester.wait("1")
+	require.Equal(t, nil, err)
+	require.Equal(t, "reply.1", replyTo)
+
+	// 回复队列失效后不再使用旧的回复地址，重新订阅后使用新的回复地址
+	provider.close()
+	require.Eventually(t, func() bool {
+		replyTo, _, err = bus.requester.wait("2")
+		return err == nil && replyTo == "reply.2"
+	}, time.Second, time.Millisecond)
+}
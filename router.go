@@ -1,10 +1,13 @@
 package final
 
 import (
+	"context"
 	"errors"
 	"sync"
+	"time"
 
 	"github.com/xyctruth/final/message"
+	"golang.org/x/time/rate"
 )
 
 type (
@@ -14,14 +17,31 @@ type (
 	routerTopic struct {
 		name        string
 		middlewares []HandlerFunc
-		bus         *Bus
+		// concurrency 处理消息的 goroutine 数量，0 表示使用 Options.NumSubscriber
+		concurrency int
+		// prefetch consumer 未 Ack 的最大消息数量，0 表示与 concurrency 相同
+		prefetch int
+		// orderByKey 相同 key 的消息按照顺序处理
+		orderByKey bool
+		// batchSize 每批最多处理的消息数量，batchWait 凑满一批消息的最长等待时间
+		batchSize int
+		batchWait time.Duration
+		// limiter 限制处理消息的速率，inflight 限制同时处理的消息数量
+		limiter     *rate.Limiter
+		maxInFlight int
+		inflight    chan struct{}
+		// breaker 连续失败后暂停处理 topic 的消息
+		breaker *breaker
+		bus     *Bus
 	}
 
 	// router 是handler的路由程序，帮助消息的到正确的handler处理
 	router struct {
-		handlers map[string]HandlerFunc
-		topics   map[string]*routerTopic
-		ctxPool  sync.Pool
+		handlers      map[string]HandlerFunc
+		batchHandlers map[string]BatchHandlerFunc
+		topics        map[string]*routerTopic
+		ctxPool       sync.Pool
+		bus           *Bus
 	}
 )
 
@@ -30,14 +50,52 @@ func (topic *routerTopic) Middleware(middlewares ...HandlerFunc) *routerTopic {
 	return topic
 }
 
+// Concurrency 设置处理 topic 消息的 goroutine 数量
+// 只在 mq 驱动为每个 topic 使用独立的队列时生效（mq.ITopicSubscriber），默认值为 Options.NumSubscriber
+func (topic *routerTopic) Concurrency(val int) *routerTopic {
+	topic.concurrency = val
+	return topic
+}
+
+// Prefetch 设置 topic 的 consumer 未 Ack 的最大消息数量
+// 只在 mq 驱动为每个 topic 使用独立的队列时生效（mq.ITopicSubscriber），默认值与 Concurrency 相同
+func (topic *routerTopic) Prefetch(val int) *routerTopic {
+	topic.prefetch = val
+	return topic
+}
+
+// OrderByKey 相同 key（message.WithKey）的消息由同一个 goroutine 按照收到的顺序处理
+// 需要 mq 驱动为每个 topic 使用独立的队列（mq.ITopicSubscriber），消息按照 key 的 hash 分配到 Concurrency 个 goroutine，
+// 否则 Bus.Start 返回 ErrTopicQueuesRequired
+func (topic *routerTopic) OrderByKey() *routerTopic {
+	topic.orderByKey = true
+	return topic
+}
+
+// Batch 设置 BatchHandler 每批最多处理的消息数量和凑满一批消息的最长等待时间
+// 默认值为 100 条消息和 1 秒，mq 驱动为每个 topic 使用独立的队列时 Prefetch 的默认值为 Concurrency * maxSize
+func (topic *routerTopic) Batch(maxSize int, maxWait time.Duration) *routerTopic {
+	topic.batchSize = maxSize
+	topic.batchWait = maxWait
+	return topic
+}
+
 func (topic *routerTopic) Handler(handler HandlerFunc) {
 	topic.bus.router.addRoute(topic.name, handler)
 }
 
-func newRouter() *router {
+// BatchHandler 批量处理 topic 的消息，不经过 Middleware
+// 需要 mq 驱动为每个 topic 使用独立的队列（mq.ITopicSubscriber），否则 Bus.Start 返回 ErrTopicQueuesRequired
+func (topic *routerTopic) BatchHandler(handler BatchHandlerFunc) {
+	topic.bus.router.addBatchRoute(topic.name, handler)
+}
+
+func newRouter(bus *Bus) *router {
 	s := &router{
-		handlers: make(map[string]HandlerFunc),
-		topics:   make(map[string]*routerTopic),
+		bus:           bus,
+		handlers:      make(map[string]HandlerFunc),
+		batchHandlers: make(map[string]BatchHandlerFunc),
+		topics:        make(map[string]*routerTopic),
 	}
 
 	s.ctxPool.New = func() interface{} {
@@ -47,9 +105,22 @@ func newRouter() *router {
 }
 
 func (r *router) addRoute(topic string, handler HandlerFunc) {
+	delete(r.batchHandlers, topic)
 	r.handlers[topic] = handler
 }
 
+func (r *router) addBatchRoute(topic string, handler BatchHandlerFunc) {
+	delete(r.handlers, topic)
+	r.batchHandlers[topic] = handler
+}
+
+func (r *router) getBatchRoute(topic string) BatchHandlerFunc {
+	if handler, ok := r.batchHandlers[topic]; ok {
+		return handler
+	}
+	return nil
+}
+
 func (r *router) getRoute(topic string) HandlerFunc {
 	if handler, ok := r.handlers[topic]; ok {
 		return handler
@@ -57,7 +128,7 @@ func (r *router) getRoute(topic string) HandlerFunc {
 	return nil
 }
 
-func (r *router) handle(msg *message.Message) error {
+func (r *router) handle(ctx context.Context, msg *message.Message) error {
 	var middlewares []HandlerFunc
 	if topic, ok := r.topics[msg.Topic]; ok {
 		middlewares = append(middlewares, topic.middlewares...)
@@ -68,6 +139,8 @@ func (r *router) handle(msg *message.Message) error {
 
 	// 初始化 context ,添加 msg，middlewares
 	c.Reset(msg, middlewares)
+	c.ctx = ctx
+	c.bus = r.bus
 
 	// 追加 handler
 	handler := r.getRoute(c.Topic)
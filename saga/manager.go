@@ -0,0 +1,272 @@
+package saga
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/lopezator/migrator"
+	uuidtools "github.com/satori/go.uuid"
+	"github.com/xyctruth/final"
+	"github.com/xyctruth/final/logger"
+	"github.com/xyctruth/final/message"
+)
+
+// Manager 执行 saga，saga 的状态保存在与 outbox 相同的数据库中
+//   开始 saga 和处理每一个回复都在一个事务中完成：读取并锁定 saga 实例、执行步骤、通过 TxBus 暂存命令、保存状态
+//   参与者的回复通过 IDHeader 关联到 saga 实例，不是当前步骤的回复（重复或过期）被忽略
+//   步骤超时通过延时消息实现：进入步骤时通过 TxBus 暂存一条发送到回复 topic 的延时超时消息，与步骤的命令一起提交，
+//   到期后按照回复处理，步骤已经完成时超时消息作为过期的回复被忽略
+type Manager struct {
+	bus        *final.Bus
+	db         *sql.DB
+	def        Definition
+	opt        Options
+	logger     logger.Logger
+	replyTopic string
+}
+
+// NewManager 创建 saga 执行器并订阅回复 topic，需要在 Bus.Start 之前调用
+func NewManager(bus *final.Bus, db *sql.DB, def Definition, opt Options) *Manager {
+	m := &Manager{
+		bus: bus,
+		db:  db,
+		def: def,
+		opt: opt,
+		logger: bus.Logger().WithFields(logger.Fields{
+			"module": "saga",
+			"saga":   def.Name,
+		}),
+		replyTopic: opt.ReplyTopic,
+	}
+	if m.replyTopic == "" {
+		m.replyTopic = "final.saga." + def.Name + ".reply"
+	}
+	bus.Subscribe(m.replyTopic).Handler(m.handleReply)
+	return m
+}
+
+// ReplyTopic 返回参与者回复命令处理结果的 topic
+func (m *Manager) ReplyTopic() string {
+	return m.replyTopic
+}
+
+// Start 创建 saga 表，需要在 Begin 之前调用
+func (m *Manager) Start() error {
+	if err := m.init(); err != nil {
+		return err
+	}
+	m.logger.Info("saga manager start success")
+	return nil
+}
+
+func (m *Manager) init() error {
+	mig, err := migrator.New(
+		migrator.TableName(fmt.Sprintf("%s_migrations", m.opt.TableName)),
+		migrator.Migrations(
+			&migrator.Migration{
+				Name: "init saga table",
+				Func: func(tx *sql.Tx) error {
+					initSQL := `CREATE TABLE IF NOT EXISTS ` + m.opt.TableName + `
+								(
+									id        varchar(64)  primary key,
+									name      varchar(255) not null,
+									step      int          not null,
+									status    tinyint      not null,
+									data      longblob     null,
+									create_at datetime(3)  null,
+									update_at datetime(3)  null
+								);`
+
+					_, err := tx.Exec(initSQL)
+					return err
+				},
+			},
+		),
+	)
+	if err != nil {
+		m.logger.WithError(err).Error("migrator error")
+		return err
+	}
+	if err = mig.Migrate(m.db); err != nil {
+		m.logger.WithError(err).Error("migrator up error")
+		return err
+	}
+	return nil
+}
+
+// Begin 开始一个新的 saga 实例，执行第一个步骤，返回 saga 实例的 id
+func (m *Manager) Begin(data []byte) (string, error) {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return "", err
+	}
+
+	var id string
+	err = m.bus.Transaction(tx, func(txBus *final.TxBus) error {
+		id, err = m.BeginTx(txBus, data)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// BeginTx 在 txBus 的事务中开始一个新的 saga 实例，saga 与业务数据一起提交，由调用者 Commit
+func (m *Manager) BeginTx(txBus *final.TxBus, data []byte) (string, error) {
+	now := time.Now()
+	inst := &Instance{
+		ID:       uuidtools.NewV4().String(),
+		Name:     m.def.Name,
+		Status:   StatusRunning,
+		CreateAt: now,
+		UpdateAt: now,
+	}
+	c := &StepContext{SagaID: inst.ID, Data: data, txBus: txBus, replyTopic: m.replyTopic}
+
+	if len(m.def.Steps) == 0 {
+		inst.Status = StatusCompleted
+	} else if err := m.enter(c); err != nil {
+		return "", err
+	}
+
+	insertSQL := "INSERT INTO " + m.opt.TableName + " (id,name,step,status,data,create_at,update_at) VALUES (?,?,?,?,?,?,?)"
+	_, err := txBus.Tx().Exec(insertSQL, inst.ID, inst.Name, c.Step, inst.Status, c.Data, inst.CreateAt, inst.UpdateAt)
+	if err != nil {
+		return "", err
+	}
+	return inst.ID, nil
+}
+
+// Get 返回 saga 实例
+func (m *Manager) Get(id string) (*Instance, error) {
+	return m.load(m.db.QueryRow("SELECT id,name,step,status,data,create_at,update_at FROM "+m.opt.TableName+" WHERE id = ?", id))
+}
+
+// enter 执行 c.Step 步骤的 Action，步骤设置了 Timeout 时在同一个事务中暂存延时的超时消息
+func (m *Manager) enter(c *StepContext) error {
+	step := m.def.Steps[c.Step]
+	if step.Action != nil {
+		if err := step.Action(c); err != nil {
+			return err
+		}
+	}
+	if step.Timeout <= 0 {
+		return nil
+	}
+	return c.txBus.Publish(m.replyTopic, nil,
+		message.WithHeader(IDHeader, c.SagaID),
+		message.WithHeader(StepHeader, strconv.Itoa(c.Step)),
+		message.WithHeader(ResultHeader, ResultTimeout),
+		message.WithDelay(step.Timeout.Milliseconds()),
+	)
+}
+
+func (m *Manager) handleReply(fc *final.Context) error {
+	tx, err := m.db.BeginTx(fc.Context(), nil)
+	if err != nil {
+		return err
+	}
+	return m.bus.Transaction(tx, func(txBus *final.TxBus) error {
+		return m.handle(txBus, fc.Message)
+	})
+}
+
+// handle 处理参与者的回复或者超时消息，推进 saga 到下一个步骤或者执行补偿
+func (m *Manager) handle(txBus *final.TxBus, reply *message.Message) error {
+	id, _ := reply.Header[IDHeader].(string)
+	result, _ := reply.Header[ResultHeader].(string)
+	stepStr, _ := reply.Header[StepHeader].(string)
+	step, err := strconv.Atoi(stepStr)
+	if err != nil {
+		m.logger.WithField("saga_id", id).WithField("step", stepStr).Warn("invalid saga reply step, ignored")
+		return nil
+	}
+	log := m.logger.WithField("saga_id", id).WithField("step", step).WithField("result", result)
+
+	inst, err := m.load(txBus.Tx().QueryRow("SELECT id,name,step,status,data,create_at,update_at FROM "+m.opt.TableName+" WHERE id = ? FOR UPDATE", id))
+	if errors.Is(err, ErrNotFound) {
+		log.Warn("saga not found, reply ignored")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if inst.Name != m.def.Name || inst.Status != StatusRunning || inst.Step != step {
+		log.WithField("status", inst.Status.String()).Info("stale saga reply ignored")
+		return nil
+	}
+
+	c := &StepContext{SagaID: inst.ID, Step: inst.Step, Data: inst.Data, Reply: reply, txBus: txBus, replyTopic: m.replyTopic}
+	switch result {
+	case ResultSuccess:
+		if onReply := m.def.Steps[step].OnReply; onReply != nil {
+			if err = onReply(c); err != nil {
+				return err
+			}
+		}
+		c.Step++
+		if c.Step >= len(m.def.Steps) {
+			inst.Status = StatusCompleted
+			c.Step = len(m.def.Steps) - 1
+			break
+		}
+		if err = m.enter(c); err != nil {
+			return err
+		}
+	case ResultFailure, ResultTimeout:
+		// 失败的步骤没有生效，只补偿已完成的步骤；超时的步骤可能已经生效，需要一起补偿
+		from := step - 1
+		if result == ResultTimeout {
+			from = step
+			log.Warn("saga step timeout")
+		}
+		if err = m.compensate(c, from); err != nil {
+			return err
+		}
+		c.Step = step
+		inst.Status = StatusCompensated
+	default:
+		log.Warn("unknown saga reply result, ignored")
+		return nil
+	}
+
+	updateSQL := "UPDATE " + m.opt.TableName + " SET step = ?, status = ?, data = ?, update_at = ? WHERE id = ?"
+	_, err = txBus.Tx().Exec(updateSQL, c.Step, inst.Status, c.Data, time.Now(), inst.ID)
+	if err != nil {
+		return err
+	}
+	log.WithField("status", inst.Status.String()).Info("saga reply handled")
+	return nil
+}
+
+// compensate 从 from 步骤开始按照相反的顺序执行补偿，补偿命令不需要回复
+func (m *Manager) compensate(c *StepContext, from int) error {
+	c.replyTopic = ""
+	for i := from; i >= 0; i-- {
+		compensate := m.def.Steps[i].Compensate
+		if compensate == nil {
+			continue
+		}
+		c.Step = i
+		if err := compensate(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Manager) load(row *sql.Row) (*Instance, error) {
+	inst := &Instance{}
+	err := row.Scan(&inst.ID, &inst.Name, &inst.Step, &inst.Status, &inst.Data, &inst.CreateAt, &inst.UpdateAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return inst, nil
+}
@@ -0,0 +1,29 @@
+package saga
+
+type Options struct {
+	// TableName 保存 saga 状态的表，与 outbox 使用同一个数据库
+	TableName string
+	// ReplyTopic 参与者回复命令处理结果的 topic，为空时使用 final.saga.<Definition.Name>.reply
+	ReplyTopic string
+}
+
+// DefaultOptions saga 默认配置
+func DefaultOptions() Options {
+	return Options{
+		TableName: "final_saga",
+	}
+}
+
+// WithTableName 设置保存 saga 状态的表
+// The default value of TableName is final_saga.
+func (opt Options) WithTableName(val string) Options {
+	opt.TableName = val
+	return opt
+}
+
+// WithReplyTopic 设置参与者回复命令处理结果的 topic
+// The default value of ReplyTopic is final.saga.<Definition.Name>.reply.
+func (opt Options) WithReplyTopic(val string) Options {
+	opt.ReplyTopic = val
+	return opt
+}
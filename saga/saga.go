@@ -0,0 +1,135 @@
+package saga
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/xyctruth/final"
+	"github.com/xyctruth/final/message"
+)
+
+const (
+	// IDHeader saga 实例的 id
+	IDHeader = "x-final-saga-id"
+	// StepHeader 命令所属的步骤
+	StepHeader = "x-final-saga-step"
+	// ReplyTopicHeader 参与者回复命令处理结果的 topic
+	ReplyTopicHeader = "x-final-saga-reply"
+	// ResultHeader 回复消息中命令的处理结果，ResultSuccess、ResultFailure 或 ResultTimeout
+	ResultHeader = "x-final-saga-result"
+)
+
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+	ResultTimeout = "timeout"
+)
+
+// Status saga 实例的状态
+type Status uint8
+
+const (
+	StatusRunning     Status = iota // 等待当前步骤的回复
+	StatusCompleted                 // 所有步骤都执行成功
+	StatusCompensated               // 步骤失败或超时，已经执行了补偿
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusRunning:
+		return "running"
+	case StatusCompleted:
+		return "completed"
+	case StatusCompensated:
+		return "compensated"
+	default:
+		return "unknown"
+	}
+}
+
+var (
+	// ErrNotFound saga 实例不存在
+	ErrNotFound = errors.New("saga not found")
+	// ErrNotCommand 消息不是 saga 发送的命令，没有回复 topic
+	ErrNotCommand = errors.New("message is not a saga command")
+)
+
+type (
+	// Definition saga 的定义，步骤按照顺序执行，步骤失败或超时后按照相反的顺序执行已完成步骤的补偿
+	Definition struct {
+		Name  string
+		Steps []Step
+	}
+
+	// Step saga 的一个步骤
+	Step struct {
+		Name string
+		// Action 进入步骤时执行，通常使用 StepContext.Publish 发送命令，参与者处理完命令后使用 Reply 回复
+		Action func(c *StepContext) error
+		// OnReply 收到步骤成功的回复后执行，可以把回复中的数据保存到 StepContext.Data，为 nil 时忽略
+		OnReply func(c *StepContext) error
+		// Compensate 补偿步骤，通常使用 StepContext.Publish 发送补偿命令，补偿命令不需要回复，为 nil 时忽略
+		Compensate func(c *StepContext) error
+		// Timeout 等待回复的超时时间，超时后执行补偿，0 表示不超时
+		Timeout time.Duration
+	}
+
+	// StepContext 执行步骤时的上下文，所有的修改在同一个事务中提交
+	StepContext struct {
+		SagaID string
+		Step   int
+		// Data saga 实例的数据，修改后在事务提交时保存
+		Data []byte
+		// Reply 触发当前操作的回复消息，开始 saga 时为 nil
+		Reply *message.Message
+
+		txBus      *final.TxBus
+		replyTopic string
+	}
+
+	// Instance saga 实例
+	Instance struct {
+		ID       string
+		Name     string
+		Step     int
+		Status   Status
+		Data     []byte
+		CreateAt time.Time
+		UpdateAt time.Time
+	}
+)
+
+// Tx 返回事务，在同一个事务中修改业务数据
+func (c *StepContext) Tx() *final.TxBus {
+	return c.txBus
+}
+
+// Publish 在事务中发送命令，命令中携带 saga 的 id、步骤和回复 topic，事务提交后发送
+func (c *StepContext) Publish(topic string, payload []byte, opts ...message.PolicyOption) error {
+	opts = append(opts,
+		message.WithHeader(IDHeader, c.SagaID),
+		message.WithHeader(StepHeader, strconv.Itoa(c.Step)),
+	)
+	if c.replyTopic != "" {
+		opts = append(opts, message.WithHeader(ReplyTopicHeader, c.replyTopic))
+	}
+	return c.txBus.Publish(topic, payload, opts...)
+}
+
+// Reply 参与者回复 saga 命令的处理结果，回复消息与参与者的业务数据在 txBus 的事务中一起提交
+func Reply(txBus *final.TxBus, command *message.Message, success bool, payload []byte) error {
+	replyTopic, _ := command.Header[ReplyTopicHeader].(string)
+	if replyTopic == "" {
+		return ErrNotCommand
+	}
+	result := ResultFailure
+	if success {
+		result = ResultSuccess
+	}
+	return txBus.Publish(replyTopic, payload,
+		message.WithHeader(IDHeader, command.Header.Get(IDHeader)),
+		message.WithHeader(StepHeader, command.Header.Get(StepHeader)),
+		message.WithHeader(ResultHeader, result),
+	)
+}
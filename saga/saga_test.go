@@ -0,0 +1,133 @@
+package saga
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/xyctruth/final"
+	"github.com/xyctruth/final/_example"
+	"github.com/xyctruth/final/message"
+	"github.com/xyctruth/final/mq/memory"
+)
+
+// newOrderSaga 创建订单 saga：扣减库存 -> 支付，支付失败时补偿库存
+func newOrderSaga(bus *final.Bus, timeout time.Duration, compensated chan string) *Manager {
+	def := Definition{
+		Name: "order",
+		Steps: []Step{
+			{
+				Name: "reserve",
+				Action: func(c *StepContext) error {
+					return c.Publish("stock.reserve", c.Data)
+				},
+				OnReply: func(c *StepContext) error {
+					c.Data = append(c.Data, c.Reply.Payload...)
+					return nil
+				},
+				Compensate: func(c *StepContext) error {
+					compensated <- c.SagaID
+					return c.Publish("stock.release", c.Data)
+				},
+			},
+			{
+				Name: "pay",
+				Action: func(c *StepContext) error {
+					return c.Publish("payment.charge", c.Data)
+				},
+				Timeout: timeout,
+			},
+		},
+	}
+	return NewManager(bus, _example.NewDB(), def, DefaultOptions().WithTableName("final_test_saga"))
+}
+
+// participant 处理命令并在事务中回复
+func participant(bus *final.Bus, topic string, handle func(c *final.Context) (bool, []byte)) {
+	db := _example.NewDB()
+	bus.Subscribe(topic).Handler(func(c *final.Context) error {
+		success, payload := handle(c)
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		return bus.Transaction(tx, func(txBus *final.TxBus) error {
+			return Reply(txBus, c.Message, success, payload)
+		})
+	})
+}
+
+func waitStatus(t *testing.T, m *Manager, id string, status Status) *Instance {
+	var inst *Instance
+	require.Eventually(t, func() bool {
+		var err error
+		inst, err = m.Get(id)
+		require.Equal(t, nil, err)
+		return inst.Status == status
+	}, 5*time.Second, 50*time.Millisecond)
+	return inst
+}
+
+func TestSaga(t *testing.T) {
+	bus := final.New("saga_svc", _example.NewDB(), memory.NewProvider(memory.NewBroker()), final.DefaultOptions().WithPurgeOnStartup(true))
+	compensated := make(chan string, 10)
+	m := newOrderSaga(bus, 0, compensated)
+
+	participant(bus, "stock.reserve", func(c *final.Context) (bool, []byte) {
+		return true, []byte(":reserved")
+	})
+	participant(bus, "payment.charge", func(c *final.Context) (bool, []byte) {
+		return string(c.Message.Payload) == "ok:reserved", nil
+	})
+	bus.Subscribe("stock.release").Handler(func(c *final.Context) error {
+		// 补偿命令没有回复 topic
+		require.Equal(t, ErrNotCommand, Reply(nil, c.Message, true, nil))
+		return nil
+	})
+
+	require.Equal(t, nil, bus.Start())
+	defer bus.Shutdown()
+	require.Equal(t, nil, m.Start())
+
+	id, err := m.Begin([]byte("ok"))
+	require.Equal(t, nil, err)
+	inst := waitStatus(t, m, id, StatusCompleted)
+	require.Equal(t, []byte("ok:reserved"), inst.Data)
+	require.Equal(t, 1, inst.Step)
+
+	id, err = m.Begin([]byte("no money"))
+	require.Equal(t, nil, err)
+	waitStatus(t, m, id, StatusCompensated)
+	require.Equal(t, id, <-compensated)
+}
+
+func TestSagaTimeout(t *testing.T) {
+	bus := final.New("saga_svc", _example.NewDB(), memory.NewProvider(memory.NewBroker()), final.DefaultOptions().WithPurgeOnStartup(true))
+	compensated := make(chan string, 10)
+	m := newOrderSaga(bus, 200*time.Millisecond, compensated)
+
+	participant(bus, "stock.reserve", func(c *final.Context) (bool, []byte) {
+		return true, nil
+	})
+	// 支付服务不回复
+	bus.Subscribe("payment.charge").Handler(func(c *final.Context) error {
+		return nil
+	})
+	bus.Subscribe("stock.release").Handler(func(c *final.Context) error {
+		return nil
+	})
+
+	require.Equal(t, nil, bus.Start())
+	defer bus.Shutdown()
+	require.Equal(t, nil, m.Start())
+
+	id, err := m.Begin([]byte("ok"))
+	require.Equal(t, nil, err)
+	inst := waitStatus(t, m, id, StatusCompensated)
+	require.Equal(t, 1, inst.Step)
+	require.Equal(t, id, <-compensated)
+}
+
+func TestReplyNotCommand(t *testing.T) {
+	require.Equal(t, ErrNotCommand, Reply(nil, message.NewMessage("", "topic1", nil), true, nil))
+}
@@ -2,81 +2,356 @@ package final
 
 import (
 	"context"
+	"errors"
+	"hash/fnv"
 	"math/rand"
+	"sync/atomic"
 	"time"
 
 	"github.com/Rican7/retry"
 	"github.com/Rican7/retry/backoff"
 	"github.com/Rican7/retry/jitter"
 	"github.com/Rican7/retry/strategy"
-	"github.com/sirupsen/logrus"
+	"github.com/xyctruth/final/logger"
 	"github.com/xyctruth/final/message"
+	"github.com/xyctruth/final/mq"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// subscriber 启动 Options.NumSubscriber 个 goroutine 订阅消息队列中的消息 使用router处理消息
+var (
+	// errBatchFailed 一批消息中有处理失败的消息
+	errBatchFailed = errors.New("batch handle failure")
+	// ErrTopicQueuesRequired topic 的设置需要 mq 驱动为每个 topic 使用独立的队列（mq.ITopicSubscriber）
+	ErrTopicQueuesRequired = errors.New("mq provider with topic queues is required")
+)
+
+// subscriber 订阅消息队列中的消息 使用router处理消息
+// 默认启动 Options.NumSubscriber 个 subscriber，每个 subscriber 一个 goroutine
+// mq 驱动为每个 topic 使用独立的队列时（mq.ITopicSubscriber），每个 topic 一个 subscriber，启动 routerTopic 设置的 concurrency 个 goroutine
 type subscriber struct {
-	logger *logrus.Entry
+	logger logger.Logger
 	id     string
 	bus    *Bus
+
+	// topic 为空时订阅所有 topic
+	topic       string
+	concurrency int
+	prefetch    int
+	// orderByKey 按照 key 的 hash 把消息分配给 goroutine，相同 key 的消息按照顺序处理
+	orderByKey bool
+	// batchSize 大于 0 时使用 BatchHandler 批量处理消息
+	batchSize int
+	batchWait time.Duration
+
+	// running 正在运行的 goroutine 数量
+	running int32
 }
 
 func newSubscriber(id string, bus *Bus) *subscriber {
 	s := &subscriber{
-		logger: bus.logger.WithFields(logrus.Fields{
+		logger: bus.logger.WithFields(logger.Fields{
 			"module":        "subscriber",
 			"subscriber_id": id,
 		}),
-		id:  id,
-		bus: bus,
+		id:          id,
+		bus:         bus,
+		concurrency: 1,
 	}
 	return s
 }
 
+// newTopicSubscriber 创建只订阅 topic 的 subscriber
+func newTopicSubscriber(id string, topic *routerTopic, bus *Bus) *subscriber {
+	s := newSubscriber(id, bus)
+	s.logger = s.logger.WithField("topic", topic.name)
+	s.topic = topic.name
+	s.concurrency = topic.concurrency
+	if s.concurrency <= 0 {
+		s.concurrency = bus.opt.NumSubscriber
+	}
+	if bus.router.getBatchRoute(topic.name) != nil {
+		s.batchSize = topic.batchSize
+		if s.batchSize <= 0 {
+			s.batchSize = defaultBatchSize
+		}
+		s.batchWait = topic.batchWait
+		if s.batchWait <= 0 {
+			s.batchWait = defaultBatchWait
+		}
+	}
+	s.prefetch = topic.prefetch
+	if s.prefetch <= 0 {
+		// 批量处理时每个 goroutine 需要预取一整批消息
+		s.prefetch = s.concurrency
+		if topic.maxInFlight > 0 && topic.maxInFlight < s.prefetch {
+			s.prefetch = topic.maxInFlight
+		}
+		if s.batchSize > 0 {
+			s.prefetch *= s.batchSize
+		}
+	}
+	s.orderByKey = topic.orderByKey
+	return s
+}
+
 func (subscriber *subscriber) Start(ctx context.Context) error {
 	msgs := make(chan *message.Message)
-	err := subscriber.bus.mqProvider.Subscribe(ctx, subscriber.id, msgs)
+	var err error
+	if subscriber.topic == "" {
+		err = subscriber.bus.mqProvider.Subscribe(ctx, subscriber.id, msgs)
+	} else {
+		err = subscriber.bus.mqProvider.(mq.ITopicSubscriber).SubscribeTopic(ctx, subscriber.id, subscriber.topic, subscriber.prefetch, msgs)
+	}
 	if err != nil {
 		subscriber.logger.WithError(err).Error("Subscriber start failure")
 		return err
 	}
 	subscriber.logger.Info("Subscriber start success")
+
+	if !subscriber.orderByKey || subscriber.concurrency <= 1 {
+		for i := 0; i < subscriber.concurrency; i++ {
+			subscriber.work(ctx, msgs)
+		}
+		return nil
+	}
+
+	partitions := make([]chan *message.Message, subscriber.concurrency)
+	for i := range partitions {
+		partitions[i] = make(chan *message.Message)
+		subscriber.work(ctx, partitions[i])
+	}
+	go subscriber.dispatch(ctx, msgs, partitions)
+	return nil
+}
+
+// work 启动一个 goroutine 依次处理 msgs 中的消息
+func (subscriber *subscriber) work(ctx context.Context, msgs chan *message.Message) {
+	atomic.AddInt32(&subscriber.running, 1)
+	if subscriber.batchSize > 0 {
+		go subscriber.workBatch(ctx, msgs)
+		return
+	}
 	go func() {
+		defer atomic.AddInt32(&subscriber.running, -1)
 		for {
 			select {
 			case <-ctx.Done():
 				subscriber.logger.Info("Subscriber stop success")
 				return
 			case msg := <-msgs:
-				subscriber.processMessage(msg)
+				subscriber.processMessage(ctx, msg)
 			}
 		}
 	}()
+}
 
-	return nil
+// workBatch 收集 batchSize 条消息或者等待 batchWait 后批量处理
+// 退出时未处理的消息没有 Ack，由 mq 重新投递
+func (subscriber *subscriber) workBatch(ctx context.Context, msgs chan *message.Message) {
+	defer atomic.AddInt32(&subscriber.running, -1)
+
+	batch := make([]*message.Message, 0, subscriber.batchSize)
+	var timeout <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			subscriber.logger.Info("Subscriber stop success")
+			return
+		case msg := <-msgs:
+			batch = append(batch, msg)
+			if len(batch) == 1 {
+				timeout = time.After(subscriber.batchWait)
+			}
+			if len(batch) < subscriber.batchSize {
+				continue
+			}
+		case <-timeout:
+		}
+
+		subscriber.processBatch(ctx, subscriber.topic, batch)
+		batch = make([]*message.Message, 0, subscriber.batchSize)
+		timeout = nil
+	}
+}
+
+// dispatch 按照 key 的 hash 把消息分配到 partitions，没有 key 的消息使用 UUID 的 hash
+func (subscriber *subscriber) dispatch(ctx context.Context, msgs chan *message.Message, partitions []chan *message.Message) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-msgs:
+			key := msg.Key()
+			if key == "" {
+				key = msg.UUID
+			}
+			h := fnv.New32a()
+			_, _ = h.Write([]byte(key))
+			select {
+			case <-ctx.Done():
+				return
+			case partitions[h.Sum32()%uint32(len(partitions))] <- msg:
+			}
+		}
+	}
+}
+
+// isRunning 所有 goroutine 都在运行
+func (subscriber *subscriber) isRunning() bool {
+	return int(atomic.LoadInt32(&subscriber.running)) == subscriber.concurrency
 }
 
-func (subscriber *subscriber) processMessage(msg *message.Message) {
+// processMessage 处理消息，ctx 结束时停止等待 topic 的限流，消息不 Ack 也不 Reject，由 mq 重新投递
+func (subscriber *subscriber) processMessage(ctx context.Context, msg *message.Message) {
+	topic := subscriber.bus.router.topics[msg.Topic]
+	if err := topic.acquire(ctx); err != nil {
+		return
+	}
+	defer topic.release()
+
 	subscriber.logger.Info("processMessage")
+	subscriber.bus.metrics.consumed(msg.Topic)
+	subscriber.bus.hooks.received(msg)
+
+	spanCtx, span := subscriber.bus.tracing.startConsumer(msg)
 
+	var lastErr error
 	retryAction := func(attempt uint) error {
-		return subscriber.bus.router.handle(msg)
+		if err := topic.wait(ctx, 1); err != nil {
+			return err
+		}
+		if err := topic.circuitBreaker().allow(ctx); err != nil {
+			return err
+		}
+		if attempt > 1 {
+			subscriber.bus.metrics.retried(msg.Topic)
+			subscriber.bus.hooks.retried(msg, attempt, lastErr)
+		}
+		start := time.Now()
+		lastErr = subscriber.bus.router.handle(spanCtx, msg)
+		subscriber.bus.metrics.observeHandle(msg.Topic, time.Since(start))
+		subscriber.bus.hooks.handled(msg, lastErr)
+		topic.circuitBreaker().record(lastErr)
+		return lastErr
+	}
+
+	err := subscriber.retry(retryAction)
+	endSpan(span, err)
+
+	if err != nil && ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		msg.Reject()
+		subscriber.bus.metrics.rejected(msg.Topic)
+		subscriber.bus.hooks.rejected(msg, err)
+		subscriber.logger.WithError(err).Error("Handle failure")
+		return
+	}
+	msg.Ack()
+}
+
+// processBatch 批量处理消息，处理成功的消息立即 Ack，处理失败的消息组成新的一批重试
+func (subscriber *subscriber) processBatch(ctx context.Context, topic string, msgs []*message.Message) {
+	routerTopic := subscriber.bus.router.topics[topic]
+	if err := routerTopic.acquire(ctx); err != nil {
+		return
+	}
+	defer routerTopic.release()
+
+	subscriber.logger.WithField("size", len(msgs)).Info("processBatch")
+	handler := subscriber.bus.router.getBatchRoute(topic)
+
+	ctxs := make([]context.Context, len(msgs))
+	spans := make([]trace.Span, len(msgs))
+	for i, msg := range msgs {
+		subscriber.bus.metrics.consumed(msg.Topic)
+		subscriber.bus.hooks.received(msg)
+		ctxs[i], spans[i] = subscriber.bus.tracing.startConsumer(msg)
+	}
+
+	// pending 等待处理的消息在 msgs 中的下标
+	pending := make([]int, len(msgs))
+	for i := range pending {
+		pending[i] = i
+	}
+	errs := make([]error, len(msgs))
+
+	retryAction := func(attempt uint) error {
+		if err := routerTopic.wait(ctx, len(pending)); err != nil {
+			return err
+		}
+		if err := routerTopic.circuitBreaker().allow(ctx); err != nil {
+			return err
+		}
+		batchMsgs := make([]*message.Message, 0, len(pending))
+		batchCtxs := make([]context.Context, 0, len(pending))
+		for _, i := range pending {
+			if attempt > 1 {
+				subscriber.bus.metrics.retried(topic)
+				subscriber.bus.hooks.retried(msgs[i], attempt, errs[i])
+			}
+			batchMsgs = append(batchMsgs, msgs[i])
+			batchCtxs = append(batchCtxs, ctxs[i])
+		}
+
+		c := newBatchContext(topic, batchMsgs, batchCtxs)
+		start := time.Now()
+		err := handler(c)
+		subscriber.bus.metrics.observeHandle(topic, time.Since(start))
+
+		failed := make([]int, 0)
+		for j, i := range pending {
+			errs[i] = c.Err(j)
+			if errs[i] == nil {
+				errs[i] = err
+			}
+			subscriber.bus.hooks.handled(msgs[i], errs[i])
+			if errs[i] != nil {
+				failed = append(failed, i)
+				continue
+			}
+			endSpan(spans[i], nil)
+			msgs[i].Ack()
+		}
+		if err == nil && len(failed) == len(batchMsgs) {
+			// 整批消息都处理失败
+			err = errBatchFailed
+		}
+		routerTopic.circuitBreaker().record(err)
+		pending = failed
+
+		if len(pending) > 0 {
+			return errBatchFailed
+		}
+		return nil
 	}
 
+	err := subscriber.retry(retryAction)
+
+	for _, i := range pending {
+		endSpan(spans[i], errs[i])
+		if err != nil && ctx.Err() != nil {
+			continue
+		}
+		msgs[i].Reject()
+		subscriber.bus.metrics.rejected(topic)
+		subscriber.bus.hooks.rejected(msgs[i], errs[i])
+		subscriber.logger.WithError(errs[i]).WithField("uuid", msgs[i].UUID).Error("Handle failure")
+	}
+}
+
+// retry 重试 action 直到成功或者重试次数用完
+// topic 的熔断器打开时 action 在调用 handler 之前等待，等待期间不消耗重试次数
+func (subscriber *subscriber) retry(action retry.Action) error {
 	seed := time.Now().UnixNano()
 	random := rand.New(rand.NewSource(seed))
 
-	err := retry.Retry(retryAction,
+	return retry.Retry(action,
 		// github.com/Rican7/retry v3版本limit包含第一次尝试的次数
 		strategy.Limit(subscriber.bus.opt.RetryCount+1),
 		strategy.BackoffWithJitter(
 			backoff.BinaryExponential(subscriber.bus.opt.RetryInterval),
 			jitter.Deviation(random, 0.5),
 		))
-
-	if err != nil {
-		msg.Reject()
-		subscriber.logger.WithError(err).Error("Handle failure")
-		return
-	}
-	msg.Ack()
 }
@@ -0,0 +1,256 @@
+package final
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/xyctruth/final/message"
+)
+
+// topicProvider 为每个 topic 使用独立队列的 fakeProvider
+type topicProvider struct {
+	fakeProvider
+	prefetch map[string]int
+	msgs     map[string]chan *message.Message
+}
+
+func (p *topicProvider) TopicQueues() bool {
+	return true
+}
+
+func (p *topicProvider) SubscribeTopic(ctx context.Context, consumerTag, topic string, prefetch int, msgs chan *message.Message) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.prefetch[topic] = prefetch
+	p.msgs[topic] = msgs
+	return nil
+}
+
+func TestNewSubscribers(t *testing.T) {
+	bus := New("test_svc", nil, &fakeProvider{}, DefaultOptions().WithNumSubscriber(3))
+	bus.Subscribe("topic1")
+	subscribers, err := bus.newSubscribers()
+	require.Equal(t, nil, err)
+	require.Equal(t, 3, len(subscribers))
+	for _, s := range subscribers {
+		require.Equal(t, "", s.topic)
+		require.Equal(t, 1, s.concurrency)
+	}
+
+	bus = New("test_svc", nil, &topicProvider{}, DefaultOptions().WithNumSubscriber(3))
+	bus.Subscribe("topic1").Concurrency(2)
+	bus.Subscribe("topic2").Concurrency(4).Prefetch(10)
+	bus.Subscribe("topic3")
+	subscribers, err = bus.newSubscribers()
+	require.Equal(t, nil, err)
+	require.Equal(t, 3, len(subscribers))
+
+	got := make(map[string][2]int)
+	for _, s := range subscribers {
+		got[s.topic] = [2]int{s.concurrency, s.prefetch}
+	}
+	require.Equal(t, map[string][2]int{
+		"topic1": {2, 2},
+		"topic2": {4, 10},
+		"topic3": {3, 3},
+	}, got)
+}
+
+func TestNewSubscribersSharedQueue(t *testing.T) {
+	// 共享队列无法保证相同 key 的消息顺序处理
+	bus := New("test_svc", nil, &fakeProvider{}, DefaultOptions())
+	bus.Subscribe("topic1").OrderByKey().Handler(func(c *Context) error { return nil })
+	_, err := bus.newSubscribers()
+	require.ErrorIs(t, err, ErrTopicQueuesRequired)
+
+	// 共享队列的消息逐条到达，无法批量处理
+	bus = New("test_svc", nil, &fakeProvider{}, DefaultOptions())
+	bus.Subscribe("topic1").BatchHandler(func(c *BatchContext) error { return nil })
+	_, err = bus.newSubscribers()
+	require.ErrorIs(t, err, ErrTopicQueuesRequired)
+
+	// 共享队列的 Qos 无法按照 topic 限制
+	bus = New("test_svc", nil, &fakeProvider{}, DefaultOptions())
+	bus.Subscribe("topic1").MaxInFlight(1).Handler(func(c *Context) error { return nil })
+	_, err = bus.newSubscribers()
+	require.ErrorIs(t, err, ErrTopicQueuesRequired)
+
+	// 等待熔断器会阻塞共享队列中其它 topic 的消息
+	bus = New("test_svc", nil, &fakeProvider{}, DefaultOptions())
+	bus.Subscribe("topic1").CircuitBreaker(1, time.Second).Handler(func(c *Context) error { return nil })
+	_, err = bus.newSubscribers()
+	require.ErrorIs(t, err, ErrTopicQueuesRequired)
+}
+
+func TestTopicSubscriberConcurrency(t *testing.T) {
+	provider := &topicProvider{prefetch: make(map[string]int), msgs: make(map[string]chan *message.Message)}
+	bus := New("test_svc", nil, provider, DefaultOptions().WithRetryCount(0))
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	release := make(chan struct{})
+	bus.Subscribe("topic1").Concurrency(3).Prefetch(5).Handler(func(c *Context) error {
+		wg.Done()
+		<-release
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	subscribers, err := bus.newSubscribers()
+	require.Equal(t, nil, err)
+	bus.subscribers = subscribers
+	require.Equal(t, nil, bus.subscribers[0].Start(ctx))
+	require.Equal(t, 5, provider.prefetch["topic1"])
+	require.True(t, bus.subscribers[0].isRunning())
+
+	msgs := make([]*message.Message, 0, 3)
+	for i := 0; i < 3; i++ {
+		msg := message.NewMessage("", "topic1", nil)
+		msgs = append(msgs, msg)
+		provider.msgs["topic1"] <- msg
+	}
+
+	// 3 条消息同时在处理
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("messages are not handled concurrently")
+	}
+
+	close(release)
+	for _, msg := range msgs {
+		select {
+		case <-msg.Acked():
+		case <-time.After(time.Second):
+			t.Fatal("message is not acked")
+		}
+	}
+}
+
+func TestTopicSubscriberOrderByKey(t *testing.T) {
+	provider := &topicProvider{prefetch: make(map[string]int), msgs: make(map[string]chan *message.Message)}
+	bus := New("test_svc", nil, provider, DefaultOptions().WithRetryCount(0))
+
+	var (
+		mutex    sync.Mutex
+		received = make(map[string][]int)
+		wg       sync.WaitGroup
+	)
+	bus.Subscribe("topic1").Concurrency(4).OrderByKey().Handler(func(c *Context) error {
+		defer wg.Done()
+		// 后收到的消息处理得更快，没有按照 key 分配时会乱序
+		seq := int(c.Message.Payload[0])
+		time.Sleep(time.Duration(40-seq) * 100 * time.Microsecond)
+		mutex.Lock()
+		received[c.Key] = append(received[c.Key], seq)
+		mutex.Unlock()
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	subscribers, err := bus.newSubscribers()
+	require.Equal(t, nil, err)
+	bus.subscribers = subscribers
+	require.Equal(t, nil, bus.subscribers[0].Start(ctx))
+
+	keys := []string{"order-1", "order-2", "order-3", "order-4", "order-5"}
+	wg.Add(40)
+	for i := 0; i < 40; i++ {
+		provider.msgs["topic1"] <- message.NewMessage("", "topic1", []byte{byte(i)}, message.WithKey(keys[i%len(keys)]))
+	}
+	wg.Wait()
+
+	for i, key := range keys {
+		seqs := received[key]
+		require.Equal(t, 8, len(seqs))
+		for j, seq := range seqs {
+			require.Equal(t, i+j*len(keys), seq)
+		}
+	}
+}
+
+func TestTopicSubscriberBatch(t *testing.T) {
+	provider := &topicProvider{prefetch: make(map[string]int), msgs: make(map[string]chan *message.Message)}
+	bus := New("test_svc", nil, provider, DefaultOptions().WithRetryCount(2).WithRetryInterval(time.Millisecond))
+
+	var (
+		mutex   sync.Mutex
+		sizes   []int
+		handled = make(map[string]int)
+	)
+	bus.Subscribe("topic1").Concurrency(1).Batch(5, 50*time.Millisecond).BatchHandler(func(c *BatchContext) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		sizes = append(sizes, c.Len())
+		for i, msg := range c.Messages {
+			handled[msg.UUID]++
+			if string(msg.Payload) == "fail" {
+				c.Fail(i, errors.New("handle failure"))
+			}
+		}
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	subscribers, err := bus.newSubscribers()
+	require.Equal(t, nil, err)
+	bus.subscribers = subscribers
+	require.Equal(t, nil, bus.subscribers[0].Start(ctx))
+	require.Equal(t, 5, provider.prefetch["topic1"])
+
+	msgs := make([]*message.Message, 0, 7)
+	for i := 0; i < 7; i++ {
+		payload := []byte("ok")
+		if i == 1 {
+			payload = []byte("fail")
+		}
+		msg := message.NewMessage(strconv.Itoa(i), "topic1", payload)
+		msgs = append(msgs, msg)
+		provider.msgs["topic1"] <- msg
+	}
+
+	for i, msg := range msgs {
+		result := msg.Acked()
+		if i == 1 {
+			result = msg.Rejected()
+		}
+		select {
+		case <-result:
+		case <-time.After(time.Second):
+			t.Fatalf("message %d is not acked or rejected", i)
+		}
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	// 第一批 5 条消息，失败的消息单独重试 2 次，剩下的 2 条消息等待 50ms 后处理
+	require.Equal(t, 5, sizes[0])
+	require.Equal(t, 3, handled["1"])
+	for i := 0; i < 7; i++ {
+		if i != 1 {
+			require.Equal(t, 1, handled[strconv.Itoa(i)])
+		}
+	}
+	require.Equal(t, 7+2, sum(sizes))
+}
+
+func sum(values []int) int {
+	total := 0
+	for _, v := range values {
+		total += v
+	}
+	return total
+}
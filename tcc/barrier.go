@@ -0,0 +1,121 @@
+package tcc
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lopezator/migrator"
+	"github.com/xyctruth/final"
+)
+
+// Barrier 参与者本地的分支事务屏障，保存在参与者的数据库中
+//   Try、Confirm 和 Cancel 在参与者数据库的同一个事务中先插入屏障记录再执行，屏障记录与业务修改一起提交或回滚
+//   重复的 Try、Confirm 和 Cancel 不再执行（幂等），没有执行过 Try 的 Cancel 不执行（空回滚），
+//   Cancel 同时插入 Try 的屏障记录，之后到达的 Try 被拒绝（防悬挂）
+//   db 与 Bus 的 outbox 使用同一个数据库时，可以通过 BranchContext.TxBus 在同一个事务中发布消息
+type Barrier struct {
+	db    *sql.DB
+	table string
+}
+
+// NewBarrier 创建分支事务屏障，在 db 中创建屏障表 table
+func NewBarrier(db *sql.DB, table string) (*Barrier, error) {
+	b := &Barrier{db: db, table: table}
+	if err := b.init(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *Barrier) init() error {
+	m, err := migrator.New(
+		migrator.TableName(fmt.Sprintf("%s_migrations", b.table)),
+		migrator.Migrations(
+			&migrator.Migration{
+				Name: "init tcc barrier table",
+				Func: func(tx *sql.Tx) error {
+					barrierSQL := `CREATE TABLE IF NOT EXISTS ` + b.table + `
+								(
+									branch_id varchar(64) not null,
+									action    varchar(16) not null,
+									xid       varchar(64) not null,
+									reason    varchar(16) not null,
+									create_at datetime(3) null,
+									primary key (branch_id, action)
+								);`
+					_, err := tx.Exec(barrierSQL)
+					return err
+				},
+			},
+		),
+	)
+	if err != nil {
+		return err
+	}
+	return m.Migrate(b.db)
+}
+
+// call 在参与者数据库的事务中插入屏障记录，需要执行时调用 fn
+func (b *Barrier) call(bus *final.Bus, c *BranchContext, fn func(c *BranchContext) error) error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+	return bus.Transaction(tx, func(txBus *final.TxBus) error {
+		c.TxBus = txBus
+		defer func() {
+			c.TxBus = nil
+		}()
+
+		inserted, err := b.insert(tx, c, c.Action, c.Action)
+		if err != nil {
+			return err
+		}
+		if !inserted {
+			if c.Action != ActionTry {
+				return nil
+			}
+			// Try 的屏障记录由 Cancel 插入，Try 到达之前分支事务已经回滚
+			reason, err := b.reason(tx, c.BranchID, ActionTry)
+			if err != nil {
+				return err
+			}
+			if reason == ActionCancel {
+				return ErrHangingTry
+			}
+			return nil
+		}
+
+		if c.Action == ActionCancel {
+			// Try 的屏障记录插入成功说明没有执行过 Try，空回滚
+			inserted, err = b.insert(tx, c, ActionTry, ActionCancel)
+			if err != nil || inserted {
+				return err
+			}
+		}
+
+		if fn == nil {
+			return nil
+		}
+		return fn(c)
+	})
+}
+
+// insert 插入屏障记录，记录已经存在时返回 false
+// 并发的 Try 和 Cancel 插入同一条记录时，后插入的一方等待先插入的事务结束
+func (b *Barrier) insert(tx *sql.Tx, c *BranchContext, action, reason string) (bool, error) {
+	result, err := tx.Exec("INSERT IGNORE INTO "+b.table+" (branch_id,action,xid,reason,create_at) VALUES (?,?,?,?,?)",
+		c.BranchID, action, c.XID, reason, time.Now())
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected == 1, err
+}
+
+func (b *Barrier) reason(tx *sql.Tx, branchID, action string) (string, error) {
+	var reason string
+	err := tx.QueryRow("SELECT reason FROM "+b.table+" WHERE branch_id = ? AND action = ? FOR UPDATE", branchID, action).Scan(&reason)
+	return reason, err
+}
@@ -0,0 +1,312 @@
+package tcc
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lopezator/migrator"
+	uuidtools "github.com/satori/go.uuid"
+	"github.com/xyctruth/final"
+	"github.com/xyctruth/final/logger"
+	"github.com/xyctruth/final/message"
+)
+
+// Coordinator TCC 事务协调者，全局事务和分支事务的状态保存在与 outbox 相同的数据库中
+//   Try 通过 Bus.Request 同步调用参与者，需要 mq 驱动支持 request/reply（mq.IReplier）
+//   Commit 和 Rollback 在一个数据库事务中修改状态并通过 TxBus 暂存 Confirm、Cancel 命令，由 outbox 保证投递
+//   Start 后定期恢复 Try 阶段超过 Options.RecoverAfter 的全局事务，例如协调者在 Try 阶段重启，这些全局事务被回滚
+type Coordinator struct {
+	bus    *final.Bus
+	db     *sql.DB
+	opt    Options
+	logger logger.Logger
+
+	globalTable string
+	branchTable string
+}
+
+// NewCoordinator 创建 TCC 事务协调者
+func NewCoordinator(bus *final.Bus, db *sql.DB, opt Options) *Coordinator {
+	return &Coordinator{
+		bus: bus,
+		db:  db,
+		opt: opt,
+		logger: bus.Logger().WithFields(logger.Fields{
+			"module": "tcc",
+		}),
+		globalTable: opt.TablePrefix + "_global",
+		branchTable: opt.TablePrefix + "_branch",
+	}
+}
+
+// Start 创建全局事务表和分支事务表，恢复未完成的全局事务并开始定期扫描，在 Bus.Start 之后调用
+func (c *Coordinator) Start(ctx context.Context) error {
+	if err := c.init(); err != nil {
+		return err
+	}
+	c.recovering()
+
+	go func() {
+		loop := time.NewTicker(c.opt.RecoverInterval)
+		defer loop.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				c.logger.Info("tcc coordinator stop success")
+				return
+			case <-loop.C:
+				c.recovering()
+			}
+		}
+	}()
+	c.logger.Info("tcc coordinator start success")
+	return nil
+}
+
+func (c *Coordinator) init() error {
+	m, err := migrator.New(
+		migrator.TableName(fmt.Sprintf("%s_migrations", c.opt.TablePrefix)),
+		migrator.Migrations(
+			&migrator.Migration{
+				Name: "init tcc tables",
+				Func: func(tx *sql.Tx) error {
+					globalSQL := `CREATE TABLE IF NOT EXISTS ` + c.globalTable + `
+								(
+									xid       varchar(64) primary key,
+									status    tinyint     not null,
+									create_at datetime(3) null,
+									update_at datetime(3) null,
+									index idx_status_update_at (status, update_at)
+								);`
+					if _, err := tx.Exec(globalSQL); err != nil {
+						return err
+					}
+
+					branchSQL := `CREATE TABLE IF NOT EXISTS ` + c.branchTable + `
+								(
+									id        varchar(64)  primary key,
+									xid       varchar(64)  not null,
+									topic     varchar(255) not null,
+									payload   longblob     null,
+									status    tinyint      not null,
+									create_at datetime(3)  null,
+									update_at datetime(3)  null,
+									index idx_xid (xid)
+								);`
+					_, err := tx.Exec(branchSQL)
+					return err
+				},
+			},
+		),
+	)
+	if err != nil {
+		c.logger.WithError(err).Error("migrator error")
+		return err
+	}
+	if err = m.Migrate(c.db); err != nil {
+		c.logger.WithError(err).Error("migrator up error")
+		return err
+	}
+	return nil
+}
+
+// Begin 开始一个全局事务
+func (c *Coordinator) Begin() (*Transaction, error) {
+	now := time.Now()
+	xid := uuidtools.NewV4().String()
+	_, err := c.db.Exec("INSERT INTO "+c.globalTable+" (xid,status,create_at,update_at) VALUES (?,?,?,?)", xid, StatusTrying, now, now)
+	if err != nil {
+		return nil, err
+	}
+	return &Transaction{XID: xid, coordinator: c}, nil
+}
+
+// Execute 开始一个全局事务并执行 fn，fn 返回 nil 时提交，否则回滚并返回 fn 的错误
+func (c *Coordinator) Execute(fn func(tx *Transaction) error) error {
+	tx, err := c.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err = fn(tx); err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			c.logger.WithError(rollbackErr).WithField("xid", tx.XID).Error("tcc rollback error")
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+// Status 返回全局事务的状态
+func (c *Coordinator) Status(xid string) (Status, error) {
+	var status Status
+	err := c.db.QueryRow("SELECT status FROM "+c.globalTable+" WHERE xid = ?", xid).Scan(&status)
+	if errors.Is(err, sql.ErrNoRows) {
+		return status, ErrNotFound
+	}
+	return status, err
+}
+
+// addBranch 在调用 Try 之前注册分支事务，回滚时即使没有收到 Try 的回复也会发送 Cancel
+func (c *Coordinator) addBranch(xid, branchID, topic string, payload []byte) error {
+	return c.transaction(func(txBus *final.TxBus) error {
+		tx := txBus.Tx()
+		// 锁定全局事务，避免与 Commit、Rollback 和恢复并发
+		status, err := c.lockGlobal(tx, xid)
+		if err != nil {
+			return err
+		}
+		if status != StatusTrying {
+			return ErrNotTrying
+		}
+
+		now := time.Now()
+		_, err = tx.Exec("INSERT INTO "+c.branchTable+" (id,xid,topic,payload,status,create_at,update_at) VALUES (?,?,?,?,?,?,?)",
+			branchID, xid, topic, payload, StatusTrying, now, now)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE "+c.globalTable+" SET update_at = ? WHERE xid = ?", now, xid)
+		return err
+	})
+}
+
+func (c *Coordinator) setBranchStatus(branchID string, status Status) error {
+	_, err := c.db.Exec("UPDATE "+c.branchTable+" SET status = ?, update_at = ? WHERE id = ? AND status = ?", status, time.Now(), branchID, StatusTrying)
+	return err
+}
+
+// finish 提交或回滚全局事务
+func (c *Coordinator) finish(xid string, status Status) error {
+	return c.transaction(func(txBus *final.TxBus) error {
+		return c.finishTx(txBus, xid, status)
+	})
+}
+
+// finishTx 修改全局事务和分支事务的状态，并在同一个数据库事务中暂存所有分支的 Confirm 或 Cancel 命令
+func (c *Coordinator) finishTx(txBus *final.TxBus, xid string, status Status) error {
+	tx := txBus.Tx()
+	current, err := c.lockGlobal(tx, xid)
+	if err != nil {
+		return err
+	}
+	switch {
+	case current == status:
+		return nil
+	case current == StatusConfirmed && status == StatusCancelled:
+		return ErrAlreadyConfirmed
+	case current != StatusTrying:
+		return ErrNotTrying
+	}
+
+	rows, err := tx.Query("SELECT id,topic,payload,status FROM "+c.branchTable+" WHERE xid = ? ORDER BY create_at ASC", xid)
+	if err != nil {
+		return err
+	}
+	type branch struct {
+		id      string
+		topic   string
+		payload []byte
+		status  Status
+	}
+	branches := make([]branch, 0)
+	for rows.Next() {
+		var b branch
+		if err := rows.Scan(&b.id, &b.topic, &b.payload, &b.status); err != nil {
+			rows.Close()
+			return err
+		}
+		branches = append(branches, b)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	action := ActionCancel
+	if status == StatusConfirmed {
+		action = ActionConfirm
+		for _, b := range branches {
+			if b.status != StatusTried {
+				return ErrNotTried
+			}
+		}
+	}
+
+	for _, b := range branches {
+		err = txBus.Publish(b.topic, b.payload,
+			message.WithHeader(XIDHeader, xid),
+			message.WithHeader(BranchHeader, b.id),
+			message.WithHeader(ActionHeader, action),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	if _, err = tx.Exec("UPDATE "+c.branchTable+" SET status = ?, update_at = ? WHERE xid = ?", status, now, xid); err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE "+c.globalTable+" SET status = ?, update_at = ? WHERE xid = ?", status, now, xid)
+	if err != nil {
+		return err
+	}
+	c.logger.WithField("xid", xid).WithField("status", status.String()).WithField("branches", len(branches)).Info("tcc transaction finished")
+	return nil
+}
+
+// recovering 回滚 Try 阶段超过 Options.RecoverAfter 的全局事务
+func (c *Coordinator) recovering() {
+	err := c.transaction(func(txBus *final.TxBus) error {
+		tx := txBus.Tx()
+		before := time.Now().Add(-c.opt.RecoverAfter)
+		rows, err := tx.Query("SELECT xid FROM "+c.globalTable+" WHERE status = ? AND update_at < ? ORDER BY update_at ASC LIMIT ? FOR UPDATE",
+			StatusTrying, before, c.opt.RecoverLimit)
+		if err != nil {
+			return err
+		}
+		xids := make([]string, 0)
+		for rows.Next() {
+			var xid string
+			if err := rows.Scan(&xid); err != nil {
+				rows.Close()
+				return err
+			}
+			xids = append(xids, xid)
+		}
+		rows.Close()
+
+		for _, xid := range xids {
+			c.logger.WithField("xid", xid).Warn("recovering tcc transaction, cancel")
+			if err := c.finishTx(txBus, xid, StatusCancelled); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		c.logger.WithError(err).Error("tcc recovering failure")
+	}
+}
+
+func (c *Coordinator) lockGlobal(tx *sql.Tx, xid string) (Status, error) {
+	var status Status
+	err := tx.QueryRow("SELECT status FROM "+c.globalTable+" WHERE xid = ? FOR UPDATE", xid).Scan(&status)
+	if errors.Is(err, sql.ErrNoRows) {
+		return status, ErrNotFound
+	}
+	return status, err
+}
+
+// transaction 在数据库事务中执行 fc，fc 返回 nil 时提交事务并发送暂存的命令
+func (c *Coordinator) transaction(fc func(txBus *final.TxBus) error) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	return c.bus.Transaction(tx, fc)
+}
@@ -0,0 +1,52 @@
+package tcc
+
+import "time"
+
+type Options struct {
+	// TablePrefix 全局事务表 <TablePrefix>_global 和分支事务表 <TablePrefix>_branch 的前缀，与 outbox 使用同一个数据库
+	TablePrefix string
+	// RecoverAfter Try 阶段超过该时间仍然没有 Commit 或 Rollback 的全局事务被恢复（取消）
+	RecoverAfter time.Duration
+	// RecoverInterval 扫描需要恢复的全局事务的间隔
+	RecoverInterval time.Duration
+	// RecoverLimit 每次扫描最多恢复的全局事务数量
+	RecoverLimit int
+}
+
+// DefaultOptions tcc 默认配置
+func DefaultOptions() Options {
+	return Options{
+		TablePrefix:     "final_tcc",
+		RecoverAfter:    time.Minute,
+		RecoverInterval: 30 * time.Second,
+		RecoverLimit:    100,
+	}
+}
+
+// WithTablePrefix 设置全局事务表和分支事务表的前缀
+// The default value of TablePrefix is final_tcc.
+func (opt Options) WithTablePrefix(val string) Options {
+	opt.TablePrefix = val
+	return opt
+}
+
+// WithRecoverAfter 设置 Try 阶段多久之后的全局事务被恢复
+// The default value of RecoverAfter is 1 minute.
+func (opt Options) WithRecoverAfter(val time.Duration) Options {
+	opt.RecoverAfter = val
+	return opt
+}
+
+// WithRecoverInterval 设置扫描需要恢复的全局事务的间隔
+// The default value of RecoverInterval is 30 second.
+func (opt Options) WithRecoverInterval(val time.Duration) Options {
+	opt.RecoverInterval = val
+	return opt
+}
+
+// WithRecoverLimit 设置每次扫描最多恢复的全局事务数量
+// The default value of RecoverLimit is 100.
+func (opt Options) WithRecoverLimit(val int) Options {
+	opt.RecoverLimit = val
+	return opt
+}
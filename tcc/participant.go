@@ -0,0 +1,78 @@
+package tcc
+
+import (
+	"errors"
+
+	"github.com/xyctruth/final"
+	"github.com/xyctruth/final/message"
+)
+
+// ErrHangingTry 分支事务已经回滚，迟到的 Try 被拒绝
+var ErrHangingTry = errors.New("tcc branch is cancelled, hanging try refused")
+
+type (
+	// Participant 参与者的 Try、Confirm 和 Cancel
+	// Confirm 和 Cancel 通过 outbox 可靠投递，可能重复执行，需要保证幂等
+	// Cancel 可能在 Try 之前或者没有执行 Try 时收到（空回滚），也需要正确处理
+	// Barrier 不为 nil 时，Try、Confirm 和 Cancel 在参与者数据库的事务中通过屏障执行，
+	// 由屏障处理幂等、空回滚和迟到的 Try（防悬挂）
+	Participant struct {
+		Try     func(c *BranchContext) error
+		Confirm func(c *BranchContext) error
+		Cancel  func(c *BranchContext) error
+		Barrier *Barrier
+	}
+
+	// BranchContext 参与者处理分支事务的上下文
+	// 设置了 Participant.Barrier 时，TxBus 是屏障所在的事务，通过 TxBus.Tx() 修改业务数据
+	BranchContext struct {
+		*final.Context
+		XID      string
+		BranchID string
+		Action   string
+		TxBus    *final.TxBus
+	}
+)
+
+// Register 订阅 topic 并按照 ActionHeader 调用参与者的 Try、Confirm 或 Cancel
+// Try 的结果通过 Context.Reply 回复给协调者，Confirm 和 Cancel 返回 error 时按照 Bus 的重试策略重试
+// 设置了 Barrier 时，Cancel 之后到达的 Try 不会执行，回复 ErrHangingTry
+func Register(bus *final.Bus, topic string, p Participant) {
+	bus.Subscribe(topic).Handler(func(c *final.Context) error {
+		bc := &BranchContext{Context: c}
+		bc.XID, _ = c.Message.Header[XIDHeader].(string)
+		bc.BranchID, _ = c.Message.Header[BranchHeader].(string)
+		bc.Action, _ = c.Message.Header[ActionHeader].(string)
+
+		switch bc.Action {
+		case ActionTry:
+			result, errText := ResultSuccess, ""
+			if err := p.call(bus, bc, p.Try); err != nil {
+				if errors.Is(err, ErrHangingTry) {
+					bus.Logger().WithField("xid", bc.XID).WithField("branch", bc.BranchID).Warn("hanging try refused")
+				}
+				result, errText = ResultFailure, err.Error()
+			}
+			return c.Reply(nil,
+				message.WithHeader(ResultHeader, result),
+				message.WithHeader(ErrorHeader, errText),
+			)
+		case ActionConfirm:
+			return p.call(bus, bc, p.Confirm)
+		case ActionCancel:
+			return p.call(bus, bc, p.Cancel)
+		}
+		return nil
+	})
+}
+
+// call 设置了 Barrier 时通过屏障调用 fn
+func (p Participant) call(bus *final.Bus, c *BranchContext, fn func(c *BranchContext) error) error {
+	if p.Barrier != nil {
+		return p.Barrier.call(bus, c, fn)
+	}
+	if fn == nil {
+		return nil
+	}
+	return fn(c)
+}
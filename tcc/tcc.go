@@ -0,0 +1,129 @@
+package tcc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	uuidtools "github.com/satori/go.uuid"
+	"github.com/xyctruth/final/message"
+)
+
+const (
+	// XIDHeader 全局事务的 id
+	XIDHeader = "x-final-tcc-xid"
+	// BranchHeader 分支事务的 id
+	BranchHeader = "x-final-tcc-branch"
+	// ActionHeader 分支事务的操作，ActionTry、ActionConfirm 或 ActionCancel
+	ActionHeader = "x-final-tcc-action"
+	// ResultHeader Try 回复中的结果，ResultSuccess 或 ResultFailure
+	ResultHeader = "x-final-tcc-result"
+	// ErrorHeader Try 失败时回复中的错误信息
+	ErrorHeader = "x-final-tcc-error"
+)
+
+const (
+	ActionTry     = "try"
+	ActionConfirm = "confirm"
+	ActionCancel  = "cancel"
+
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+)
+
+// Status 全局事务和分支事务的状态
+type Status uint8
+
+const (
+	StatusTrying    Status = iota // 全局事务正在执行 Try，分支事务已经发送 Try 还没有收到回复
+	StatusTried                   // 分支事务 Try 成功
+	StatusTryFailed               // 分支事务 Try 失败或者超时
+	StatusConfirmed               // 已经提交，Confirm 命令暂存在 outbox 中可靠投递
+	StatusCancelled               // 已经回滚，Cancel 命令暂存在 outbox 中可靠投递
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusTrying:
+		return "trying"
+	case StatusTried:
+		return "tried"
+	case StatusTryFailed:
+		return "try_failed"
+	case StatusConfirmed:
+		return "confirmed"
+	case StatusCancelled:
+		return "cancelled"
+	default:
+		return "unknown"
+	}
+}
+
+var (
+	// ErrNotFound 全局事务不存在
+	ErrNotFound = errors.New("tcc transaction not found")
+	// ErrNotTrying 全局事务已经提交或回滚
+	ErrNotTrying = errors.New("tcc transaction is not trying")
+	// ErrAlreadyConfirmed 已经提交的全局事务不能回滚
+	ErrAlreadyConfirmed = errors.New("tcc transaction is already confirmed")
+	// ErrNotTried 存在 Try 没有成功的分支事务，不能提交
+	ErrNotTried = errors.New("tcc branch is not tried")
+)
+
+// TryError 参与者的 Try 返回了错误
+type TryError struct {
+	Topic string
+	Msg   string
+}
+
+func (e *TryError) Error() string {
+	return fmt.Sprintf("tcc try %s failure: %s", e.Topic, e.Msg)
+}
+
+// Transaction 全局事务
+type Transaction struct {
+	XID         string
+	coordinator *Coordinator
+}
+
+// Try 注册分支事务并通过 Bus.Request 调用参与者的 Try，等待参与者回复
+// 返回 error 时调用者需要 Rollback，ctx 控制等待回复的超时时间
+func (tx *Transaction) Try(ctx context.Context, topic string, payload []byte) error {
+	c := tx.coordinator
+	branchID := uuidtools.NewV4().String()
+	if err := c.addBranch(tx.XID, branchID, topic, payload); err != nil {
+		return err
+	}
+
+	reply, err := c.bus.Request(ctx, topic, payload,
+		message.WithHeader(XIDHeader, tx.XID),
+		message.WithHeader(BranchHeader, branchID),
+		message.WithHeader(ActionHeader, ActionTry),
+	)
+	if err == nil {
+		if result, _ := reply.Header[ResultHeader].(string); result != ResultSuccess {
+			msg, _ := reply.Header[ErrorHeader].(string)
+			err = &TryError{Topic: topic, Msg: msg}
+		}
+	}
+
+	status := StatusTried
+	if err != nil {
+		status = StatusTryFailed
+	}
+	if updateErr := c.setBranchStatus(branchID, status); updateErr != nil {
+		return updateErr
+	}
+	return err
+}
+
+// Commit 提交全局事务，所有分支事务的 Confirm 命令与全局事务的状态在同一个数据库事务中暂存到 outbox
+func (tx *Transaction) Commit() error {
+	return tx.coordinator.finish(tx.XID, StatusConfirmed)
+}
+
+// Rollback 回滚全局事务，所有分支事务的 Cancel 命令与全局事务的状态在同一个数据库事务中暂存到 outbox
+// 已经回滚的全局事务返回 nil
+func (tx *Transaction) Rollback() error {
+	return tx.coordinator.finish(tx.XID, StatusCancelled)
+}
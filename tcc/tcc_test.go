@@ -0,0 +1,196 @@
+package tcc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	uuidtools "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/require"
+	"github.com/xyctruth/final"
+	"github.com/xyctruth/final/_example"
+	"github.com/xyctruth/final/message"
+	"github.com/xyctruth/final/mq/memory"
+)
+
+// newTestBus 使用内存驱动创建 Bus，注册库存和账户两个参与者，actions 记录参与者收到的操作
+func newTestBus(t *testing.T, actions chan string) (*final.Bus, *Coordinator) {
+	bus := final.New("tcc_svc", _example.NewDB(), memory.NewProvider(memory.NewBroker()), final.DefaultOptions().WithPurgeOnStartup(true))
+	for _, topic := range []string{"stock", "account"} {
+		topic := topic
+		Register(bus, topic, Participant{
+			Try: func(c *BranchContext) error {
+				actions <- topic + "." + c.Action
+				if string(c.Message.Payload) == "fail" {
+					return errors.New("insufficient")
+				}
+				return nil
+			},
+			Confirm: func(c *BranchContext) error {
+				actions <- topic + "." + c.Action
+				return nil
+			},
+			Cancel: func(c *BranchContext) error {
+				actions <- topic + "." + c.Action
+				return nil
+			},
+		})
+	}
+	require.Equal(t, nil, bus.Start())
+	t.Cleanup(func() {
+		_ = bus.Shutdown()
+	})
+	return bus, NewCoordinator(bus, _example.NewDB(), DefaultOptions().WithTablePrefix("final_test_tcc").WithRecoverAfter(100*time.Millisecond).WithRecoverInterval(100*time.Millisecond))
+}
+
+func receive(t *testing.T, actions chan string, n int) []string {
+	received := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		select {
+		case action := <-actions:
+			received = append(received, action)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %v, want %d actions", received, n)
+		}
+	}
+	return received
+}
+
+func TestCoordinatorCommit(t *testing.T) {
+	actions := make(chan string, 10)
+	_, c := newTestBus(t, actions)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	require.Equal(t, nil, c.Start(ctx))
+
+	var xid string
+	err := c.Execute(func(tx *Transaction) error {
+		xid = tx.XID
+		if err := tx.Try(ctx, "stock", []byte("1")); err != nil {
+			return err
+		}
+		return tx.Try(ctx, "account", []byte("1"))
+	})
+	require.Equal(t, nil, err)
+	require.Equal(t, []string{"stock.try", "account.try"}, receive(t, actions, 2))
+	require.ElementsMatch(t, []string{"stock.confirm", "account.confirm"}, receive(t, actions, 2))
+
+	status, err := c.Status(xid)
+	require.Equal(t, nil, err)
+	require.Equal(t, StatusConfirmed, status)
+
+	// 已经提交的全局事务不能回滚
+	require.Equal(t, ErrAlreadyConfirmed, (&Transaction{XID: xid, coordinator: c}).Rollback())
+}
+
+func TestCoordinatorRollback(t *testing.T) {
+	actions := make(chan string, 10)
+	_, c := newTestBus(t, actions)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	require.Equal(t, nil, c.Start(ctx))
+
+	var xid string
+	err := c.Execute(func(tx *Transaction) error {
+		xid = tx.XID
+		if err := tx.Try(ctx, "stock", []byte("1")); err != nil {
+			return err
+		}
+		return tx.Try(ctx, "account", []byte("fail"))
+	})
+	var tryErr *TryError
+	require.True(t, errors.As(err, &tryErr))
+	require.Equal(t, "account", tryErr.Topic)
+	require.Equal(t, "insufficient", tryErr.Msg)
+
+	require.Equal(t, []string{"stock.try", "account.try"}, receive(t, actions, 2))
+	// Try 失败的分支也会收到 Cancel
+	require.ElementsMatch(t, []string{"stock.cancel", "account.cancel"}, receive(t, actions, 2))
+
+	status, err := c.Status(xid)
+	require.Equal(t, nil, err)
+	require.Equal(t, StatusCancelled, status)
+}
+
+func TestCoordinatorRecover(t *testing.T) {
+	actions := make(chan string, 10)
+	_, c := newTestBus(t, actions)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	require.Equal(t, nil, c.Start(ctx))
+
+	// 协调者在 Try 之后没有 Commit 或 Rollback
+	tx, err := c.Begin()
+	require.Equal(t, nil, err)
+	require.Equal(t, nil, tx.Try(ctx, "stock", []byte("1")))
+	require.Equal(t, []string{"stock.try"}, receive(t, actions, 1))
+
+	require.Equal(t, []string{"stock.cancel"}, receive(t, actions, 1))
+	status, err := c.Status(tx.XID)
+	require.Equal(t, nil, err)
+	require.Equal(t, StatusCancelled, status)
+	require.Equal(t, ErrNotTrying, tx.Commit())
+}
+
+func TestTryError(t *testing.T) {
+	err := &TryError{Topic: "stock", Msg: "insufficient"}
+	require.Equal(t, "tcc try stock failure: insufficient", err.Error())
+	require.Equal(t, "try_failed", StatusTryFailed.String())
+}
+
+func TestBarrier(t *testing.T) {
+	db := _example.NewDB()
+	bus := final.New("tcc_barrier_svc", db, nil, final.DefaultOptions())
+	barrier, err := NewBarrier(db, "final_test_tcc_barrier")
+	require.Equal(t, nil, err)
+
+	called := make([]string, 0)
+	fn := func(c *BranchContext) error {
+		require.NotNil(t, c.TxBus)
+		called = append(called, c.Action)
+		if string(c.Message.Payload) == "fail" {
+			return errors.New("insufficient")
+		}
+		return nil
+	}
+	call := func(branchID, action, payload string) error {
+		c := &BranchContext{
+			Context:  &final.Context{Message: &message.Message{Payload: []byte(payload)}},
+			XID:      "1",
+			BranchID: branchID,
+			Action:   action,
+		}
+		return barrier.call(bus, c, fn)
+	}
+
+	// 重复的 Try 和 Cancel 只执行一次
+	branchID := uuidtools.NewV4().String()
+	require.Equal(t, nil, call(branchID, ActionTry, ""))
+	require.Equal(t, nil, call(branchID, ActionTry, ""))
+	require.Equal(t, nil, call(branchID, ActionCancel, ""))
+	require.Equal(t, nil, call(branchID, ActionCancel, ""))
+	require.Equal(t, []string{ActionTry, ActionCancel}, called)
+
+	// 重复的 Confirm 只执行一次
+	called = called[:0]
+	branchID = uuidtools.NewV4().String()
+	require.Equal(t, nil, call(branchID, ActionTry, ""))
+	require.Equal(t, nil, call(branchID, ActionConfirm, ""))
+	require.Equal(t, nil, call(branchID, ActionConfirm, ""))
+	require.Equal(t, []string{ActionTry, ActionConfirm}, called)
+
+	// Cancel 先到达时空回滚，迟到的 Try 被拒绝
+	called = called[:0]
+	branchID = uuidtools.NewV4().String()
+	require.Equal(t, nil, call(branchID, ActionCancel, ""))
+	require.Equal(t, ErrHangingTry, call(branchID, ActionTry, ""))
+	require.Equal(t, 0, len(called))
+
+	// Try 失败时屏障记录随事务回滚，Cancel 空回滚
+	called = called[:0]
+	branchID = uuidtools.NewV4().String()
+	require.Equal(t, "insufficient", call(branchID, ActionTry, "fail").Error())
+	require.Equal(t, nil, call(branchID, ActionCancel, ""))
+	require.Equal(t, []string{ActionTry}, called)
+}
@@ -0,0 +1,3 @@
+// Package tests 使用 miniredis 和嵌入式 nats-server 测试 mq 驱动
+// 测试使用独立的 module，库的使用者不会引入这些只有测试需要的依赖
+package tests
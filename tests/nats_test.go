@@ -0,0 +1,131 @@
+package tests
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/require"
+	"github.com/xyctruth/final/message"
+	finalnats "github.com/xyctruth/final/mq/nats"
+)
+
+func runNatsServer(t *testing.T) *server.Server {
+	s, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      server.RANDOM_PORT,
+		NoLog:     true,
+		NoSigs:    true,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+	})
+	require.Equal(t, nil, err)
+	go s.Start()
+	require.True(t, s.ReadyForConnections(5*time.Second))
+	t.Cleanup(s.Shutdown)
+	return s
+}
+
+func newNatsProvider(t *testing.T, opt finalnats.Options) (*finalnats.Provider, nats.JetStreamContext) {
+	s := runNatsServer(t)
+	provider := finalnats.NewProviderWithOptions(s.ClientURL(), opt).(*finalnats.Provider)
+	t.Cleanup(func() { _ = provider.Exit() })
+
+	conn, err := nats.Connect(s.ClientURL())
+	require.Equal(t, nil, err)
+	t.Cleanup(conn.Close)
+	js, err := conn.JetStream()
+	require.Equal(t, nil, err)
+	return provider, js
+}
+
+func TestNatsPublishConfirm(t *testing.T) {
+	provider, js := newNatsProvider(t, finalnats.DefaultOptions().WithStorage(nats.MemoryStorage))
+
+	err := provider.Init(context.Background(), "test_svc", false, []string{"topic.1"})
+	require.Equal(t, nil, err)
+
+	ack := make(chan uint64, 10)
+	provider.NotifyConfirm(ack, make(chan uint64, 10))
+
+	msg := message.NewMessage("1", "topic.1", []byte("payload1"))
+	msg.Header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	require.Equal(t, nil, provider.Publish(msg))
+	require.Equal(t, nil, provider.Publish(message.NewMessage("2", "topic.1", nil, message.WithConfirm(false))))
+	require.Equal(t, nil, provider.Publish(message.NewMessage("3", "topic.1", nil)))
+	// 相同 UUID 的消息被 JetStream 去重
+	require.Equal(t, nil, provider.Publish(message.NewMessage("3", "topic.1", nil)))
+
+	acks := []uint64{<-ack, <-ack, <-ack}
+	require.ElementsMatch(t, []uint64{1, 2, 3}, acks)
+
+	info, err := js.StreamInfo(finalnats.StreamName("topic.1"))
+	require.Equal(t, nil, err)
+	require.Equal(t, uint64(3), info.State.Msgs)
+
+	raw, err := js.GetMsg(finalnats.StreamName("topic.1"), 1)
+	require.Equal(t, nil, err)
+	received := finalnats.NewMessageFromMsg(&nats.Msg{Subject: raw.Subject, Header: raw.Header, Data: raw.Data})
+	require.Equal(t, "1", received.UUID)
+	require.Equal(t, "topic.1", received.Topic)
+	require.Equal(t, []byte("payload1"), received.Payload)
+	require.Equal(t, msg.Header.Get("traceparent"), received.Header.Get("traceparent"))
+}
+
+func TestNatsSubscribe(t *testing.T) {
+	provider, js := newNatsProvider(t, finalnats.DefaultOptions().
+		WithStorage(nats.MemoryStorage).
+		WithFetchTimeout(50*time.Millisecond))
+
+	err := provider.Init(context.Background(), "test_svc", false, []string{"topic1"})
+	require.Equal(t, nil, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	msgs := make(chan *message.Message)
+	err = provider.Subscribe(ctx, "consumer_0", msgs)
+	require.Equal(t, nil, err)
+
+	require.Equal(t, nil, provider.Publish(message.NewMessage("1", "topic1", []byte("payload1"))))
+	msg := <-msgs
+	require.Equal(t, "1", msg.UUID)
+	require.Equal(t, "topic1", msg.Topic)
+	require.Equal(t, []byte("payload1"), msg.Payload)
+	msg.Ack()
+
+	require.Equal(t, nil, provider.Publish(message.NewMessage("2", "topic1", []byte("payload2"))))
+	msg = <-msgs
+	require.Equal(t, "2", msg.UUID)
+	msg.Reject()
+
+	require.Eventually(t, func() bool {
+		info, err := js.ConsumerInfo("topic1", "test_svc")
+		return err == nil && info.NumAckPending == 0 && info.NumPending == 0
+	}, 2*time.Second, 10*time.Millisecond)
+
+	raw, err := js.GetMsg("test_svc_dlx", 1)
+	require.Equal(t, nil, err)
+	require.Equal(t, "2", raw.Header.Get(nats.MsgIdHdr))
+	require.Equal(t, []byte("payload2"), raw.Data)
+}
+
+func TestNatsPurge(t *testing.T) {
+	provider, js := newNatsProvider(t, finalnats.DefaultOptions().WithStorage(nats.MemoryStorage))
+
+	err := provider.Init(context.Background(), "test_svc", false, []string{"topic1"})
+	require.Equal(t, nil, err)
+	ack := make(chan uint64, 10)
+	provider.NotifyConfirm(ack, make(chan uint64, 10))
+	require.Equal(t, nil, provider.Publish(message.NewMessage("1", "topic1", nil)))
+	<-ack
+	require.Equal(t, nil, provider.Exit())
+
+	err = provider.Init(context.Background(), "test_svc", true, []string{"topic1"})
+	require.Equal(t, nil, err)
+
+	info, err := js.ConsumerInfo("topic1", "test_svc")
+	require.Equal(t, nil, err)
+	require.Equal(t, uint64(0), info.NumPending)
+}
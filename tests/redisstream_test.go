@@ -0,0 +1,137 @@
+package tests
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/require"
+	"github.com/xyctruth/final/message"
+	"github.com/xyctruth/final/mq/redisstream"
+)
+
+func newRedisProvider(t *testing.T, opt redisstream.Options) (*redisstream.Provider, *redis.Client, *miniredis.Miniredis) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	provider := redisstream.NewProviderWithOptions(client, opt).(*redisstream.Provider)
+	return provider, client, server
+}
+
+func TestRedisStreamPublishConfirm(t *testing.T) {
+	provider, client, _ := newRedisProvider(t, redisstream.DefaultOptions())
+
+	err := provider.Init(context.Background(), "test_svc", false, []string{"topic1"})
+	require.Equal(t, nil, err)
+
+	ack := make(chan uint64, 10)
+	provider.NotifyConfirm(ack, make(chan uint64, 10))
+
+	msg := message.NewMessage("1", "topic1", []byte("payload1"))
+	msg.Header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	require.Equal(t, nil, provider.Publish(msg))
+	require.Equal(t, nil, provider.Publish(message.NewMessage("2", "topic1", nil, message.WithConfirm(false))))
+	require.Equal(t, nil, provider.Publish(message.NewMessage("3", "topic1", nil)))
+
+	require.Equal(t, uint64(1), <-ack)
+	require.Equal(t, uint64(2), <-ack)
+
+	entries, err := client.XRange(context.Background(), "topic1", "-", "+").Result()
+	require.Equal(t, nil, err)
+	require.Equal(t, 3, len(entries))
+
+	received := redisstream.NewMessageFromXMessage("topic1", entries[0])
+	require.Equal(t, "1", received.UUID)
+	require.Equal(t, []byte("payload1"), received.Payload)
+	require.Equal(t, msg.Header.Get("traceparent"), received.Header.Get("traceparent"))
+}
+
+func TestRedisStreamSubscribe(t *testing.T) {
+	provider, client, _ := newRedisProvider(t, redisstream.DefaultOptions().WithBlockTimeout(10*time.Millisecond))
+
+	err := provider.Init(context.Background(), "test_svc", false, []string{"topic1"})
+	require.Equal(t, nil, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	msgs := make(chan *message.Message)
+	err = provider.Subscribe(ctx, "consumer_0", msgs)
+	require.Equal(t, nil, err)
+
+	require.Equal(t, nil, provider.Publish(message.NewMessage("1", "topic1", []byte("payload1"))))
+	msg := <-msgs
+	require.Equal(t, "1", msg.UUID)
+	require.Equal(t, "topic1", msg.Topic)
+	msg.Ack()
+
+	require.Equal(t, nil, provider.Publish(message.NewMessage("2", "topic1", []byte("payload2"))))
+	msg = <-msgs
+	require.Equal(t, "2", msg.UUID)
+	msg.Reject()
+
+	require.Eventually(t, func() bool {
+		pending, err := client.XPending(context.Background(), "topic1", "test_svc").Result()
+		return err == nil && pending.Count == 0
+	}, time.Second, 10*time.Millisecond)
+
+	dlx, err := client.XRange(context.Background(), "test_svc_dlx", "-", "+").Result()
+	require.Equal(t, nil, err)
+	require.Equal(t, 1, len(dlx))
+	require.Equal(t, "2", redisstream.NewMessageFromXMessage("test_svc_dlx", dlx[0]).UUID)
+}
+
+func TestRedisStreamClaimStuckMessage(t *testing.T) {
+	provider, client, _ := newRedisProvider(t, redisstream.DefaultOptions().
+		WithBlockTimeout(10*time.Millisecond).
+		WithClaimInterval(10*time.Millisecond).
+		WithClaimMinIdle(50*time.Millisecond))
+
+	err := provider.Init(context.Background(), "test_svc", false, []string{"topic1"})
+	require.Equal(t, nil, err)
+	require.Equal(t, nil, provider.Publish(message.NewMessage("1", "topic1", []byte("payload1"))))
+
+	// 另一个 consumer 读取消息后没有 XACK
+	_, err = client.XReadGroup(context.Background(), &redis.XReadGroupArgs{
+		Group:    "test_svc",
+		Consumer: "crashed_consumer",
+		Streams:  []string{"topic1", ">"},
+		Count:    1,
+	}).Result()
+	require.Equal(t, nil, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	msgs := make(chan *message.Message)
+	err = provider.Subscribe(ctx, "consumer_0", msgs)
+	require.Equal(t, nil, err)
+
+	select {
+	case msg := <-msgs:
+		require.Equal(t, "1", msg.UUID)
+		msg.Ack()
+	case <-time.After(2 * time.Second):
+		t.Fatal("stuck message is not claimed")
+	}
+}
+
+func TestRedisStreamPurge(t *testing.T) {
+	provider, client, _ := newRedisProvider(t, redisstream.DefaultOptions().WithBlockTimeout(10*time.Millisecond))
+
+	err := provider.Init(context.Background(), "test_svc", false, []string{"topic1"})
+	require.Equal(t, nil, err)
+	require.Equal(t, nil, provider.Publish(message.NewMessage("1", "topic1", nil)))
+
+	err = provider.Init(context.Background(), "test_svc", true, []string{"topic1"})
+	require.Equal(t, nil, err)
+
+	result, err := client.XReadGroup(context.Background(), &redis.XReadGroupArgs{
+		Group:    "test_svc",
+		Consumer: "consumer_0",
+		Streams:  []string{"topic1", ">"},
+		Count:    1,
+		Block:    -1,
+	}).Result()
+	require.Equal(t, redis.Nil, err)
+	require.Equal(t, 0, len(result))
+}
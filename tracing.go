@@ -0,0 +1,98 @@
+package final
+
+import (
+	"context"
+
+	"github.com/xyctruth/final/message"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/xyctruth/final"
+
+// tracing 使用 OpenTelemetry 跟踪消息的发布和消费
+// trace context 以 W3C 格式注入到 message.Header 中，随消息保存在 outbox，并由 mq 驱动传递给消费者
+type tracing struct {
+	svcName    string
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+func newTracing(bus *Bus) *tracing {
+	tp := bus.opt.TracerProvider
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	propagator := bus.opt.Propagator
+	if propagator == nil {
+		propagator = propagation.TraceContext{}
+	}
+	return &tracing{
+		svcName:    bus.svcName,
+		tracer:     tp.Tracer(tracerName),
+		propagator: propagator,
+	}
+}
+
+// startProducer 开始 producer span，并把 trace context 注入到消息 Header 中
+func (t *tracing) startProducer(ctx context.Context, msg *message.Message) (context.Context, trace.Span) {
+	ctx, span := t.tracer.Start(ctx, msg.Topic+" send",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(t.attributes(msg)...),
+	)
+	t.propagator.Inject(ctx, headerCarrier(msg.Header))
+	return ctx, span
+}
+
+// startConsumer 从消息 Header 中提取 trace context，开始 consumer span
+func (t *tracing) startConsumer(msg *message.Message) (context.Context, trace.Span) {
+	ctx := t.propagator.Extract(context.Background(), headerCarrier(msg.Header))
+	return t.tracer.Start(ctx, msg.Topic+" process",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(t.attributes(msg)...),
+	)
+}
+
+func (t *tracing) attributes(msg *message.Message) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("messaging.system", "final"),
+		attribute.String("messaging.destination", msg.Topic),
+		attribute.String("messaging.message_id", msg.UUID),
+		attribute.String("final.svc", t.svcName),
+	}
+}
+
+// endSpan 结束 span，err 不为 nil 时记录错误
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// headerCarrier 使 message.Header 满足 propagation.TextMapCarrier
+type headerCarrier message.Header
+
+func (c headerCarrier) Get(key string) string {
+	v, ok := c[key].(string)
+	if !ok {
+		return ""
+	}
+	return v
+}
+
+func (c headerCarrier) Set(key string, value string) {
+	c[key] = value
+}
+
+func (c headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
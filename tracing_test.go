@@ -0,0 +1,42 @@
+package final
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vmihailenco/msgpack/v5"
+	"github.com/xyctruth/final/message"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	bus := New("test_svc", nil, nil, DefaultOptions().WithTracerProvider(tp))
+
+	msg := message.NewMessage("", "Tracing", NewDemoMessage("message", 100))
+	_, producer := bus.tracing.startProducer(context.Background(), msg)
+	producer.End()
+	require.NotEqual(t, "", msg.Header.Get("traceparent"))
+
+	// outbox 保存的消息重新发送时保留 trace context
+	msgBytes, err := msgpack.Marshal(msg)
+	require.Equal(t, nil, err)
+	stored := &message.Message{}
+	err = msgpack.Unmarshal(msgBytes, stored)
+	require.Equal(t, nil, err)
+
+	ctx, consumer := bus.tracing.startConsumer(stored)
+	consumer.End()
+
+	spans := recorder.Ended()
+	require.Equal(t, 2, len(spans))
+	require.Equal(t, trace.SpanKindProducer, spans[0].SpanKind())
+	require.Equal(t, trace.SpanKindConsumer, spans[1].SpanKind())
+	require.Equal(t, spans[0].SpanContext().TraceID(), spans[1].SpanContext().TraceID())
+	require.Equal(t, spans[0].SpanContext().SpanID(), spans[1].Parent().SpanID())
+	require.Equal(t, spans[1].SpanContext().TraceID(), trace.SpanContextFromContext(ctx).TraceID())
+}
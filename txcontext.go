@@ -0,0 +1,44 @@
+package final
+
+import (
+	"context"
+	"database/sql"
+)
+
+type txBusKey struct{}
+
+// ContextWithTxBus 返回携带 txBus 的 ctx
+// 使用返回的 ctx 调用 Bus.PublishCtx 时，消息添加到 txBus 的事务中，而不是直接发送
+func ContextWithTxBus(ctx context.Context, txBus *TxBus) context.Context {
+	return context.WithValue(ctx, txBusKey{}, txBus)
+}
+
+// ContextWithTxBusFunc 与 ContextWithTxBus 相同，第一次从 ctx 中取出 TxBus 时才调用 fn 创建，
+// fn 需要保证多次调用返回同一个 TxBus，适用于大部分事务不发布消息的场景
+func ContextWithTxBusFunc(ctx context.Context, fn func() *TxBus) context.Context {
+	return context.WithValue(ctx, txBusKey{}, fn)
+}
+
+// TxBusFromContext 返回 ctx 中携带的 TxBus
+func TxBusFromContext(ctx context.Context) (*TxBus, bool) {
+	if ctx == nil {
+		return nil, false
+	}
+	var txBus *TxBus
+	switch val := ctx.Value(txBusKey{}).(type) {
+	case *TxBus:
+		txBus = val
+	case func() *TxBus:
+		txBus = val()
+	}
+	return txBus, txBus != nil
+}
+
+// TransactionCtx 与 Transaction 相同，fc 的 ctx 中携带 TxBus
+// fc 中使用 ctx 调用 Bus.PublishCtx 发布的消息与 tx 中的修改一起提交，
+// 适用于 sqlx、ent 等可以拿到 *sql.Tx 的库
+func (bus *Bus) TransactionCtx(ctx context.Context, tx *sql.Tx, fc func(ctx context.Context) error) error {
+	return bus.Transaction(tx, func(txBus *TxBus) error {
+		return fc(ContextWithTxBus(ctx, txBus))
+	})
+}
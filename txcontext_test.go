@@ -0,0 +1,123 @@
+package final
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/xyctruth/final/_example"
+	"github.com/xyctruth/final/message"
+)
+
+func TestTxBusFromContext(t *testing.T) {
+	provider := &fakeProvider{}
+	bus := New("test_svc", nil, provider, DefaultOptions())
+
+	_, ok := TxBusFromContext(context.Background())
+	require.Equal(t, false, ok)
+
+	txBus := bus.WithTx(nil)
+	got, ok := TxBusFromContext(ContextWithTxBus(context.Background(), txBus))
+	require.Equal(t, true, ok)
+	require.Equal(t, txBus, got)
+
+	// 第一次取出时才创建 TxBus
+	created := 0
+	ctx := ContextWithTxBusFunc(context.Background(), func() *TxBus {
+		created++
+		return txBus
+	})
+	require.Equal(t, 0, created)
+	got, ok = TxBusFromContext(ctx)
+	require.Equal(t, true, ok)
+	require.Equal(t, txBus, got)
+	require.Equal(t, 1, created)
+
+	// 其它 Bus 的 TxBus 不影响发布
+	other := New("other_svc", nil, provider, DefaultOptions())
+	ctx = ContextWithTxBus(context.Background(), other.WithTx(nil))
+	err := bus.PublishCtx(ctx, "TxBusFromContext", NewDemoMessage("message", 1), message.WithConfirm(false))
+	require.Equal(t, nil, err)
+	require.Equal(t, 1, len(bus.publisher.queue))
+}
+
+func TestPublishCtxTxBus(t *testing.T) {
+	bus := New("test_svc", _example.NewDB(), _example.NewAmqp(), DefaultOptions().WithPurgeOnStartup(true))
+	err := bus.outbox.init()
+	require.Equal(t, nil, err)
+
+	tx, err := bus.db.Begin()
+	require.Equal(t, nil, err)
+	txBus := bus.WithTx(tx)
+	ctx := ContextWithTxBus(context.Background(), txBus)
+
+	err = bus.PublishCtx(ctx, "PublishCtxTxBus", NewDemoMessage("message", 1))
+	require.Equal(t, nil, err)
+	require.Equal(t, 1, len(txBus.msgs))
+	require.Equal(t, 0, len(bus.publisher.queue))
+
+	var count int
+	err = tx.QueryRow("SELECT COUNT(*) FROM " + bus.outbox.name).Scan(&count)
+	require.Equal(t, nil, err)
+	require.Equal(t, 1, count)
+
+	err = txBus.RollBack()
+	require.Equal(t, nil, err)
+	pending, _, err := bus.outbox.stat()
+	require.Equal(t, nil, err)
+	require.Equal(t, int64(0), pending)
+}
+
+func TestTransactionCtx(t *testing.T) {
+	bus := New("test_svc", _example.NewDB(), _example.NewAmqp(), DefaultOptions().WithPurgeOnStartup(true))
+	err := bus.outbox.init()
+	require.Equal(t, nil, err)
+
+	// sqlx 的 sqlx.Tx.Tx 和 ent 的 entsql.Conn 都使用 *sql.Tx
+	tx, err := bus.db.Begin()
+	require.Equal(t, nil, err)
+	err = bus.TransactionCtx(context.Background(), tx, func(ctx context.Context) error {
+		return bus.PublishCtx(ctx, "TransactionCtx", NewDemoMessage("message", 1), message.WithConfirm(true))
+	})
+	require.Equal(t, nil, err)
+	require.Equal(t, 1, len(bus.publisher.queue))
+
+	// fc 返回 error 时回滚，消息不会暂存
+	tx, err = bus.db.Begin()
+	require.Equal(t, nil, err)
+	err = bus.TransactionCtx(context.Background(), tx, func(ctx context.Context) error {
+		if err := bus.PublishCtx(ctx, "TransactionCtx", NewDemoMessage("message", 2)); err != nil {
+			return err
+		}
+		return errors.New("rollback")
+	})
+	require.Equal(t, "rollback", err.Error())
+	require.Equal(t, 1, len(bus.publisher.queue))
+
+	pending, _, err := bus.outbox.stat()
+	require.Equal(t, nil, err)
+	require.Equal(t, int64(1), pending)
+}
+
+func TestTxBusAfterCommit(t *testing.T) {
+	provider := &fakeProvider{}
+	bus := New("test_svc", nil, provider, DefaultOptions())
+
+	staged := 0
+	bus.AddHook(Hook{OnStaged: func(msg *message.Message) { staged++ }})
+
+	// 消息在 Publish 时已经暂存到事务中，AfterCommit 只负责发送
+	txBus := bus.WithTx(nil)
+	txBus.msgs = append(txBus.msgs,
+		message.NewMessage("1", "TxBusAfterCommit", nil, message.WithConfirm(false)),
+		message.NewMessage("2", "TxBusAfterCommit", nil, message.WithConfirm(false)))
+
+	require.Equal(t, 0, staged)
+
+	// 事务提交后回调 OnStaged
+	txBus.AfterCommit()
+	require.Equal(t, 2, staged)
+	require.Equal(t, 0, len(txBus.msgs))
+	require.Equal(t, 2, len(bus.publisher.queue))
+}